@@ -0,0 +1,37 @@
+package main
+
+import (
+	"avaron/agent"
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// the tools the model may call that live in this package
+func registerAgentTools(a *agent.Agent) {
+	a.Register(agent.Tool{
+		Name:        "list_services",
+		Description: "List the systemd services with their load, active & sub states",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+		Run: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			units, err := ListServices(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			type service struct {
+				Name        string `json:"name"`
+				Description string `json:"description"`
+				Load        string `json:"load"`
+				Active      string `json:"active"`
+				Sub         string `json:"sub"`
+			}
+			list := make([]service, 0, len(units))
+			for _, u := range units {
+				list = append(list, service{u.Name, u.Description, u.LoadState, u.ActiveState, u.SubState})
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+			return list, nil
+		},
+	})
+}
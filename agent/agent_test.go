@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"avaron/llama"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func call(id, name, args string) llama.ToolCall {
+	return llama.ToolCall{ID: id, Type: "function", Function: llama.FunctionCall{Name: name, Arguments: args}}
+}
+
+// echo returns its arguments, or fails when asked to
+var echo = Tool{
+	Name:       "echo",
+	Parameters: json.RawMessage(`{"type":"object","properties":{"say":{"type":"string"}}}`),
+	Run: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var a struct{ Say string }
+		json.Unmarshal(args, &a)
+		if a.Say == "fail" {
+			return nil, errors.New("asked to")
+		}
+		return a.Say, nil
+	},
+}
+
+func setup(responses []string, calls [][]llama.ToolCall) (*Agent, *llama.Fake) {
+	fake := &llama.Fake{Responses: responses, ToolCalls: calls}
+	a := &Agent{Backend: fake, MaxSteps: DefaultMaxSteps, MaxTokens: DefaultMaxTokens, tools: make(map[string]Tool)}
+	a.Register(echo)
+	return a, fake
+}
+
+func TestRun(t *testing.T) {
+	a, fake := setup([]string{"", "", "HEALTHY all good"}, [][]llama.ToolCall{
+		{call("1", "echo", `{"say":"hi"}`), call("2", "nope", "")},
+		{call("3", "echo", `{"say":"fail"}`), call("4", "echo", `{not json`)},
+	})
+
+	var steps []Step
+	var tokens []string
+	messages, err := a.Run(context.Background(), []llama.Message{{Role: "user", Content: "how's the network?"}}, Observer{
+		Token: func(s string) { tokens = append(tokens, s) },
+		Step:  func(s Step) { steps = append(steps, s) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// user, reply, 2 tools, reply, 2 tools, reply
+	if len(messages) != 8 || messages[7].Content != "HEALTHY all good" || strings.Join(tokens, "") != "HEALTHY all good" {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+	if m := messages[2]; m.Role != "tool" || m.ToolCallID != "1" || m.Content != "hi" {
+		t.Errorf("unexpected tool message %+v", m)
+	}
+	if len(steps) != 4 || steps[0].Err != nil || steps[0].Value != "hi" {
+		t.Fatalf("unexpected steps %+v", steps)
+	}
+	// failures go back to the model rather than ending the run
+	for _, s := range steps[1:] {
+		if s.Err == nil || !strings.Contains(s.Result, `"error"`) {
+			t.Errorf("expected %s to fail, got %+v", s.Call.ID, s)
+		}
+	}
+	// the last tool result is what the model was last asked about
+	if last := fake.Requests[len(fake.Requests)-1]; !strings.Contains(last, "arguments aren't JSON") {
+		t.Errorf("unexpected last request %q", last)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	loop := make([][]llama.ToolCall, 20)
+	for i := range loop {
+		loop[i] = []llama.ToolCall{call("x", "echo", `{"say":"again"}`)}
+	}
+
+	a, _ := setup([]string{"thinking"}, loop)
+	a.MaxSteps = 3
+	if messages, err := a.Run(context.Background(), nil, Observer{}); !errors.Is(err, ErrSteps) || len(messages) != 6 {
+		t.Errorf("got %d messages & %v, want ErrSteps after 3 replies", len(messages), err)
+	}
+
+	a, _ = setup([]string{"thinking very hard"}, loop)
+	a.MaxSteps, a.MaxTokens = 0, 5
+	if _, err := a.Run(context.Background(), nil, Observer{}); !errors.Is(err, ErrBudget) {
+		t.Errorf("got %v, want ErrBudget", err)
+	}
+
+	a, _ = setup([]string{strings.Repeat("x", 100)}, loop[:1])
+	a.Register(Tool{Name: "big", Run: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		return strings.Repeat("y", 100), nil
+	}})
+	a.MaxResult = 10
+	if s := a.call(context.Background(), call("1", "big", "")); s.Result != strings.Repeat("y", 10)+"\n(truncated)" {
+		t.Errorf("unexpected result %q", s.Result)
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	a := New()
+	names := make([]string, 0)
+	for _, tool := range a.Tools() {
+		if !json.Valid(tool.Parameters) {
+			t.Errorf("%s's parameters aren't JSON", tool.Name)
+		}
+		names = append(names, tool.Name)
+	}
+	if got := strings.Join(names, " "); got != "dns_lookup get_interfaces get_routes get_tunnels" {
+		t.Errorf("unexpected tools %s", got)
+	}
+}
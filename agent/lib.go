@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"avaron/llama"
+	"avaron/logging"
+	"avaron/metrics"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("agent")
+
+const (
+	DefaultMaxSteps  = 8
+	DefaultMaxTokens = 4096
+	DefaultMaxResult = 8 << 10
+)
+
+var (
+	ErrSteps  = errors.New("ran out of steps")
+	ErrBudget = errors.New("ran out of tokens")
+
+	Calls = metrics.NewCounter("avaron_agent_tool_calls_total",
+		"Tools called by the model, by tool & outcome", "tool", "outcome")
+)
+
+// Tool is a function the model may call
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage // JSON schema of the arguments
+	// Run's result is given to the model as JSON, or as is if it's a string
+	Run func(ctx context.Context, args json.RawMessage) (interface{}, error)
+}
+
+// Step is one tool call & its result
+type Step struct {
+	Call     llama.ToolCall
+	Value    interface{} // what the tool returned, nil if it failed
+	Result   string      // what the model is told
+	Err      error
+	Started  time.Time
+	Duration time.Duration
+}
+
+// Observer follows a run, any of its funcs may be nil
+type Observer struct {
+	Reply   func()                    // the model starts replying
+	Token   func(token string)        // to its reply
+	Replied func(reply llama.Message) // it's done
+	Step    func(step Step)           // a tool call's done
+}
+
+// Agent has a model answer with tools until it stops calling them
+type Agent struct {
+	Backend   llama.Backend // llama.Default when nil
+	Model     string        // llama.Model when empty
+	MaxSteps  int           // replies per run, unlimited when 0
+	MaxTokens int           // predicted across a run, unlimited when 0
+	MaxResult int           // bytes of a tool's result, truncated beyond
+
+	lock  sync.Mutex
+	tools map[string]Tool
+}
+
+// Primary constructor for this package, with the built in tools
+func New() *Agent {
+	a := &Agent{
+		MaxSteps:  DefaultMaxSteps,
+		MaxTokens: DefaultMaxTokens,
+		MaxResult: DefaultMaxResult,
+		tools:     make(map[string]Tool),
+	}
+	for _, t := range Builtin {
+		a.Register(t)
+	}
+	return a
+}
+
+// Register offers a tool to the model, replacing any of the same name
+func (a *Agent) Register(t Tool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.tools[t.Name] = t
+}
+
+// Tools lists what's registered, by name
+func (a *Agent) Tools() []Tool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	tools := make([]Tool, 0, len(a.tools))
+	for _, t := range a.tools {
+		tools = append(tools, t)
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+	return tools
+}
+
+func (a *Agent) tool(name string) (Tool, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	t, ok := a.tools[name]
+	return t, ok
+}
+
+// Run continues the chat until the model replies without calling a tool,
+// returning messages with every reply & tool result appended
+func (a *Agent) Run(ctx context.Context, messages []llama.Message, obs Observer) ([]llama.Message, error) {
+	backend, model := a.Backend, a.Model
+	if backend == nil {
+		backend = llama.Default
+	}
+	if model == "" {
+		model = llama.Model
+	}
+
+	var specs []llama.Tool
+	for _, t := range a.Tools() {
+		specs = append(specs, llama.Tool{
+			Type:     "function",
+			Function: llama.Function{Name: t.Name, Description: t.Description, Parameters: t.Parameters},
+		})
+	}
+
+	budget := a.MaxTokens
+	for step := 0; ; step++ {
+		if a.MaxSteps > 0 && step >= a.MaxSteps {
+			return messages, ErrSteps
+		}
+		req := llama.ChatRequest{Model: model, Messages: messages, Tools: specs}
+		if a.MaxTokens > 0 {
+			if budget <= 0 {
+				return messages, ErrBudget
+			}
+			req.MaxTokens = budget
+		}
+
+		if obs.Reply != nil {
+			obs.Reply()
+		}
+		var streamed int
+		completion, err := backend.Chat(ctx, req, func(t llama.Token) error {
+			streamed++
+			if obs.Token != nil {
+				obs.Token(t.Content)
+			}
+			return nil
+		})
+		reply := llama.Message{Role: "assistant", Content: completion.Content, ToolCalls: completion.ToolCalls}
+		if obs.Replied != nil {
+			obs.Replied(reply)
+		}
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, reply)
+
+		// not every server reports usage when streaming
+		if completion.Predicted > 0 {
+			budget -= completion.Predicted
+		} else {
+			budget -= streamed
+		}
+
+		if len(reply.ToolCalls) == 0 {
+			return messages, nil
+		}
+		for _, call := range reply.ToolCalls {
+			s := a.call(ctx, call)
+			if obs.Step != nil {
+				obs.Step(s)
+			}
+			messages = append(messages, llama.Message{Role: "tool", ToolCallID: call.ID, Name: call.Function.Name, Content: s.Result})
+		}
+	}
+}
+
+// call runs a tool, its errors going back to the model rather than ending the run
+func (a *Agent) call(ctx context.Context, call llama.ToolCall) (s Step) {
+	s.Call, s.Started = call, time.Now()
+	name := "unknown" // the model's made up names aren't labels
+	defer func() {
+		s.Duration = time.Since(s.Started)
+		outcome := "ok"
+		if s.Err != nil {
+			outcome = "error"
+			buf, _ := json.Marshal(map[string]string{"error": s.Err.Error()})
+			s.Result = string(buf)
+		}
+		Calls.Inc(name, outcome)
+	}()
+
+	t, ok := a.tool(call.Function.Name)
+	if !ok {
+		s.Err = fmt.Errorf("no such tool %q", call.Function.Name)
+		return
+	}
+	name = t.Name
+
+	args := json.RawMessage(call.Function.Arguments)
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	} else if !json.Valid(args) {
+		s.Err = fmt.Errorf("arguments aren't JSON: %s", call.Function.Arguments)
+		return
+	}
+
+	logger.InfoContext(ctx, "calling tool", "tool", t.Name, "args", call.Function.Arguments)
+	if s.Value, s.Err = t.Run(ctx, args); s.Err != nil {
+		logger.WarnContext(ctx, "tool failed", "tool", t.Name, "err", s.Err)
+		return
+	}
+
+	if str, ok := s.Value.(string); ok {
+		s.Result = str
+	} else {
+		buf, err := json.Marshal(s.Value)
+		if err != nil {
+			s.Err = err
+			return
+		}
+		s.Result = string(buf)
+	}
+	if a.MaxResult > 0 && len(s.Result) > a.MaxResult {
+		s.Result = s.Result[:a.MaxResult] + "\n(truncated)"
+	}
+	return
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	network "avaron/net"
+	wg "avaron/wireguard"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Builtin tools every agent starts with
+var Builtin = []Tool{
+	{
+		Name:        "get_interfaces",
+		Description: "List the network interfaces with their state, addresses & counters",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+		Run:         GetInterfaces,
+	},
+	{
+		Name:        "get_routes",
+		Description: "List the IPv4 routing table",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+		Run:         GetRoutes,
+	},
+	{
+		Name:        "get_tunnels",
+		Description: "List the wireguard tunnels & their peers, with each peer's endpoint, allowed IPs, latest handshake & transfer",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+		Run:         GetTunnels,
+	},
+	{
+		Name:        "dns_lookup",
+		Description: "Resolve a name through the system's resolver, or an address back to names with type PTR",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"name":{"type":"string"},` +
+			`"type":{"type":"string","enum":["A","AAAA","CNAME","MX","NS","TXT","PTR"],"description":"A & AAAA together by default"}` +
+			`},"required":["name"]}`),
+		Run: DNSLookup,
+	},
+}
+
+type iface struct {
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	MTU       int      `json:"mtu"`
+	MAC       string   `json:"mac,omitempty"`
+	Addresses []string `json:"addresses"`
+	Flags     []string `json:"flags"`
+	RxBytes   uint64   `json:"rx_bytes"`
+	TxBytes   uint64   `json:"tx_bytes"`
+	RxErrors  uint64   `json:"rx_errors"`
+	TxErrors  uint64   `json:"tx_errors"`
+	Dropped   uint64   `json:"dropped"`
+}
+
+// GetInterfaces summarises network.List, which is far more than the model needs
+func GetInterfaces(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	links, err := network.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]iface, 0, len(links))
+	for name, l := range links {
+		i := iface{
+			Name:      name,
+			State:     l.OperState,
+			MTU:       l.MTU,
+			MAC:       l.Address,
+			Addresses: []string{},
+			Flags:     l.Flags,
+			RxBytes:   l.Stats64.Rx.Bytes,
+			TxBytes:   l.Stats64.Tx.Bytes,
+			RxErrors:  l.Stats64.Rx.Errors,
+			TxErrors:  l.Stats64.Tx.Errors,
+			Dropped:   l.Stats64.Rx.Dropped + l.Stats64.Tx.Dropped,
+		}
+		for _, a := range l.AddrInfo {
+			i.Addresses = append(i.Addresses, a.Local+"/"+strconv.Itoa(a.PrefixLen))
+		}
+		list = append(list, i)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+type route struct {
+	Destination string   `json:"destination"`
+	Gateway     string   `json:"gateway,omitempty"`
+	Interface   string   `json:"interface"`
+	Metric      int      `json:"metric"`
+	Flags       []string `json:"flags,omitempty"`
+}
+
+func GetRoutes(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	routes, err := network.Routes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]route, 0, len(routes))
+	for name, r := range routes {
+		rt := route{Destination: r.Destination.String(), Interface: name, Metric: r.Metric, Flags: r.Flags}
+		if r.Gateway != nil && !r.Gateway.IsUnspecified() {
+			rt.Gateway = r.Gateway.String()
+		}
+		list = append(list, rt)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Destination < list[j].Destination })
+	return list, nil
+}
+
+type tunnel struct {
+	Name          string `json:"name"`
+	ListeningPort int    `json:"listening_port"`
+	PublicKey     string `json:"public_key"`
+	Peers         []peer `json:"peers"`
+}
+
+type peer struct {
+	PublicKey       string   `json:"public_key"`
+	Endpoint        string   `json:"endpoint,omitempty"`
+	AllowedIPs      []string `json:"allowed_ips"`
+	LatestHandshake string   `json:"latest_handshake,omitempty"`
+	Received        string   `json:"received,omitempty"`
+	Sent            string   `json:"sent,omitempty"`
+}
+
+// GetTunnels is wireguard.Interfaces without the private & preshared keys
+func GetTunnels(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	interfaces, err := wg.Interfaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]tunnel, 0, len(interfaces))
+	for key, i := range interfaces {
+		t := tunnel{Name: i.Name, ListeningPort: i.ListeningPort, PublicKey: key.String(), Peers: []peer{}}
+		for k, p := range i.Peers {
+			t.Peers = append(t.Peers, peer{
+				PublicKey:       k.String(),
+				Endpoint:        p.Endpoint,
+				AllowedIPs:      p.AllowedIPs,
+				LatestHandshake: p.LatestHandshake,
+				Received:        p.Received,
+				Sent:            p.Sent,
+			})
+		}
+		sort.Slice(t.Peers, func(i, j int) bool { return t.Peers[i].PublicKey < t.Peers[j].PublicKey })
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func DNSLookup(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Name == "" {
+		return nil, fmt.Errorf("no name")
+	}
+
+	var (
+		r       net.Resolver
+		records []string
+		err     error
+	)
+	switch strings.ToUpper(a.Type) {
+	case "":
+		records, err = r.LookupHost(ctx, a.Name)
+	case "A", "AAAA":
+		family := "ip4"
+		if strings.ToUpper(a.Type) == "AAAA" {
+			family = "ip6"
+		}
+		var ips []net.IP
+		ips, err = r.LookupIP(ctx, family, a.Name)
+		for _, ip := range ips {
+			records = append(records, ip.String())
+		}
+	case "CNAME":
+		var cname string
+		cname, err = r.LookupCNAME(ctx, a.Name)
+		records = []string{cname}
+	case "MX":
+		var mx []*net.MX
+		mx, err = r.LookupMX(ctx, a.Name)
+		for _, m := range mx {
+			records = append(records, fmt.Sprintf("%d %s", m.Pref, m.Host))
+		}
+	case "NS":
+		var ns []*net.NS
+		ns, err = r.LookupNS(ctx, a.Name)
+		for _, n := range ns {
+			records = append(records, n.Host)
+		}
+	case "TXT":
+		records, err = r.LookupTXT(ctx, a.Name)
+	case "PTR":
+		records, err = r.LookupAddr(ctx, a.Name)
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", a.Type)
+	}
+
+	// NXDOMAIN is an answer, not a failure
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return map[string]interface{}{"records": []string{}, "error": dnsErr.Error()}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if records == nil {
+		records = []string{}
+	}
+	return map[string]interface{}{"records": records}, nil
+}
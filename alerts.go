@@ -0,0 +1,116 @@
+package main
+
+import (
+	"avaron/alerts"
+	network "avaron/net"
+	"avaron/sys/disk"
+	"avaron/sys/mem"
+	wg "avaron/wireguard"
+	"context"
+	"time"
+)
+
+var (
+	Alerts *alerts.Engine
+
+	started = time.Now()
+)
+
+// the metrics alert rules may refer to
+func registerAlertSources(e *alerts.Engine) {
+	e.Source("link_up", func(ctx context.Context) (list []alerts.Observation, err error) {
+		links, err := network.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for name, link := range links {
+			up := 0.0
+			// interfaces without carrier detection, ie. wireguard, report UNKNOWN
+			if link.OperState == "UP" || link.OperState == "UNKNOWN" {
+				up = 1
+			}
+			list = append(list, alerts.Observation{Subject: name, Value: up})
+		}
+		return
+	})
+
+	e.Source("wireguard_handshake_age", func(ctx context.Context) (list []alerts.Observation, err error) {
+		peers, err := wg.Dump(ctx)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for _, p := range peers {
+			// never having had a handshake counts from when we started
+			since := started
+			if !p.LatestHandshake.IsZero() {
+				since = p.LatestHandshake
+			}
+			list = append(list, alerts.Observation{Subject: p.Key.String(), Value: now.Sub(since).Seconds()})
+		}
+		return
+	})
+
+	e.Source("interface_error_rate", func(ctx context.Context) (list []alerts.Observation, err error) {
+		links, err := network.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		to := time.Now()
+		from := to.Add(-time.Minute)
+		for name := range links {
+			var rate float64
+			for _, series := range []string{"rx_errors", "tx_errors"} {
+				points, _, err := History.Query("interface/"+name+"/"+series, from, to, 0)
+				if err != nil || len(points) == 0 {
+					continue // not sampled yet
+				}
+				var sum float64
+				for _, p := range points {
+					sum += p.V
+				}
+				rate += sum / float64(len(points))
+			}
+			list = append(list, alerts.Observation{Subject: name, Value: rate})
+		}
+		return
+	})
+
+	e.Source("unit_failed", func(ctx context.Context) (list []alerts.Observation, err error) {
+		units, err := ListServices(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for name, unit := range units {
+			failed := 0.0
+			if unit.ActiveState == "failed" {
+				failed = 1
+			}
+			list = append(list, alerts.Observation{Subject: name, Value: failed})
+		}
+		return
+	})
+
+	e.Source("memory_used_ratio", func(ctx context.Context) ([]alerts.Observation, error) {
+		total, err := mem.GetTotal()
+		if err != nil {
+			return nil, err
+		}
+		available, err := mem.GetAvailable()
+		if err != nil {
+			return nil, err
+		}
+		return []alerts.Observation{{Subject: "memory", Value: 1 - float64(available)/float64(total)}}, nil
+	})
+
+	e.Source("disk_used_ratio", func(ctx context.Context) (list []alerts.Observation, err error) {
+		usage, err := disk.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range usage {
+			list = append(list, alerts.Observation{Subject: u.Mount, Value: u.Used()})
+		}
+		return
+	})
+}
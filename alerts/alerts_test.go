@@ -0,0 +1,232 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	filepath "path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhook records what it's sent
+type webhook struct {
+	lock   sync.Mutex
+	alerts []Alert
+}
+
+func (w *webhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var a Alert
+	json.NewDecoder(req.Body).Decode(&a)
+	w.lock.Lock()
+	w.alerts = append(w.alerts, a)
+	w.lock.Unlock()
+}
+
+func (w *webhook) states() (states []string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, a := range w.alerts {
+		states = append(states, a.Subject+" "+a.State)
+	}
+	return
+}
+
+func setup(t *testing.T, path string, value *float64) (*Engine, *webhook) {
+	hook := &webhook{}
+	server := httptest.NewServer(hook)
+	t.Cleanup(server.Close)
+
+	e := New(path)
+	e.Source("errors", func(ctx context.Context) ([]Observation, error) {
+		return []Observation{{"eth0", *value}, {"lo", 0}}, nil
+	})
+	if err := e.SetSinks([]SinkConfig{{Name: "hook", Type: "webhook", URL: server.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetRules([]Rule{{Name: "errors", Metric: "errors", Op: ">", Threshold: 1, For: 30}}); err != nil {
+		t.Fatal(err)
+	}
+	return e, hook
+}
+
+func TestLifecycle(t *testing.T) {
+	value := 5.0
+	e, hook := setup(t, "", &value)
+	ctx, now := context.Background(), time.Unix(1700000000, 0)
+
+	e.Evaluate(ctx, now)
+	if list := e.Alerts(); len(list) != 1 || list[0].State != Pending || list[0].Subject != "eth0" {
+		t.Fatalf("expected eth0 pending, got %+v", list)
+	}
+
+	e.Evaluate(ctx, now.Add(30*time.Second))
+	e.Evaluate(ctx, now.Add(45*time.Second))
+	if list := e.Alerts(); len(list) != 1 || list[0].State != Firing {
+		t.Fatalf("expected eth0 firing, got %+v", list)
+	}
+
+	value = 0
+	e.Evaluate(ctx, now.Add(60*time.Second))
+	if list := e.Alerts(); len(list) != 1 || list[0].State != Resolved {
+		t.Fatalf("expected eth0 resolved, got %+v", list)
+	}
+
+	// notified once per transition, however long it held
+	states := hook.states()
+	if len(states) != 2 || states[0] != "eth0 firing" || states[1] != "eth0 resolved" {
+		t.Errorf("unexpected notifications %v", states)
+	}
+
+	e.Evaluate(ctx, now.Add(DefaultRetain+time.Hour))
+	if list := e.Alerts(); len(list) != 0 {
+		t.Errorf("resolved alert wasn't dropped: %+v", list)
+	}
+}
+
+func TestPendingClears(t *testing.T) {
+	value := 5.0
+	e, hook := setup(t, "", &value)
+	ctx, now := context.Background(), time.Unix(1700000000, 0)
+
+	e.Evaluate(ctx, now)
+	value = 0
+	e.Evaluate(ctx, now.Add(10*time.Second))
+	if list := e.Alerts(); len(list) != 0 {
+		t.Errorf("pending alert wasn't cleared: %+v", list)
+	}
+	if states := hook.states(); len(states) != 0 {
+		t.Errorf("unexpected notifications %v", states)
+	}
+}
+
+func TestSilence(t *testing.T) {
+	value := 5.0
+	e, hook := setup(t, "", &value)
+	ctx, now := context.Background(), time.Now()
+
+	s, err := e.Silence(Silence{Subject: "eth*", Until: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Evaluate(ctx, now)
+	e.Evaluate(ctx, now.Add(time.Minute))
+	if list := e.Alerts(); len(list) != 1 || list[0].State != Firing || !list[0].Silenced {
+		t.Fatalf("expected a silenced firing alert, got %+v", list)
+	}
+	if states := hook.states(); len(states) != 0 {
+		t.Errorf("silenced alert was notified: %v", states)
+	}
+
+	if err := e.Unsilence(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Unsilence(s.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+	if _, err := e.Silence(Silence{Until: now.Add(-time.Second)}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("accepted an expired silence: %v", err)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	e := New("")
+	e.Source("errors", func(ctx context.Context) ([]Observation, error) { return nil, nil })
+
+	for _, rules := range [][]Rule{
+		{{Name: "", Metric: "errors", Op: ">"}},
+		{{Name: "a", Metric: "nope", Op: ">"}},
+		{{Name: "a", Metric: "errors", Op: "=>"}},
+		{{Name: "a", Metric: "errors", Op: ">", Subject: "["}},
+		{{Name: "a", Metric: "errors", Op: ">", Sinks: []string{"nope"}}},
+		{{Name: "a", Metric: "errors", Op: ">"}, {Name: "a", Metric: "errors", Op: "<"}},
+	} {
+		if err := e.SetRules(rules); !errors.Is(err, ErrInvalid) {
+			t.Errorf("accepted %+v: %v", rules, err)
+		}
+	}
+
+	for _, sinks := range [][]SinkConfig{
+		{{Name: "a", Type: "pager"}},
+		{{Name: "a", Type: "webhook", URL: "ftp://example.com"}},
+		{{Name: "a", Type: "smtp", From: "avaron@localhost"}},
+		{{Name: "a", Type: "syslog"}, {Name: "a", Type: "syslog"}},
+	} {
+		if err := e.SetSinks(sinks); !errors.Is(err, ErrInvalid) {
+			t.Errorf("accepted %+v: %v", sinks, err)
+		}
+	}
+
+	// a sink can't be removed from under a rule
+	if err := e.SetSinks([]SinkConfig{{Name: "a", Type: "syslog"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetRules([]Rule{{Name: "a", Metric: "errors", Op: ">", Sinks: []string{"a"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetSinks(nil); !errors.Is(err, ErrInvalid) {
+		t.Errorf("removed a sink in use: %v", err)
+	}
+	if sinks := e.Sinks(); len(sinks) != 1 {
+		t.Errorf("unexpected sinks %+v", sinks)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts", "config.json")
+	value := 0.0
+	e, _ := setup(t, path, &value)
+	if _, err := e.Silence(Silence{Rule: "errors", Until: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := loaded.Rules(); len(rules) != 1 || rules[0].Name != "errors" {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+	if sinks := loaded.Sinks(); len(sinks) != 1 || sinks[0].Type != "webhook" {
+		t.Errorf("unexpected sinks %+v", sinks)
+	}
+	if silences := loaded.Silences(); len(silences) != 1 || silences[0].ID == "" {
+		t.Errorf("unexpected silences %+v", silences)
+	}
+
+	// expired silences aren't listed, & stay gone once evaluated
+	e.lock.Lock()
+	e.config.Silences = append(e.config.Silences, Silence{ID: "old", Until: time.Now().Add(-time.Second)})
+	e.lock.Unlock()
+	if silences := e.Silences(); len(silences) != 1 {
+		t.Errorf("listed an expired silence: %+v", silences)
+	}
+	e.Evaluate(context.Background(), time.Now().Add(2*time.Hour))
+	if loaded, err = Load(path); err != nil {
+		t.Fatal(err)
+	} else if silences := loaded.Silences(); len(silences) != 0 {
+		t.Errorf("expected pruned silences to be saved, got %+v", silences)
+	}
+
+	// rules on disk are held to the same checks as SetRules
+	for _, config := range []string{
+		`{"rules": [{"name": "a", "metric": "errors", "op": "=>"}]}`,
+		`{"rules": [{"name": "a", "metric": "errors", "op": ">"}, {"name": "a", "metric": "errors", "op": "<"}]}`,
+		`{"rules": [{"name": "a", "metric": "errors", "op": ">", "sinks": ["nope"]}]}`,
+	} {
+		if err = os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Load(path); !errors.Is(err, ErrInvalid) {
+			t.Errorf("loaded %s: %v", config, err)
+		}
+	}
+
+	if e, err := Load(filepath.Join(t.TempDir(), "missing.json")); err != nil || len(e.Rules()) != len(DefaultRules) {
+		t.Errorf("missing configuration should fall back to the defaults: %v", err)
+	}
+}
@@ -0,0 +1,706 @@
+package alerts
+
+import (
+	"avaron/logging"
+	"avaron/metrics"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/smtp"
+	"os"
+	filepath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("alerts")
+
+// states of an alert, resolved ones stay listed for Engine.Retain
+const (
+	Pending  = "pending"
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+const (
+	DefaultInterval = 15 * time.Second
+	DefaultRetain   = time.Hour
+	NotifyTimeout   = 10 * time.Second
+)
+
+var (
+	ErrInvalid  = errors.New("invalid alert configuration")
+	ErrNotFound = errors.New("no such silence")
+
+	Notifications = metrics.NewCounter("avaron_alert_notifications_total",
+		"Alert notifications sent, by sink & result", "sink", "result")
+)
+
+// DefaultRules apply until rules are configured, the metrics are those main registers
+var DefaultRules = []Rule{
+	{Name: "link-down", Metric: "link_up", Op: "<", Threshold: 1, For: 30, Severity: "critical",
+		Summary: "interface is not up"},
+	{Name: "stale-handshake", Metric: "wireguard_handshake_age", Op: ">", Threshold: 300, Severity: "warning",
+		Summary: "no wireguard handshake with peer for over 5 minutes"},
+	{Name: "packet-errors", Metric: "interface_error_rate", Op: ">", Threshold: 1, For: 60, Severity: "warning",
+		Summary: "interface is seeing more than 1 packet error per second"},
+	{Name: "unit-failed", Metric: "unit_failed", Op: "==", Threshold: 1, Severity: "critical",
+		Summary: "systemd unit has failed"},
+	{Name: "memory", Metric: "memory_used_ratio", Op: ">", Threshold: 0.9, For: 120, Severity: "warning",
+		Summary: "over 90% of memory is in use"},
+	{Name: "disk", Metric: "disk_used_ratio", Op: ">", Threshold: 0.9, For: 120, Severity: "warning",
+		Summary: "filesystem is over 90% full"},
+}
+
+// Observation is one subject's current value of a metric, ie. the error rate of eth0
+type Observation struct {
+	Subject string
+	Value   float64
+}
+
+// Source measures a metric for every subject it applies to
+type Source func(ctx context.Context) ([]Observation, error)
+
+// Rule raises an alert for each subject whose value compares true against
+// Threshold for at least For seconds
+type Rule struct {
+	Name      string   `json:"name"`
+	Metric    string   `json:"metric"`
+	Subject   string   `json:"subject,omitempty"` // glob, every subject when empty
+	Op        string   `json:"op"`                // one of > >= < <= == !=
+	Threshold float64  `json:"threshold"`
+	For       float64  `json:"for"` // seconds
+	Severity  string   `json:"severity,omitempty"`
+	Summary   string   `json:"summary,omitempty"`
+	Sinks     []string `json:"sinks,omitempty"` // names, every sink when empty
+}
+
+func (r *Rule) matches(subject string) bool {
+	if r.Subject == "" {
+		return true
+	}
+	ok, _ := filepath.Match(r.Subject, subject)
+	return ok
+}
+
+func (r *Rule) test(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	case "==":
+		return v == r.Threshold
+	case "!=":
+		return v != r.Threshold
+	}
+	return false
+}
+
+type Alert struct {
+	Rule     string     `json:"rule"`
+	Subject  string     `json:"subject"`
+	State    string     `json:"state"`
+	Value    float64    `json:"value"`
+	Severity string     `json:"severity,omitempty"`
+	Summary  string     `json:"summary,omitempty"`
+	Since    time.Time  `json:"since"` // when the condition started holding
+	Fired    *time.Time `json:"fired,omitempty"`
+	Resolved *time.Time `json:"resolved,omitempty"`
+	Silenced bool       `json:"silenced"`
+
+	notified time.Time
+	sinks    []string
+}
+
+// Silence suppresses notifications of matching alerts until it expires
+type Silence struct {
+	ID      string    `json:"id"`
+	Rule    string    `json:"rule,omitempty"`    // glob, any rule when empty
+	Subject string    `json:"subject,omitempty"` // glob, any subject when empty
+	Until   time.Time `json:"until"`
+	Comment string    `json:"comment,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (s *Silence) matches(a *Alert) bool {
+	rule, _ := filepath.Match(s.Rule, a.Rule)
+	subject, _ := filepath.Match(s.Subject, a.Subject)
+	return (s.Rule == "" || rule) && (s.Subject == "" || subject)
+}
+
+// SinkConfig describes where notifications go, fields apply by Type
+type SinkConfig struct {
+	Name string   `json:"name"`
+	Type string   `json:"type"`           // webhook, smtp or syslog
+	URL  string   `json:"url,omitempty"`  // webhook
+	Addr string   `json:"addr,omitempty"` // smtp relay, localhost:25 by default
+	From string   `json:"from,omitempty"` // smtp
+	To   []string `json:"to,omitempty"`   // smtp
+	Tag  string   `json:"tag,omitempty"`  // syslog, avaron by default
+}
+
+// Sink delivers one alert as it fires or resolves
+type Sink interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+func (c SinkConfig) Sink() (Sink, error) {
+	switch c.Type {
+	case "webhook":
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return nil, fmt.Errorf("%w: sink '%s' needs an http(s) url", ErrInvalid, c.Name)
+		}
+		return &Webhook{URL: c.URL}, nil
+	case "smtp":
+		if c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("%w: sink '%s' needs from & to addresses", ErrInvalid, c.Name)
+		}
+		addr := c.Addr
+		if addr == "" {
+			addr = "localhost:25"
+		}
+		return &SMTP{Addr: addr, From: c.From, To: c.To}, nil
+	case "syslog":
+		tag := c.Tag
+		if tag == "" {
+			tag = "avaron"
+		}
+		return &Syslog{Tag: tag}, nil
+	}
+	return nil, fmt.Errorf("%w: sink '%s' has unknown type '%s'", ErrInvalid, c.Name, c.Type)
+}
+
+// Webhook POSTs each alert as JSON
+type Webhook struct {
+	URL string
+}
+
+func (w *Webhook) Notify(ctx context.Context, a Alert) error {
+	buf, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+// SMTP mails each alert through a relay which accepts unauthenticated local mail
+type SMTP struct {
+	Addr string
+	From string
+	To   []string
+}
+
+func (s *SMTP) Notify(ctx context.Context, a Alert) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\n", s.From, strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", title(&a))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nvalue: %g\r\nsince: %s\r\n", a.Summary, a.Value, a.Since.Format(time.RFC3339))
+
+	// net/smtp has no context, a hung relay is abandoned rather than waited on
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, nil, s.From, s.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Syslog logs each alert to the local syslog daemon
+type Syslog struct {
+	Tag string
+}
+
+func (s *Syslog) Notify(ctx context.Context, a Alert) error {
+	w, err := syslog.Dial("", "", syslog.LOG_DAEMON|syslog.LOG_WARNING, s.Tag)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	line := fmt.Sprintf("%s: %s (value %g)", title(&a), a.Summary, a.Value)
+	switch {
+	case a.State == Resolved:
+		return w.Notice(line)
+	case a.Severity == "critical":
+		return w.Crit(line)
+	}
+	return w.Warning(line)
+}
+
+func title(a *Alert) string {
+	return fmt.Sprintf("[%s] %s %s", strings.ToUpper(a.State), a.Rule, a.Subject)
+}
+
+// Config is what's persisted at Engine.Path
+type Config struct {
+	Rules    []Rule       `json:"rules"`
+	Sinks    []SinkConfig `json:"sinks"`
+	Silences []Silence    `json:"silences"`
+}
+
+// Engine evaluates rules against sources, tracks alerts & notifies sinks
+type Engine struct {
+	Path     string
+	Interval time.Duration // between evaluations
+	Repeat   time.Duration // notify still firing alerts again after, never when zero
+	Retain   time.Duration // resolved alerts stay listed
+
+	lock    sync.Mutex
+	config  Config
+	sinks   map[string]Sink
+	sources map[string]Source
+	alerts  map[string]*Alert
+}
+
+// Primary constructor for this package, path is where the configuration is saved
+func New(path string) *Engine {
+	return &Engine{
+		Path:     path,
+		Interval: DefaultInterval,
+		Retain:   DefaultRetain,
+		config:   Config{Rules: append([]Rule(nil), DefaultRules...)},
+		sinks:    make(map[string]Sink),
+		sources:  make(map[string]Source),
+		alerts:   make(map[string]*Alert),
+	}
+}
+
+// Load reads the configuration at path, falling back to DefaultRules if it doesn't exist
+func Load(path string) (*Engine, error) {
+	e := New(path)
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err = json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("reading %s: %+v", path, err)
+	}
+	sinks, err := build(config.Sinks)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %+v", path, err)
+	}
+	// metrics are registered after loading, Evaluate warns of unknown ones
+	if _, err = check(config.Rules, sinks, nil); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	e.config, e.sinks = config, sinks
+	return e, nil
+}
+
+func build(configs []SinkConfig) (map[string]Sink, error) {
+	sinks := make(map[string]Sink, len(configs))
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%w: unnamed sink", ErrInvalid)
+		} else if _, ok := sinks[c.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate sink '%s'", ErrInvalid, c.Name)
+		}
+		sink, err := c.Sink()
+		if err != nil {
+			return nil, err
+		}
+		sinks[c.Name] = sink
+	}
+	return sinks, nil
+}
+
+// save writes the configuration, the lock must be held
+func (e *Engine) save() error {
+	if e.Path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(e.Path), 0700); err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(e.config, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := e.Path + ".tmp"
+	if err = os.WriteFile(tmp, append(buf, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.Path)
+}
+
+// Source registers the measurement behind a rule's metric
+func (e *Engine) Source(metric string, fn Source) {
+	e.lock.Lock()
+	e.sources[metric] = fn
+	e.lock.Unlock()
+}
+
+func (e *Engine) Rules() []Rule {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]Rule{}, e.config.Rules...)
+}
+
+// SetRules validates & saves rules, replacing all of them. Alerts of rules
+// which are gone are dropped, those of changed rules start over.
+func (e *Engine) SetRules(rules []Rule) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	names, err := check(rules, e.sinks, e.sources)
+	if err != nil {
+		return err
+	}
+
+	old := make(map[string]Rule, len(e.config.Rules))
+	for _, r := range e.config.Rules {
+		old[r.Name] = r
+	}
+	for k, a := range e.alerts {
+		if r, ok := old[a.Rule]; !ok || !names[a.Rule] || !same(&r, rules) {
+			delete(e.alerts, k)
+		}
+	}
+
+	e.config.Rules = append([]Rule{}, rules...)
+	return e.save()
+}
+
+// check validates rules against sinks & sources, returning their names.
+// Metrics aren't checked when sources is nil.
+func check(rules []Rule, sinks map[string]Sink, sources map[string]Source) (map[string]bool, error) {
+	names := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		switch {
+		case r.Name == "", strings.ContainsAny(r.Name, "/\xff"):
+			return nil, fmt.Errorf("%w: rule name '%s'", ErrInvalid, r.Name)
+		case names[r.Name]:
+			return nil, fmt.Errorf("%w: duplicate rule '%s'", ErrInvalid, r.Name)
+		case sources != nil && sources[r.Metric] == nil:
+			return nil, fmt.Errorf("%w: rule '%s' has unknown metric '%s'", ErrInvalid, r.Name, r.Metric)
+		case !r.valid():
+			return nil, fmt.Errorf("%w: rule '%s' has unknown op '%s'", ErrInvalid, r.Name, r.Op)
+		case r.For < 0:
+			return nil, fmt.Errorf("%w: rule '%s' has negative for", ErrInvalid, r.Name)
+		}
+		if _, err := filepath.Match(r.Subject, ""); err != nil {
+			return nil, fmt.Errorf("%w: rule '%s' subject: %+v", ErrInvalid, r.Name, err)
+		}
+		for _, sink := range r.Sinks {
+			if sinks[sink] == nil {
+				return nil, fmt.Errorf("%w: rule '%s' has unknown sink '%s'", ErrInvalid, r.Name, sink)
+			}
+		}
+		names[r.Name] = true
+	}
+	return names, nil
+}
+
+func (r *Rule) valid() bool {
+	switch r.Op {
+	case ">", ">=", "<", "<=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// same reports whether r is among rules unchanged
+func same(r *Rule, rules []Rule) bool {
+	a, _ := json.Marshal(r)
+	for i := range rules {
+		if rules[i].Name == r.Name {
+			b, _ := json.Marshal(&rules[i])
+			return bytes.Equal(a, b)
+		}
+	}
+	return false
+}
+
+func (e *Engine) Sinks() []SinkConfig {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]SinkConfig{}, e.config.Sinks...)
+}
+
+// SetSinks validates & saves sinks, replacing all of them
+func (e *Engine) SetSinks(configs []SinkConfig) error {
+	sinks, err := build(configs)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	// a sink still named by a rule would keep the configuration from loading
+	if _, err = check(e.config.Rules, sinks, nil); err != nil {
+		return err
+	}
+	e.config.Sinks, e.sinks = append([]SinkConfig{}, configs...), sinks
+	return e.save()
+}
+
+// Silences lists those which haven't expired
+func (e *Engine) Silences() []Silence {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now, list := time.Now(), []Silence{}
+	for _, s := range e.config.Silences {
+		if s.Until.After(now) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Silence adds s, assigning its ID
+func (e *Engine) Silence(s Silence) (Silence, error) {
+	for _, pattern := range []string{s.Rule, s.Subject} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return s, fmt.Errorf("%w: silence: %+v", ErrInvalid, err)
+		}
+	}
+	if !s.Until.After(time.Now()) {
+		return s, fmt.Errorf("%w: silence has already expired", ErrInvalid)
+	}
+
+	var buf [8]byte
+	rand.Read(buf[:])
+	s.ID, s.Created = hex.EncodeToString(buf[:]), time.Now()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.config.Silences = append(e.config.Silences, s)
+	for _, a := range e.alerts {
+		a.Silenced = a.Silenced || s.matches(a)
+	}
+	return s, e.save()
+}
+
+func (e *Engine) Unsilence(id string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for i, s := range e.config.Silences {
+		if s.ID == id {
+			e.config.Silences = append(e.config.Silences[:i:i], e.config.Silences[i+1:]...)
+			return e.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Alerts lists pending, firing & recently resolved alerts, most recent first
+func (e *Engine) Alerts() []Alert {
+	e.lock.Lock()
+	list := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		list = append(list, *a)
+	}
+	e.lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Since.Equal(list[j].Since) {
+			return list[i].Since.After(list[j].Since)
+		}
+		return list[i].Rule+"/"+list[i].Subject < list[j].Rule+"/"+list[j].Subject
+	})
+	return list
+}
+
+type notification struct {
+	sink  string
+	alert Alert
+}
+
+// Evaluate runs every rule once as of now, notifying sinks of alerts which
+// fired or resolved. Each alert is identified by rule & subject, so a
+// condition which keeps holding is only notified of once (or every Repeat).
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) {
+	e.lock.Lock()
+	rules := append([]Rule(nil), e.config.Rules...)
+	sources := make(map[string]Source)
+	for _, r := range rules {
+		if fn := e.sources[r.Metric]; fn != nil {
+			sources[r.Metric] = fn
+		} else {
+			logger.WarnContext(ctx, "rule has unknown metric", "rule", r.Name, "metric", r.Metric)
+		}
+	}
+	e.lock.Unlock()
+
+	// sources shell out, so they run without the lock
+	observed := make(map[string][]Observation, len(sources))
+	for metric, fn := range sources {
+		list, err := fn(ctx)
+		if err != nil {
+			logger.WarnContext(ctx, "failed measuring", "metric", metric, "err", err)
+			continue
+		}
+		observed[metric] = list
+	}
+
+	e.lock.Lock()
+	var out []notification
+
+	silences := e.config.Silences[:0]
+	for _, s := range e.config.Silences {
+		if s.Until.After(now) {
+			silences = append(silences, s)
+		}
+	}
+	if len(silences) != len(e.config.Silences) {
+		e.config.Silences = silences
+		if err := e.save(); err != nil {
+			logger.WarnContext(ctx, "failed saving pruned silences", "err", err)
+		}
+	}
+
+	notify := func(a *Alert) {
+		a.notified = now
+		if a.Silenced {
+			return
+		}
+		names := a.sinks
+		if len(names) == 0 {
+			for name := range e.sinks {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			out = append(out, notification{name, *a})
+		}
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		list, ok := observed[r.Metric]
+		if !ok {
+			continue // keep state as it was rather than resolving everything
+		}
+
+		holding := make(map[string]bool)
+		for _, o := range list {
+			if !r.matches(o.Subject) || !r.test(o.Value) {
+				continue
+			}
+			holding[o.Subject] = true
+
+			k := r.Name + "\xff" + o.Subject
+			a, ok := e.alerts[k]
+			if !ok || a.State == Resolved {
+				a = &Alert{Rule: r.Name, Subject: o.Subject, State: Pending, Since: now}
+				e.alerts[k] = a
+			}
+			a.Value, a.Severity, a.Summary, a.sinks = o.Value, r.Severity, r.Summary, r.Sinks
+
+			a.Silenced = false
+			for j := range silences {
+				a.Silenced = a.Silenced || silences[j].matches(a)
+			}
+
+			switch {
+			case a.State == Pending && now.Sub(a.Since) >= time.Duration(r.For*float64(time.Second)):
+				fired := now
+				a.State, a.Fired = Firing, &fired
+				logger.WarnContext(ctx, "alert firing", "rule", a.Rule, "subject", a.Subject, "value", a.Value, "silenced", a.Silenced)
+				notify(a)
+			case a.State == Firing && e.Repeat > 0 && now.Sub(a.notified) >= e.Repeat:
+				notify(a)
+			}
+		}
+
+		for k, a := range e.alerts {
+			if a.Rule != r.Name || holding[a.Subject] || a.State == Resolved {
+				continue
+			}
+			if a.State == Pending {
+				delete(e.alerts, k)
+				continue
+			}
+			resolved := now
+			a.State, a.Resolved = Resolved, &resolved
+			logger.InfoContext(ctx, "alert resolved", "rule", a.Rule, "subject", a.Subject)
+			notify(a)
+		}
+	}
+
+	for k, a := range e.alerts {
+		if a.State == Resolved && now.Sub(*a.Resolved) >= e.Retain {
+			delete(e.alerts, k)
+		}
+	}
+
+	sinks := make(map[string]Sink, len(e.sinks))
+	for name, sink := range e.sinks {
+		sinks[name] = sink
+	}
+	e.lock.Unlock()
+
+	for _, n := range out {
+		sink := sinks[n.sink]
+		if sink == nil {
+			logger.WarnContext(ctx, "rule has unknown sink", "rule", n.alert.Rule, "sink", n.sink)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, NotifyTimeout)
+		err := sink.Notify(ctx, n.alert)
+		cancel()
+		if err != nil {
+			logger.WarnContext(ctx, "failed notifying", "sink", n.sink, "rule", n.alert.Rule, "err", err)
+			Notifications.Inc(n.sink, "failure")
+		} else {
+			Notifications.Inc(n.sink, "success")
+		}
+	}
+}
+
+// Loop evaluates rules every Interval until ctx is done
+func (e *Engine) Loop(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			e.Evaluate(ctx, now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
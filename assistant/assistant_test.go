@@ -0,0 +1,102 @@
+package assistant
+
+import (
+	"avaron/agent"
+	"avaron/llama"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func setup(t *testing.T, fake *llama.Fake) *Manager {
+	a := agent.New()
+	a.Backend = fake
+	m := New(t.TempDir(), a)
+	m.Seed = func(ctx context.Context) (string, error) {
+		return `{"name":"branch-a"}`, nil
+	}
+	return m
+}
+
+func TestConversation(t *testing.T) {
+	fake := &llama.Fake{Responses: []string{"branch-b's handshake is stale", "restart its tunnel"}}
+	m := setup(t, fake)
+	ctx := context.Background()
+
+	s, err := m.Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Messages) != 2 || !strings.Contains(s.Messages[1].Content, "branch-a") {
+		t.Fatalf("session wasn't seeded: %+v", s.Messages)
+	}
+
+	var tokens []string
+	obs := agent.Observer{Token: func(s string) { tokens = append(tokens, s) }}
+	if s, err = m.Send(ctx, s.ID, "why can't branch-a reach branch-b?\nit worked yesterday", obs); err != nil {
+		t.Fatal(err)
+	}
+	if s.Title != "why can't branch-a reach branch-b?" || strings.Join(tokens, "") != "branch-b's handshake is stale" {
+		t.Errorf("unexpected title %q or tokens %q", s.Title, tokens)
+	}
+	if _, err = m.Send(ctx, s.ID, "what now?", agent.Observer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// history survives, & is what the model is given
+	loaded, err := m.Get(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Messages) != 6 || loaded.Messages[5].Content != "restart its tunnel" || loaded.Messages[4].Content != "what now?" {
+		t.Errorf("unexpected history %+v", loaded.Messages)
+	}
+
+	list, err := m.List()
+	if err != nil || len(list) != 1 || list[0].Messages != 6 {
+		t.Errorf("unexpected sessions %+v: %v", list, err)
+	}
+
+	if err := m.Delete(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{m.Delete(s.ID), func() error { _, err := m.Get(s.ID); return err }(), func() error { _, err := m.Get("../etc"); return err }()} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want ErrNotFound", err)
+		}
+	}
+}
+
+func TestRefusals(t *testing.T) {
+	m := setup(t, &llama.Fake{})
+	ctx := context.Background()
+	s, _ := m.Create(ctx)
+
+	if _, err := m.Send(ctx, s.ID, "  ", agent.Observer{}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("got %v, want ErrInvalid", err)
+	}
+	if _, err := m.Send(ctx, "42", "hello", agent.Observer{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+
+	// one answer at a time
+	release := make(chan struct{})
+	answering, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Send(ctx, s.ID, "hello", agent.Observer{Reply: func() {
+			close(answering)
+			<-release
+		}})
+	}()
+	<-answering
+	if _, err := m.Send(ctx, s.ID, "hello again", agent.Observer{}); !errors.Is(err, ErrBusy) {
+		t.Errorf("got %v, want ErrBusy", err)
+	}
+	if err := m.Delete(s.ID); !errors.Is(err, ErrBusy) {
+		t.Errorf("got %v, want ErrBusy", err)
+	}
+	close(release)
+	<-done
+}
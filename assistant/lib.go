@@ -0,0 +1,237 @@
+package assistant
+
+import (
+	"avaron/agent"
+	"avaron/llama"
+	"avaron/logging"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	filepath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("assistant")
+
+var (
+	ErrNotFound = errors.New("assistant session not found")
+	ErrBusy     = errors.New("assistant session is already answering")
+	ErrInvalid  = errors.New("invalid message")
+)
+
+// MaxMessage is the most bytes an operator may send at once
+const MaxMessage = 16 << 10
+
+const PROMPT = `
+You are the network assistant of an avaron node, a branch of a wireguard mesh.
+Operators ask you about this node & its peers, ie. why one branch can't reach another.
+The node's state when the conversation started is below. It may have changed since, so use the tools you're given to check anything you rely on.
+Be brief & specific, & say which commands or tools led you to an answer.
+`
+
+// Session is a conversation with its history
+type Session struct {
+	ID       string          `json:"id"`
+	Title    string          `json:"title"` // the start of the first question
+	Created  time.Time       `json:"created"`
+	Updated  time.Time       `json:"updated"`
+	Messages []llama.Message `json:"messages"`
+}
+
+// Summary describes a session without its history
+type Summary struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Messages int       `json:"messages"`
+}
+
+type Manager struct {
+	Dir   string
+	Agent *agent.Agent
+	// Seed describes the node, given to the model when a session is created
+	Seed func(ctx context.Context) (string, error)
+
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+// Primary constructor for this package
+func New(dir string, a *agent.Agent) *Manager {
+	return &Manager{
+		Dir:   dir,
+		Agent: a,
+		busy:  make(map[string]bool),
+	}
+}
+
+func (m *Manager) path(id string) string {
+	return filepath.Join(m.Dir, id+".json")
+}
+
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Manager) save(s *Session) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path(s.ID) + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path(s.ID))
+}
+
+// Create starts a session seeded with the node's state
+func (m *Manager) Create(ctx context.Context) (Session, error) {
+	now := time.Now()
+	s := Session{
+		ID:       strconv.FormatInt(now.UnixNano(), 10),
+		Created:  now,
+		Updated:  now,
+		Messages: []llama.Message{{Role: "system", Content: PROMPT}},
+	}
+
+	if m.Seed != nil {
+		state, err := m.Seed(ctx)
+		if err != nil {
+			// the tools still work without it
+			logger.WarnContext(ctx, "failed describing the node", "err", err)
+			state = fmt.Sprintf("unavailable: %v", err)
+		}
+		s.Messages = append(s.Messages, llama.Message{Role: "system", Content: "Node state:\n```json\n" + state + "\n```"})
+	}
+
+	return s, m.save(&s)
+}
+
+// Get returns a session with its history
+func (m *Manager) Get(id string) (s Session, err error) {
+	if !validID(id) {
+		return s, ErrNotFound
+	}
+	buf, err := os.ReadFile(m.path(id))
+	if os.IsNotExist(err) {
+		return s, ErrNotFound
+	} else if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(buf, &s)
+	return
+}
+
+// List summarises every session, most recently updated first
+func (m *Manager) List() ([]Summary, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if os.IsNotExist(err) {
+		return []Summary{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	list := make([]Summary, 0, len(entries))
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if id == e.Name() || !validID(id) {
+			continue
+		}
+		s, err := m.Get(id)
+		if err != nil {
+			logger.Warn("skipping unreadable session", "id", id, "err", err)
+			continue
+		}
+		list = append(list, Summary{s.ID, s.Title, s.Created, s.Updated, len(s.Messages)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Updated.After(list[j].Updated) })
+	return list, nil
+}
+
+// Delete forgets a session, unless it's answering
+func (m *Manager) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.busy[id] {
+		return ErrBusy
+	}
+	if err := os.Remove(m.path(id)); os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Send asks the model about content in the context of the session, with
+// obs following its answer, & returns the session with the answer appended
+func (m *Manager) Send(ctx context.Context, id, content string, obs agent.Observer) (Session, error) {
+	content = strings.TrimSpace(content)
+	if content == "" || len(content) > MaxMessage {
+		return Session{}, fmt.Errorf("%w: must be between 1 & %d bytes", ErrInvalid, MaxMessage)
+	}
+
+	m.lock.Lock()
+	if m.busy[id] {
+		m.lock.Unlock()
+		return Session{}, ErrBusy
+	}
+	m.busy[id] = true
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.busy, id)
+		m.lock.Unlock()
+	}()
+
+	s, err := m.Get(id)
+	if err != nil {
+		return s, err
+	}
+	if s.Title == "" {
+		s.Title = content
+		if i := strings.IndexByte(s.Title, '\n'); i != -1 {
+			s.Title = s.Title[:i]
+		}
+		if len(s.Title) > 80 {
+			s.Title = s.Title[:80]
+		}
+	}
+
+	messages := append(s.Messages, llama.Message{Role: "user", Content: content})
+	messages, err = m.Agent.Run(ctx, messages, obs)
+
+	// whatever was said is kept, even if the answer was cut short
+	s.Messages, s.Updated = messages, time.Now()
+	if e := m.save(&s); e != nil {
+		logger.ErrorContext(ctx, "failed saving session", "id", id, "err", e)
+		if err == nil {
+			err = e
+		}
+	}
+	return s, err
+}
@@ -0,0 +1,112 @@
+package ca
+
+import (
+	"avaron/certs"
+	"avaron/vertex"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	filepath "path"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	dir := t.TempDir()
+
+	var peer, stranger vertex.Key
+	peer[0], stranger[0] = 1, 2
+
+	a, err := New(filepath.Join(dir, "ca"), filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), func(k vertex.Key) bool {
+		return k == peer
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := certs.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := CSR(priv, peer, "branch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Sign(csr, nil); !errors.Is(err, ErrNotAuthority) {
+		t.Fatalf("expected ErrNotAuthority, got %v", err)
+	}
+
+	if err = a.Init("test CA"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Sign(csr, stranger.GlobalAddress().IP); !errors.Is(err, ErrIdentity) {
+		t.Errorf("expected ErrIdentity, got %v", err)
+	}
+
+	other, _ := CSR(priv, stranger, "stranger")
+	if _, err = a.Sign(other, stranger.GlobalAddress().IP); !errors.Is(err, ErrUnapproved) {
+		t.Errorf("expected ErrUnapproved, got %v", err)
+	}
+
+	chain, err := a.Sign(csr, peer.GlobalAddress().IP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := parseCertificates(chain)
+	if len(list) != 2 {
+		t.Fatalf("expected leaf & CA, got %d certificates", len(list))
+	}
+	if k, err := KeyOf(list[0].URIs); err != nil || k != peer {
+		t.Errorf("certificate not bound to peer: %v", err)
+	}
+	if !list[0].IPAddresses[0].Equal(peer.GlobalAddress().IP) {
+		t.Errorf("expected global address SAN, got %v", list[0].IPAddresses)
+	}
+
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{list[0]}}
+	if err = a.Verify(cs, &peer); err != nil {
+		t.Errorf("expected valid certificate: %v", err)
+	}
+	if err = a.Verify(cs, &stranger); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("expected key mismatch, got %v", err)
+	}
+
+	// another node trusting our CA learns of the revocation through the CRL
+	b, err := New(filepath.Join(dir, "b"), filepath.Join(dir, "b.pem"), filepath.Join(dir, "b.key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Trust("a", a.Bundle()); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Verify(cs, &peer); err != nil {
+		t.Errorf("expected valid certificate: %v", err)
+	}
+
+	if err = a.Revoke(peer); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Verify(cs, &peer); !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected ErrRevoked, got %v", err)
+	}
+
+	crl, err := a.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.AddCRL(crl); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Verify(cs, &peer); !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected ErrRevoked, got %v", err)
+	}
+
+	// revocations survive restarts
+	if a, err = New(a.Dir, a.CertFile, a.KeyFile, a.Approved); err != nil {
+		t.Fatal(err)
+	} else if !a.IsRevoked(list[0]) {
+		t.Errorf("expected revocation to persist")
+	}
+}
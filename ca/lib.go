@@ -0,0 +1,592 @@
+package ca
+
+import (
+	"avaron/certs"
+	"avaron/client"
+	"avaron/logging"
+	"avaron/vertex"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	filepath "path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("ca")
+
+const (
+	// certificates bind a wireguard key through a URI SAN, ie. avaron:wg:<hex>
+	URIPrefix = "avaron:wg:"
+
+	CRLValidity = 24 * time.Hour
+)
+
+var (
+	ErrNotAuthority = errors.New("this node is not a certificate authority")
+	ErrUnapproved   = errors.New("wireguard key is not an approved peer")
+	ErrIdentity     = errors.New("request doesn't originate from the key's global address")
+	ErrBadCSR       = errors.New("bad certificate signing request")
+	ErrRevoked      = errors.New("certificate revoked")
+	ErrUntrusted    = errors.New("certificate not issued by a trusted mesh CA")
+)
+
+func KeyURI(k vertex.Key) string {
+	return URIPrefix + hex.EncodeToString(k[:])
+}
+
+// KeyOf extracts the wireguard key a certificate (or CSR's) URI SANs are bound to
+func KeyOf(uris []*url.URL) (k vertex.Key, err error) {
+	for _, u := range uris {
+		s := u.String()
+		if !strings.HasPrefix(s, URIPrefix) {
+			continue
+		}
+		buf, err := hex.DecodeString(strings.TrimPrefix(s, URIPrefix))
+		if err != nil || len(buf) != len(k) {
+			return k, fmt.Errorf("malformed key URI '%s'", s)
+		}
+		copy(k[:], buf)
+		return k, nil
+	}
+	return k, fmt.Errorf("no %s URI", URIPrefix)
+}
+
+type Issued struct {
+	Serial   string    `json:"serial"`
+	Key      string    `json:"key"`
+	Issued   time.Time `json:"issued"`
+	NotAfter time.Time `json:"notAfter"`
+	Revoked  time.Time `json:"revoked,omitempty"`
+}
+
+// Authority signs certificates for approved peers when this node holds the
+// mesh CA (CertFile/KeyFile), & on every node tracks which CAs are trusted &
+// which serials were revoked. Several nodes may be designated CAs, each with
+// their own key; every node trusts the union of them.
+type Authority struct {
+	Dir      string // ca/, trusted certificates & the issuance log
+	CertFile string // tls/ca.pem, only present on designated nodes
+	KeyFile  string // tls/ca.key
+
+	// Approved reports whether a wireguard key has been paired with
+	Approved func(vertex.Key) bool
+
+	lock    sync.Mutex
+	issued  []Issued
+	revoked map[string]time.Time // serials, ours & from fetched CRLs
+}
+
+// Primary constructor for this package
+func New(dir, certFile, keyFile string, approved func(vertex.Key) bool) (*Authority, error) {
+	a := &Authority{
+		Dir:      dir,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Approved: approved,
+		revoked:  make(map[string]time.Time),
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "trusted"), 0700); err != nil {
+		return nil, err
+	}
+
+	buf, err := os.ReadFile(filepath.Join(dir, "issued.json"))
+	if err == nil {
+		err = json.Unmarshal(buf, &a.issued)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading issuance log: %+v", err)
+	}
+
+	for _, i := range a.issued {
+		if !i.Revoked.IsZero() {
+			a.revoked[i.Serial] = i.Revoked
+		}
+	}
+
+	return a, nil
+}
+
+func (a *Authority) save() error {
+	buf, err := json.MarshalIndent(a.issued, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(a.Dir, "issued.json")
+	if err = os.WriteFile(path+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Init makes this node a designated CA, it's a no-op if it already is one
+func (a *Authority) Init(name string) error {
+	if _, err := os.Stat(a.CertFile); err == nil {
+		return nil
+	}
+
+	key, err := certs.NewKey()
+	if err != nil {
+		return err
+	}
+
+	der, err := certs.IssueCA(name, key)
+	if err != nil {
+		return err
+	}
+
+	buf, err := certs.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(a.KeyFile), 0700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(a.KeyFile, buf, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(a.CertFile, certs.EncodeCertificate(der), 0644)
+}
+
+func (a *Authority) signer() (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrNotAuthority
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("CA private key can't sign")
+	}
+	return cert, signer, nil
+}
+
+func (a *Authority) IsAuthority() bool {
+	_, _, err := a.signer()
+	return err == nil
+}
+
+// Sign issues a certificate for csr, which must name an approved wireguard key
+// & arrive from that key's global address. The result is a PEM chain.
+func (a *Authority) Sign(csr []byte, remote net.IP) ([]byte, error) {
+	ca, signer, err := a.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(csr)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("%w: expected PEM 'CERTIFICATE REQUEST'", ErrBadCSR)
+	}
+
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrBadCSR, err)
+	} else if err = req.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrBadCSR, err)
+	}
+
+	k, err := KeyOf(req.URIs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrBadCSR, err)
+	}
+
+	if !a.Approved(k) {
+		return nil, fmt.Errorf("%w: %s", ErrUnapproved, k)
+	}
+
+	global := k.GlobalAddress().IP
+	if remote != nil && !remote.Equal(global) {
+		return nil, fmt.Errorf("%w: %s != %s", ErrIdentity, remote, global)
+	}
+
+	id := certs.Identity{
+		CommonName: req.Subject.CommonName,
+		IPs:        []net.IP{global},
+		URIs:       []string{KeyURI(k)},
+	}
+	for _, name := range req.DNSNames {
+		// hostnames within the mesh only
+		if !strings.Contains(name, ".") || strings.HasSuffix(name, ".avaron.lan") {
+			id.DNSNames = append(id.DNSNames, name)
+		}
+	}
+
+	der, err := certs.Issue(id, req.PublicKey, signer, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	a.issued = append(a.issued, Issued{
+		Serial:   cert.SerialNumber.Text(16),
+		Key:      k.String(),
+		Issued:   time.Now(),
+		NotAfter: cert.NotAfter,
+	})
+	err = a.save()
+	a.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("recording issued certificate: %+v", err)
+	}
+
+	logger.Info("issued certificate", "serial", cert.SerialNumber.Text(16), "key", k)
+
+	return append(certs.EncodeCertificate(der), certs.EncodeCertificate(ca.Raw)...), nil
+}
+
+// Revoke invalidates every certificate issued for k, ie. when the peer is deleted
+func (a *Authority) Revoke(k vertex.Key) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var n int
+	now := time.Now()
+	for i := range a.issued {
+		if a.issued[i].Key != k.String() || !a.issued[i].Revoked.IsZero() {
+			continue
+		}
+		a.issued[i].Revoked = now
+		a.revoked[a.issued[i].Serial] = now
+		n++
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	logger.Info("revoked certificates", "count", n, "key", k)
+	return a.save()
+}
+
+// CRL returns a DER revocation list signed by this node's CA
+func (a *Authority) CRL() ([]byte, error) {
+	ca, signer, err := a.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	var entries []x509.RevocationListEntry
+	for _, i := range a.issued {
+		if i.Revoked.IsZero() || time.Now().After(i.NotAfter) {
+			continue
+		}
+		sn, ok := new(big.Int).SetString(i.Serial, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   sn,
+			RevocationTime: i.Revoked,
+		})
+	}
+	a.lock.Unlock()
+
+	now := time.Now()
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(CRLValidity),
+		RevokedCertificateEntries: entries,
+	}, ca, signer)
+}
+
+// AddCRL merges a revocation list fetched from another designated node
+func (a *Authority) AddCRL(der []byte) error {
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return err
+	}
+
+	var verified bool
+	for _, ca := range a.trusted() {
+		if crl.CheckSignatureFrom(ca) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return ErrUntrusted
+	}
+
+	a.lock.Lock()
+	for _, entry := range crl.RevokedCertificateEntries {
+		a.revoked[entry.SerialNumber.Text(16)] = entry.RevocationTime
+	}
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *Authority) IsRevoked(cert *x509.Certificate) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, ok := a.revoked[cert.SerialNumber.Text(16)]
+	return ok
+}
+
+func parseCertificates(buf []byte) (list []*x509.Certificate) {
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			return
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			list = append(list, cert)
+		}
+	}
+}
+
+func (a *Authority) trusted() (list []*x509.Certificate) {
+	if buf, err := os.ReadFile(a.CertFile); err == nil {
+		list = append(list, parseCertificates(buf)...)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(a.Dir, "trusted"))
+	for _, entry := range entries {
+		if buf, err := os.ReadFile(filepath.Join(a.Dir, "trusted", entry.Name())); err == nil {
+			list = append(list, parseCertificates(buf)...)
+		}
+	}
+	return
+}
+
+// Bundle is every trusted CA certificate as PEM
+func (a *Authority) Bundle() []byte {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for _, cert := range a.trusted() {
+		if seen[string(cert.Raw)] {
+			continue
+		}
+		seen[string(cert.Raw)] = true
+		buf.Write(certs.EncodeCertificate(cert.Raw))
+	}
+	return buf.Bytes()
+}
+
+func (a *Authority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range a.trusted() {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+// Trust records the CA certificate(s) of another designated node
+func (a *Authority) Trust(name string, buf []byte) error {
+	list := parseCertificates(buf)
+	if len(list) == 0 {
+		return fmt.Errorf("no certificates in bundle from %s", name)
+	}
+	for _, cert := range list {
+		if !cert.IsCA {
+			return fmt.Errorf("certificate '%s' from %s is not a CA", cert.Subject.CommonName, name)
+		}
+	}
+	return os.WriteFile(filepath.Join(a.Dir, "trusted", name+".pem"), buf, 0644)
+}
+
+// Verify checks a peer's certificate chain against the trusted CAs & the
+// revocation lists, & that it is bound to want when want isn't nil
+func (a *Authority) Verify(cs tls.ConnectionState, want *vertex.Key) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrUntrusted
+	}
+
+	leaf := cs.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.Pool(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %+v", ErrUntrusted, err)
+	}
+
+	if a.IsRevoked(leaf) {
+		return fmt.Errorf("%w: serial %s", ErrRevoked, leaf.SerialNumber.Text(16))
+	}
+
+	if want == nil {
+		return nil
+	}
+
+	k, err := KeyOf(leaf.URIs)
+	if err != nil {
+		return fmt.Errorf("%w: %+v", ErrUntrusted, err)
+	} else if k != *want {
+		return fmt.Errorf("%w: certificate is for %s, expected %s", ErrUntrusted, k, want)
+	}
+	return nil
+}
+
+// CSR creates a signing request binding priv to the wireguard key k
+func CSR(priv crypto.Signer, k vertex.Key, hostname string) ([]byte, error) {
+	u, err := url.Parse(KeyURI(k))
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname, Organization: []string{"Avaron"}},
+		DNSNames: []string{hostname, hostname + ".avaron.lan"},
+		URIs:     []*url.URL{u},
+	}, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// Issuer reports whether cert was issued by a trusted mesh CA
+func (a *Authority) Issuer(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     a.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+// Refresh fetches the CA bundle & CRL of every designated node, through
+// mesh a client whose server certificate must be trusted & bound to the
+// node's key. Only the very first bundle, before anything's trusted, comes
+// over plain HTTP, where the overlay's tunnel already authenticates the key
+func (a *Authority) Refresh(ctx context.Context, authorities []vertex.Key, mesh func(vertex.Key) *http.Client) {
+	bootstrap := len(a.trusted()) == 0
+	for _, k := range authorities {
+		c := client.ForKey(k, "http", 8080, nil)
+		if !bootstrap {
+			c = client.ForKey(k, "https", 8443, mesh(k))
+			defer c.HTTP.CloseIdleConnections()
+		}
+
+		if buf, err := c.CABundle(ctx); err != nil {
+			logger.WarnContext(ctx, "failed fetching CA bundle", "authority", k, "err", err)
+		} else if err = a.Trust(k.Path(), buf); err != nil {
+			logger.WarnContext(ctx, "failed trusting CA bundle", "authority", k, "err", err)
+		}
+
+		if buf, err := c.CRL(ctx); err != nil {
+			logger.WarnContext(ctx, "failed fetching CRL", "authority", k, "err", err)
+		} else if err = a.AddCRL(buf); err != nil {
+			logger.WarnContext(ctx, "failed merging CRL", "authority", k, "err", err)
+		}
+	}
+}
+
+// Enroll asks the designated nodes in turn to sign a fresh key for us,
+// handing the resulting pair to store
+func (a *Authority) Enroll(ctx context.Context, authorities []vertex.Key, k vertex.Key, hostname string, store func(cert, key []byte) error) error {
+	priv, err := certs.NewKey()
+	if err != nil {
+		return err
+	}
+
+	csr, err := CSR(priv, k, hostname)
+	if err != nil {
+		return err
+	}
+
+	key, err := certs.EncodeKey(priv)
+	if err != nil {
+		return err
+	}
+
+	if a.IsAuthority() && a.Approved(k) {
+		chain, err := a.Sign(csr, nil)
+		if err != nil {
+			return err
+		}
+		return store(chain, key)
+	}
+
+	for _, authority := range authorities {
+		chain, err := client.ForKey(authority, "http", 8080, nil).SignCSR(ctx, csr)
+		if err != nil {
+			logger.WarnContext(ctx, "CSR not signed", "authority", authority, "err", err)
+			continue
+		}
+
+		list := parseCertificates(chain)
+		if len(list) == 0 {
+			logger.WarnContext(ctx, "no certificate in response", "authority", authority)
+			continue
+		} else if got, err := KeyOf(list[0].URIs); err != nil || got != k {
+			logger.WarnContext(ctx, "certificate isn't bound to our key", "authority", authority)
+			continue
+		}
+
+		return store(chain, key)
+	}
+
+	return fmt.Errorf("no designated CA signed our request")
+}
+
+// Authorities reads the wireguard keys of the designated nodes, one per line
+func (a *Authority) Authorities() ([]vertex.Key, error) {
+	buf, err := os.ReadFile(filepath.Join(a.Dir, "authorities"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []vertex.Key
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var k vertex.Key
+		if err := k.UnmarshalText([]byte(line)); err != nil {
+			return nil, fmt.Errorf("bad key '%s' in authorities: %+v", line, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -0,0 +1,124 @@
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	filepath "path"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	id := Identity{
+		CommonName: "branch",
+		DNSNames:   []string{"branch"},
+		IPs:        []net.IP{net.ParseIP("fc00:a7a0::1")},
+	}
+
+	m, err := Load(cert, key, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Generated() {
+		t.Errorf("expected self-signed certificate")
+	}
+	if err = m.Leaf().VerifyHostname("fc00:a7a0::1"); err != nil {
+		t.Error(err)
+	}
+	serial := m.Leaf().SerialNumber
+
+	// loading again keeps the pair on disk
+	if m, err = Load(cert, key, id, nil); err != nil {
+		t.Fatal(err)
+	} else if m.Leaf().SerialNumber.Cmp(serial) != 0 {
+		t.Errorf("expected existing certificate to be reused")
+	}
+
+	// a CA appearing replaces the self-signed certificate
+	ca := newCA(t)
+	if m, err = Load(cert, key, id, ca); err != nil {
+		t.Fatal(err)
+	}
+	if m.Generated() {
+		t.Errorf("expected CA issued certificate")
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	if _, err = m.Leaf().Verify(x509.VerifyOptions{Roots: pool, DNSName: "branch"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	dir := t.TempDir()
+	m, err := Load(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), Identity{CommonName: "branch"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a self-signed pair close to expiry is regenerated
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "branch"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(Renewal / 2),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := EncodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Store(EncodeCertificate(der), buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.renew(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(m.Leaf().NotAfter) < Renewal || !m.Generated() {
+		t.Errorf("expected a renewed certificate, expiring %v", m.Leaf().NotAfter)
+	}
+
+	// one issued by somebody else's CA is left alone
+	other := newCA(t)
+	if der, err = x509.CreateCertificate(rand.Reader, template, other.Leaf, key.Public(), other.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Store(EncodeCertificate(der), buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.renew(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Leaf().SerialNumber.Cmp(template.SerialNumber) != 0 {
+		t.Errorf("expected a foreign certificate to be kept")
+	}
+}
+
+func newCA(t *testing.T) *tls.Certificate {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := IssueCA("test CA", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
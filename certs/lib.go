@@ -0,0 +1,378 @@
+package certs
+
+import (
+	"avaron/logging"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	filepath "path"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("certs")
+
+const (
+	Validity = 397 * 24 * time.Hour
+	Renewal  = 30 * 24 * time.Hour // regenerate our own certificates this long before expiry
+)
+
+// Identity is what a generated certificate is issued for
+type Identity struct {
+	CommonName string
+	DNSNames   []string
+	IPs        []net.IP
+	URIs       []string
+}
+
+// Manager serves a certificate/key pair from disk, reloading when the files change
+type Manager struct {
+	CertFile string
+	KeyFile  string
+
+	lock  sync.RWMutex
+	cert  *tls.Certificate
+	stamp [2]time.Time
+
+	// what Load generates pairs for, so Watch can renew them
+	id     *Identity
+	ca     *tls.Certificate
+	issuer *x509.Certificate
+}
+
+func serial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+}
+
+func NewKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func EncodeKey(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func EncodeCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// Issue signs a leaf certificate for pub, self-signed when ca is nil
+func Issue(id Identity, pub crypto.PublicKey, priv crypto.Signer, ca *x509.Certificate) ([]byte, error) {
+	sn, err := serial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: id.CommonName, Organization: []string{"Avaron"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              id.DNSNames,
+		IPAddresses:           id.IPs,
+	}
+
+	for _, s := range id.URIs {
+		u, err := parseURI(s)
+		if err != nil {
+			return nil, err
+		}
+		template.URIs = append(template.URIs, u)
+	}
+
+	parent := template
+	if ca != nil {
+		parent = ca
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+}
+
+// IssueCA self-signs a certificate authority for the mesh
+func IssueCA(name string, priv crypto.Signer) ([]byte, error) {
+	sn, err := serial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"Avaron"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+}
+
+// Generate writes a fresh key & certificate to the manager's paths,
+// signed by ca if given (a mesh CA), otherwise self-signed
+func (m *Manager) Generate(id Identity, ca *tls.Certificate) error {
+	key, err := NewKey()
+	if err != nil {
+		return err
+	}
+
+	var (
+		signer crypto.Signer = key
+		parent *x509.Certificate
+	)
+
+	if ca != nil {
+		if parent, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return fmt.Errorf("parsing CA certificate: %+v", err)
+		}
+		var ok bool
+		if signer, ok = ca.PrivateKey.(crypto.Signer); !ok {
+			return fmt.Errorf("CA private key can't sign")
+		}
+	}
+
+	der, err := Issue(id, key.Public(), signer, parent)
+	if err != nil {
+		return err
+	}
+
+	buf, err := EncodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	chain := EncodeCertificate(der)
+	if ca != nil {
+		for _, c := range ca.Certificate {
+			chain = append(chain, EncodeCertificate(c)...)
+		}
+	}
+
+	return m.Store(chain, buf)
+}
+
+// Store atomically replaces the certificate & key on disk, the watcher picks them up
+func (m *Manager) Store(cert, key []byte) error {
+	for _, dir := range []string{filepath.Dir(m.CertFile), filepath.Dir(m.KeyFile)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(m.KeyFile, key, 0600); err != nil {
+		return err
+	}
+	if err := writeFile(m.CertFile, cert, 0644); err != nil {
+		return err
+	}
+	return m.Reload()
+}
+
+func parseURI(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad URI SAN '%s': %+v", s, err)
+	}
+	return u, nil
+}
+
+func writeFile(path string, buf []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func stamps(paths ...string) (t [2]time.Time, err error) {
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return t, err
+		}
+		t[i] = info.ModTime()
+	}
+	return
+}
+
+// Reload reads the pair from disk, keeping the previous certificate on failure
+func (m *Manager) Reload() error {
+	stamp, err := stamps(m.CertFile, m.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	m.lock.Lock()
+	m.cert = &cert
+	m.stamp = stamp
+	m.lock.Unlock()
+	return nil
+}
+
+// Load serves certFile/keyFile, generating a pair for id if they don't exist.
+// Generated pairs are issued by ca when given, so that branches trust each
+// other, otherwise they're self-signed. Pairs we issued ourselves are
+// renewed ahead of expiry, & upgraded to CA issued ones once a CA appears.
+func Load(certFile, keyFile string, id Identity, ca *tls.Certificate) (*Manager, error) {
+	m := &Manager{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		id:       &id,
+		ca:       ca,
+	}
+
+	var issuer *x509.Certificate
+	if ca != nil {
+		var err error
+		if issuer, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("parsing CA certificate: %+v", err)
+		}
+	}
+	m.issuer = issuer
+
+	err := m.Reload()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logger.Info("no certificate, generating one", "file", certFile)
+		err = m.Generate(id, ca)
+	case err != nil:
+	case issuer != nil && m.Generated():
+		logger.Info("replacing self-signed certificate", "file", certFile, "issuer", issuer.Subject.CommonName)
+		err = m.Generate(id, ca)
+	case !m.Generated() && (issuer == nil || m.Leaf().CheckSignatureFrom(issuer) != nil):
+		// configured elsewhere, ie. by certbot
+	case time.Until(m.Leaf().NotAfter) < Renewal:
+		logger.Info("certificate expiring, regenerating", "file", certFile, "expiry", m.Leaf().NotAfter)
+		err = m.Generate(id, ca)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Generated reports whether the current certificate is self-signed
+func (m *Manager) Generated() bool {
+	leaf := m.Leaf()
+	if leaf == nil || !bytes.Equal(leaf.RawIssuer, leaf.RawSubject) {
+		return false
+	}
+	// not CheckSignatureFrom, our leaves aren't CAs
+	return leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil
+}
+
+func (m *Manager) Leaf() *x509.Certificate {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.cert == nil {
+		return nil
+	}
+	return m.cert.Leaf
+}
+
+func (m *Manager) Certificate() *tls.Certificate {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.cert
+}
+
+// for tls.Config
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := m.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate loaded")
+}
+
+// for tls.Config
+func (m *Manager) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := m.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return &tls.Certificate{}, nil
+}
+
+// renew regenerates a pair Load issued itself once it's within Renewal of
+// expiry, leaving certificates configured elsewhere alone
+func (m *Manager) renew() error {
+	leaf := m.Leaf()
+	if m.id == nil || leaf == nil || time.Until(leaf.NotAfter) >= Renewal {
+		return nil
+	}
+	if !m.Generated() && (m.issuer == nil || leaf.CheckSignatureFrom(m.issuer) != nil) {
+		return nil
+	}
+	logger.Info("certificate expiring, regenerating", "file", m.CertFile, "expiry", leaf.NotAfter)
+	return m.Generate(*m.id, m.ca)
+}
+
+// Watch polls the files for changes, a renewed certificate is picked up
+// without restarting listeners, & renews pairs we generated ahead of expiry
+func (m *Manager) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := m.renew(); err != nil {
+			logger.Error("failed to renew", "file", m.CertFile, "err", err)
+		}
+
+		stamp, err := stamps(m.CertFile, m.KeyFile)
+		if err != nil {
+			continue
+		}
+
+		m.lock.RLock()
+		changed := stamp != m.stamp
+		m.lock.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := m.Reload(); err != nil {
+			logger.Error("failed to reload", "file", m.CertFile, "err", err)
+		} else {
+			logger.Info("reloaded", "file", m.CertFile, "expiry", m.Leaf().NotAfter)
+		}
+	}
+}
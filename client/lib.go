@@ -0,0 +1,514 @@
+package client
+
+import (
+	"avaron/alerts"
+	"avaron/assistant"
+	"avaron/diag"
+	"avaron/dns"
+	"avaron/health"
+	network "avaron/net"
+	"avaron/rid"
+	"avaron/vertex"
+	"avaron/whois"
+	wg "avaron/wireguard"
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPI 3 description of the management API, served at /api/openapi.json
+//
+//go:embed openapi.json
+var Spec []byte
+
+type Node struct {
+	Name       string                        `json:"name"`
+	Location   *whois.Info                   `json:"location"`
+	Interfaces map[string]*network.Interface `json:"interfaces"`
+	Tunnels    map[vertex.Key]*wg.Interface  `json:"tunnels"`
+	TCPMetrics []network.TCPMetric           `json:"metrics"`
+	Routes     map[string]*network.Route     `json:"routes"`
+}
+
+type Service = systemd.UnitStatus
+
+// LogLevel changes the level of one subsystem, or the default when Subsystem is empty.
+// An empty Level makes the subsystem follow the default again.
+type LogLevel struct {
+	Subsystem string `json:"subsystem,omitempty"`
+	Level     string `json:"level"`
+}
+
+// Decision approves or rejects a suggested command awaiting approval
+type Decision struct {
+	Approve bool `json:"approve"`
+}
+
+// AssistantMessage is an operator's question to the assistant
+type AssistantMessage struct {
+	Content string `json:"content"`
+}
+
+// Metrics answers /api/metrics/query, each series being [unix seconds, value] pairs.
+// Counters are reported as per second rates.
+type Metrics struct {
+	Step   int64                   `json:"step"` // seconds
+	Series map[string][][2]float64 `json:"series"`
+}
+
+// Error is the body of every failed API request
+type Error struct {
+	Code      int         `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// StatusError is returned for non-2xx responses, API is decoded from the body when present
+type StatusError struct {
+	Code   int
+	Status string
+	Body   []byte
+	API    *Error
+}
+
+func (e *StatusError) Error() string {
+	switch {
+	case e.API != nil && e.API.Details != nil:
+		return fmt.Sprintf("%s: %s (%v) [%s]", e.Status, e.API.Message, e.API.Details, e.API.RequestID)
+	case e.API != nil:
+		return fmt.Sprintf("%s: %s [%s]", e.Status, e.API.Message, e.API.RequestID)
+	case len(e.Body) == 0:
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, bytes.TrimSpace(e.Body))
+}
+
+type Client struct {
+	Base string // ie. http://[fc00:a7a0::1]:8080
+	HTTP *http.Client
+}
+
+// Primary constructor for this package, a nil client means http.DefaultClient
+func New(base string, c *http.Client) *Client {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &Client{
+		Base: strings.TrimSuffix(base, "/"),
+		HTTP: c,
+	}
+}
+
+// ForKey addresses a branch by its overlay address
+func ForKey(k vertex.Key, scheme string, port int, c *http.Client) *Client {
+	host := net.JoinHostPort(k.GlobalAddress().IP.String(), strconv.Itoa(port))
+	return New(scheme+"://"+host, c)
+}
+
+func (c *Client) Do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.Base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Avaron-Core")
+	if id := rid.From(ctx); id != "" {
+		req.Header.Set(rid.Header, id)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		buf, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		e := &StatusError{
+			Code:   res.StatusCode,
+			Status: fmt.Sprintf("%s %s responded with %s", method, path, res.Status),
+			Body:   buf,
+		}
+		if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+			var body Error
+			if json.Unmarshal(buf, &body) == nil && body.Message != "" {
+				e.API = &body
+			}
+		}
+		return nil, e
+	}
+	return res, nil
+}
+
+func (c *Client) bytes(ctx context.Context, method, path string, body io.Reader, contentType string) ([]byte, error) {
+	res, err := c.Do(ctx, method, path, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+func (c *Client) json(ctx context.Context, method, path string, in, out interface{}) error {
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(buf), "application/json"
+	}
+
+	res, err := c.Do(ctx, method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		return err
+	}
+	if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s: %+v", method, path, err)
+	}
+	return nil
+}
+
+// GET /api/keys/wireguard
+func (c *Client) WireguardKey(ctx context.Context) (k vertex.Key, err error) {
+	buf, err := c.bytes(ctx, "GET", "/api/keys/wireguard", nil, "")
+	if err != nil {
+		return k, err
+	}
+	if err = k.UnmarshalText(bytes.TrimSpace(buf)); err != nil {
+		err = fmt.Errorf("failed to parse response as Wireguard Key: %+v", err)
+	}
+	return k, err
+}
+
+// GET /api/keys/ssh
+func (c *Client) SSHKeys(ctx context.Context) ([]byte, error) {
+	return c.bytes(ctx, "GET", "/api/keys/ssh", nil, "")
+}
+
+// POST /api/link
+func (c *Client) Link(ctx context.Context, k vertex.Key) error {
+	buf, _ := k.MarshalText()
+	_, err := c.bytes(ctx, "POST", "/api/link", bytes.NewReader(buf), "text/plain")
+	return err
+}
+
+// GET /api/nodes
+func (c *Client) Nodes(ctx context.Context) (nodes map[vertex.Key]Node, err error) {
+	err = c.json(ctx, "GET", "/api/nodes", nil, &nodes)
+	return
+}
+
+// GET /api/wireguard
+func (c *Client) Tunnels(ctx context.Context) (tunnels map[vertex.Key]*wg.Interface, err error) {
+	err = c.json(ctx, "GET", "/api/wireguard", nil, &tunnels)
+	return
+}
+
+// POST /api/wireguard, returns the new peer's configuration as an SVG QR code.
+// A nil endpoint lets the branch pick the address of its default route.
+func (c *Client) AddPeer(ctx context.Context, endpoint net.IP) ([]byte, error) {
+	var body io.Reader
+	if endpoint != nil {
+		body = strings.NewReader(endpoint.String())
+	}
+	return c.bytes(ctx, "POST", "/api/wireguard", body, "text/plain")
+}
+
+// DELETE /api/wireguard
+func (c *Client) DeletePeer(ctx context.Context, k vertex.Key) error {
+	buf, _ := k.MarshalText()
+	_, err := c.bytes(ctx, "DELETE", "/api/wireguard", bytes.NewReader(buf), "text/plain")
+	return err
+}
+
+// GET /api/services
+func (c *Client) Services(ctx context.Context) (services map[string]Service, err error) {
+	err = c.json(ctx, "GET", "/api/services", nil, &services)
+	return
+}
+
+// POST /api/services/{start,stop,restart}
+func (c *Client) ControlServices(ctx context.Context, action string, units ...string) error {
+	switch action {
+	case "start", "stop", "restart":
+	default:
+		return fmt.Errorf("unknown service action '%s'", action)
+	}
+	if units == nil {
+		units = []string{}
+	}
+	return c.json(ctx, "POST", "/api/services/"+action, units, nil)
+}
+
+// GET /api/health, run start times (unix) to their verdict
+func (c *Client) HealthRuns(ctx context.Context) (runs map[int64]string, err error) {
+	err = c.json(ctx, "GET", "/api/health", nil, &runs)
+	return
+}
+
+// GET /api/health/{ts}, the structured report of a run, so far if pending
+func (c *Client) HealthReport(ctx context.Context, ts int64) (report health.Report, err error) {
+	err = c.json(ctx, "GET", "/api/health/"+strconv.FormatInt(ts, 10), nil, &report)
+	return
+}
+
+// GET /api/health/{ts}/stream, calling fn with each event until the run finishes
+func (c *Client) FollowHealth(ctx context.Context, ts int64, fn func(health.Event) error) error {
+	res, err := c.Do(ctx, "GET", "/api/health/"+strconv.FormatInt(ts, 10)+"/stream", nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var e health.Event
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// GET /api/health/{ts}/transcript
+func (c *Client) HealthTranscript(ctx context.Context, ts int64) ([]byte, error) {
+	return c.bytes(ctx, "GET", "/api/health/"+strconv.FormatInt(ts, 10)+"/transcript", nil, "")
+}
+
+// POST /api/exec
+func (c *Client) Exec(ctx context.Context, req diag.Request) (res diag.Result, err error) {
+	err = c.json(ctx, "POST", "/api/exec", req, &res)
+	return
+}
+
+// GET /api/exec
+func (c *Client) ExecHistory(ctx context.Context) (history []diag.Result, err error) {
+	err = c.json(ctx, "GET", "/api/exec", nil, &history)
+	return
+}
+
+// GET /api/exec/pending, suggested commands awaiting approval
+func (c *Client) PendingCommands(ctx context.Context) (list []diag.Pending, err error) {
+	err = c.json(ctx, "GET", "/api/exec/pending", nil, &list)
+	return
+}
+
+// POST /api/exec/pending/{id}
+func (c *Client) Decide(ctx context.Context, id int64, approve bool) error {
+	return c.json(ctx, "POST", "/api/exec/pending/"+strconv.FormatInt(id, 10), Decision{approve}, nil)
+}
+
+// GET /api/ca, the PEM bundle of trusted mesh CAs
+func (c *Client) CABundle(ctx context.Context) ([]byte, error) {
+	return c.bytes(ctx, "GET", "/api/ca", nil, "")
+}
+
+// GET /api/ca/crl, DER encoded
+func (c *Client) CRL(ctx context.Context) ([]byte, error) {
+	return c.bytes(ctx, "GET", "/api/ca/crl", nil, "")
+}
+
+// POST /api/ca/csr, returns the issued PEM chain
+func (c *Client) SignCSR(ctx context.Context, csr []byte) ([]byte, error) {
+	return c.bytes(ctx, "POST", "/api/ca/csr", bytes.NewReader(csr), "application/pkcs10")
+}
+
+// GET /api/log/level, subsystems to their level, the default under ""
+func (c *Client) LogLevels(ctx context.Context) (levels map[string]string, err error) {
+	err = c.json(ctx, "GET", "/api/log/level", nil, &levels)
+	return
+}
+
+// PUT /api/log/level
+func (c *Client) SetLogLevel(ctx context.Context, change LogLevel) (levels map[string]string, err error) {
+	err = c.json(ctx, "PUT", "/api/log/level", change, &levels)
+	return
+}
+
+// GET /api/metrics/series, names of recorded series starting with prefix
+func (c *Client) MetricSeries(ctx context.Context, prefix string) (names []string, err error) {
+	err = c.json(ctx, "GET", "/api/metrics/series?"+url.Values{"prefix": {prefix}}.Encode(), nil, &names)
+	return
+}
+
+// GET /api/metrics/query, series may end in '*' to match by prefix & a zero step picks the finest available
+func (c *Client) QueryMetrics(ctx context.Context, series []string, from, to time.Time, step time.Duration) (m Metrics, err error) {
+	q := url.Values{
+		"series": {strings.Join(series, ",")},
+		"from":   {strconv.FormatInt(from.Unix(), 10)},
+		"to":     {strconv.FormatInt(to.Unix(), 10)},
+	}
+	if step > 0 {
+		q.Set("step", step.String())
+	}
+	err = c.json(ctx, "GET", "/api/metrics/query?"+q.Encode(), nil, &m)
+	return
+}
+
+// GET /api/alerts, pending, firing & recently resolved alerts
+func (c *Client) Alerts(ctx context.Context) (list []alerts.Alert, err error) {
+	err = c.json(ctx, "GET", "/api/alerts", nil, &list)
+	return
+}
+
+// GET /api/alerts/rules
+func (c *Client) AlertRules(ctx context.Context) (rules []alerts.Rule, err error) {
+	err = c.json(ctx, "GET", "/api/alerts/rules", nil, &rules)
+	return
+}
+
+// PUT /api/alerts/rules, replacing all of them
+func (c *Client) SetAlertRules(ctx context.Context, rules []alerts.Rule) (saved []alerts.Rule, err error) {
+	err = c.json(ctx, "PUT", "/api/alerts/rules", rules, &saved)
+	return
+}
+
+// GET /api/alerts/sinks
+func (c *Client) AlertSinks(ctx context.Context) (sinks []alerts.SinkConfig, err error) {
+	err = c.json(ctx, "GET", "/api/alerts/sinks", nil, &sinks)
+	return
+}
+
+// PUT /api/alerts/sinks, replacing all of them
+func (c *Client) SetAlertSinks(ctx context.Context, sinks []alerts.SinkConfig) (saved []alerts.SinkConfig, err error) {
+	err = c.json(ctx, "PUT", "/api/alerts/sinks", sinks, &saved)
+	return
+}
+
+// GET /api/alerts/silences
+func (c *Client) Silences(ctx context.Context) (list []alerts.Silence, err error) {
+	err = c.json(ctx, "GET", "/api/alerts/silences", nil, &list)
+	return
+}
+
+// POST /api/alerts/silences, returns the silence with its ID
+func (c *Client) AddSilence(ctx context.Context, s alerts.Silence) (saved alerts.Silence, err error) {
+	err = c.json(ctx, "POST", "/api/alerts/silences", s, &saved)
+	return
+}
+
+// DELETE /api/alerts/silences/{id}
+func (c *Client) DeleteSilence(ctx context.Context, id string) error {
+	return c.json(ctx, "DELETE", "/api/alerts/silences/"+url.PathEscape(id), nil, nil)
+}
+
+// GET /api/dns/records
+func (c *Client) DNSRecords(ctx context.Context) (list []dns.Custom, err error) {
+	err = c.json(ctx, "GET", "/api/dns/records", nil, &list)
+	return
+}
+
+// POST /api/dns/records, returns the record with its ID
+func (c *Client) AddDNSRecord(ctx context.Context, r dns.Custom) (saved dns.Custom, err error) {
+	err = c.json(ctx, "POST", "/api/dns/records", r, &saved)
+	return
+}
+
+// PUT /api/dns/records/{id}
+func (c *Client) UpdateDNSRecord(ctx context.Context, id string, r dns.Custom) (saved dns.Custom, err error) {
+	err = c.json(ctx, "PUT", "/api/dns/records/"+url.PathEscape(id), r, &saved)
+	return
+}
+
+// DELETE /api/dns/records/{id}
+func (c *Client) DeleteDNSRecord(ctx context.Context, id string) error {
+	return c.json(ctx, "DELETE", "/api/dns/records/"+url.PathEscape(id), nil, nil)
+}
+
+// GET /api/dns/forwarders
+func (c *Client) DNSForwarders(ctx context.Context) (list []string, err error) {
+	err = c.json(ctx, "GET", "/api/dns/forwarders", nil, &list)
+	return
+}
+
+// PUT /api/dns/forwarders
+func (c *Client) SetDNSForwarders(ctx context.Context, list []string) (saved []string, err error) {
+	err = c.json(ctx, "PUT", "/api/dns/forwarders", list, &saved)
+	return
+}
+
+// GET /api/dns/stats, only kept by the built in server
+func (c *Client) DNSStats(ctx context.Context) (stats []dns.ClientStats, err error) {
+	err = c.json(ctx, "GET", "/api/dns/stats", nil, &stats)
+	return
+}
+
+// GET /api/assistant/sessions, most recently updated first
+func (c *Client) AssistantSessions(ctx context.Context) (list []assistant.Summary, err error) {
+	err = c.json(ctx, "GET", "/api/assistant/sessions", nil, &list)
+	return
+}
+
+// POST /api/assistant/sessions, seeded with the node's state
+func (c *Client) CreateAssistantSession(ctx context.Context) (s assistant.Session, err error) {
+	err = c.json(ctx, "POST", "/api/assistant/sessions", nil, &s)
+	return
+}
+
+// GET /api/assistant/sessions/{id}
+func (c *Client) AssistantSession(ctx context.Context, id string) (s assistant.Session, err error) {
+	err = c.json(ctx, "GET", "/api/assistant/sessions/"+url.PathEscape(id), nil, &s)
+	return
+}
+
+// DELETE /api/assistant/sessions/{id}
+func (c *Client) DeleteAssistantSession(ctx context.Context, id string) error {
+	return c.json(ctx, "DELETE", "/api/assistant/sessions/"+url.PathEscape(id), nil, nil)
+}
+
+// POST /api/assistant/sessions/{id}/messages, calling fn with each event of
+// the answer: token, calls, tool, then done or error
+func (c *Client) Ask(ctx context.Context, id, content string, fn func(event string, data json.RawMessage) error) error {
+	buf, err := json.Marshal(AssistantMessage{content})
+	if err != nil {
+		return err
+	}
+	res, err := c.Do(ctx, "POST", "/api/assistant/sessions/"+url.PathEscape(id)+"/messages", bytes.NewReader(buf), "application/json")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var event string
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		switch line := scanner.Text(); {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := fn(event, json.RawMessage(strings.TrimPrefix(line, "data: "))); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,222 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowlist(t *testing.T) {
+	rules, err := ReadAllowlist(strings.NewReader("# comment\nwg show\n\nping # trailing\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(rules)
+	for argv, ok := range map[string]bool{
+		"wg show avaron":       true,
+		"wg set avaron":        false,
+		"ping -c 1 ::1":        true,
+		"/usr/bin/ping -c 1 x": false,
+		"rm -rf /":             false,
+	} {
+		if r.Allowed(strings.Fields(argv)) != ok {
+			t.Errorf("Allowed(%q) != %v", argv, ok)
+		}
+	}
+}
+
+func TestDefaultAllowlist(t *testing.T) {
+	r := New(DefaultAllowlist)
+	for argv, ok := range map[string]bool{
+		"ip -br addr show":               true,
+		"ping -c 3 fc00:a7a0::1":         true,
+		"ping -c 3 -f fc00:a7a0::1":      false,
+		"ping -f fc00:a7a0::1":           false,
+		"ping -c 3 -s 65000 example.com": false,
+		"ping -c 100 example.com":        false,
+		"ss":                             true,
+		"ss -tunap":                      true,
+		"ss -K dst 10.0.0.1":             false,
+		"ss -tK":                         false,
+		"ss -D /tmp/x":                   false,
+		"dig example.com":                true,
+		"dig +short example.com AAAA":    true,
+		"dig @192.0.2.53 example.com":    true,
+		"dig -x 192.0.2.1":               true,
+		"dig -f /etc/shadow":             false,
+		"dig example.com -f /etc/shadow": false,
+		"traceroute -n 192.0.2.1":        true,
+		"traceroute -q 100 192.0.2.1":    false,
+		"host -t TXT example.com":        true,
+		"wg show avaron":                 true,
+		"wg show avaron private-key":     false,
+	} {
+		if r.Allowed(strings.Fields(argv)) != ok {
+			t.Errorf("Allowed(%q) != %v", argv, ok)
+		}
+	}
+}
+
+func TestDefaultProposals(t *testing.T) {
+	r := New(DefaultAllowlist)
+	for argv, ok := range map[string]bool{
+		"ping -c 3 fc00:a7a0::1":      true,
+		"ping -c 9 fc00:a7a0::1":      false,
+		"ss -tunp":                    true,
+		"ss -K":                       false,
+		"dig +short example.com AAAA": true,
+		"dig -f /etc/shadow":          false,
+		"dig @192.0.2.53 example.com": false,
+		"ip link set avaron down":     false,
+	} {
+		if r.Proposable(strings.Fields(argv)) != ok {
+			t.Errorf("Proposable(%q) != %v", argv, ok)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	r := New([]Rule{{"sh"}})
+
+	res, err := r.Run(context.Background(), Request{
+		Argv: []string{"sh", "-c", "echo out; echo err >&2; exit 3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 3 || res.Stdout != "out\n" || res.Stderr != "err\n" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	res, err = r.Run(context.Background(), Request{
+		Argv:    []string{"sh", "-c", "sleep 5"},
+		Timeout: 0.1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.TimedOut {
+		t.Errorf("expected timeout: %+v", res)
+	}
+
+	if _, err = r.Run(context.Background(), Request{Argv: []string{"cat"}}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("expected ErrNotAllowed, got %+v", err)
+	}
+
+	if _, err = r.Run(context.Background(), Request{Argv: []string{"sh"}, Env: map[string]string{"LD_PRELOAD": "x"}}); !errors.Is(err, ErrBadEnv) {
+		t.Errorf("expected ErrBadEnv, got %+v", err)
+	}
+
+	// refusals are recorded along with what ran
+	if h := r.History(); len(h) != 4 || h[0].ID != 1 || h[1].ID != 2 || h[2].Error == "" || h[3].ExitCode != -1 {
+		t.Errorf("unexpected history: %+v", h)
+	}
+}
+
+func TestLimited(t *testing.T) {
+	l := &Limited{N: 4}
+	l.Write([]byte("abc"))
+	l.Write([]byte("def"))
+	if l.String() != "abcd" || !l.Truncated {
+		t.Errorf("unexpected limited buffer: %q %v", l.String(), l.Truncated)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := ReadPolicy(strings.NewReader("ping -c [1-5] *\nip route get * $\n@timeout ping 3s\n@propose ping -c 1 * $\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Timeouts["ping"] != 3*time.Second {
+		t.Errorf("unexpected timeouts %v", p.Timeouts)
+	}
+	if len(p.Proposals) != 1 || p.Proposals[0].String() != "ping -c 1 * $" {
+		t.Errorf("unexpected proposals %v", p.Proposals)
+	}
+
+	r := New(p.Rules)
+	for argv, ok := range map[string]bool{
+		"ping -c 3 ::1":              true,
+		"ping -c 100 ::1":            false,
+		"ping -f ::1":                false,
+		"ip route get 10.0.0.1":      true,
+		"ip route get 10.0.0.1 mark": false,
+		"* route get 10.0.0.1":       false,
+	} {
+		if r.Allowed(strings.Fields(argv)) != ok {
+			t.Errorf("Allowed(%q) != %v", argv, ok)
+		}
+	}
+
+	for _, bad := range []string{"@timeout ping\n", "@timeout ping soon\n", "@limit ping 3\n", "ping [\n", "@propose\n", "@propose ping [\n"} {
+		if _, err := ReadPolicy(strings.NewReader(bad)); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	argv, err := Split(`dig +short 'example.com' "TXT"`)
+	if err != nil || strings.Join(argv, "|") != "dig|+short|example.com|TXT" {
+		t.Errorf("unexpected argv %q %v", argv, err)
+	}
+	for _, line := range []string{"ip a | grep x", "ping $(hostname)", "rm -rf /*", "echo 'open", "  "} {
+		if _, err := Split(line); err == nil {
+			t.Errorf("accepted %q", line)
+		}
+	}
+}
+
+func TestPropose(t *testing.T) {
+	r := New([]Rule{{"echo"}})
+	r.proposals = []Rule{{"echo", "hi", "$"}}
+	ctx := context.Background()
+
+	// allowed for operators isn't enough
+	for _, argv := range [][]string{{"rm", "x"}, {"echo", "bye"}} {
+		if res, err := r.Propose(ctx, "test", argv); !errors.Is(err, ErrNotAllowed) || res.Error == "" {
+			t.Errorf("expected ErrNotAllowed, got %+v %v", res, err)
+		}
+	}
+
+	r.Mode = ModeDryRun
+	if res, err := r.Propose(ctx, "test", []string{"echo", "hi"}); err != nil || !res.DryRun || res.Stdout != "" {
+		t.Errorf("unexpected dry run %+v %v", res, err)
+	}
+
+	r.Mode = ModeApprove
+	for _, approve := range []bool{true, false} {
+		done := make(chan Result)
+		go func() {
+			res, _ := r.Propose(ctx, "test", []string{"echo", "hi"})
+			done <- res
+		}()
+
+		var pending []Pending
+		for len(pending) == 0 {
+			time.Sleep(time.Millisecond)
+			pending = r.Pending()
+		}
+		if err := r.Decide(pending[0].ID, approve); err != nil {
+			t.Fatal(err)
+		}
+
+		res := <-done
+		if approve && (res.Approval != "approved" || res.Stdout != "hi\n") {
+			t.Errorf("unexpected approved result %+v", res)
+		} else if !approve && (res.Approval != "rejected" || res.Stdout != "") {
+			t.Errorf("unexpected rejected result %+v", res)
+		}
+	}
+	if err := r.Decide(1000, true); !errors.Is(err, ErrNoPending) {
+		t.Errorf("got %v, want ErrNoPending", err)
+	}
+
+	// every proposal is recorded, whether it ran or not
+	if h := r.History(); len(h) != 5 || h[0].Source != "test" {
+		t.Errorf("unexpected history %+v", h)
+	}
+}
@@ -0,0 +1,641 @@
+package diag
+
+import (
+	"avaron/logging"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	filepath "path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var logger = logging.For("diag")
+
+const (
+	DefaultTimeout  = 10 * time.Second
+	MaxTimeout      = 60 * time.Second
+	MaxOutput       = 64 * 1024
+	HistorySize     = 128
+	ApprovalTimeout = 2 * time.Minute
+)
+
+// how Propose treats suggested commands, Run isn't affected
+const (
+	ModeRun     = "run"     // straight away
+	ModeApprove = "approve" // once an operator approves
+	ModeDryRun  = "dry-run" // never, they're only recorded
+)
+
+// the environment every command starts from, request env is layered on top
+var BaseEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"LANG=C",
+	"LC_ALL=C",
+}
+
+// read-only diagnostics, used when there is no allowlist file. Arguments
+// are pinned, since the likes of `ss -K`, `ping -f` & `dig -f <file>`
+// aren't read-only; hosts & names can't start with '-' to pass as flags
+var DefaultAllowlist = []Rule{
+	{"ip", "-br", "addr", "show"},
+	{"ip", "-br", "link", "show"},
+	{"ip", "addr", "show"},
+	{"ip", "link", "show"},
+	{"ip", "route", "show"},
+	{"ip", "-6", "route", "show"},
+	{"ip", "neigh", "show"},
+	{"ip", "rule", "show"},
+	{"ping", "-c", "[1-9]", host, "$"},
+	{"ping", "-6", "-c", "[1-9]", host, "$"},
+	{"ping6", "-c", "[1-9]", host, "$"},
+	{"traceroute", host, "$"},
+	{"traceroute", "-n", host, "$"},
+	{"tracepath", host, "$"},
+	{"tracepath", "-n", host, "$"},
+	{"ss", "$"},
+	{"ss", "-" + ssFlags, "$"},
+	{"ss", "-" + ssFlags + ssFlags, "$"},
+	{"ss", "-" + ssFlags + ssFlags + ssFlags, "$"},
+	{"ss", "-" + ssFlags + ssFlags + ssFlags + ssFlags, "$"},
+	{"ss", "-" + ssFlags + ssFlags + ssFlags + ssFlags + ssFlags, "$"},
+	{"dig", host, "$"},
+	{"dig", host, recordType, "$"},
+	{"dig", "+short", host, "$"},
+	{"dig", "+short", host, recordType, "$"},
+	{"dig", "@" + host, host, "$"},
+	{"dig", "@" + host, host, recordType, "$"},
+	{"dig", "-x", address, "$"},
+	{"host", host, "$"},
+	{"host", "-t", recordType, host, "$"},
+	{"wg", "show", "$"},
+	{"wg", "show", "[a-z0-9]*", "$"},
+}
+
+// DefaultProposals narrow what the model may propose, on top of the
+// allowlist: short probes of the mesh & the names it resolves, nothing an
+// operator would want to tune
+var DefaultProposals = []Rule{
+	{"ip", "-br", "addr", "show"},
+	{"ip", "-br", "link", "show"},
+	{"ip", "route", "show"},
+	{"ip", "-6", "route", "show"},
+	{"ip", "neigh", "show"},
+	{"ping", "-c", "[1-5]", host, "$"},
+	{"ping", "-6", "-c", "[1-5]", host, "$"},
+	{"traceroute", "-n", host, "$"},
+	{"tracepath", "-n", host, "$"},
+	{"ss", "-" + ssFlags + ssFlags + ssFlags + ssFlags, "$"},
+	{"dig", "+short", host, recordType, "$"},
+	{"host", host, "$"},
+	{"wg", "show", "[a-z0-9]*", "$"},
+}
+
+// patterns of the arguments DefaultAllowlist pins
+const (
+	host       = `[a-zA-Z0-9_:]*`
+	address    = `[0-9a-fA-F:.]*`
+	recordType = `[A-Z]*`
+	// ss's listing options, -K kills sockets & -D, -F & -N read or write files
+	ssFlags = `[46ainpstulex]`
+)
+
+// DefaultTimeouts are for commands which take longer than DefaultTimeout to be useful
+var DefaultTimeouts = map[string]time.Duration{
+	"ping":       15 * time.Second,
+	"ping6":      15 * time.Second,
+	"traceroute": 30 * time.Second,
+	"tracepath":  30 * time.Second,
+}
+
+var (
+	ErrEmpty      = errors.New("empty argv")
+	ErrNotAllowed = errors.New("command not in allowlist")
+	ErrBadEnv     = errors.New("environment variable not allowed")
+	ErrShell      = errors.New("shell syntax not supported")
+	ErrRejected   = errors.New("command rejected")
+	ErrNoPending  = errors.New("no such pending command")
+)
+
+// Rule is an argv prefix, ie. {"wg", "show"} allows `wg show avaron`.
+// Arguments may be globs, ie. {"ping", "-c", "[1-5]"}, & a final "$"
+// forbids any further arguments.
+type Rule []string
+
+func (r Rule) Match(argv []string) bool {
+	exact := len(r) > 0 && r[len(r)-1] == "$"
+	if exact {
+		r = r[:len(r)-1]
+	}
+	if len(r) == 0 || len(argv) < len(r) || (exact && len(argv) != len(r)) {
+		return false
+	}
+	for i := range r {
+		if r[i] == argv[i] {
+			continue
+		}
+		// command names are never patterns
+		if ok, _ := filepath.Match(r[i], argv[i]); i == 0 || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Rule) String() string {
+	return strings.Join(r, " ")
+}
+
+// Policy is what an allowlist file configures
+type Policy struct {
+	Rules     []Rule
+	Proposals []Rule                   // replacing DefaultProposals when any
+	Timeouts  map[string]time.Duration // by command name
+}
+
+type Request struct {
+	Argv    []string          `json:"argv"`
+	Timeout float64           `json:"timeout"` // seconds
+	Env     map[string]string `json:"env"`
+}
+
+type Result struct {
+	ID        int64             `json:"id"`
+	Argv      []string          `json:"argv"`
+	Env       map[string]string `json:"env,omitempty"`
+	Started   time.Time         `json:"started"`
+	Duration  float64           `json:"duration"` // seconds
+	ExitCode  int               `json:"exitCode"`
+	Stdout    string            `json:"stdout"`
+	Stderr    string            `json:"stderr"`
+	Truncated bool              `json:"truncated"`
+	TimedOut  bool              `json:"timedOut"`
+	Error     string            `json:"error,omitempty"`
+	Source    string            `json:"source,omitempty"`   // who suggested it, empty for operators
+	Approval  string            `json:"approval,omitempty"` // approved, rejected or expired in ModeApprove
+	DryRun    bool              `json:"dryRun,omitempty"`
+}
+
+// Pending is a suggested command awaiting an operator's decision
+type Pending struct {
+	ID       int64     `json:"id"`
+	Argv     []string  `json:"argv"`
+	Source   string    `json:"source"`
+	Proposed time.Time `json:"proposed"`
+
+	decision chan bool
+}
+
+// Runner executes allowlisted commands & keeps a bounded history of runs
+type Runner struct {
+	// Timeouts are the default & limit for each command, others get
+	// DefaultTimeout unless they ask for up to MaxTimeout
+	Timeouts map[string]time.Duration
+	Mode     string // of Propose
+	Record   string // file every result is appended to as a JSON line, if any
+
+	lock      sync.Mutex
+	allowlist []Rule
+	proposals []Rule
+	history   []Result
+	next      int64
+	pending   []*Pending
+}
+
+// Primary constructor for this package
+func New(allowlist []Rule) *Runner {
+	return &Runner{
+		Timeouts:  DefaultTimeouts,
+		Mode:      ModeApprove,
+		allowlist: allowlist,
+		proposals: DefaultProposals,
+		next:      1,
+	}
+}
+
+// ReadAllowlist parses one rule per line, blank lines & '#' comments are skipped
+func ReadAllowlist(r io.Reader) (rules []Rule, err error) {
+	p, err := ReadPolicy(r)
+	return p.Rules, err
+}
+
+// ReadPolicy parses an allowlist, where lines like `@timeout ping 20s`
+// set a command's timeout rather than allowing anything, & ones like
+// `@propose ping -c [1-3] * $` are what the model may propose
+func ReadPolicy(r io.Reader) (p Policy, err error) {
+	p.Timeouts = make(map[string]time.Duration)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 0:
+		case f[0] == "@timeout":
+			if len(f) != 3 {
+				return p, fmt.Errorf("line %d: expected @timeout <command> <duration>", n)
+			}
+			d, err := time.ParseDuration(f[2])
+			if err != nil || d <= 0 {
+				return p, fmt.Errorf("line %d: bad timeout '%s'", n, f[2])
+			}
+			p.Timeouts[f[1]] = d
+		case f[0] == "@propose" && len(f) == 1:
+			return p, fmt.Errorf("line %d: expected @propose <command> [<argument>...]", n)
+		case f[0] == "@propose":
+			if err := checkPatterns(f[2:]); err != nil {
+				return p, fmt.Errorf("line %d: %+v", n, err)
+			}
+			p.Proposals = append(p.Proposals, Rule(f[1:]))
+		case strings.HasPrefix(f[0], "@"):
+			return p, fmt.Errorf("line %d: unknown directive '%s'", n, f[0])
+		default:
+			if err := checkPatterns(f[1:]); err != nil {
+				return p, fmt.Errorf("line %d: %+v", n, err)
+			}
+			p.Rules = append(p.Rules, Rule(f))
+		}
+	}
+	return p, scanner.Err()
+}
+
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// Load reads the allowlist at path, falling back to DefaultAllowlist if it doesn't exist
+func Load(path string) (*Runner, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return New(DefaultAllowlist), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := ReadPolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %+v", path, err)
+	}
+	r := New(p.Rules)
+	if len(p.Timeouts) > 0 {
+		r.Timeouts = p.Timeouts
+	}
+	if len(p.Proposals) > 0 {
+		r.proposals = p.Proposals
+	}
+	return r, nil
+}
+
+func (r *Runner) Allowlist() []Rule {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Rule(nil), r.allowlist...)
+}
+
+func (r *Runner) Allowed(argv []string) bool {
+	if len(argv) == 0 || strings.ContainsRune(argv[0], '/') {
+		return false
+	}
+	for _, rule := range r.Allowlist() {
+		if rule.Match(argv) {
+			return true
+		}
+	}
+	return false
+}
+
+// Proposable is whether the model may propose argv, which must be allowed
+// & match one of the proposal rules too
+func (r *Runner) Proposable(argv []string) bool {
+	if !r.Allowed(argv) {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, rule := range r.proposals {
+		if rule.Match(argv) {
+			return true
+		}
+	}
+	return false
+}
+
+// History returns past runs, oldest first
+func (r *Runner) History() []Result {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Result(nil), r.history...)
+}
+
+func (r *Runner) record(res *Result) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res.ID = r.next
+	r.next++
+	r.history = append(r.history, *res)
+	if n := len(r.history) - HistorySize; n > 0 {
+		r.history = append(r.history[:0], r.history[n:]...)
+	}
+
+	if r.Record == "" {
+		return
+	}
+	if err := r.append(res); err != nil {
+		logger.Warn("failed recording command", "file", r.Record, "err", err)
+	}
+}
+
+func (r *Runner) append(res *Result) error {
+	if err := os.MkdirAll(filepath.Dir(r.Record), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.Record, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(res)
+	if err == nil {
+		_, err = f.Write(append(buf, '\n'))
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func validateEnv(env map[string]string) error {
+	for k := range env {
+		switch {
+		case k == "", strings.ContainsAny(k, "=\x00"):
+			return fmt.Errorf("%w: '%s'", ErrBadEnv, k)
+		case k == "PATH", k == "IFS", strings.HasPrefix(k, "LD_"):
+			return fmt.Errorf("%w: '%s'", ErrBadEnv, k)
+		}
+	}
+	return nil
+}
+
+// Run checks the request against the allowlist & executes it without a shell.
+// A command that ran, whatever its exit status, is reported through Result
+// rather than err; err is only for requests which were refused.
+func (r *Runner) Run(ctx context.Context, req Request) (Result, error) {
+	return r.execute(ctx, req, Result{})
+}
+
+// execute runs req, res carrying where it came from. Refusals are
+// recorded in the history too
+func (r *Runner) execute(ctx context.Context, req Request, res Result) (Result, error) {
+	var err error
+	if len(req.Argv) == 0 {
+		err = ErrEmpty
+	} else if !r.Allowed(req.Argv) {
+		err = fmt.Errorf("%w: %s", ErrNotAllowed, strings.Join(req.Argv, " "))
+	} else {
+		err = validateEnv(req.Env)
+	}
+	if err != nil {
+		res.Argv, res.Env, res.Started, res.ExitCode, res.Error = req.Argv, req.Env, time.Now(), -1, err.Error()
+		r.record(&res)
+		return res, err
+	}
+
+	timeout, limit := DefaultTimeout, MaxTimeout
+	if d, ok := r.Timeouts[req.Argv[0]]; ok {
+		timeout, limit = d, d
+	}
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout * float64(time.Second))
+	}
+	if timeout > limit {
+		timeout = limit
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		stdout = &Limited{N: MaxOutput}
+		stderr = &Limited{N: MaxOutput}
+		cmd    = exec.CommandContext(ctx, req.Argv[0], req.Argv[1:]...)
+	)
+
+	cmd.Env = append([]string(nil), BaseEnv...)
+	for k, v := range req.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdin = nil
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// kill the whole process group on timeout, so that grandchildren holding
+	// stdout open (ie. `sh -c 'sleep 5'`) don't outlive the deadline
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	res.Argv = req.Argv
+	res.Env = req.Env
+	res.Started = time.Now()
+
+	e := cmd.Run()
+
+	res.Duration = time.Since(res.Started).Seconds()
+	res.Stdout = stdout.String()
+	res.Stderr = stderr.String()
+	res.Truncated = stdout.Truncated || stderr.Truncated
+	res.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+
+	var exit *exec.ExitError
+	switch {
+	case e == nil:
+	case errors.As(e, &exit):
+		res.ExitCode = exit.ExitCode()
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			res.ExitCode = 128 + int(status.Signal())
+		}
+	default:
+		res.ExitCode = -1
+		res.Error = e.Error()
+	}
+
+	r.record(&res)
+	return res, nil
+}
+
+// Propose runs a command suggested by source, ie. the health checker,
+// according to Mode if it's Proposable. Whatever happens to it is recorded
+// in the history.
+func (r *Runner) Propose(ctx context.Context, source string, argv []string) (res Result, err error) {
+	res = Result{Argv: argv, Source: source, Started: time.Now(), ExitCode: -1}
+
+	switch {
+	case len(argv) == 0:
+		return res, ErrEmpty
+	case !r.Proposable(argv):
+		err = fmt.Errorf("%w: %s", ErrNotAllowed, strings.Join(argv, " "))
+	case r.Mode == ModeDryRun:
+		res.DryRun = true
+	case r.Mode == ModeRun:
+		return r.run(ctx, source, "", argv)
+	default:
+		var approved bool
+		if approved, err = r.await(ctx, source, argv); approved {
+			return r.run(ctx, source, "approved", argv)
+		} else if err == nil {
+			res.Approval, err = "rejected", ErrRejected
+		} else {
+			res.Approval, err = "expired", fmt.Errorf("%w: %+v", ErrRejected, err)
+		}
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+	r.record(&res)
+	return
+}
+
+func (r *Runner) run(ctx context.Context, source, approval string, argv []string) (Result, error) {
+	return r.execute(ctx, Request{Argv: argv}, Result{Source: source, Approval: approval})
+}
+
+// await blocks until an operator decides, for up to ApprovalTimeout
+func (r *Runner) await(ctx context.Context, source string, argv []string) (bool, error) {
+	p := &Pending{Argv: argv, Source: source, Proposed: time.Now(), decision: make(chan bool, 1)}
+
+	r.lock.Lock()
+	p.ID = r.next
+	r.next++
+	r.pending = append(r.pending, p)
+	r.lock.Unlock()
+	logger.InfoContext(ctx, "command awaiting approval", "id", p.ID, "source", source, "argv", argv)
+
+	defer func() {
+		r.lock.Lock()
+		for i := range r.pending {
+			if r.pending[i] == p {
+				r.pending = append(r.pending[:i:i], r.pending[i+1:]...)
+				break
+			}
+		}
+		r.lock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, ApprovalTimeout)
+	defer cancel()
+	select {
+	case approved := <-p.decision:
+		return approved, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Pending lists suggested commands awaiting approval, oldest first
+func (r *Runner) Pending() []Pending {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := make([]Pending, len(r.pending))
+	for i, p := range r.pending {
+		list[i] = *p
+	}
+	return list
+}
+
+// Decide approves or rejects a pending command
+func (r *Runner) Decide(id int64, approve bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, p := range r.pending {
+		if p.ID == id {
+			select {
+			case p.decision <- approve:
+			default:
+				// already decided
+			}
+			return nil
+		}
+	}
+	return ErrNoPending
+}
+
+// Split parses a suggested command line into argv, honouring quotes.
+// There's no shell, so pipes, redirections & the like are refused.
+func Split(line string) (argv []string, err error) {
+	var (
+		arg   strings.Builder
+		quote rune
+		have  bool
+	)
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, have = c, true
+		case c == ' ' || c == '\t':
+			if have {
+				argv = append(argv, arg.String())
+				arg.Reset()
+				have = false
+			}
+		case strings.ContainsRune("|&;<>()$`\\*?[]{}~\n", c):
+			return nil, fmt.Errorf("%w: '%c' in %s", ErrShell, c, strconv.Quote(line))
+		default:
+			arg.WriteRune(c)
+			have = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("%w: unterminated quote in %s", ErrShell, strconv.Quote(line))
+	}
+	if have {
+		argv = append(argv, arg.String())
+	}
+	if len(argv) == 0 {
+		return nil, ErrEmpty
+	}
+	return argv, nil
+}
+
+// Limited buffers up to N bytes & silently discards the rest
+type Limited struct {
+	bytes.Buffer
+	N         int
+	Truncated bool
+}
+
+func (l *Limited) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := l.N - l.Len(); room < len(p) {
+		if room > 0 {
+			l.Buffer.Write(p[:room])
+		}
+		l.Truncated = true
+		return n, nil
+	}
+	l.Buffer.Write(p)
+	return n, nil
+}
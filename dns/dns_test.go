@@ -0,0 +1,393 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	filepath "path"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+var zoneTemplate = template.Must(template.New("").Parse(`{{ .Serial }} ; serial
+{{ .Origin }}. AAAA {{ .IPv6 }}
+{{- range .Hosts }}
+{{ .Name }} AAAA {{ .IP }}
+{{- end }}
+`))
+
+func TestLabel(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"branch-a":              "branch-a",
+		"Branch_B.local":        "branch-b",
+		"--weird..":             "weird",
+		"www":                   "",
+		"ünïcode":               "n-code",
+		strings.Repeat("a", 70): strings.Repeat("a", 63),
+	} {
+		if got := Label(hostname); got != want {
+			t.Errorf("Label(%q) = %q, want %q", hostname, got, want)
+		}
+	}
+}
+
+func TestSerial(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	for prev, want := range map[uint32]uint32{
+		2014072184: 2024030900,
+		2024030900: 2024030901,
+		2024031000: 2024031001, // a clock running backwards still increases
+	} {
+		if got := Serial(prev, now); got != want {
+			t.Errorf("Serial(%d) = %d, want %d", prev, got, want)
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zone")
+	var reloads int
+	z := New("avaron.lan", file, net.ParseIP("fc00:a7a0::1"), zoneTemplate)
+	z.Reload = func(ctx context.Context, origin string) error {
+		reloads++
+		return nil
+	}
+	ctx := context.Background()
+
+	hosts := map[string]net.IP{"branch-a": net.ParseIP("fc00:a7a0::a"), "Branch-B": net.ParseIP("fc00:a7a0::b"), "www": net.ParseIP("::2")}
+	if err := z.Replace(ctx, hosts); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Replace(ctx, hosts); err != nil || reloads != 1 {
+		t.Errorf("reloaded %d times without a change: %v", reloads, err)
+	}
+	buf, _ := os.ReadFile(file)
+	if got := string(buf)[11:]; got != "; serial\navaron.lan. AAAA fc00:a7a0::1\nbranch-a AAAA fc00:a7a0::a\nbranch-b AAAA fc00:a7a0::b\n" {
+		t.Errorf("unexpected zone %q", buf)
+	}
+
+	// removing a peer bumps the serial, which survives a restart
+	delete(hosts, "branch-a")
+	if err := z.Replace(ctx, hosts); err != nil || reloads != 2 {
+		t.Fatalf("reloaded %d times: %v", reloads, err)
+	}
+	restarted := New("avaron.lan", file, z.Self, zoneTemplate)
+	if restarted.serial != z.serial || z.serial != Serial(Serial(0, time.Now()), time.Now()) {
+		t.Errorf("serial %d after restart, was %d", restarted.serial, z.serial)
+	}
+	if got := z.Hosts(); len(got) != 1 || got["branch-b"] == nil {
+		t.Errorf("unexpected hosts %v", got)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	_, overlay, _ := net.ParseCIDR("fc00:a7a0::/32")
+	if got, err := ReverseOrigin(*overlay); err != nil || got != "0.a.7.a.0.0.c.f.ip6.arpa" {
+		t.Errorf("got %q: %v", got, err)
+	}
+	_, odd, _ := net.ParseCIDR("fc00:a7a0::/30")
+	if _, err := ReverseOrigin(*odd); err == nil {
+		t.Error("named a /30")
+	}
+
+	dir := t.TempDir()
+	z := New("avaron.lan", filepath.Join(dir, "zone"), net.ParseIP("fc00:a7a0::1"), zoneTemplate)
+	z.Prefix, z.ReverseFile = *overlay, filepath.Join(dir, "reverse")
+	z.ReverseTemplate = template.Must(template.New("").Parse("{{ .ReverseOrigin }}\n{{ range .Pointers }}{{ .Name }} PTR {{ .Target }}\n{{ end }}"))
+	var reloaded []string
+	z.Reload = func(ctx context.Context, origin string) error {
+		reloaded = append(reloaded, origin)
+		return nil
+	}
+
+	err := z.Replace(context.Background(), map[string]net.IP{"branch-a": net.ParseIP("fc00:a7a0::a"), "elsewhere": net.ParseIP("2001:db8::1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := os.ReadFile(z.ReverseFile)
+	want := "0.a.7.a.0.0.c.f.ip6.arpa\n" +
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.a.7.a.0.0.c.f.ip6.arpa PTR avaron.lan\n" +
+		"a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.a.7.a.0.0.c.f.ip6.arpa PTR branch-a.avaron.lan\n"
+	if string(buf) != want {
+		t.Errorf("unexpected reverse zone %q", buf)
+	}
+	if strings.Join(reloaded, " ") != "avaron.lan 0.a.7.a.0.0.c.f.ip6.arpa" {
+		t.Errorf("reloaded %q", reloaded)
+	}
+}
+
+// query asks for name's records of typ, recursion desired
+func query(id uint16, name string, typ uint16) []byte {
+	b := appendUint16(nil, id)
+	b = appendUint16(b, flagRD)
+	b = appendUint16(b, 1)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	b = appendName(b, name)
+	b = appendUint16(b, typ)
+	return appendUint16(b, ClassIN)
+}
+
+func TestServer(t *testing.T) {
+	_, overlay, _ := net.ParseCIDR("fc00:a7a0::/32")
+	z := New("avaron.lan", filepath.Join(t.TempDir(), "zone"), net.ParseIP("fc00:a7a0::1"), zoneTemplate)
+	z.Prefix = *overlay
+	if err := z.Replace(context.Background(), map[string]net.IP{"branch-a": net.ParseIP("fc00:a7a0::a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upstream answers everything with its own ID back & no records
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			res := append([]byte{}, buf[:n]...)
+			res[2] |= 0x80
+			upstream.WriteTo(res, addr)
+		}
+	}()
+
+	s := NewServer(z, []string{upstream.LocalAddr().String()})
+	ctx := context.Background()
+	client := net.ParseIP("fc00:a7a0::b")
+	for _, c := range []struct {
+		name          string
+		typ           uint16
+		rcode         int
+		answers, auth int
+		aa            bool
+	}{
+		{"Branch-A.avaron.lan.", TypeAAAA, RcodeSuccess, 1, 0, true},
+		{"branch-a.avaron.lan", TypeA, RcodeSuccess, 0, 1, true},
+		{"branch-c.avaron.lan", TypeAAAA, RcodeNameError, 0, 1, true},
+		{"avaron.lan", TypeANY, RcodeSuccess, 3, 0, true},
+		{Reverse(net.ParseIP("fc00:a7a0::a")), TypePTR, RcodeSuccess, 1, 0, true},
+		{"example.com", TypeA, RcodeSuccess, 0, 0, false},
+	} {
+		res := s.Answer(ctx, client, query(42, c.name, c.typ), false, udpSize)
+		h, err := parseHeader(res)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if h.ID != 42 || int(h.Flags&0xf) != c.rcode || int(h.Answers) != c.answers || int(h.Authorities) != c.auth || (h.Flags&flagAA != 0) != c.aa {
+			t.Errorf("%s %s: unexpected answer %+v", c.name, TypeName[c.typ], h)
+		}
+		// the question comes back as it was asked
+		if q, _ := parseQuestion(res); string(q.raw) != string(query(42, c.name, c.typ)[12:]) {
+			t.Errorf("%s: question became %q", c.name, q.raw)
+		}
+	}
+
+	res := s.Answer(ctx, client, query(7, "branch-a.avaron.lan", TypeAAAA), false, udpSize)
+	name, off, _ := readName(res, 12+len(appendName(nil, "branch-a.avaron.lan"))+4)
+	if name != "branch-a.avaron.lan" || !net.IP(res[off+10:off+26]).Equal(net.ParseIP("fc00:a7a0::a")) {
+		t.Errorf("unexpected record %q %x", name, res[off:])
+	}
+
+	// without upstreams, or beyond the limit
+	if err := s.SetForwarders(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := parseHeader(s.Answer(ctx, client, query(1, "example.com", TypeA), false, udpSize)); h.Flags&0xf != RcodeRefused {
+		t.Errorf("forwarded without upstreams: %+v", h)
+	}
+	if h, _ := parseHeader(s.Answer(ctx, client, query(1, "avaron.lan", TypeANY), false, 40)); h.Flags&flagTC == 0 || h.Answers != 0 {
+		t.Errorf("didn't truncate: %+v", h)
+	}
+	if res := s.Answer(ctx, client, []byte{1, 2, 3}, false, udpSize); res != nil {
+		t.Errorf("answered garbage with %x", res)
+	}
+}
+
+func TestUpstreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	os.WriteFile(path, []byte("# generated\nnameserver 127.0.0.53\nnameserver 192.0.2.1\nnameserver fe80::1%eth0\nsearch lan\n"), 0644)
+	if list, err := Upstreams(path); err != nil || strings.Join(list, " ") != "192.0.2.1:53 [fe80::1%eth0]:53" {
+		t.Errorf("got %q: %v", list, err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct {
+		in   Custom
+		want string // the value, or "" if invalid
+	}{
+		{Custom{Name: "printer", Type: "a", Value: " 192.0.2.7 "}, "192.0.2.7"},
+		{Custom{Name: "printer.avaron.lan.", Type: "AAAA", Value: "FC00:A7A0::7"}, "fc00:a7a0::7"},
+		{Custom{Name: "docs", Type: "CNAME", Value: "Branch-A.avaron.lan."}, "branch-a.avaron.lan"},
+		{Custom{Name: "@", Type: "TXT", Value: `v=spf1 "-all"`}, `v=spf1 "-all"`},
+		{Custom{Name: "_http._tcp", Type: "SRV", Value: "branch-a.avaron.lan", Port: 80}, "branch-a.avaron.lan"},
+		{Custom{Name: "printer", Type: "A", Value: "fc00::1"}, ""},
+		{Custom{Name: "printer", Type: "AAAA", Value: "192.0.2.7"}, ""},
+		{Custom{Name: "@", Type: "CNAME", Value: "example.com"}, ""},
+		{Custom{Name: "bad name", Type: "A", Value: "192.0.2.7"}, ""},
+		{Custom{Name: "-bad", Type: "A", Value: "192.0.2.7"}, ""},
+		{Custom{Name: "mail", Type: "MX", Value: "branch-a"}, ""},
+		{Custom{Name: "_http._tcp", Type: "SRV", Value: "branch-a.avaron.lan"}, ""},
+		{Custom{Name: "note", Type: "TXT", Value: "line\nbreak"}, ""},
+		{Custom{Name: "printer", Type: "A", Value: "192.0.2.7", TTL: MaxTTL + 1}, ""},
+	} {
+		got := c.in
+		err := got.Normalize("avaron.lan")
+		if c.want == "" {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("%+v: got %v, want invalid", c.in, err)
+			}
+		} else if err != nil || got.Value != c.want || got.TTL != DefaultTTL {
+			t.Errorf("%+v: got %+v: %v", c.in, got, err)
+		}
+	}
+
+	for name, want := range map[string]string{"avaron.lan.": "@", "printer.Avaron.lan": "printer", "fooavaron.lan": "fooavaron.lan"} {
+		c := Custom{Name: name, Type: "A", Value: "192.0.2.7"}
+		if err := c.Normalize("avaron.lan"); err != nil || c.Name != want {
+			t.Errorf("%q: got %q, want %q: %v", name, c.Name, want, err)
+		}
+	}
+}
+
+func TestCustom(t *testing.T) {
+	dir := t.TempDir()
+	zt := template.Must(template.New("").Parse("{{ .Serial }} ; serial\n{{ range .Custom }}{{ .Name }}. {{ .TTL }} IN {{ .Type }} {{ .Data }}\n{{ end }}"))
+	z := New("avaron.lan", filepath.Join(dir, "zone"), net.ParseIP("fc00:a7a0::1"), zt)
+	if err := z.LoadRecords(filepath.Join(dir, "dns", "records.json")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := z.Replace(ctx, map[string]net.IP{"branch-a": net.ParseIP("fc00:a7a0::a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	alias, err := z.AddRecord(ctx, Custom{Name: "docs", Type: "CNAME", Value: "branch-a.avaron.lan"})
+	if err != nil || alias.ID == "" {
+		t.Fatalf("got %+v: %v", alias, err)
+	}
+	txt, _ := z.AddRecord(ctx, Custom{Name: "@", Type: "TXT", Value: `say "hi"`})
+	if _, err = z.AddRecord(ctx, Custom{Name: "_http._tcp", Type: "SRV", Value: "docs.avaron.lan", Priority: 10, Weight: 5, Port: 8080}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Custom{
+		{Name: "docs", Type: "TXT", Value: "alongside an alias"},
+		{Name: "branch-a", Type: "CNAME", Value: "example.com"},
+		{Name: "@", Type: "TXT", Value: `say "hi"`},
+	} {
+		if _, err = z.AddRecord(ctx, c); !errors.Is(err, ErrInvalid) {
+			t.Errorf("added %+v: %v", c, err)
+		}
+	}
+
+	buf, _ := os.ReadFile(z.File)
+	for _, line := range []string{
+		"docs.avaron.lan. 30 IN CNAME branch-a.avaron.lan.\n",
+		`avaron.lan. 30 IN TXT "say \"hi\""` + "\n",
+		"_http._tcp.avaron.lan. 30 IN SRV 10 5 8080 docs.avaron.lan.\n",
+	} {
+		if !strings.Contains(string(buf), line) {
+			t.Errorf("zone is missing %q:\n%s", line, buf)
+		}
+	}
+
+	// an alias is answered along with its target
+	answers, _, _, _ := z.Lookup("docs.avaron.lan", TypeAAAA)
+	if len(answers) != 2 || answers[0].Type != TypeCNAME || !answers[1].IP.Equal(net.ParseIP("fc00:a7a0::a")) {
+		t.Errorf("unexpected answers %+v", answers)
+	}
+
+	if _, err = z.UpdateRecord(ctx, txt.ID, Custom{Name: "@", Type: "TXT", Value: "bye"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.DeleteRecord(ctx, alias.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.DeleteRecord(ctx, alias.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted twice: %v", err)
+	}
+
+	// the records survive a restart
+	restarted := New("avaron.lan", z.File, z.Self, zt)
+	if err = restarted.LoadRecords(z.RecordsFile); err != nil {
+		t.Fatal(err)
+	}
+	if list := restarted.Custom(); len(list) != 2 || list[0].Value != "bye" || list[1].Type != "SRV" {
+		t.Errorf("unexpected records %+v", list)
+	}
+}
+
+func TestRecordWire(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	b := appendRecord(nil, Record{Name: "a.lan", Type: TypeTXT, TTL: 1, Text: long})
+	data := b[len(appendName(nil, "a.lan"))+10:]
+	if len(data) != 302 || data[0] != 255 || data[256] != 45 {
+		t.Errorf("unexpected TXT data %d bytes", len(data))
+	}
+
+	b = appendRecord(nil, Record{Name: "a.lan", Type: TypeSRV, TTL: 1, Priority: 1, Weight: 2, Port: 443, Target: "b.lan"})
+	data = b[len(appendName(nil, "a.lan"))+10:]
+	if target, _, err := readName(data, 6); err != nil || target != "b.lan" || data[4] != 1 || data[5] != 187 || data[1] != 1 || data[3] != 2 {
+		t.Errorf("unexpected SRV data %x: %v", data, err)
+	}
+}
+
+func TestForwarders(t *testing.T) {
+	got, err := ParseForwarders([]string{"192.0.2.1", "[2001:db8::1]:5353", "192.0.2.1:53"})
+	if err != nil || strings.Join(got, " ") != "192.0.2.1:53 [2001:db8::1]:5353" {
+		t.Errorf("got %q: %v", got, err)
+	}
+	for _, bad := range []string{"resolver.example", "0.0.0.0", "192.0.2.1:0", "192.0.2.1:http"} {
+		if _, err = ParseForwarder(bad); !errors.Is(err, ErrInvalid) {
+			t.Errorf("accepted %q: %v", bad, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "forwarders.json")
+	s := NewServer(nil, nil)
+	s.ForwardersFile = path
+	if err = s.SetForwarders(context.Background(), []string{"192.0.2.53"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, ok, err := LoadForwarders(path); err != nil || !ok || strings.Join(list, " ") != "192.0.2.53:53" {
+		t.Errorf("loaded %q %v: %v", list, ok, err)
+	}
+
+	n := NewNamed(filepath.Join(t.TempDir(), "conf"), template.Must(template.New("").Parse("{{ range .Forwarders }}{{ .IP }} port {{ .Port }};\n{{ end }}")), NamedConf{}, Rndc{}, s.Forwarders())
+	if err = n.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := os.ReadFile(n.File); string(buf) != "192.0.2.53 port 53;\n" {
+		t.Errorf("unexpected configuration %q", buf)
+	}
+	if _, err = n.Stats(); err != ErrUnsupported {
+		t.Errorf("named kept stats: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	z := New("avaron.lan", filepath.Join(t.TempDir(), "zone"), net.ParseIP("fc00:a7a0::1"), zoneTemplate)
+	s := NewServer(z, nil)
+	ctx := context.Background()
+	a, b := net.ParseIP("fc00:a7a0::a"), net.ParseIP("fc00:a7a0::b")
+	s.Answer(ctx, a, query(1, "avaron.lan", TypeAAAA), false, udpSize)
+	s.Answer(ctx, a, query(2, "nowhere.avaron.lan", TypeAAAA), false, udpSize)
+	s.Answer(ctx, b, query(3, "example.com", TypeA), false, udpSize)
+
+	stats, err := s.Stats()
+	if err != nil || len(stats) != 2 {
+		t.Fatalf("got %+v: %v", stats, err)
+	}
+	if stats[0].Client != a.String() || stats[0].Queries != 2 || stats[0].Types["AAAA"] != 2 || stats[0].Outcomes["nxdomain"] != 1 {
+		t.Errorf("unexpected stats %+v", stats[0])
+	}
+	if stats[1].Outcomes["refused"] != 1 {
+		t.Errorf("unexpected stats %+v", stats[1])
+	}
+}
@@ -0,0 +1,174 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+)
+
+// MaxForwarders is as many upstream resolvers as are worth trying in turn
+const MaxForwarders = 8
+
+var ErrUnsupported = errors.New("not supported by this dns server")
+
+// Resolver is whichever server answers for the mesh, forwarding the rest
+type Resolver interface {
+	// Forwarders lists the upstream resolvers, as host:port
+	Forwarders() []string
+	// SetForwarders validates, saves & applies a new list of them
+	SetForwarders(ctx context.Context, list []string) error
+	// Stats is the queries of each client, ErrUnsupported when they aren't kept
+	Stats() ([]ClientStats, error)
+}
+
+// ParseForwarder normalizes an upstream resolver, an address with an
+// optional port, to host:port
+func ParseForwarder(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, "53"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+		return "", invalidf("%q isn't a resolver's address", s)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", invalidf("%q isn't a port", port)
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// ParseForwarders normalizes each of list, which may be empty to answer
+// only for the zone
+func ParseForwarders(list []string) ([]string, error) {
+	if len(list) > MaxForwarders {
+		return nil, invalidf("at most %d forwarders", MaxForwarders)
+	}
+	parsed := make([]string, 0, len(list))
+	seen := make(map[string]bool)
+	for _, s := range list {
+		f, err := ParseForwarder(s)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[f] {
+			parsed, seen[f] = append(parsed, f), true
+		}
+	}
+	return parsed, nil
+}
+
+// LoadForwarders reads the forwarders saved at path, ok being false when
+// none ever were
+func LoadForwarders(path string) (list []string, ok bool, err error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if err = json.Unmarshal(buf, &list); err != nil {
+		return nil, false, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	list, err = ParseForwarders(list)
+	return list, err == nil, err
+}
+
+// Forwarder is an upstream as named's configuration has it
+type Forwarder struct {
+	IP   string
+	Port string
+}
+
+// NamedConf is the data of named's configuration template
+type NamedConf struct {
+	Directory     string
+	ProcessIDFile string
+	Reverse       string
+	ReverseZone   string
+	Zone          string
+	KeyFile       string
+	KeyName       string
+	ControlPort   int
+	Forwarders    []Forwarder
+}
+
+// Named is BIND's named as the Resolver, reconfigured through rndc
+type Named struct {
+	File     string // where the configuration's written
+	Template *template.Template
+	Conf     NamedConf
+	Rndc     Rndc
+	// ForwardersFile keeps the forwarders set through SetForwarders
+	ForwardersFile string
+
+	lock       sync.Mutex
+	forwarders []string
+}
+
+// NewNamed configures named from t, forwarding to upstreams
+func NewNamed(file string, t *template.Template, conf NamedConf, rndc Rndc, upstreams []string) *Named {
+	return &Named{File: file, Template: t, Conf: conf, Rndc: rndc, forwarders: upstreams}
+}
+
+// Write renders named's configuration to File
+func (n *Named) Write() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.write()
+}
+
+func (n *Named) write() error {
+	conf := n.Conf
+	conf.Forwarders = nil
+	for _, f := range n.forwarders {
+		host, port, _ := net.SplitHostPort(f)
+		conf.Forwarders = append(conf.Forwarders, Forwarder{host, port})
+	}
+
+	var buf bytes.Buffer
+	if err := n.Template.Execute(&buf, conf); err != nil {
+		return fmt.Errorf("rendering named configuration: %w", err)
+	}
+	tmp := n.File + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.File)
+}
+
+func (n *Named) Forwarders() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]string{}, n.forwarders...)
+}
+
+func (n *Named) SetForwarders(ctx context.Context, list []string) error {
+	list, err := ParseForwarders(list)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err = save(n.ForwardersFile, list); err != nil {
+		return err
+	}
+	n.forwarders = list
+	if err = n.write(); err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "forwarders changed", "forwarders", list)
+	return n.Rndc.Reconfig(ctx)
+}
+
+// Stats aren't kept by named, whose query log isn't enabled
+func (n *Named) Stats() ([]ClientStats, error) {
+	return nil, ErrUnsupported
+}
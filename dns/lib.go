@@ -0,0 +1,366 @@
+package dns
+
+import (
+	"avaron/logging"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var logger = logging.For("dns")
+
+const (
+	DefaultTTL = 30
+
+	// KeyName is the key named & rndc share, as rndc-confgen names it
+	KeyName = "rndc-key"
+)
+
+// Host is a name in the zone, relative to its origin
+type Host struct {
+	Name string
+	IP   net.IP
+}
+
+// Zone is the mesh's zone, published as named's zone file & reloaded
+// whenever its hosts change
+type Zone struct {
+	Origin   string // ie. avaron.lan
+	File     string
+	TTL      int
+	Self     net.IP // this node, the zone's apex, www & ns
+	Template *template.Template
+	// Reload has named pick up a zone's file, skipped when nil
+	Reload func(ctx context.Context, origin string) error
+
+	// ReverseFile, when set, is Prefix's ip6.arpa zone with a PTR for each
+	// host in it, published along with the forward zone
+	Prefix          net.IPNet
+	ReverseFile     string
+	ReverseTemplate *template.Template
+
+	// RecordsFile keeps the custom records, see LoadRecords
+	RecordsFile string
+
+	lock      sync.Mutex
+	hosts     map[string]net.IP
+	custom    []Custom
+	serial    uint32
+	published bool
+}
+
+// Primary constructor for this package, carrying on from the serial of
+// any zone already at file
+func New(origin, file string, self net.IP, t *template.Template) *Zone {
+	z := &Zone{
+		Origin:   origin,
+		File:     file,
+		TTL:      DefaultTTL,
+		Self:     self,
+		Template: t,
+		hosts:    make(map[string]net.IP),
+	}
+	if buf, err := os.ReadFile(file); err == nil {
+		if m := serialLine.FindSubmatch(buf); m != nil {
+			n, _ := strconv.ParseUint(string(m[1]), 10, 32)
+			z.serial = uint32(n)
+		}
+	}
+	return z
+}
+
+var (
+	serialLine = regexp.MustCompile(`(?m)^\s*(\d+)\s*; serial`)
+	invalid    = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+// Label turns a hostname into a name that's valid in the zone, "" if
+// nothing of it is
+func Label(hostname string) string {
+	label, _, _ := strings.Cut(strings.ToLower(hostname), ".")
+	label = strings.Trim(invalid.ReplaceAllString(label, "-"), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	switch label {
+	case "www", "ns":
+		// already this node's
+		return ""
+	}
+	return label
+}
+
+// Pointer is a PTR record, both names absolute without the trailing dot
+type Pointer struct {
+	Name   string
+	Target string
+}
+
+// Reverse is ip's name under ip6.arpa, nibble by nibble
+func Reverse(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
+
+// ReverseOrigin is the ip6.arpa zone of prefix, whose length must be a
+// whole number of nibbles
+func ReverseOrigin(prefix net.IPNet) (string, error) {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || ones%4 != 0 {
+		return "", fmt.Errorf("%s isn't an IPv6 prefix on a nibble boundary", prefix.String())
+	}
+	name := Reverse(prefix.IP)
+	// each nibble is 2 characters of the name, "x."
+	return name[2*(32-ones/4):], nil
+}
+
+// Serial follows prev in the YYYYMMDDnn convention, bumping the count
+// within a day & jumping to today's first otherwise
+func Serial(prev uint32, now time.Time) uint32 {
+	y, m, d := now.Date()
+	today := uint32(y*1000000 + int(m)*10000 + d*100)
+	if prev < today {
+		return today
+	}
+	return prev + 1
+}
+
+// Hosts is the zone's hosts, by name
+func (z *Zone) Hosts() map[string]net.IP {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	hosts := make(map[string]net.IP, len(z.hosts))
+	for name, ip := range z.hosts {
+		hosts[name] = ip
+	}
+	return hosts
+}
+
+// Replace makes hosts the zone's, by hostname, publishing them if that's
+// a change. Hostnames that aren't valid labels are left out
+func (z *Zone) Replace(ctx context.Context, hosts map[string]net.IP) error {
+	next := make(map[string]net.IP, len(hosts))
+	for hostname, ip := range hosts {
+		if label := Label(hostname); label != "" && ip != nil {
+			next[label] = ip
+		}
+	}
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if z.published && same(z.hosts, next) {
+		return nil
+	}
+	added, removed := diff(z.hosts, next)
+	z.hosts = next
+	if err := z.publish(ctx); err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "zone updated", "origin", z.Origin, "serial", z.serial, "added", added, "removed", removed)
+	return nil
+}
+
+// Publish writes & reloads the zone as it is
+func (z *Zone) Publish(ctx context.Context) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return z.publish(ctx)
+}
+
+// Set publishes a single host, leaving the rest
+func (z *Zone) Set(ctx context.Context, hostname string, ip net.IP) error {
+	hosts := z.Hosts()
+	hosts[hostname] = ip
+	return z.Replace(ctx, hosts)
+}
+
+func same(a, b map[string]net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, ip := range a {
+		if !ip.Equal(b[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// diff names the hosts added to & removed from a to make b, changed ones being both
+func diff(a, b map[string]net.IP) (added, removed []string) {
+	for name, ip := range b {
+		if !ip.Equal(a[name]) {
+			added = append(added, name)
+		}
+	}
+	for name, ip := range a {
+		if !ip.Equal(b[name]) {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// sorted lists the hosts by name, z.lock being held
+func (z *Zone) sorted() []Host {
+	hosts := make([]Host, 0, len(z.hosts))
+	for name, ip := range z.hosts {
+		hosts = append(hosts, Host{name, ip})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
+}
+
+// pointers names each address in Prefix for its first host, & this node
+// for the zone when it goes by no other name
+func (z *Zone) pointers(hosts []Host) []Pointer {
+	var list []Pointer
+	named := make(map[string]bool)
+	for _, h := range hosts {
+		if ptr := Reverse(h.IP); z.Prefix.Contains(h.IP) && !named[ptr] {
+			list = append(list, Pointer{ptr, h.Name + "." + z.Origin})
+			named[ptr] = true
+		}
+	}
+	if ptr := Reverse(z.Self); z.Prefix.Contains(z.Self) && !named[ptr] {
+		list = append(list, Pointer{ptr, z.Origin})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+type zoneFile struct {
+	origin, file string
+	t            *template.Template
+}
+
+// publish writes the zones under a new serial & reloads them, z.lock being held
+func (z *Zone) publish(ctx context.Context) error {
+	if z.Template == nil {
+		return errors.New("no zone template")
+	}
+
+	hosts := z.sorted()
+	data := struct {
+		Origin        string
+		ReverseOrigin string
+		Serial        uint32
+		TTL           int
+		IPv6          string
+		Hosts         []Host
+		Custom        []Entry
+		Pointers      []Pointer
+	}{
+		Origin: z.Origin,
+		Serial: Serial(z.serial, time.Now()),
+		TTL:    z.TTL,
+		IPv6:   z.Self.String(),
+		Hosts:  hosts,
+		Custom: z.entries(),
+	}
+
+	files := []zoneFile{{z.Origin, z.File, z.Template}}
+	if z.ReverseFile != "" {
+		var err error
+		if data.ReverseOrigin, err = ReverseOrigin(z.Prefix); err != nil {
+			return err
+		}
+		if z.ReverseTemplate == nil {
+			return errors.New("no reverse zone template")
+		}
+
+		data.Pointers = z.pointers(hosts)
+		files = append(files, zoneFile{data.ReverseOrigin, z.ReverseFile, z.ReverseTemplate})
+	}
+
+	for _, f := range files {
+		var buf bytes.Buffer
+		if err := f.t.Execute(&buf, data); err != nil {
+			return fmt.Errorf("rendering %s: %w", f.origin, err)
+		}
+		tmp := f.file + ".tmp"
+		if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, f.file); err != nil {
+			return err
+		}
+	}
+	z.serial, z.published = data.Serial, true
+
+	if z.Reload == nil {
+		return nil
+	}
+	for _, f := range files {
+		if err := z.Reload(ctx, f.origin); err != nil {
+			return fmt.Errorf("reloading %s: %w", f.origin, err)
+		}
+	}
+	return nil
+}
+
+// Rndc reloads zones through named's control channel
+type Rndc struct {
+	Command string // rndc when empty
+	KeyFile string
+	Server  string
+	Port    int
+}
+
+func (r Rndc) Reload(ctx context.Context, origin string) error {
+	return r.run(ctx, "reload", origin)
+}
+
+// Reconfig has named read its configuration again, without reloading zones
+func (r Rndc) Reconfig(ctx context.Context) error {
+	return r.run(ctx, "reconfig")
+}
+
+func (r Rndc) run(ctx context.Context, args ...string) error {
+	command := r.Command
+	if command == "" {
+		command = "rndc"
+	}
+	args = append([]string{"-k", r.KeyFile, "-s", r.Server, "-p", strconv.Itoa(r.Port)}, args...)
+	out, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// WriteKey generates the key shared by named & rndc as a key statement,
+// which named includes & rndc reads with -k
+func WriteKey(path string) error {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("key %q {\n\talgorithm hmac-sha256;\n\tsecret %q;\n};\n", KeyName, base64.StdEncoding.EncodeToString(secret[:]))
+
+	os.Remove(path)
+	return os.WriteFile(path, []byte(key), 0600)
+}
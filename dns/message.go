@@ -0,0 +1,257 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// the little of RFC 1035 the server needs, queries in & answers out
+
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeANY   uint16 = 255
+
+	ClassIN  uint16 = 1
+	ClassANY uint16 = 255
+)
+
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3 // NXDOMAIN
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+)
+
+var (
+	errShort = errors.New("dns message too short")
+	errName  = errors.New("malformed dns name")
+)
+
+// TypeName is the mnemonic of each type the server answers
+var TypeName = map[uint16]string{
+	TypeA: "A", TypeNS: "NS", TypeCNAME: "CNAME", TypeSOA: "SOA", TypePTR: "PTR",
+	TypeTXT: "TXT", TypeAAAA: "AAAA", TypeSRV: "SRV", TypeANY: "ANY",
+}
+
+// Record is a resource record the server answers with
+type Record struct {
+	Name   string // absolute, lower case & without the trailing dot
+	Type   uint16
+	TTL    uint32
+	IP     net.IP // A & AAAA
+	Target string // NS, CNAME, PTR & SRV, or SOA's primary server
+	Text   string // TXT
+	SOA    *SOA
+
+	Priority, Weight, Port uint16 // SRV
+}
+
+type SOA struct {
+	Mailbox                          string
+	Serial                           uint32
+	Refresh, Retry, Expire, Negative uint32
+}
+
+type header struct {
+	ID, Flags, Questions, Answers, Authorities, Additionals uint16
+}
+
+type question struct {
+	Name        string
+	Type, Class uint16
+	raw         []byte // as asked, which may be in mixed case
+}
+
+func (h header) opcode() int {
+	return int(h.Flags>>11) & 0xf
+}
+
+func parseHeader(buf []byte) (h header, err error) {
+	if len(buf) < 12 {
+		return h, errShort
+	}
+	h = header{
+		ID:          binary.BigEndian.Uint16(buf[0:]),
+		Flags:       binary.BigEndian.Uint16(buf[2:]),
+		Questions:   binary.BigEndian.Uint16(buf[4:]),
+		Answers:     binary.BigEndian.Uint16(buf[6:]),
+		Authorities: binary.BigEndian.Uint16(buf[8:]),
+		Additionals: binary.BigEndian.Uint16(buf[10:]),
+	}
+	return h, nil
+}
+
+// parseQuestion reads the first question, which follows the header
+func parseQuestion(buf []byte) (q question, err error) {
+	name, off, err := readName(buf, 12)
+	if err != nil {
+		return q, err
+	}
+	if len(buf) < off+4 {
+		return q, errShort
+	}
+	return question{name, binary.BigEndian.Uint16(buf[off:]), binary.BigEndian.Uint16(buf[off+2:]), buf[12 : off+4]}, nil
+}
+
+// readName reads the name at off, following compression pointers, &
+// returns it lower cased with the offset after it
+func readName(buf []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		end    = -1
+		length int
+	)
+	for jumps := 0; ; {
+		if off >= len(buf) {
+			return "", 0, errShort
+		}
+		n := int(buf[off])
+		switch {
+		case n == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(buf) {
+				return "", 0, errShort
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errName
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(buf[off:]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, errName
+		default:
+			if off+1+n > len(buf) {
+				return "", 0, errShort
+			}
+			if length += n + 1; length > 255 {
+				return "", 0, errName
+			}
+			labels = append(labels, string(buf[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendRecord(b []byte, r Record) []byte {
+	b = appendName(b, r.Name)
+	b = appendUint16(b, r.Type)
+	b = appendUint16(b, ClassIN)
+	b = appendUint32(b, r.TTL)
+
+	// the length is filled in once the data's written
+	at := len(b)
+	b = append(b, 0, 0)
+	switch r.Type {
+	case TypeA:
+		b = append(b, r.IP.To4()...)
+	case TypeAAAA:
+		b = append(b, r.IP.To16()...)
+	case TypeNS, TypeCNAME, TypePTR:
+		b = appendName(b, r.Target)
+	case TypeTXT:
+		for _, chunk := range chunks(r.Text) {
+			b = append(b, byte(len(chunk)))
+			b = append(b, chunk...)
+		}
+	case TypeSRV:
+		b = appendUint16(b, r.Priority)
+		b = appendUint16(b, r.Weight)
+		b = appendUint16(b, r.Port)
+		b = appendName(b, r.Target)
+	case TypeSOA:
+		b = appendName(b, r.Target)
+		b = appendName(b, r.SOA.Mailbox)
+		for _, v := range []uint32{r.SOA.Serial, r.SOA.Refresh, r.SOA.Retry, r.SOA.Expire, r.SOA.Negative} {
+			b = appendUint32(b, v)
+		}
+	}
+	binary.BigEndian.PutUint16(b[at:], uint16(len(b)-at-2))
+	return b
+}
+
+// chunks splits text into the character strings of a TXT record
+func chunks(text string) []string {
+	list := []string{}
+	for len(text) > 255 {
+		list, text = append(list, text[:255]), text[255:]
+	}
+	return append(list, text)
+}
+
+// reply answers q, truncating to max bytes by leaving out the records
+func reply(h header, q question, flags uint16, rcode int, answers, authority []Record, max int) []byte {
+	flags |= flagQR | h.Flags&(0xf<<11|flagRD) | uint16(rcode)
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], h.ID)
+	b = append(b, q.raw...)
+	question := len(b)
+
+	for _, r := range answers {
+		b = appendRecord(b, r)
+	}
+	for _, r := range authority {
+		b = appendRecord(b, r)
+	}
+	if len(b) > max {
+		b, flags = b[:question], flags|flagTC
+		answers, authority = nil, nil
+	}
+
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(authority)))
+	return b
+}
+
+// failure answers a query with only its header readable
+func failure(h header, rcode int) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], h.ID)
+	binary.BigEndian.PutUint16(b[2:], flagQR|h.Flags&(0xf<<11|flagRD)|uint16(rcode))
+	return b
+}
@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"avaron/metrics"
+	"context"
+	"os/exec"
+	"time"
+)
+
+const (
+	MinBackoff = time.Second
+	MaxBackoff = time.Minute
+)
+
+var Restarts = metrics.NewCounter("avaron_named_restarts_total",
+	"Times named exited & was started again")
+
+// Supervise runs argv, BIND's named, until ctx is done. Whenever it exits
+// it's started again, waiting twice as long after each exit up to
+// MaxBackoff, & from MinBackoff again once it's stayed up that long
+func Supervise(ctx context.Context, argv []string) {
+	backoff := MinBackoff
+	for {
+		started := time.Now()
+		err := exec.CommandContext(ctx, argv[0], argv[1:]...).Run()
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) >= MaxBackoff {
+			backoff = MinBackoff
+		}
+		logger.ErrorContext(ctx, "named exited", "err", err, "uptime", time.Since(started).Round(time.Millisecond), "restart", backoff)
+		Restarts.Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
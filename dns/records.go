@@ -0,0 +1,362 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	filepath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid  = errors.New("invalid dns record")
+	ErrNotFound = errors.New("dns record not found")
+)
+
+const (
+	// MaxTTL is a week, as long as anything in a mesh should be cached
+	MaxTTL = 7 * 24 * 60 * 60
+	// MaxText is the most bytes of a TXT record
+	MaxText = 4096
+)
+
+// Types of custom records, by name
+var Types = map[string]uint16{"A": TypeA, "AAAA": TypeAAAA, "CNAME": TypeCNAME, "TXT": TypeTXT, "SRV": TypeSRV}
+
+// Custom is a record added to the zone by an operator, rather than for a peer
+type Custom struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"` // relative to the zone, @ for the zone itself
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"` // the address, target or text
+
+	Priority uint16 `json:"priority,omitempty"` // SRV
+	Weight   uint16 `json:"weight,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
+
+// validName checks a name of labels, which may start with _ as services do
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Normalize checks c can be published in origin, tidying its name, type,
+// TTL & value
+func (c *Custom) Normalize(origin string) error {
+	c.Name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(c.Name)), ".")
+	if c.Name == "" || c.Name == origin {
+		c.Name = "@"
+	} else {
+		c.Name = strings.TrimSuffix(c.Name, "."+origin)
+	}
+	if c.Name != "@" && (!validName(c.Name) || len(c.Name)+1+len(origin) > 253) {
+		return invalidf("%q isn't a name in %s", c.Name, origin)
+	}
+
+	c.Type = strings.ToUpper(strings.TrimSpace(c.Type))
+	if _, ok := Types[c.Type]; !ok {
+		return invalidf("type %q isn't one of A, AAAA, CNAME, TXT or SRV", c.Type)
+	}
+
+	switch {
+	case c.TTL == 0:
+		c.TTL = DefaultTTL
+	case c.TTL > MaxTTL:
+		return invalidf("TTL may be at most %d", MaxTTL)
+	}
+
+	if c.Type != "SRV" {
+		c.Priority, c.Weight, c.Port = 0, 0, 0
+	}
+	ip := net.ParseIP(strings.TrimSpace(c.Value))
+	switch c.Type {
+	case "A":
+		if ip == nil || ip.To4() == nil {
+			return invalidf("%q isn't an IPv4 address", c.Value)
+		}
+		c.Value = ip.String()
+	case "AAAA":
+		if ip == nil || ip.To4() != nil {
+			return invalidf("%q isn't an IPv6 address", c.Value)
+		}
+		c.Value = ip.String()
+	case "CNAME", "SRV":
+		if c.Type == "CNAME" && c.Name == "@" {
+			return invalidf("the zone itself can't be an alias")
+		}
+		if c.Type == "SRV" && c.Port == 0 {
+			return invalidf("SRV records need a port")
+		}
+		c.Value = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(c.Value)), ".")
+		if !validName(c.Value) {
+			return invalidf("%q isn't a hostname", c.Value)
+		}
+	case "TXT":
+		if c.Value == "" || len(c.Value) > MaxText {
+			return invalidf("text must be between 1 & %d bytes", MaxText)
+		}
+		for _, r := range c.Value {
+			if r < ' ' || r == 0x7f {
+				return invalidf("text can't hold control characters")
+			}
+		}
+	}
+	return nil
+}
+
+// Owner is c's absolute name in origin
+func (c Custom) Owner(origin string) string {
+	if c.Name == "@" {
+		return origin
+	}
+	return c.Name + "." + origin
+}
+
+// Data is c's value in a zone file
+func (c Custom) Data() string {
+	switch c.Type {
+	case "CNAME":
+		return c.Value + "."
+	case "SRV":
+		return fmt.Sprintf("%d %d %d %s.", c.Priority, c.Weight, c.Port, c.Value)
+	case "TXT":
+		var quoted []string
+		for _, chunk := range chunks(c.Value) {
+			var b strings.Builder
+			b.WriteByte('"')
+			for i := 0; i < len(chunk); i++ {
+				switch ch := chunk[i]; {
+				case ch == '"' || ch == '\\':
+					b.WriteByte('\\')
+					b.WriteByte(ch)
+				case ch >= 0x80:
+					fmt.Fprintf(&b, "\\%03d", ch)
+				default:
+					b.WriteByte(ch)
+				}
+			}
+			b.WriteByte('"')
+			quoted = append(quoted, b.String())
+		}
+		return strings.Join(quoted, " ")
+	}
+	return c.Value
+}
+
+// Entry is a custom record as a line of the zone file
+type Entry struct {
+	Name string // absolute, without the trailing dot
+	TTL  uint32
+	Type string
+	Data string
+}
+
+// visible is the custom records that go in the zone, leaving out aliases
+// a host has since taken the name of, z.lock being held
+func (z *Zone) visible() []Custom {
+	reserved := z.reserved()
+	var list []Custom
+	for _, c := range z.custom {
+		if c.Type == "CNAME" && reserved[c.Name] {
+			continue
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// entries is the custom records of the zone file, z.lock being held
+func (z *Zone) entries() []Entry {
+	var list []Entry
+	for _, c := range z.visible() {
+		list = append(list, Entry{c.Owner(z.Origin), c.TTL, c.Type, c.Data()})
+	}
+	return list
+}
+
+func (c Custom) record(origin string) Record {
+	r := Record{Name: c.Owner(origin), Type: Types[c.Type], TTL: c.TTL}
+	switch c.Type {
+	case "A", "AAAA":
+		r.IP = net.ParseIP(c.Value)
+	case "TXT":
+		r.Text = c.Value
+	default:
+		r.Target, r.Priority, r.Weight, r.Port = c.Value, c.Priority, c.Weight, c.Port
+	}
+	return r
+}
+
+// conflicts finds what in list, with the zone's own names, can't be published together
+func conflicts(list []Custom, reserved map[string]bool) error {
+	names := make(map[string][]Custom)
+	for _, c := range list {
+		names[c.Name] = append(names[c.Name], c)
+	}
+	for name, records := range names {
+		for i, c := range records {
+			if c.Type == "CNAME" && (len(records) > 1 || reserved[name]) {
+				return invalidf("%s is an alias, so it can't have other records", name)
+			}
+			for _, other := range records[:i] {
+				if other.Type == c.Type && other.Value == c.Value && other.Port == c.Port {
+					return invalidf("%s already has that %s record", name, c.Type)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reserved is the names the zone already has records at, z.lock being held
+func (z *Zone) reserved() map[string]bool {
+	names := map[string]bool{"@": true, "www": true, "ns": true}
+	for name := range z.hosts {
+		names[name] = true
+	}
+	return names
+}
+
+// save writes v as JSON to path, if there is one
+func save(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, append(buf, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadRecords reads the custom records kept at path, which is where
+// changes are saved from now on
+func (z *Zone) LoadRecords(path string) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	z.RecordsFile = path
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list []Custom
+	if err = json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+	for i := range list {
+		if err = list[i].Normalize(z.Origin); err != nil {
+			return fmt.Errorf("record %s in %s: %w", list[i].ID, path, err)
+		}
+	}
+	z.custom = list
+	return nil
+}
+
+// Custom lists the custom records, by name then type
+func (z *Zone) Custom() []Custom {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	list := append([]Custom{}, z.custom...)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+// change validates the custom records fn makes of the current ones,
+// saving & publishing them if they're fine
+func (z *Zone) change(ctx context.Context, fn func(list []Custom) ([]Custom, error)) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	list, err := fn(append([]Custom{}, z.custom...))
+	if err != nil {
+		return err
+	}
+	if err = conflicts(list, z.reserved()); err != nil {
+		return err
+	}
+
+	if err = save(z.RecordsFile, list); err != nil {
+		return err
+	}
+	z.custom = list
+	return z.publish(ctx)
+}
+
+func (z *Zone) AddRecord(ctx context.Context, c Custom) (Custom, error) {
+	if err := c.Normalize(z.Origin); err != nil {
+		return c, err
+	}
+	c.ID = strconv.FormatInt(time.Now().UnixNano(), 10)
+	err := z.change(ctx, func(list []Custom) ([]Custom, error) {
+		return append(list, c), nil
+	})
+	return c, err
+}
+
+func (z *Zone) UpdateRecord(ctx context.Context, id string, c Custom) (Custom, error) {
+	if err := c.Normalize(z.Origin); err != nil {
+		return c, err
+	}
+	c.ID = id
+	err := z.change(ctx, func(list []Custom) ([]Custom, error) {
+		for i := range list {
+			if list[i].ID == id {
+				list[i] = c
+				return list, nil
+			}
+		}
+		return nil, ErrNotFound
+	})
+	return c, err
+}
+
+func (z *Zone) DeleteRecord(ctx context.Context, id string) error {
+	return z.change(ctx, func(list []Custom) ([]Custom, error) {
+		for i := range list {
+			if list[i].ID == id {
+				return append(list[:i], list[i+1:]...), nil
+			}
+		}
+		return nil, ErrNotFound
+	})
+}
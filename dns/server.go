@@ -0,0 +1,481 @@
+package dns
+
+import (
+	"avaron/metrics"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds each upstream's answer to a forwarded query
+	DefaultTimeout = 3 * time.Second
+
+	// udpSize is what's answered over UDP without EDNS, beyond which the
+	// client's told to ask again over TCP
+	udpSize = 512
+	tcpIdle = 10 * time.Second
+
+	// MaxClients is how many clients' queries are counted, the longest
+	// quiet making way for new ones
+	MaxClients = 1024
+)
+
+var Queries = metrics.NewCounter("avaron_dns_queries_total",
+	"Queries answered by the built in DNS server, by type & how",
+	"type", "outcome")
+
+// Records is the zone's resource records, forward then reverse, its
+// authority's SOA & NS first
+func (z *Zone) Records() []Record {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	serial := z.serial
+	if serial == 0 {
+		serial = Serial(0, time.Now())
+	}
+	ttl := uint32(z.TTL)
+	ns := "ns." + z.Origin
+	authority := func(origin string) []Record {
+		return []Record{
+			{Name: origin, Type: TypeSOA, TTL: ttl, Target: ns, SOA: &SOA{"admin." + z.Origin, serial, 28800, 3600, 604800, 38400}},
+			{Name: origin, Type: TypeNS, TTL: ttl, Target: ns},
+		}
+	}
+
+	records := append(authority(z.Origin),
+		Record{Name: z.Origin, Type: TypeAAAA, TTL: ttl, IP: z.Self},
+		Record{Name: "www." + z.Origin, Type: TypeAAAA, TTL: ttl, IP: z.Self},
+		Record{Name: ns, Type: TypeAAAA, TTL: ttl, IP: net.IPv6loopback},
+	)
+	hosts := z.sorted()
+	for _, h := range hosts {
+		typ := TypeAAAA
+		if h.IP.To4() != nil {
+			typ = TypeA
+		}
+		records = append(records, Record{Name: h.Name + "." + z.Origin, Type: typ, TTL: ttl, IP: h.IP})
+	}
+	for _, c := range z.visible() {
+		records = append(records, c.record(z.Origin))
+	}
+
+	if reverse, err := ReverseOrigin(z.Prefix); err == nil && z.Prefix.IP != nil {
+		records = append(records, authority(reverse)...)
+		for _, p := range z.pointers(hosts) {
+			records = append(records, Record{Name: p.Name, Type: TypePTR, TTL: ttl, Target: p.Target})
+		}
+	}
+	return records
+}
+
+// Lookup answers for name from the zone's records. ok is false for names
+// outside the zone, otherwise no answers with the zone's SOA as authority
+// is NODATA, & NXDOMAIN when exists is also false. An alias is answered
+// for any type, along with its target's records when they're in the zone
+func (z *Zone) Lookup(name string, typ uint16) (answers []Record, authority []Record, exists, ok bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	records := z.Records()
+	var soa *Record
+	for _, r := range records {
+		r := r
+		if r.Type == TypeSOA && (name == r.Name || strings.HasSuffix(name, "."+r.Name)) {
+			soa, ok = &r, true
+		}
+		if r.Name != name {
+			continue
+		}
+		exists = true
+		if typ == r.Type || typ == TypeANY || r.Type == TypeCNAME {
+			answers = append(answers, r)
+		}
+	}
+	if len(answers) == 1 && answers[0].Type == TypeCNAME && typ != TypeCNAME && typ != TypeANY {
+		for _, r := range records {
+			if r.Name == answers[0].Target && r.Type == typ {
+				answers = append(answers, r)
+			}
+		}
+	}
+	if ok && len(answers) == 0 {
+		authority = []Record{*soa}
+	}
+	return
+}
+
+// ClientStats counts a client's queries, by type & how they were answered
+type ClientStats struct {
+	Client   string            `json:"client"`
+	Queries  uint64            `json:"queries"`
+	Types    map[string]uint64 `json:"types"`
+	Outcomes map[string]uint64 `json:"outcomes"`
+	Last     time.Time         `json:"last"`
+}
+
+// Server answers for a zone itself & forwards the rest upstream
+type Server struct {
+	Zone    *Zone
+	Timeout time.Duration
+	// Allow decides who may ask, Local when nil
+	Allow func(ip net.IP) bool
+	// ForwardersFile keeps the forwarders set through SetForwarders
+	ForwardersFile string
+
+	lock      sync.Mutex
+	upstreams []string // host:port
+	clients   map[string]*ClientStats
+}
+
+// NewServer answers for z, forwarding everything else to upstreams
+func NewServer(z *Zone, upstreams []string) *Server {
+	return &Server{Zone: z, Timeout: DefaultTimeout, upstreams: upstreams, clients: make(map[string]*ClientStats)}
+}
+
+func (s *Server) Forwarders() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.upstreams...)
+}
+
+func (s *Server) SetForwarders(ctx context.Context, list []string) error {
+	list, err := ParseForwarders(list)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err = save(s.ForwardersFile, list); err != nil {
+		return err
+	}
+	s.upstreams = list
+	logger.InfoContext(ctx, "forwarders changed", "forwarders", list)
+	return nil
+}
+
+// Stats is each client's queries, the busiest first
+func (s *Server) Stats() ([]ClientStats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]ClientStats, 0, len(s.clients))
+	for _, c := range s.clients {
+		stats := *c
+		stats.Types, stats.Outcomes = make(map[string]uint64), make(map[string]uint64)
+		for k, v := range c.Types {
+			stats.Types[k] = v
+		}
+		for k, v := range c.Outcomes {
+			stats.Outcomes[k] = v
+		}
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Queries != list[j].Queries {
+			return list[i].Queries > list[j].Queries
+		}
+		return list[i].Client < list[j].Client
+	})
+	return list, nil
+}
+
+// count records a query of client's, logging it at debug level
+func (s *Server) count(ctx context.Context, client net.IP, name, typ, outcome string) {
+	Queries.Inc(typ, outcome)
+	logger.DebugContext(ctx, "dns query", "client", client.String(), "name", name, "type", typ, "outcome", outcome)
+
+	key := client.String()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.clients == nil {
+		s.clients = make(map[string]*ClientStats)
+	}
+	c, ok := s.clients[key]
+	if !ok {
+		if len(s.clients) >= MaxClients {
+			var quietest *ClientStats
+			for _, other := range s.clients {
+				if quietest == nil || other.Last.Before(quietest.Last) {
+					quietest = other
+				}
+			}
+			delete(s.clients, quietest.Client)
+		}
+		c = &ClientStats{Client: key, Types: make(map[string]uint64), Outcomes: make(map[string]uint64)}
+		s.clients[key] = c
+	}
+	c.Queries++
+	if typ != "" {
+		c.Types[typ]++
+	}
+	c.Outcomes[outcome]++
+	c.Last = time.Now()
+}
+
+// Upstreams lists the resolvers of /etc/resolv.conf, without loopback ones
+// which are likely this server
+func Upstreams(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		host, _, _ := strings.Cut(fields[1], "%")
+		if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+			list = append(list, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return list, scanner.Err()
+}
+
+// Local accepts loopback & the networks of this host's interfaces, as
+// named's localhost & localnets
+func Local(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer responds to client's query, in no more than max bytes unless
+// forwarded, or returns nil when it's not worth a response
+func (s *Server) Answer(ctx context.Context, client net.IP, query []byte, tcp bool, max int) []byte {
+	h, err := parseHeader(query)
+	if err != nil || h.Flags&flagQR != 0 {
+		return nil
+	}
+	if h.opcode() != 0 {
+		s.count(ctx, client, "", "", "notimp")
+		return failure(h, RcodeNotImplemented)
+	}
+	q, err := parseQuestion(query)
+	if err != nil || h.Questions != 1 {
+		s.count(ctx, client, "", "", "formerr")
+		return failure(h, RcodeFormatError)
+	}
+	typ, ok := TypeName[q.Type]
+	if !ok {
+		typ = "other"
+	}
+
+	if s.Zone != nil {
+		if answers, authority, exists, ok := s.Zone.Lookup(q.Name, q.Type); ok {
+			rcode, outcome := RcodeSuccess, "authoritative"
+			switch {
+			case q.Class != ClassIN && q.Class != ClassANY:
+				answers, authority, rcode, outcome = nil, nil, RcodeRefused, "refused"
+			case !exists:
+				rcode, outcome = RcodeNameError, "nxdomain"
+			}
+			s.count(ctx, client, q.Name, typ, outcome)
+			return reply(h, q, flagAA|s.recursion(), rcode, answers, authority, max)
+		}
+	}
+
+	upstreams := s.Forwarders()
+	if h.Flags&flagRD == 0 || len(upstreams) == 0 {
+		s.count(ctx, client, q.Name, typ, "refused")
+		return reply(h, q, s.recursion(), RcodeRefused, nil, nil, max)
+	}
+	res, err := s.forward(ctx, upstreams, query, tcp)
+	if err != nil {
+		logger.DebugContext(ctx, "failed forwarding query", "name", q.Name, "type", typ, "err", err)
+		s.count(ctx, client, q.Name, typ, "servfail")
+		return reply(h, q, s.recursion(), RcodeServerFailure, nil, nil, max)
+	}
+	s.count(ctx, client, q.Name, typ, "forwarded")
+	return res
+}
+
+func (s *Server) recursion() uint16 {
+	if len(s.Forwarders()) > 0 {
+		return flagRA
+	}
+	return 0
+}
+
+// forward asks each upstream in turn, returning the first answer as is
+func (s *Server) forward(ctx context.Context, upstreams []string, query []byte, tcp bool) (res []byte, err error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	id := binary.BigEndian.Uint16(query)
+
+	for _, upstream := range upstreams {
+		if res, err = exchange(ctx, upstream, query, tcp, timeout); err == nil && len(res) >= 2 && binary.BigEndian.Uint16(res) == id {
+			return res, nil
+		} else if err == nil {
+			err = errors.New("mismatched answer from " + upstream)
+		}
+	}
+	return nil, err
+}
+
+func exchange(ctx context.Context, upstream string, query []byte, tcp bool, timeout time.Duration) ([]byte, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if tcp {
+		return exchangeTCP(conn, query)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	return buf[:n], err
+}
+
+func exchangeTCP(conn net.Conn, query []byte) ([]byte, error) {
+	if _, err := conn.Write(append(appendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+	return readTCP(bufio.NewReader(conn))
+}
+
+// readTCP reads a length prefixed message
+func readTCP(r *bufio.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// allowed decides whether addr may ask, returning its IP either way
+func (s *Server) allowed(addr net.Addr) (net.IP, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if s.Allow != nil {
+		return ip, s.Allow(ip)
+	}
+	return ip, Local(ip)
+}
+
+// ListenAndServe answers over UDP & TCP on addr until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		l.Close()
+	}()
+
+	logger.InfoContext(ctx, "serving dns", "addr", addr, "upstreams", s.Forwarders())
+	errs := make(chan error, 2)
+	go func() { errs <- s.serveUDP(ctx, pc) }()
+	go func() { errs <- s.serveTCP(ctx, l) }()
+	err = <-errs
+	pc.Close()
+	l.Close()
+	<-errs
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) serveUDP(ctx context.Context, pc net.PacketConn) error {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		client, ok := s.allowed(addr)
+		if !ok {
+			s.count(ctx, client, "", "", "denied")
+			continue
+		}
+		go func() {
+			if res := s.Answer(ctx, client, buf[:n], false, udpSize); res != nil {
+				pc.WriteTo(res, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		client, ok := s.allowed(conn.RemoteAddr())
+		if !ok {
+			s.count(ctx, client, "", "", "denied")
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				conn.SetDeadline(time.Now().Add(tcpIdle))
+				query, err := readTCP(r)
+				if err != nil {
+					return
+				}
+				res := s.Answer(ctx, client, query, true, 65535)
+				if res == nil {
+					return
+				}
+				if _, err = conn.Write(append(appendUint16(nil, uint16(len(res))), res...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
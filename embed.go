@@ -0,0 +1,15 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed public
+var public embed.FS
+
+func init() {
+	Embedded, _ = fs.Sub(public, "public")
+}
@@ -1,6 +1,6 @@
 module avaron
 
-go 1.17
+go 1.21
 
 require (
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
@@ -0,0 +1,243 @@
+package health
+
+import (
+	"avaron/diag"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func wait(t *testing.T, s *Scheduler, n int64) string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if status := s.List()[n]; status != "pending" {
+			return status
+		}
+	}
+	t.Fatalf("run %d didn't finish", n)
+	return ""
+}
+
+func TestConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	s := New("")
+	s.Check = func(ctx context.Context, rec *Recorder) error {
+		rec.Probes([]ProbeResult{{Name: "fine", Status: Pass}})
+		io.WriteString(rec, "checking\n")
+		<-release
+		io.WriteString(rec, "HEALTHY\n")
+		return nil
+	}
+
+	ctx, now := context.Background(), time.Now()
+	if !s.start(ctx, now) {
+		t.Fatal("first check didn't start")
+	}
+	if s.start(ctx, now.Add(time.Second)) {
+		t.Error("started a second check beyond the concurrency limit")
+	}
+
+	// a pending transcript streams until the run finishes
+	r, err := s.Transcript(now.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	buf, _ := io.ReadAll(r)
+	if string(buf) != "checking\nHEALTHY\n" {
+		t.Errorf("unexpected transcript %q", buf)
+	}
+	if status := wait(t, s, now.Unix()); status != "healthy" {
+		t.Errorf("status %s, want healthy", status)
+	}
+
+	if _, err := s.Transcript(42); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+	if _, err := s.Report(42); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s := New("")
+	s.Timeout = 10 * time.Millisecond
+	s.Check = func(ctx context.Context, rec *Recorder) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	now := time.Now()
+	s.start(context.Background(), now)
+	if status := wait(t, s, now.Unix()); status != "error" {
+		t.Errorf("status %s, want error", status)
+	}
+	if report, err := s.Report(now.Unix()); err != nil || report.Error == "" || report.Finished == nil {
+		t.Errorf("unexpected report %+v: %v", report, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir)
+	s.Keep = 2
+	s.Check = func(ctx context.Context, rec *Recorder) error {
+		rec.Input("uptime", "up 1 day")
+		_, err := io.WriteString(rec, "fine")
+		return err
+	}
+
+	now := time.Now()
+	for i := int64(0); i < 3; i++ {
+		s.start(context.Background(), now.Add(time.Duration(i)*time.Second))
+		wait(t, s, now.Unix()+i)
+	}
+	if runs := s.List(); len(runs) != 2 || runs[now.Unix()] != "" {
+		t.Errorf("oldest run wasn't pruned: %v", runs)
+	}
+
+	loaded := New(dir)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if runs := loaded.List(); len(runs) != 2 || runs[now.Unix()+2] != "healthy" {
+		t.Fatalf("unexpected runs after a restart: %v", runs)
+	}
+	report, err := loaded.Report(now.Unix() + 2)
+	if err != nil || report.Status != "healthy" || len(report.Inputs) != 1 {
+		t.Errorf("unexpected report %+v: %v", report, err)
+	}
+	r, err := loaded.Transcript(now.Unix() + 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if buf, _ := io.ReadAll(r); string(buf) != "fine" {
+		t.Errorf("unexpected transcript %q", buf)
+	}
+
+	loaded.MaxAge = time.Nanosecond
+	loaded.lock.Lock()
+	loaded.prune(now.Add(time.Hour))
+	loaded.lock.Unlock()
+	if runs := loaded.List(); len(runs) != 0 {
+		t.Errorf("old runs weren't pruned: %v", runs)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	release := make(chan struct{})
+	s := New("")
+	s.Check = func(ctx context.Context, rec *Recorder) error {
+		rec.Probes([]ProbeResult{{Name: "dns", Status: Warn}})
+		rec.Turn()
+		rec.Token("UNHEALTHY ")
+		<-release
+		rec.Token("no route")
+		rec.EndTurn()
+		rec.Note("refused `reboot`")
+		return nil
+	}
+
+	now := time.Now()
+	s.start(context.Background(), now)
+
+	var types []string
+	err := s.Follow(context.Background(), now.Unix(), func(e Event) error {
+		types = append(types, e.Type)
+		if e.Type == "token" && e.Token == "UNHEALTHY " {
+			close(release)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(types, " "); got != "probes turn token token turn done" {
+		t.Errorf("unexpected events %s", got)
+	}
+
+	wait(t, s, now.Unix())
+	report, err := s.Report(now.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != "degraded" || len(report.Turns) != 2 || report.Turns[0].Verdict != "unhealthy" || report.Turns[0].Content != "UNHEALTHY no route" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// a finished run follows as its report
+	types = nil
+	s.Follow(context.Background(), now.Unix(), func(e Event) error {
+		types = append(types, e.Type)
+		return nil
+	})
+	if len(types) != 1 || types[0] != "done" {
+		t.Errorf("unexpected events %v", types)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	probes := []Probe{
+		{"ok", func(ctx context.Context) (string, string) { return Pass, "fine" }},
+		{"slow", func(ctx context.Context) (string, string) {
+			<-ctx.Done()
+			return Fail, ctx.Err().Error()
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results := RunProbes(ctx, probes)
+	if len(results) != 2 || results[0].Name != "ok" || results[1].Status != Fail {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if d := Describe(results[:1]); d != "ok: PASS - fine\n" {
+		t.Errorf("unexpected description %q", d)
+	}
+
+	for _, c := range []struct {
+		statuses []string
+		model    bool
+		want     string
+	}{
+		{[]string{Pass, Pass}, true, "healthy"},
+		{[]string{Pass, Pass}, false, "degraded"},
+		{[]string{Pass, Warn}, true, "degraded"},
+		{[]string{Warn, Fail}, true, "unhealthy"},
+		{nil, true, "healthy"},
+	} {
+		var results []ProbeResult
+		for _, status := range c.statuses {
+			results = append(results, ProbeResult{Status: status})
+		}
+		if got := Combine(results, c.model); got != c.want {
+			t.Errorf("Combine(%v, %v) = %s, want %s", c.statuses, c.model, got, c.want)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	defer func(d *diag.Runner) { Diagnostics = d }(Diagnostics)
+	Diagnostics = diag.New(diag.DefaultAllowlist)
+	Diagnostics.Mode = diag.ModeDryRun
+	ping := Ping("health").Run
+
+	for _, host := range []string{"-f", "a b", "$(reboot)", ""} {
+		if _, err := ping(context.Background(), json.RawMessage(`{"host":"`+host+`"}`)); err == nil {
+			t.Errorf("pinged %q", host)
+		}
+	}
+
+	// pings are proposed like any other command, so they're recorded
+	if _, err := ping(context.Background(), json.RawMessage(`{"host":"fc00:a7a0::1","count":9}`)); err == nil {
+		t.Errorf("pinged during a dry run")
+	}
+	history := Diagnostics.History()
+	if len(history) != 1 || strings.Join(history[0].Argv, " ") != "ping -c 5 fc00:a7a0::1" || !history[0].DryRun || history[0].Source != "health" {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
@@ -1,27 +1,40 @@
 package health
 
 import (
+	"avaron/agent"
+	"avaron/diag"
 	"avaron/llama"
+	"avaron/logging"
+	"avaron/metrics"
 	"avaron/mickey"
 	network "avaron/net"
-	"bufio"
 	"bytes"
 	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
-	"os/exec"
+	"net"
+	"os"
+	filepath "path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+var logger = logging.For("health")
+
+// Diagnostics vets & runs the commands the model suggests
+var Diagnostics = diag.New(diag.DefaultAllowlist)
+
 const HEALTH_PROMPT = `
-You are a Linux Network Engineer. Your job is to diagnose network configurations.
-If the information you're given is indicative of a HEALTHY network configuration, say HEALTHY.
-If it's UNHEALTHY, say UNHEALTHY, followed by the command you'd like to run for further diagnostics.
+You are a Linux Network Engineer. Your job is to diagnose this machine's network configuration.
+You're given ` + "`ip -br addr show`" + ` & the results of some probes. Investigate anything that looks wrong with the tools you're given, as often as you need.
+When you're done, answer HEALTHY or UNHEALTHY on the first line, followed by a short explanation.
 
 
 Here is an example:
@@ -31,105 +44,107 @@ Here is an example:
 	Everything looks good
 
 
-Here is another example:
-
-	UNHEALTHY
-
-	`+"```"+`
-	$ ip -br link show
-	`+"```"+`
-
-	Let's run "ip -br link show" to see more about the links
-
-
 And another:
 
 	HEALTHY
 
-	docker0 is down
+	docker0 is down, but nothing's routed through it
 
 
 And another:
 
 	UNHEALTHY
 
-	`+"```"+`
-	$ ping 8.8.8.8
-	`+"```"+`
-
-	there's not enough information here. let's try running `+"`"+`ping 8.8.8.8`+"`"+` to confirm that we're able to access the internet.
-
+	There's no default route, so nothing beyond the LAN is reachable
 `
 
-type Remark struct {
-	User bool
-	Content []byte
-}
+// Agent diagnoses the network, main registers the tools that live outside this package
+var Agent = agent.New()
+
+// Command lets the model run anything the diagnostics policy allows, proposed as source
+func Command(source string) agent.Tool {
+	return agent.Tool{
+		Name:        "run_command",
+		Description: "Run a diagnostic command, which may need an operator's approval. Only allowlisted commands run, never through a shell",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"argv":{"type":"array","items":{"type":"string"},"description":"the command & its arguments"}},"required":["argv"]}`),
+		Run: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			var a struct {
+				Argv []string `json:"argv"`
+			}
+			if err := json.Unmarshal(args, &a); err != nil {
+				return nil, err
+			}
 
-func Healthy(remarks []Remark) bool {
-	if len(remarks) <= 1 {
-		return true
-	}
-	for _, r := range remarks[1:] {
-		if bytes.Contains(r.Content, []byte("UNHEALTHY")) {
-			return false
-		}
+			result, err := Diagnostics.Propose(ctx, source, a.Argv)
+			if err == nil && result.DryRun {
+				err = errors.New("dry run, commands aren't executed")
+			}
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
+		},
 	}
-	return true
 }
 
-func Split(p []byte) (r []Remark) {
-	var i, j, k int
-	for i = 0; i < len(p); {
-		j = bytes.Index(p[i:], []byte("[INST]"))
-		switch j {
-		case -1:
-			r = append(r, Remark{
-				false,
-				p[i:],
-			})
-			return
-		case 0:
-			j += i + len("[INST]")
-
-			k = bytes.Index(p[j:], []byte("[/INST]"))
-			if k <= 0 {
-				return
+// hostname is loose, it's only here to keep ping's flags out of reach
+var hostname = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,252}$`)
+
+// Ping checks a host's reachability, proposed as source like run_command's
+// commands so it's held to the same policy, approval & history
+func Ping(source string) agent.Tool {
+	return agent.Tool{
+		Name:        "ping",
+		Description: "Ping a host by address or name",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"host":{"type":"string","description":"IPv4 or IPv6 address, or hostname"},` +
+			`"count":{"type":"integer","minimum":1,"maximum":5,"description":"echo requests to send, 3 by default"}` +
+			`},"required":["host"]}`),
+		Run: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			var a struct {
+				Host  string `json:"host"`
+				Count int    `json:"count"`
 			}
-
-			k += j
-			r = append(r, Remark{
-				true,
-				p[j:k],
-			})
-			i += k
-		default:
-			j += i
-
-			r = append(r, Remark{
-				false,
-				p[i:j],
-			})
-
-			j += len("[INST]")
-
-			k = bytes.Index(p[j:], []byte("[/INST]"))
-			if k <= 0 {
-				return
+			if err := json.Unmarshal(args, &a); err != nil {
+				return nil, err
+			}
+			if net.ParseIP(a.Host) == nil && !hostname.MatchString(a.Host) {
+				return nil, fmt.Errorf("%q isn't an address or hostname", a.Host)
+			}
+			switch {
+			case a.Count <= 0:
+				a.Count = 3
+			case a.Count > 5:
+				a.Count = 5
 			}
 
-			k += j
-			r = append(r, Remark{
-				true,
-				p[j:k],
-			})
-			i += k
-		}
+			result, err := Diagnostics.Propose(ctx, source, []string{"ping", "-c", strconv.Itoa(a.Count), a.Host})
+			if err == nil && result.DryRun {
+				err = errors.New("dry run, commands aren't executed")
+			}
+			if err != nil {
+				return nil, err
+			}
+			// an unreachable host is an answer, not a failure
+			return map[string]interface{}{
+				"reachable": result.ExitCode == 0,
+				"output":    strings.TrimSpace(result.Stdout + result.Stderr),
+			}, nil
+		},
 	}
-	return
 }
 
-func Tick(ctx context.Context, writer io.Writer) (err error) {
+func init() {
+	Agent.Register(Command("health"))
+	Agent.Register(Ping("health"))
+}
+
+// Tick runs the probes, then has the model diagnose the network with their
+// results as context, recording each step & the dialogue's transcript
+func Tick(ctx context.Context, writer *Recorder) (err error) {
+	results := RunProbes(ctx, Probes)
+	writer.Probes(results)
+
 	r, w := io.Pipe()
 	go func() {
 		err = network.ListBrief(ctx, w)
@@ -139,178 +154,364 @@ func Tick(ctx context.Context, writer io.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	writer.Input("ip -br addr show", string(buf))
+
+	messages := []llama.Message{
+		{Role: "system", Content: HEALTH_PROMPT},
+		{Role: "user", Content: fmt.Sprintf("`$ ip -br addr show`:\n```\n%s\n```\n\nProbe results:\n```\n%s```\n", string(buf), Describe(results))},
+	}
+	for _, m := range messages {
+		if err = transcribe(writer, m.Role, m.Content); err != nil {
+			return
+		}
+	}
 
-	prompt := fmt.Sprintf("%s\n[INST]`$ ip -br addr show`: \n```\n%s\n```\n[/INST]\n", HEALTH_PROMPT, string(buf))
-	_, err = fmt.Fprintf(writer, "%s", prompt)
+	// anyone asking the model something themselves goes first
+	_, err = Agent.Run(llama.WithPriority(ctx, llama.Background), messages, agent.Observer{
+		Reply: func() {
+			writer.Turn()
+			io.WriteString(writer, "### assistant\n\n")
+		},
+		Token: func(token string) {
+			writer.Token(token)
+			io.WriteString(writer, token)
+		},
+		Replied: func(reply llama.Message) {
+			writer.EndTurn()
+			for _, call := range reply.ToolCalls {
+				fmt.Fprintf(writer, "\n%s(%s)", call.Function.Name, call.Function.Arguments)
+			}
+			io.WriteString(writer, "\n\n")
+		},
+		Step: func(step agent.Step) {
+			writer.Step(step)
+			transcribe(writer, "tool", fmt.Sprintf("%s:\n```\n%s\n```", step.Call.Function.Name, step.Result))
+		},
+	})
 	if err != nil {
-		return
+		logger.ErrorContext(ctx, "health check agent failed", "err", err)
 	}
+	return
+}
 
-	for {
-		buf, err = json.Marshal(llama.Request{
-			Prompt: prompt,
-			Model:  "mixtral.gguf",
-			Stream: true,
-		})
+// transcribe writes a message to the transcript under its role
+func transcribe(w io.Writer, role, content string) error {
+	_, err := fmt.Fprintf(w, "### %s\n\n%s\n\n", role, strings.TrimSpace(content))
+	return err
+}
 
-		if err != nil {
-			log.Println("failed marshalling:", err)
-			continue
-		}
+const (
+	DefaultInterval    = time.Minute
+	DefaultConcurrency = 1
+	DefaultTimeout     = 5 * time.Minute
+	DefaultKeep        = 100
+	DefaultMaxAge      = 7 * 24 * time.Hour
+)
 
-		var (
-			req *http.Request
-			res *http.Response
-		)
+var (
+	ErrNotFound = errors.New("no such health check run")
 
-		req, err = http.NewRequestWithContext(ctx, "POST", "http://localhost/completions", bytes.NewReader(buf))
-		if err != nil {
-			log.Println("error forming llama request:", err)
-			break
-		}
+	Checks = metrics.NewCounter("avaron_health_checks_total", "Completed health checks, by verdict", "verdict")
+)
 
-		res, err = llama.Client.Do(req)
-		if err != nil {
-			log.Println("error forwarding request to llama:", err)
-			break
-		} else if res.StatusCode < 200 || res.StatusCode >= 300 {
-			log.Println("error forwarding request to llama:", err)
-			break
-		}
+type run struct {
+	status     string    // pending, healthy, degraded, unhealthy or error
+	recorder   *Recorder // while pending
+	transcript *mickey.Muxer
 
-		r, w = io.Pipe()
-		var token llama.Token
-		scanner := bufio.NewScanner(res.Body)
-
-		go func() {
-			defer w.Close()
-			for scanner.Scan() {
-				line := scanner.Text()
-				switch {
-				case len(line) == 0:
-					continue
-				case strings.HasPrefix(line, "data: "):
-					line = strings.TrimPrefix(line, "data: ")
-					break
-				default:
-					log.Panicln("unexpected line from llama-server stream:", line)
-				}
-				if err = json.Unmarshal([]byte(line), &token); err != nil {
-					log.Panicln("error marshalling llama json:", err, line)
-				}
-				_, err = w.Write([]byte(token.Content))
-				if err != nil {
-					log.Println("error writing llama token to response body:", err, line)
-				}
+	// when finished & not persisted
+	report *Report
+	text   []byte
+}
 
-			}
-		}()
+// Scheduler runs checks every Interval, skipping ticks while Concurrency
+// checks are still running, & keeps the latest Keep runs younger than MaxAge
+type Scheduler struct {
+	Dir         string // where reports are persisted, in memory only when empty
+	Interval    time.Duration
+	Concurrency int
+	Timeout     time.Duration // after which a check is cancelled
+	Keep        int
+	MaxAge      time.Duration
+
+	// the check itself, Tick unless testing
+	Check func(ctx context.Context, rec *Recorder) error
+
+	lock   sync.Mutex
+	runs   map[int64]*run
+	active int
+}
 
-		buf, _ = io.ReadAll(io.TeeReader(r, writer))
-		prompt += string(buf)
+// Primary constructor for this package
+func New(dir string) *Scheduler {
+	return &Scheduler{
+		Dir:         dir,
+		Interval:    DefaultInterval,
+		Concurrency: DefaultConcurrency,
+		Timeout:     DefaultTimeout,
+		Keep:        DefaultKeep,
+		MaxAge:      DefaultMaxAge,
+		Check:       Tick,
+		runs:        make(map[int64]*run),
+	}
+}
 
-		var i int
-		if i = strings.Index(string(buf), "\n$ "); i == -1 || strings.Index(string(buf), "UNHEALTHY") == -1 {
-			break
-		}
+// path of a run's file, ext being json for the report or txt for the transcript
+func (s *Scheduler) path(t int64, ext string) string {
+	return filepath.Join(s.Dir, strconv.FormatInt(t, 10)+"."+ext)
+}
+
+func (s *Scheduler) index() string {
+	return filepath.Join(s.Dir, "index.json")
+}
+
+// Load restores runs persisted before a restart
+func (s *Scheduler) Load() error {
+	if s.Dir == "" {
+		return nil
+	}
 
-		shell := string(buf)[i+3:]
-		if i = strings.Index(shell, "\n"); i != -1 {
-			shell = shell[:i]
+	buf, err := os.ReadFile(s.index())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var index map[int64]string
+	if err = json.Unmarshal(buf, &index); err != nil {
+		return fmt.Errorf("reading %s: %+v", s.index(), err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for t, status := range index {
+		if _, err := os.Stat(s.path(t, "json")); err != nil {
+			logger.Warn("dropping run without report", "time", t, "err", err)
+			continue
 		}
+		s.runs[t] = &run{status: status}
+	}
+	s.prune(time.Now())
+	return nil
+}
 
-		shell = strings.TrimSpace(shell)
-		if shell == "" {
-			break
+// save writes the index of finished runs, the lock must be held
+func (s *Scheduler) save() error {
+	index := make(map[int64]string, len(s.runs))
+	for t, r := range s.runs {
+		if r.status != "pending" {
+			index[t] = r.status
 		}
-		log.Println("running suggested command:", shell)
+	}
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
 
-		var out []byte
-		out, err = exec.CommandContext(ctx, "/bin/sh", "-c", shell).CombinedOutput()
-		if err != nil {
-			log.Printf("failed to run ai suggestion: %+v\n", err)
-			break
+	tmp := s.index() + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.index())
+}
+
+// persist writes a finished run's report & transcript
+func (s *Scheduler) persist(report *Report, text []byte) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(s.path(report.Time, "txt"), text, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(report.Time, "json"), buf, 0600)
+}
+
+// prune drops finished runs beyond Keep or older than MaxAge, the lock must be held
+func (s *Scheduler) prune(now time.Time) {
+	times := make([]int64, 0, len(s.runs))
+	for t, r := range s.runs {
+		if r.status != "pending" {
+			times = append(times, t)
 		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
 
-		_, err = fmt.Fprintf(writer, "[INST]'%s':\n\n```\n%s\n```\n[/INST]", shell, string(out))
-		if err != nil {
-			return
+	for i, t := range times {
+		if (s.Keep > 0 && i >= s.Keep) || (s.MaxAge > 0 && now.Sub(time.Unix(t, 0)) > s.MaxAge) {
+			delete(s.runs, t)
+			if s.Dir == "" {
+				continue
+			}
+			for _, ext := range []string{"json", "txt"} {
+				if err := os.Remove(s.path(t, ext)); err != nil && !os.IsNotExist(err) {
+					logger.Warn("failed removing health check run", "time", t, "err", err)
+				}
+			}
 		}
+	}
+}
+
+// List maps the start time of every retained run to its status
+func (s *Scheduler) List() map[int64]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		prompt += fmt.Sprintf("[INST]%s[/INST]", out)
+	m := make(map[int64]string, len(s.runs))
+	for t, r := range s.runs {
+		m[t] = r.status
 	}
-	return
+	return m
 }
 
-type Request struct {
-	Time int64
-	io.WriteCloser
+func (s *Scheduler) get(t int64) (run, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.runs[t]
+	if !ok {
+		return run{}, false
+	}
+	return *r, true
 }
 
-var (
-	Get  = make(chan Request)
-	List = make(chan map[int64]string)
-)
+// Report returns the report of a run, so far if it's pending
+func (s *Scheduler) Report(t int64) (Report, error) {
+	r, ok := s.get(t)
+	switch {
+	case !ok:
+		return Report{}, ErrNotFound
+	case r.recorder != nil:
+		return r.recorder.Report(), nil
+	case r.report != nil:
+		return *r.report, nil
+	}
 
-func Loop(ctx context.Context) {
-	ticker := time.NewTicker(time.Second)
-	dialogues := make(map[time.Time]*mickey.Muxer)
-	listings := make(map[int64]string)
+	var report Report
+	buf, err := os.ReadFile(s.path(t, "json"))
+	if os.IsNotExist(err) {
+		return report, ErrNotFound
+	} else if err == nil {
+		err = json.Unmarshal(buf, &report)
+	}
+	return report, err
+}
 
-	var (
-		t  time.Time
-		ch = make(chan *mickey.Muxer)
-	)
+// Follow calls fn with each event of a pending run until it finishes, or
+// once with the report of a finished one
+func (s *Scheduler) Follow(ctx context.Context, t int64, fn func(Event) error) error {
+	if r, ok := s.get(t); ok && r.recorder != nil {
+		return r.recorder.Follow(ctx, fn)
+	}
+	report, err := s.Report(t)
+	if err != nil {
+		return err
+	}
+	return fn(Event{Type: "done", Report: &report})
+}
+
+// Transcript returns the text of a run's dialogue, which streams until the run finishes if pending
+func (s *Scheduler) Transcript(t int64) (io.ReadCloser, error) {
+	r, ok := s.get(t)
+	switch {
+	case !ok:
+		return nil, ErrNotFound
+	case r.transcript != nil:
+		return io.NopCloser(r.transcript.NewReader()), nil
+	case r.text != nil:
+		return io.NopCloser(bytes.NewReader(r.text)), nil
+	}
+
+	f, err := os.Open(s.path(t, "txt"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// start begins a run unless Concurrency are already running
+func (s *Scheduler) start(ctx context.Context, now time.Time) bool {
+	t := now.Unix()
+
+	s.lock.Lock()
+	if _, ok := s.runs[t]; ok || (s.Concurrency > 0 && s.active >= s.Concurrency) {
+		s.lock.Unlock()
+		return false
+	}
+	r, w := io.Pipe()
+	current := &run{status: "pending", transcript: mickey.New(r)}
+	current.recorder = NewRecorder(time.Unix(t, 0), w)
+	s.runs[t] = current
+	s.active++
+	s.lock.Unlock()
 
 	go func() {
-		for _ = range ticker.C {
-			log.Println("HealthChecker tick")
-			r, w := io.Pipe()
-			muxer := mickey.New(r)
-			select {
-			case ch <- muxer:
-			case <-ctx.Done():
+		// drains the pipe whether or not anyone's watching
+		go io.Copy(io.Discard, current.transcript.NewReader())
+
+		ctx := ctx
+		if s.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+			defer cancel()
+		}
+
+		err := s.Check(ctx, current.recorder)
+		w.Close()
+		text, _ := io.ReadAll(current.transcript.NewReader())
+
+		report := current.recorder.Report()
+		status := Combine(report.Probes, report.Model())
+		if err != nil {
+			logger.ErrorContext(ctx, "health check failed", "time", t, "err", err)
+			// the probes still stand without the model
+			if len(report.Probes) == 0 {
+				status = "error"
 			}
-			go io.Copy(io.Discard, muxer.NewReader())
-			err := Tick(ctx, w)
-			if err != nil {
-				log.Println("HealthCheck error:", err)
+		}
+		Checks.Inc(status)
+		report = current.recorder.Finish(status, err)
+
+		var persisted bool
+		if s.Dir != "" {
+			if err := s.persist(&report, text); err != nil {
+				logger.Warn("failed persisting health check", "time", t, "err", err)
+			} else {
+				persisted = true
 			}
-			w.Close()
 		}
-	}()
 
-	for {
-		select {
-		case List<-listings:
-		case req := <-Get:
-			m, ok := dialogues[time.Unix(req.Time, 0)]
-			if !ok {
-				log.Fatalln("expected to find time", req.Time)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		current.status, current.recorder, current.transcript = status, nil, nil
+		if !persisted {
+			current.report, current.text = &report, text
+		}
+		s.active--
+		s.prune(time.Now())
+		if persisted {
+			if err := s.save(); err != nil {
+				logger.Warn("failed saving health check index", "err", err)
 			}
+		}
+	}()
+	return true
+}
 
-			go func(m *mickey.Muxer) {
-				n, err := io.Copy(req.WriteCloser, m.NewReader())
-				if err != nil {
-					log.Println("error writing response:", err)
-				}
-				log.Println("copied", n)
-				req.WriteCloser.Close()
-			}(m)
-		case m := <-ch:
-			t = time.Now().Round(time.Second)
-			dialogues[t] = m
-			listings = make(map[int64]string)
-			for t, m := range dialogues {
-				if !m.EOF() {
-					listings[t.Unix()] = "pending"
-				} else if buf, _ := io.ReadAll(m.NewReader()); Healthy(Split(buf)) {
-					listings[t.Unix()] = "healthy"
-				} else {
-					listings[t.Unix()] = "unhealthy"
-				}
-
+// Loop starts a check every Interval until ctx is done, which also cancels running checks
+func (s *Scheduler) Loop(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case now := <-ticker.C:
+			if !s.start(ctx, now) {
+				logger.Debug("skipping health check, previous checks still running")
+				Checks.Inc("skipped")
 			}
 		case <-ctx.Done():
 			return
@@ -0,0 +1,270 @@
+package health
+
+import (
+	network "avaron/net"
+	wg "avaron/wireguard"
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+)
+
+// outcomes of a probe, from best to worst
+const (
+	Pass = "pass"
+	Warn = "warn"
+	Fail = "fail"
+)
+
+const (
+	ProbeTimeout = 10 * time.Second
+
+	// wireguard re-handshakes every 2 minutes while there's traffic
+	StaleHandshake = 5 * time.Minute
+)
+
+// ProbeResult is the structured outcome of one probe
+type ProbeResult struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Detail   string  `json:"detail"`
+	Duration float64 `json:"duration"` // seconds
+}
+
+type Probe struct {
+	Name string
+	Run  func(ctx context.Context) (status, detail string)
+}
+
+// Probes run before every check, in this order
+var Probes = []Probe{
+	{"default-route", DefaultRoute},
+	{"dns", LocalDNS},
+	{"avaron-link", AvaronLink},
+	{"handshakes", Handshakes},
+	{"overlay-ping", OverlayPing},
+	{"failed-units", FailedUnits},
+}
+
+// RunProbes runs probes concurrently, each bounded by ProbeTimeout
+func RunProbes(ctx context.Context, probes []Probe) []ProbeResult {
+	results := make([]ProbeResult, len(probes))
+
+	var wait sync.WaitGroup
+	for i, p := range probes {
+		wait.Add(1)
+		go func(i int, p Probe) {
+			defer wait.Done()
+			ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+			defer cancel()
+
+			t := time.Now()
+			status, detail := p.Run(ctx)
+			results[i] = ProbeResult{p.Name, status, detail, time.Since(t).Seconds()}
+		}(i, p)
+	}
+	wait.Wait()
+	return results
+}
+
+// Combine reports unhealthy if any probe failed, otherwise degraded if a
+// probe warned or the model judged the network unhealthy
+func Combine(results []ProbeResult, model bool) string {
+	status := "healthy"
+	for _, r := range results {
+		switch r.Status {
+		case Fail:
+			return "unhealthy"
+		case Warn:
+			status = "degraded"
+		}
+	}
+	if !model {
+		status = "degraded"
+	}
+	return status
+}
+
+// Describe renders results for the model's prompt
+func Describe(results []ProbeResult) string {
+	var b strings.Builder
+	for _, r := range results {
+		fmt.Fprintf(&b, "%s: %s - %s\n", r.Name, strings.ToUpper(r.Status), r.Detail)
+	}
+	return b.String()
+}
+
+// DefaultRoute passes when there's an IPv4 or IPv6 default route
+func DefaultRoute(ctx context.Context) (string, string) {
+	var found []string
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	if err := scan("/proc/net/route", func(f []string) {
+		if len(f) >= 8 && f[1] == "00000000" && f[7] == "00000000" {
+			found = append(found, "IPv4 via "+f[0])
+		}
+	}); err != nil {
+		return Fail, err.Error()
+	}
+
+	// Destination PrefixLength Source PrefixLength NextHop Metric RefCnt Use Flags Iface,
+	// unreachable defaults live on lo
+	if err := scan("/proc/net/ipv6_route", func(f []string) {
+		if len(f) >= 10 && f[1] == "00" && strings.Trim(f[0], "0") == "" && f[9] != "lo" {
+			found = append(found, "IPv6 via "+f[9])
+		}
+	}); err != nil && !os.IsNotExist(err) {
+		return Fail, err.Error()
+	}
+
+	if len(found) == 0 {
+		return Fail, "no default route"
+	}
+	return Pass, strings.Join(found, ", ")
+}
+
+func scan(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fn(strings.Fields(scanner.Text()))
+	}
+	return scanner.Err()
+}
+
+// LocalDNS resolves the mesh zone through the local named
+func LocalDNS(ctx context.Context) (string, string) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, "[::1]:53")
+		},
+	}
+
+	addrs, err := resolver.LookupHost(ctx, "avaron.lan")
+	if err != nil {
+		return Fail, fmt.Sprintf("resolving avaron.lan: %v", err)
+	}
+	return Pass, "avaron.lan is " + strings.Join(addrs, ", ")
+}
+
+// AvaronLink passes when the wireguard interface exists & is up
+func AvaronLink(ctx context.Context) (string, string) {
+	links, err := network.List(ctx)
+	if err != nil {
+		return Fail, err.Error()
+	}
+	link, ok := links["avaron"]
+	switch {
+	case !ok:
+		return Fail, "no avaron interface"
+	case link.OperState == "DOWN":
+		return Fail, "avaron is down"
+	case len(link.IPs()) == 0:
+		return Warn, "avaron has no addresses"
+	}
+	// wireguard interfaces have no carrier, so they're UNKNOWN rather than UP
+	return Pass, "avaron is " + link.OperState
+}
+
+// Handshakes warns about peers without a handshake in StaleHandshake, & fails if that's all of them
+func Handshakes(ctx context.Context) (string, string) {
+	peers, err := wg.Dump(ctx)
+	if err != nil {
+		return Fail, err.Error()
+	}
+	if len(peers) == 0 {
+		return Warn, "no peers"
+	}
+
+	var stale []string
+	for _, p := range peers {
+		if p.LatestHandshake.IsZero() {
+			stale = append(stale, p.Key.String()+" (never)")
+		} else if age := time.Since(p.LatestHandshake); age > StaleHandshake {
+			stale = append(stale, fmt.Sprintf("%s (%s ago)", p.Key.String(), age.Round(time.Second)))
+		}
+	}
+
+	switch {
+	case len(stale) == 0:
+		return Pass, fmt.Sprintf("%d peers with recent handshakes", len(peers))
+	case len(stale) == len(peers):
+		return Fail, "every peer is stale: " + strings.Join(stale, ", ")
+	}
+	return Warn, fmt.Sprintf("%d of %d peers stale: %s", len(stale), len(peers), strings.Join(stale, ", "))
+}
+
+// OverlayPing pings every peer's global address over the mesh
+func OverlayPing(ctx context.Context) (string, string) {
+	peers, err := wg.Dump(ctx)
+	if err != nil {
+		return Fail, err.Error()
+	}
+	if len(peers) == 0 {
+		return Warn, "no peers"
+	}
+
+	var (
+		lock        sync.Mutex
+		wait        sync.WaitGroup
+		unreachable []string
+	)
+	for _, p := range peers {
+		wait.Add(1)
+		go func(p wg.PeerStats) {
+			defer wait.Done()
+			addr := p.Key.GlobalAddress().IP.String()
+			if err := exec.CommandContext(ctx, "ping", "-6", "-n", "-q", "-c", "1", "-W", "2", addr).Run(); err != nil {
+				lock.Lock()
+				unreachable = append(unreachable, addr)
+				lock.Unlock()
+			}
+		}(p)
+	}
+	wait.Wait()
+
+	switch {
+	case len(unreachable) == 0:
+		return Pass, fmt.Sprintf("%d peers reachable", len(peers))
+	case len(unreachable) == len(peers):
+		return Fail, "no peer is reachable"
+	}
+	return Warn, fmt.Sprintf("%d of %d peers unreachable: %s", len(unreachable), len(peers), strings.Join(unreachable, ", "))
+}
+
+// FailedUnits fails when systemd has units in the failed state
+func FailedUnits(ctx context.Context) (string, string) {
+	conn, err := systemd.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return Fail, err.Error()
+	}
+	defer conn.Close()
+
+	units, err := conn.ListUnitsFilteredContext(ctx, []string{"failed"})
+	if err != nil {
+		return Fail, err.Error()
+	}
+	if len(units) == 0 {
+		return Pass, "no failed units"
+	}
+
+	names := make([]string, len(units))
+	for i, u := range units {
+		names[i] = u.Name
+	}
+	return Fail, "failed: " + strings.Join(names, ", ")
+}
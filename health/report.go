@@ -0,0 +1,226 @@
+package health
+
+import (
+	"avaron/agent"
+	"avaron/diag"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Input is context the model is given up front, ie. `ip -br addr show`
+type Input struct {
+	Name   string `json:"name"`
+	Output string `json:"output"`
+}
+
+// Turn is one model response, or one tool it called
+type Turn struct {
+	Role      string       `json:"role"` // model, tool, command or note
+	Content   string       `json:"content,omitempty"`
+	Verdict   string       `json:"verdict,omitempty"` // healthy or unhealthy, as the model put it
+	Tool      string       `json:"tool,omitempty"`
+	Arguments string       `json:"arguments,omitempty"` // JSON, as the model called the tool
+	Command   *diag.Result `json:"command,omitempty"`
+	Started   time.Time    `json:"started"`
+	Duration  float64      `json:"duration"` // seconds
+}
+
+// Report is the structured record of one health check run
+type Report struct {
+	Time     int64         `json:"time"` // unix seconds, identifies the run
+	Started  time.Time     `json:"started"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	Duration float64       `json:"duration"` // seconds
+	Status   string        `json:"status"`
+	Inputs   []Input       `json:"inputs"`
+	Probes   []ProbeResult `json:"probes"`
+	Turns    []Turn        `json:"turns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Model reports whether the model's last verdict was anything but unhealthy
+func (r *Report) Model() bool {
+	for i := len(r.Turns) - 1; i >= 0; i-- {
+		if r.Turns[i].Role == "model" && r.Turns[i].Verdict != "" {
+			return r.Turns[i].Verdict != "unhealthy"
+		}
+	}
+	return true
+}
+
+// Event is one change to a report, streamed while the run is in progress
+type Event struct {
+	Type   string        `json:"type"` // input, probes, turn, token, done
+	Input  *Input        `json:"input,omitempty"`
+	Probes []ProbeResult `json:"probes,omitempty"`
+	Turn   *Turn         `json:"turn,omitempty"`  // started, or a finished command or note
+	Token  string        `json:"token,omitempty"` // appended to the model's turn
+	Report *Report       `json:"report,omitempty"`
+}
+
+// Recorder builds a report as a check runs, writes to it go to the text transcript
+type Recorder struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	report Report
+	events []Event
+	done   bool
+
+	transcript io.Writer
+}
+
+func NewRecorder(t time.Time, transcript io.Writer) *Recorder {
+	r := &Recorder{
+		report:     Report{Time: t.Unix(), Started: t, Status: "pending", Inputs: []Input{}, Probes: []ProbeResult{}, Turns: []Turn{}},
+		transcript: transcript,
+	}
+	r.cond = sync.NewCond(&r.lock)
+	return r
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	return r.transcript.Write(p)
+}
+
+func (r *Recorder) emit(e Event) {
+	r.events = append(r.events, e)
+	r.cond.Broadcast()
+}
+
+func (r *Recorder) Input(name, output string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	in := Input{name, output}
+	r.report.Inputs = append(r.report.Inputs, in)
+	r.emit(Event{Type: "input", Input: &in})
+}
+
+func (r *Recorder) Probes(results []ProbeResult) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.report.Probes = append(r.report.Probes, results...)
+	r.emit(Event{Type: "probes", Probes: results})
+}
+
+// Turn starts a model turn, which Token appends to until EndTurn
+func (r *Recorder) Turn() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	turn := Turn{Role: "model", Started: time.Now()}
+	r.report.Turns = append(r.report.Turns, turn)
+	r.emit(Event{Type: "turn", Turn: &turn})
+}
+
+func (r *Recorder) Token(s string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n := len(r.report.Turns); n > 0 && r.report.Turns[n-1].Role == "model" {
+		r.report.Turns[n-1].Content += s
+	}
+	r.emit(Event{Type: "token", Token: s})
+}
+
+// EndTurn times the model's turn & reads its verdict
+func (r *Recorder) EndTurn() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := len(r.report.Turns)
+	if n == 0 || r.report.Turns[n-1].Role != "model" {
+		return
+	}
+	turn := &r.report.Turns[n-1]
+	turn.Duration = time.Since(turn.Started).Seconds()
+
+	// the prompt asks for the verdict first
+	switch content := strings.TrimSpace(turn.Content); {
+	case strings.HasPrefix(content, "UNHEALTHY"):
+		turn.Verdict = "unhealthy"
+	case strings.HasPrefix(content, "HEALTHY"):
+		turn.Verdict = "healthy"
+	}
+}
+
+// Step records a tool call, as a command if it ran one
+func (r *Recorder) Step(s agent.Step) {
+	turn := Turn{Role: "tool", Tool: s.Call.Function.Name, Arguments: s.Call.Function.Arguments, Content: s.Result, Started: s.Started, Duration: s.Duration.Seconds()}
+	if res, ok := s.Value.(diag.Result); ok {
+		turn.Role, turn.Content, turn.Command = "command", "", &res
+	}
+	r.add(turn)
+}
+
+// Note records something that happened outside the dialogue, ie. a refused command
+func (r *Recorder) Note(s string) {
+	r.add(Turn{Role: "note", Content: s, Started: time.Now()})
+}
+
+func (r *Recorder) add(turn Turn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.report.Turns = append(r.report.Turns, turn)
+	r.emit(Event{Type: "turn", Turn: &turn})
+}
+
+// Finish completes the report, waking everyone following it
+func (r *Recorder) Finish(status string, err error) Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	finished := time.Now()
+	r.report.Finished, r.report.Status = &finished, status
+	r.report.Duration = finished.Sub(r.report.Started).Seconds()
+	if err != nil {
+		r.report.Error = err.Error()
+	}
+	report := r.copy()
+	r.emit(Event{Type: "done", Report: &report})
+	r.done = true
+	return report
+}
+
+func (r *Recorder) copy() Report {
+	report := r.report
+	report.Inputs = append([]Input{}, r.report.Inputs...)
+	report.Probes = append([]ProbeResult{}, r.report.Probes...)
+	report.Turns = append([]Turn{}, r.report.Turns...)
+	return report
+}
+
+// Report returns the report so far
+func (r *Recorder) Report() Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.copy()
+}
+
+// Follow calls fn with every event so far, then each new one until the run
+// finishes or ctx is done
+func (r *Recorder) Follow(ctx context.Context, fn func(Event) error) error {
+	// wake the wait below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		r.lock.Lock()
+		r.cond.Broadcast()
+		r.lock.Unlock()
+	})
+	defer stop()
+
+	for i := 0; ; i++ {
+		r.lock.Lock()
+		for i >= len(r.events) && !r.done && ctx.Err() == nil {
+			r.cond.Wait()
+		}
+		if i >= len(r.events) || ctx.Err() != nil {
+			r.lock.Unlock()
+			return ctx.Err()
+		}
+		e := r.events[i]
+		r.lock.Unlock()
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"avaron/agent"
+	"avaron/alerts"
+	"avaron/assistant"
+	"avaron/ca"
+	"avaron/certs"
+	"avaron/client"
+	"avaron/diag"
+	"avaron/dns"
+	"avaron/rid"
 	"avaron/llama"
+	"avaron/logging"
+	"avaron/metrics"
+	"avaron/static"
+	"avaron/tsdb"
 	network "avaron/net"
+	"avaron/terminal"
 	"avaron/vertex"
+	"avaron/websocket"
 	"avaron/health"
 	wg "avaron/wireguard"
 	"bufio"
@@ -12,22 +27,27 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	systemd "github.com/coreos/go-systemd/v22/dbus"
 	"io"
-	"log"
-	"mime"
+	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	filepath "path"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+var httpLogger = logging.For("http")
+
 func Listen(ctx context.Context, ch chan net.Conn, listener net.Listener) {
 	defer close(ch)
 	defer listener.Close()
@@ -35,7 +55,7 @@ func Listen(ctx context.Context, ch chan net.Conn, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("error accepting connection:", err)
+			httpLogger.Error("error accepting connection", "err", err)
 			continue
 		}
 		select {
@@ -46,8 +66,55 @@ func Listen(ctx context.Context, ch chan net.Conn, listener net.Listener) {
 	}
 }
 
+// Identity is what this node's generated certificates are issued for
+func Identity() (id certs.Identity) {
+	id.IPs = []net.IP{PublicWireguardKey.GlobalAddress().IP, net.IPv6loopback, net.IPv4(127, 0, 0, 1)}
+	id.DNSNames = []string{"localhost"}
+	id.URIs = []string{ca.KeyURI(PublicWireguardKey)}
+	if hostname, err := os.Hostname(); err != nil {
+		httpLogger.Warn("failed to query OS hostname", "err", err)
+		id.CommonName = PublicWireguardKey.GlobalAddress().IP.String()
+	} else {
+		id.CommonName = hostname
+		id.DNSNames = append(id.DNSNames, hostname, hostname+".avaron.lan")
+	}
+	return
+}
+
+// LoadCertificates prefers TLS_CERT/TLS_KEY, falling back to a pair generated
+// under tls/. If tls/ca.pem & tls/ca.key hold a mesh CA, generated
+// certificates are issued by it rather than self-signed.
+func LoadCertificates() (*certs.Manager, error) {
+	var ca *tls.Certificate
+	if pair, err := tls.LoadX509KeyPair("tls/ca.pem", "tls/ca.key"); err == nil {
+		ca = &pair
+	} else if !errors.Is(err, os.ErrNotExist) {
+		httpLogger.Warn("ignoring mesh CA", "err", err)
+	}
+
+	if cert, key := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"); cert != "" && key != "" {
+		m, err := certs.Load(cert, key, Identity(), nil)
+		if err == nil {
+			return m, nil
+		}
+		httpLogger.Warn("failed to load certificate, falling back to a generated one", "file", cert, "err", err)
+	}
+
+	return certs.Load("tls/cert.pem", "tls/key.pem", Identity(), ca)
+}
+
 var (
+	// the public/ tree, when built with `-tags embed`
+	Embedded fs.FS
+
 	ServeDirectory string
+	Static         *static.Server
+	Certificates   *certs.Manager
+	Authority      *ca.Authority
+	Diagnostics    *diag.Runner
+	Terminals      *terminal.Manager
+	Health         *health.Scheduler
+	Assistant      *assistant.Manager
 )
 
 func ServeHTTP(ctx context.Context) {
@@ -55,34 +122,52 @@ func ServeHTTP(ctx context.Context) {
 		err      error
 		listener net.Listener
 		conns    chan net.Conn = make(chan net.Conn)
-		config                 = &tls.Config{
-			Certificates: make([]tls.Certificate, 1),
-		}
 	)
 
 	if s := os.Getenv("SERVE_DIR"); s != "" {
 		ServeDirectory = s
+		Static = static.New(os.DirFS(s))
+	} else if Embedded != nil {
+		ServeDirectory = "(embedded)"
+		Static = static.New(Embedded)
 	} else {
 		ServeDirectory = "public"
+		Static = static.New(os.DirFS(ServeDirectory))
 	}
 
-	config.Certificates[0], err = tls.LoadX509KeyPair("/etc/letsencrypt/live/isreal.estate/fullchain.pem",
-		"/etc/letsencrypt/live/isreal.estate/privkey.pem")
+	// branches present their mesh certificates when syncing, browsers don't
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				GetCertificate: Certificates.GetCertificate,
+				ClientAuth:     tls.VerifyClientCertIfGiven,
+				ClientCAs:      Authority.Pool(),
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					if len(cs.PeerCertificates) == 0 {
+						return nil
+					}
+					return Authority.Verify(cs, nil)
+				},
+			}, nil
+		},
+	}
 
-	if err != nil {
-		log.Println("failed to load certificates:", err)
+	if Certificates == nil {
+		httpLogger.Warn("no certificates loaded, not serving HTTPS")
 	} else if listener, err := tls.Listen("tcp", ":8443", config); err != nil {
-		log.Println("error starting HTTPS listener:", err)
+		httpLogger.Error("error starting HTTPS listener", "err", err)
 	} else {
+		go Certificates.Watch(ctx, 10*time.Second)
 		go Listen(ctx, conns, listener)
-		log.Printf("listening on %s\n", listener.Addr().String())
+		httpLogger.Info("listening", "addr", listener.Addr().String())
 	}
 
 	if listener, err = net.Listen("tcp", ":8080"); err != nil {
-		log.Fatalln("error starting HTTP listener:", err)
+		httpLogger.Error("error starting HTTP listener", "err", err)
+		os.Exit(1)
 	} else {
 		go Listen(ctx, conns, listener)
-		log.Printf("listening on %s\n", listener.Addr().String())
+		httpLogger.Info("listening", "addr", listener.Addr().String())
 	}
 
 	// load balancer - connection times out quicker the more connections there are
@@ -147,8 +232,14 @@ func ServeHTTP(ctx context.Context) {
 			reader := bufio.NewReader(conn)
 
 			if req, err := http.ReadRequest(reader); err != nil {
-				log.Println("error reading request:", err)
+				httpLogger.Debug("error reading request", "remote", conn.RemoteAddr().String(), "err", err)
 			} else {
+				id := req.Header.Get(rid.Header)
+				if !rid.Valid(id) {
+					id = rid.New()
+				}
+				ctx := rid.With(ctx, id)
+
 				if d != 0 {
 					var cancel context.CancelFunc
 					ctx, cancel = context.WithDeadline(ctx, t)
@@ -158,17 +249,40 @@ func ServeHTTP(ctx context.Context) {
 					Proto:      "HTTP/1.1",
 					ProtoMajor: 1,
 					ProtoMinor: 1,
+					Request:    req,
 				}
-				res.StatusCode, res.Header, res.Body = handle(ctx, req, conn)
-				if err != nil {
-					log.Println("error processing request:", err)
+				res.StatusCode, res.Header, res.Body = recovered(ctx, req, conn)
+				if res.Header == nil {
+					res.Header = make(http.Header)
+				}
+				res.Header.Set(rid.Header, id)
+				if n, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err == nil {
+					res.ContentLength = n
 				}
-
 				res.Status = http.StatusText(res.StatusCode)
 
-				log.Printf("%-24s %7s %-24s - %d(%s)\n", conn.RemoteAddr().String(), req.Method, req.URL.Path, res.StatusCode, res.Status)
+				// after switching protocols the body is the raw stream to the client
+				var stream io.ReadCloser
+				if res.StatusCode == http.StatusSwitchingProtocols {
+					stream, res.Body = res.Body, nil
+				}
+
+				httpLogger.InfoContext(ctx, "request", "remote", conn.RemoteAddr().String(), "method", req.Method, "path", req.URL.Path, "status", res.StatusCode, "duration", time.Since(t))
 				if err = res.Write(conn); err != nil {
-					log.Println("error writing request:", err)
+					httpLogger.DebugContext(ctx, "error writing response", "err", err)
+					if stream != nil {
+						stream.Close()
+					}
+					return
+				}
+
+				RequestDuration.Observe(time.Since(t).Seconds(), route(req.URL.Path), method(req.Method), strconv.Itoa(res.StatusCode))
+
+				if stream != nil {
+					if _, err = io.Copy(conn, stream); err != nil {
+						httpLogger.DebugContext(ctx, "error writing stream", "err", err)
+					}
+					stream.Close()
 					return
 				}
 			}
@@ -183,22 +297,524 @@ func ServeHTTP(ctx context.Context) {
 	}
 }
 
-func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, header http.Header, r io.ReadCloser) {
-	var err error
-	code = http.StatusOK
+// split finds the end of the route, the path up to its third '/'
+func split(path string) int {
+	var i, j int
+	for i, j = 0, 0; i < len(path); i++ {
+		if path[i] == '/' {
+			j++
+		}
+		if j == 3 {
+			break
+		}
+	}
+	return i
+}
+
+// routed are the prefixes handle serves, anything else under /api/ is a 404
+var routed = map[string]bool{
+	"/api/keys": true, "/api/link": true, "/api/nodes": true, "/api/wireguard": true,
+	"/api/exec": true, "/api/ca": true, "/api/terminal": true, "/api/health": true,
+	"/api/assistant": true, "/api/completions": true, "/api/services": true, "/api/log": true,
+	"/api/alerts": true, "/api/dns": true, "/api/metrics": true, "/metrics": true,
+}
+
+// route labels a request's metrics without one series per file, run or
+// whatever path a client makes up
+func route(path string) string {
+	switch prefix := path[:split(path)]; {
+	case routed[prefix]:
+		return prefix
+	case prefix == "" || prefix == "/":
+		return "/"
+	case prefix == "/api" || strings.HasPrefix(prefix, "/api/"):
+		return "other"
+	}
+	return "static"
+}
 
-	i := func() int {
-		var i, j int
-		for i, j = 0, 0; i < len(req.URL.Path); i++ {
-			if req.URL.Path[i] == '/' {
-				j++
+// method labels a request's metrics, folding made up methods together
+func method(m string) string {
+	switch m {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return m
+	}
+	return "OTHER"
+}
+
+// errorBody renders the JSON envelope for a failed API request
+func errorBody(ctx context.Context, code int, message string, err error) (http.Header, io.ReadCloser) {
+	e := client.Error{
+		Code:      code,
+		Message:   message,
+		RequestID: rid.From(ctx),
+	}
+	if err != nil {
+		e.Details = details(err)
+	}
+
+	buf, _ := json.Marshal(e)
+	return http.Header{
+		"Content-Type":   []string{"application/json"},
+		"Content-Length": []string{strconv.Itoa(len(buf))},
+	}, io.NopCloser(bytes.NewReader(buf))
+}
+
+// details describes err for the client, passing on JSON from llama-server as is
+func details(err error) interface{} {
+	var status *llama.StatusError
+	if errors.As(err, &status) && json.Valid(status.Body) {
+		return json.RawMessage(status.Body)
+	}
+	return err.Error()
+}
+
+// Fail logs err & explains it to the client, handlers return it directly
+func Fail(ctx context.Context, code int, message string, err error) (int, http.Header, io.ReadCloser) {
+	level := slog.LevelWarn
+	if code >= 500 {
+		level = slog.LevelError
+	}
+	httpLogger.Log(ctx, level, message, "status", code, "err", err)
+	header, r := errorBody(ctx, code, message, err)
+	return code, header, r
+}
+
+// recovered turns a panicking handler into a 500 rather than taking the process down
+func recovered(ctx context.Context, req *http.Request, conn net.Conn) (code int, header http.Header, r io.ReadCloser) {
+	defer func() {
+		if v := recover(); v != nil {
+			httpLogger.ErrorContext(ctx, "panic", "method", req.Method, "path", req.URL.Path, "value", v, "stack", string(debug.Stack()))
+			code, header, r = Fail(ctx, http.StatusInternalServerError, "internal error", fmt.Errorf("%v", v))
+		}
+	}()
+
+	code, header, r = handle(ctx, req, conn)
+
+	// bare errors from the API still get an envelope
+	if code >= 400 && r == nil && strings.HasPrefix(req.URL.Path, "/api/") {
+		var h http.Header
+		h, r = errorBody(ctx, code, http.StatusText(code), nil)
+		if header == nil {
+			header = h
+		} else {
+			for k, v := range h {
+				header[k] = v
 			}
-			if j == 3 {
-				break
+		}
+	}
+	return
+}
+
+// pending lists commands awaiting approval, or decides one of them by id
+func pending(ctx context.Context, req *http.Request, id string) (code int, header http.Header, r io.ReadCloser) {
+	switch {
+	case id == "" && req.Method == "GET":
+		buf, err := json.Marshal(Diagnostics.Pending())
+		if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error marshalling pending commands", err)
+		}
+		return http.StatusOK, http.Header{"Content-Type": []string{"application/json"}}, io.NopCloser(bytes.NewReader(buf))
+	case id != "" && req.Method == "POST":
+	default:
+		return http.StatusMethodNotAllowed, nil, nil
+	}
+
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Fail(ctx, http.StatusBadRequest, "malformed pending command id", err)
+	}
+	var decision client.Decision
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<12)).Decode(&decision); err != nil {
+		return Fail(ctx, http.StatusBadRequest, "malformed decision", err)
+	}
+	if err := Diagnostics.Decide(n, decision.Approve); errors.Is(err, diag.ErrNoPending) {
+		return Fail(ctx, http.StatusNotFound, "no such pending command", err)
+	} else if err != nil {
+		return Fail(ctx, http.StatusInternalServerError, "error deciding pending command", err)
+	}
+	httpLogger.InfoContext(ctx, "pending command decided", "id", n, "approve", decision.Approve)
+	return http.StatusNoContent, nil, nil
+}
+
+// assist serves the assistant's sessions, rest being what follows /api/assistant/sessions
+func assist(ctx context.Context, req *http.Request, rest string) (code int, header http.Header, r io.ReadCloser) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	reply := func(code int, v interface{}) (int, http.Header, io.ReadCloser) {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error marshalling assistant session", err)
+		}
+		return code, http.Header{"Content-Type": []string{"application/json"}}, io.NopCloser(bytes.NewReader(buf))
+	}
+
+	switch {
+	case id == "" && req.Method == "GET":
+		list, err := Assistant.List()
+		if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error listing assistant sessions", err)
+		}
+		return reply(http.StatusOK, list)
+	case id == "" && req.Method == "POST":
+		session, err := Assistant.Create(ctx)
+		if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error creating assistant session", err)
+		}
+		return reply(http.StatusCreated, session)
+	case id == "":
+		return http.StatusMethodNotAllowed, nil, nil
+	case sub == "" && req.Method == "GET":
+		session, err := Assistant.Get(id)
+		if errors.Is(err, assistant.ErrNotFound) {
+			return Fail(ctx, http.StatusNotFound, "no such assistant session", err)
+		} else if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error reading assistant session", err)
+		}
+		return reply(http.StatusOK, session)
+	case sub == "" && req.Method == "DELETE":
+		switch err := Assistant.Delete(id); {
+		case errors.Is(err, assistant.ErrNotFound):
+			return Fail(ctx, http.StatusNotFound, "no such assistant session", err)
+		case errors.Is(err, assistant.ErrBusy):
+			return Fail(ctx, http.StatusConflict, "assistant session is answering", err)
+		case err != nil:
+			return Fail(ctx, http.StatusInternalServerError, "error deleting assistant session", err)
+		}
+		return http.StatusNoContent, nil, nil
+	case sub == "":
+		return http.StatusMethodNotAllowed, nil, nil
+	case sub == "messages" && req.Method == "POST":
+	case sub == "messages":
+		return http.StatusMethodNotAllowed, nil, nil
+	default:
+		return http.StatusNotFound, nil, nil
+	}
+
+	var message client.AssistantMessage
+	if err := json.NewDecoder(io.LimitReader(req.Body, 2*assistant.MaxMessage)).Decode(&message); err != nil {
+		return Fail(ctx, http.StatusBadRequest, "malformed assistant message", err)
+	}
+
+	// the answer streams as server-sent events, holding the response until
+	// the model starts so refusals still get a status
+	pr, pw := io.Pipe()
+	var (
+		lock      sync.Mutex
+		once      sync.Once
+		streaming bool
+		started   = make(chan error, 1)
+	)
+	// begin reports whether the response is streaming, deciding it on the first call
+	begin := func(err error) bool {
+		once.Do(func() {
+			streaming = err == nil
+			started <- err
+		})
+		return streaming
+	}
+	send := func(event string, v interface{}) {
+		begin(nil)
+		buf, _ := json.Marshal(v)
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintf(pw, "event: %s\ndata: %s\n\n", event, buf)
+	}
+
+	go func() {
+		defer pw.Close()
+		session, err := Assistant.Send(ctx, id, message.Content, agent.Observer{
+			Token: func(token string) {
+				send("token", map[string]string{"content": token})
+			},
+			Replied: func(reply llama.Message) {
+				if len(reply.ToolCalls) > 0 {
+					send("calls", reply.ToolCalls)
+				}
+			},
+			Step: func(step agent.Step) {
+				send("tool", map[string]string{"id": step.Call.ID, "name": step.Call.Function.Name, "result": step.Result})
+			},
+		})
+		switch {
+		case !begin(err):
+			// refused before answering, so it's the response's status
+		case err != nil:
+			httpLogger.WarnContext(ctx, "assistant failed", "id", id, "err", err)
+			send("error", client.Error{Code: http.StatusInternalServerError, Message: "assistant failed", Details: err.Error(), RequestID: rid.From(ctx)})
+		default:
+			send("done", session.Messages[len(session.Messages)-1])
+		}
+	}()
+
+	switch err := <-started; {
+	case err == nil:
+	case errors.Is(err, assistant.ErrNotFound):
+		return Fail(ctx, http.StatusNotFound, "no such assistant session", err)
+	case errors.Is(err, assistant.ErrBusy):
+		return Fail(ctx, http.StatusConflict, "assistant session is answering", err)
+	case errors.Is(err, assistant.ErrInvalid):
+		return Fail(ctx, http.StatusBadRequest, "invalid assistant message", err)
+	case errors.As(err, new(*llama.RateError)), errors.Is(err, llama.ErrQueueFull):
+		return failLlama(ctx, err)
+	default:
+		return Fail(ctx, http.StatusInternalServerError, "assistant failed", err)
+	}
+	return http.StatusOK, http.Header{"Content-Type": []string{"text/event-stream"}, "Cache-Control": []string{"no-cache"}}, pr
+}
+
+// MaxCompletionRequest is the most bytes a completion request may be
+const MaxCompletionRequest = 1 << 20
+
+// resolver serves the zone's custom records, the forwarders & query
+// stats, rest being what follows /api/dns
+func resolver(ctx context.Context, req *http.Request, rest string) (code int, header http.Header, r io.ReadCloser) {
+	section, id, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	switch {
+	case section == "records" && id == "" && (req.Method == "GET" || req.Method == "POST"):
+	case section == "records" && id != "" && (req.Method == "PUT" || req.Method == "DELETE"):
+	case section == "forwarders" && id == "" && (req.Method == "GET" || req.Method == "PUT"):
+	case section == "stats" && id == "" && req.Method == "GET":
+	case section == "records", section == "forwarders" && id == "", section == "stats" && id == "":
+		return http.StatusMethodNotAllowed, nil, nil
+	default:
+		return http.StatusNotFound, nil, nil
+	}
+	if Zone == nil || Resolver == nil {
+		return Fail(ctx, http.StatusServiceUnavailable, "dns isn't running", nil)
+	}
+
+	body := io.LimitReader(req.Body, 1<<16)
+	failZone := func(err error) (int, http.Header, io.ReadCloser) {
+		switch {
+		case errors.Is(err, dns.ErrInvalid):
+			return Fail(ctx, http.StatusBadRequest, "invalid dns record", err)
+		case errors.Is(err, dns.ErrNotFound):
+			return Fail(ctx, http.StatusNotFound, "no such dns record", err)
+		}
+		return Fail(ctx, http.StatusInternalServerError, "error publishing zone", err)
+	}
+
+	var v interface{}
+	code = http.StatusOK
+	switch {
+	case section == "records" && req.Method == "GET":
+		v = Zone.Custom()
+	case section == "records" && req.Method == "DELETE":
+		if err := Zone.DeleteRecord(ctx, id); err != nil {
+			return failZone(err)
+		}
+		httpLogger.InfoContext(ctx, "dns record deleted", "id", id)
+		return http.StatusNoContent, nil, nil
+	case section == "records":
+		var record dns.Custom
+		if err := json.NewDecoder(body).Decode(&record); err != nil {
+			return Fail(ctx, http.StatusBadRequest, "malformed dns record", err)
+		}
+		var err error
+		if req.Method == "POST" {
+			record, err = Zone.AddRecord(ctx, record)
+			code = http.StatusCreated
+		} else {
+			record, err = Zone.UpdateRecord(ctx, id, record)
+		}
+		if err != nil {
+			return failZone(err)
+		}
+		httpLogger.InfoContext(ctx, "dns record saved", "id", record.ID, "name", record.Name, "type", record.Type, "value", record.Value)
+		v = record
+	case section == "forwarders":
+		if req.Method == "PUT" {
+			var list []string
+			if err := json.NewDecoder(body).Decode(&list); err != nil {
+				return Fail(ctx, http.StatusBadRequest, "malformed forwarders", err)
+			}
+			if err := Resolver.SetForwarders(ctx, list); errors.Is(err, dns.ErrInvalid) {
+				return Fail(ctx, http.StatusBadRequest, "invalid forwarders", err)
+			} else if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error applying forwarders", err)
 			}
 		}
-		return i
+		v = Resolver.Forwarders()
+	default:
+		stats, err := Resolver.Stats()
+		if errors.Is(err, dns.ErrUnsupported) {
+			return Fail(ctx, http.StatusNotImplemented, "query stats need DNS_MODE=builtin", err)
+		} else if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error reading query stats", err)
+		}
+		v = stats
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return Fail(ctx, http.StatusInternalServerError, "error marshalling dns", err)
+	}
+	return code, http.Header{"Content-Type": []string{"application/json"}}, io.NopCloser(bytes.NewReader(buf))
+}
+
+// hangup returns a context cancelled once the client closes conn. Each
+// connection carries a single request, so once its body has been read
+// anything more from the client is taken as it going away
+func hangup(ctx context.Context, conn net.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if conn == nil {
+		return ctx, cancel
+	}
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		conn.Read(make([]byte, 1))
+		cancel()
 	}()
+	return ctx, cancel
+}
+
+// remote is who's on the other end of conn, for rate limits
+func remote(conn net.Conn) string {
+	if conn == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// failLlama explains a backend's failure, passing on llama-server's own
+// status & error
+func failLlama(ctx context.Context, err error) (int, http.Header, io.ReadCloser) {
+	var (
+		status  *llama.StatusError
+		limited *llama.RateError
+	)
+	switch {
+	case errors.As(err, &status):
+		return Fail(ctx, status.Code, "llama refused the completion", err)
+	case errors.As(err, &limited):
+		code, header, r := Fail(ctx, http.StatusTooManyRequests, "too many llama requests", err)
+		header.Set("Retry-After", strconv.Itoa(int(limited.Retry/time.Second)+1))
+		return code, header, r
+	case errors.Is(err, llama.ErrQueueFull):
+		code, header, r := Fail(ctx, http.StatusServiceUnavailable, "llama is busy", err)
+		header.Set("Retry-After", "5")
+		return code, header, r
+	case errors.Is(err, context.DeadlineExceeded):
+		return Fail(ctx, http.StatusGatewayTimeout, "llama took too long", err)
+	}
+	return Fail(ctx, http.StatusBadGateway, "error completing with llama", err)
+}
+
+// completions relays a completion from llama.Default, streamed as
+// llama-server's events when asked to
+func completions(ctx context.Context, req *http.Request, conn net.Conn) (code int, header http.Header, r io.ReadCloser) {
+	if req.Method != "POST" {
+		return http.StatusMethodNotAllowed, nil, nil
+	}
+	if req.ContentLength > MaxCompletionRequest {
+		return Fail(ctx, http.StatusRequestEntityTooLarge, "completion request too large", nil)
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, MaxCompletionRequest+1))
+	if err != nil {
+		return Fail(ctx, http.StatusBadRequest, "error reading completion request", err)
+	} else if len(buf) > MaxCompletionRequest {
+		return Fail(ctx, http.StatusRequestEntityTooLarge, "completion request too large", nil)
+	}
+
+	var request struct {
+		llama.Request
+		Messages []llama.Message `json:"messages"`
+	}
+	if err := json.Unmarshal(buf, &request); err != nil {
+		return Fail(ctx, http.StatusBadRequest, "malformed completion request", err)
+	}
+	if request.Model == "" {
+		request.Model = llama.Model
+	}
+	switch {
+	case request.Predict <= 0:
+		request.Predict = llama.MaxPredict
+	case request.Predict > llama.MaxPredict:
+		return Fail(ctx, http.StatusBadRequest, fmt.Sprintf("n_predict may be at most %d", llama.MaxPredict), nil)
+	}
+
+	// the body's been read, so llama stops when the dashboard goes away
+	ctx, cancel := hangup(llama.WithClient(ctx, remote(conn)), conn)
+
+	// a prompt is completed as is, messages through the model's chat template
+	complete := func(fn func(llama.Token) error) (llama.Completion, error) {
+		switch {
+		case len(request.Messages) > 0:
+			return llama.Default.Chat(ctx, llama.ChatRequest{Model: request.Model, Messages: request.Messages, MaxTokens: request.Predict}, fn)
+		case fn == nil:
+			return llama.Default.Complete(ctx, request.Request)
+		}
+		return llama.Default.Stream(ctx, request.Request, fn)
+	}
+
+	if !request.Stream {
+		defer cancel()
+		completion, err := complete(nil)
+		if err != nil {
+			return failLlama(ctx, err)
+		}
+		buf, err := json.Marshal(llama.Token{Content: completion.Content, Stop: true, Predicted: completion.Predicted, Evaluated: completion.Evaluated})
+		if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error marshalling completion", err)
+		}
+		return http.StatusOK, http.Header{"Content-Type": []string{"application/json"}}, io.NopCloser(bytes.NewReader(buf))
+	}
+
+	// tokens are relayed as llama-server's events, whichever backend answers,
+	// holding the response until the first so errors still get a status.
+	// Each event is written through to conn as it's read from the pipe, &
+	// closing either end cancels the completion
+	pr, pw := io.Pipe()
+	stop := context.AfterFunc(ctx, func() { pr.CloseWithError(ctx.Err()) })
+	var (
+		once      sync.Once
+		streaming bool
+		started   = make(chan error, 1)
+	)
+	begin := func(err error) bool {
+		once.Do(func() {
+			streaming = err == nil
+			started <- err
+		})
+		return streaming
+	}
+	go func() {
+		defer cancel()
+		defer stop()
+		defer pw.Close()
+		_, err := complete(func(token llama.Token) error {
+			begin(nil)
+			buf, err := json.Marshal(token)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(pw, "data: %s\n\n", buf)
+			return err
+		})
+		if begin(err) && err != nil && ctx.Err() == nil {
+			// too late for a status, so it's an error event as llama-server sends
+			httpLogger.WarnContext(ctx, "llama failed mid completion", "err", err)
+			buf, _ := json.Marshal(client.Error{Code: http.StatusBadGateway, Message: "llama failed mid completion", Details: details(err), RequestID: rid.From(ctx)})
+			fmt.Fprintf(pw, "error: %s\n\n", buf)
+		}
+	}()
+	if err := <-started; err != nil {
+		pr.Close()
+		return failLlama(ctx, err)
+	}
+
+	return http.StatusOK, http.Header{"Content-Type": []string{"text/event-stream"}, "Cache-Control": []string{"no-cache"}}, pr
+}
+
+func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, header http.Header, r io.ReadCloser) {
+	var err error
+	code = http.StatusOK
+
+	i := split(req.URL.Path)
 
 	switch req.URL.Path[:i] {
 	case "/api/keys":
@@ -212,16 +828,17 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 		case "/wireguard":
 			buf, _ := PublicWireguardKey.MarshalText()
 			r = io.NopCloser(bytes.NewReader(buf))
+		default:
+			return http.StatusNotFound, nil, nil
 		}
 	case "/api/link":
 		if req.Method != "POST" {
 			return http.StatusMethodNotAllowed, nil, nil
 		}
-		log.Printf("pairing with %s\n", conn.RemoteAddr().String())
+		httpLogger.InfoContext(ctx, "pairing", "remote", conn.RemoteAddr().String())
 		// check content-length
 		if l := req.ContentLength; l < 44 || l > 44+1 {
-			log.Printf("Request Content-Length (%d) != %d +/- 1/0\n", l, 44)
-			return http.StatusBadRequest, nil, nil
+			return Fail(ctx, http.StatusBadRequest, fmt.Sprintf("Content-Length is %d, expected a %d byte base64 key", l, 44), nil)
 		}
 
 		// read body
@@ -230,11 +847,10 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 		var key vertex.Key
 		_, err := io.ReadFull(r, key[:])
 		if err != nil && err != io.EOF {
-			log.Println("failed to public key:", err)
-			return http.StatusBadRequest, nil, nil
+			return Fail(ctx, http.StatusBadRequest, "malformed public key", err)
 		}
 
-		log.Printf("got buffer! %s\n", key.String())
+		httpLogger.DebugContext(ctx, "pairing key", "key", key.String())
 
 		files, err := os.ReadDir("pending")
 		if err == nil {
@@ -243,8 +859,7 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 			// fine
 			err := os.Mkdir("pending", 0700)
 			if err != nil {
-				log.Println("failed to make 'pending' dir:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed to make 'pending' dir", err)
 			}
 		} else if len(files) == 0 {
 			// still fine
@@ -259,20 +874,19 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 			}
 
 			if match {
-				log.Printf("case insensitive, matching pending link: %s & %s - rejecting & deleting\n", key.String(), files[i].Name())
+				httpLogger.WarnContext(ctx, "case insensitive match with pending link, rejecting & deleting", "key", key.String(), "pending", files[i].Name())
 				err := os.Remove(filepath.Join("pending", files[i].Name()))
 				if err != nil {
 					// something nasty is going on
-					panic(err)
+					return Fail(ctx, http.StatusInternalServerError, "failed rejecting conflicting link", err)
 				}
-				return http.StatusUnauthorized, nil, nil
+				return Fail(ctx, http.StatusUnauthorized, "conflicts with a pending link, both were rejected", nil)
 			}
 		}
 
 		err = os.MkdirAll(fmt.Sprintf("pending/%s", key.String()), 0700)
 		if err != nil {
-			log.Println("failed to make pending link dir:", err)
-			return http.StatusInternalServerError, nil, nil
+			return Fail(ctx, http.StatusInternalServerError, "failed to make pending link dir", err)
 		}
 	case "/api/nodes":
 		if req.Method != "GET" {
@@ -294,9 +908,9 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 		case "GET":
 			info, err := wg.Interfaces(ctx)
 			if err != nil {
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed listing wireguard interfaces", err)
 			}
-			log.Println("peer info", info)
+			httpLogger.DebugContext(ctx, "peer info", "interfaces", info)
 
 			var w io.WriteCloser
 			r, w = io.Pipe()
@@ -305,15 +919,14 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 				defer w.Close()
 				err := enc.Encode(info)
 				if err != nil {
-					log.Println("error encoding peers:", err)
+					httpLogger.ErrorContext(ctx, "error encoding peers", "err", err)
 				}
 			}()
 
 		case "POST":
 			buf, err := io.ReadAll(req.Body)
 			if err != nil {
-				log.Println("failed reading body:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed reading body", err)
 			}
 
 			var ip net.IP
@@ -322,8 +935,7 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 				// ok
 				var routes map[string]*network.Route
 				if routes, err = network.Routes(ctx); err != nil {
-					log.Println("failed reading routes:", err)
-					return http.StatusInternalServerError, nil, nil
+					return Fail(ctx, http.StatusInternalServerError, "failed reading routes", err)
 				}
 
 				var names []string
@@ -331,17 +943,16 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 					names = append(names, i)
 				}
 
-				log.Println("routes pre-sort", names)
+				httpLogger.DebugContext(ctx, "routes pre-sort", "routes", names)
 				sort.Sort(&network.RouteMask{names, routes})
-				log.Println("routes post-sort", names)
+				httpLogger.DebugContext(ctx, "routes post-sort", "routes", names)
 				if len(routes) < 1 {
-					return http.StatusBadRequest, nil, nil
+					return Fail(ctx, http.StatusBadRequest, "no routes to pick an endpoint from, supply its address", nil)
 				}
 
 				list, err := network.List(ctx)
 				if err != nil {
-					log.Println("failed to probe network links:", err)
-					os.Exit(1)
+					return Fail(ctx, http.StatusInternalServerError, "failed to probe network links", err)
 				}
 
 				route := routes[names[len(names)-1]]
@@ -359,18 +970,15 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 				}()
 
 				if ip == nil {
-					log.Println("failed to to find IP matching first route:", route)
-					os.Exit(1)
+					return Fail(ctx, http.StatusInternalServerError, "no address matches the default route, supply one", fmt.Errorf("%s", route.Destination))
 				}
 			} else if ip = net.ParseIP(string(buf)); ip == nil {
-				log.Println("failed parsing IP")
-				return http.StatusBadRequest, nil, nil
+				return Fail(ctx, http.StatusBadRequest, "malformed endpoint address", nil)
 			}
 
 			public, private, err := wg.GenerateKeyPair()
 			if err != nil {
-				log.Println("error generating wireguard key pair:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "error generating wireguard key pair", err)
 			}
 
 			var pw io.WriteCloser
@@ -378,24 +986,20 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 			qr := exec.Command("sh", "-c", "qrencode -t SVG | grep -v '<?' | grep -v '<!'")
 
 			if pw, err = qr.StdinPipe(); err != nil {
-				log.Println("failed spawning qrencode pipe:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed spawning qrencode pipe", err)
 			}
 
 			if r, err = qr.StdoutPipe(); err != nil {
-				log.Println("failed spawning qrencode pipe:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed spawning qrencode pipe", err)
 			}
 
 			if err = qr.Start(); err != nil {
-				log.Println("error generating wireguard key pair:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "error generating wireguard key pair", err)
 			}
 
 			dir := filepath.Join("peers", public.Path())
 			if err := os.Mkdir(dir, 0700); err != nil {
-				log.Println("error creating peer directory:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "error creating peer directory", err)
 			}
 
 			fmt.Fprintf(pw, "[Interface]\n")
@@ -415,243 +1019,507 @@ func handle(ctx context.Context, req *http.Request, conn net.Conn) (code int, he
 			cmd := exec.Command("sudo", "wg", "set", "avaron", "peer", public.String(), "allowed-ips", "fc00:a7a0::/32")
 			buf, err = cmd.CombinedOutput()
 			if err != nil {
-				log.Println("failed adding peer", string(buf), err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed adding peer", fmt.Errorf("%v: %s", err, bytes.TrimSpace(buf)))
 
 			}
+			notifyPeer(ctx, peerChange{Key: public})
 
 		case "DELETE":
 			buf, err := io.ReadAll(req.Body)
 			if err != nil {
-				log.Println("failed reading body:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed reading body", err)
 			}
 
 			var key vertex.Key
-			_, err = key.UnmarshalText(buf)
+			err = key.UnmarshalText(buf)
 			if err != nil {
-				log.Println("failed unmarshalling key:", err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusBadRequest, "malformed public key", err)
 			}
 
-			err = os.RemoveAll(filepath.Join("peers", key.Path()))
-			if err != nil {
-				log.Println("failed deleting peer:", err)
-				return http.StatusNotFound, nil, nil
+			// the directory goes last, so a failed step is retried by deleting
+			// again, each being a no-op once done
+			if err = Authority.Revoke(key); err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "failed revoking peer certificates", err)
 			}
-			log.Println("deleted", key.Path())
 
 			cmd := exec.Command("sudo", "wg", "set", "avaron", "peer", key.String(), "remove")
 			buf, err = cmd.CombinedOutput()
 			if err != nil {
-				log.Println("failed removing peer", string(buf), err)
-				return http.StatusInternalServerError, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "failed removing peer", fmt.Errorf("%v: %s", err, bytes.TrimSpace(buf)))
 
 			}
+
+			err = os.RemoveAll(filepath.Join("peers", key.Path()))
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "failed deleting peer", err)
+			}
+			notifyPeer(ctx, peerChange{Key: key, Removed: true})
+			httpLogger.InfoContext(ctx, "deleted peer", "key", key.String())
 		default:
 			return http.StatusMethodNotAllowed, nil, nil
 		}
 		header = http.Header{
 			"Content-Type": []string{"application/json"},
 		}
-	case "/api/shell":
-		buf, err := io.ReadAll(req.Body)
-		if err != nil {
-			log.Println("failed reading body:", err)
-			return http.StatusInternalServerError, nil, nil
+	case "/api/exec":
+		if rest := req.URL.Path[i:]; rest == "/pending" || strings.HasPrefix(rest, "/pending/") {
+			return pending(ctx, req, strings.TrimPrefix(strings.TrimPrefix(rest, "/pending"), "/"))
+		} else if rest != "" {
+			return http.StatusNotFound, nil, nil
 		}
-		log.Println("SHELL", string(buf))
 
-		sh := exec.Command("sh", "-c", string(buf))
+		switch req.Method {
+		case "GET":
+			buf, err := json.Marshal(Diagnostics.History())
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error marshalling exec history", err)
+			}
+			r = io.NopCloser(bytes.NewReader(buf))
+		case "POST":
+			var run diag.Request
+			if err := json.NewDecoder(io.LimitReader(req.Body, 1<<16)).Decode(&run); err != nil {
+				return Fail(ctx, http.StatusBadRequest, "failed decoding exec request", err)
+			}
 
-		var w io.WriteCloser
-		r, w = io.Pipe()
-		r = io.NopCloser(io.TeeReader(r, os.Stderr))
-		sh.Stdout = w
-		sh.Stderr = w
+			res, err := Diagnostics.Run(ctx, run)
+			if errors.Is(err, diag.ErrNotAllowed) {
+				return Fail(ctx, http.StatusForbidden, "refusing exec", err)
+			} else if err != nil {
+				return Fail(ctx, http.StatusBadRequest, "bad exec request", err)
+			}
+			httpLogger.InfoContext(ctx, "exec", "argv", res.Argv, "exit", res.ExitCode, "duration", res.Duration)
 
-		if err := sh.Start(); err != nil {
-			log.Println("failed starting shell", string(buf), err)
-			return http.StatusInternalServerError, nil, nil
-		}
-		go func() {
-			log.Println("command completed:", sh.Wait())
-			w.Close()
-		}()
-	case "/api/health":
-		if req.Method != "GET" {
+			buf, err := json.Marshal(res)
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error marshalling exec result", err)
+			}
+			r = io.NopCloser(bytes.NewReader(buf))
+		default:
 			return http.StatusMethodNotAllowed, nil, nil
 		}
-
 		header = http.Header{
 			"Content-Type": []string{"application/json"},
 		}
+	case "/api/ca":
+		switch rest := req.URL.Path[i:]; {
+		case req.Method == "GET" && (rest == "" || rest == "/"):
+			r = io.NopCloser(bytes.NewReader(Authority.Bundle()))
+			header = http.Header{
+				"Content-Type": []string{"application/x-pem-file"},
+			}
+		case req.Method == "GET" && rest == "/crl":
+			buf, err := Authority.CRL()
+			if errors.Is(err, ca.ErrNotAuthority) {
+				return Fail(ctx, http.StatusNotFound, "not a designated CA", err)
+			} else if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error generating CRL", err)
+			}
+			r = io.NopCloser(bytes.NewReader(buf))
+			header = http.Header{
+				"Content-Type": []string{"application/pkix-crl"},
+			}
+		case req.Method == "POST" && rest == "/csr":
+			buf, err := io.ReadAll(io.LimitReader(req.Body, 1<<16))
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "failed reading body", err)
+			}
 
-		var w io.WriteCloser
-		r, w = io.Pipe()
+			var remote net.IP
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				remote = addr.IP
+			}
 
-		switch req.URL.Path[i:] {
-		case "/", "":
+			chain, err := Authority.Sign(buf, remote)
+			switch {
+			case errors.Is(err, ca.ErrNotAuthority):
+				return Fail(ctx, http.StatusNotFound, "not a designated CA", err)
+			case errors.Is(err, ca.ErrUnapproved), errors.Is(err, ca.ErrIdentity):
+				return Fail(ctx, http.StatusForbidden, "refusing CSR", err)
+			case errors.Is(err, ca.ErrBadCSR):
+				return Fail(ctx, http.StatusBadRequest, "bad CSR", err)
+			case err != nil:
+				return Fail(ctx, http.StatusInternalServerError, "error signing CSR", err)
+			}
 
+			r = io.NopCloser(bytes.NewReader(chain))
+			header = http.Header{
+				"Content-Type": []string{"application/x-pem-file"},
+			}
+		case rest == "" || rest == "/" || rest == "/crl" || rest == "/csr":
+			return http.StatusMethodNotAllowed, nil, nil
+		default:
+			return http.StatusNotFound, nil, nil
+		}
+	case "/api/terminal":
+		if req.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil, nil
+		}
 
-			enc := json.NewEncoder(w)
+		switch rest := strings.TrimPrefix(req.URL.Path[i:], "/"); {
+		case rest == "":
+			header, err = websocket.Accept(req)
+			if errors.Is(err, websocket.ErrOrigin) {
+				return Fail(ctx, http.StatusForbidden, "terminal opened from another site", err)
+			} else if err != nil {
+				return Fail(ctx, http.StatusBadRequest, "bad terminal upgrade", err)
+			}
+
+			pr, pw := io.Pipe()
+			ws := websocket.New(conn, pw)
 			go func() {
-				defer w.Close()
-				times := <-health.List
-				if err := enc.Encode(times); err != nil {
-					log.Println("error encoding:", err)
+				err := Terminals.Serve(ctx, ws, conn.RemoteAddr().String())
+				if err != nil {
+					httpLogger.InfoContext(ctx, "terminal session ended", "err", err)
 				}
+				pw.Close()
 			}()
-		default:
-			n, err := strconv.ParseInt(req.URL.Path[i+1:], 10, 64)
+			return http.StatusSwitchingProtocols, header, pr
+		case rest == "sessions":
+			sessions, err := Terminals.List()
 			if err != nil {
-				log.Println("failed parsing integer", err)
-				return http.StatusBadRequest, nil, nil
+				return Fail(ctx, http.StatusInternalServerError, "error listing terminal sessions", err)
 			}
 
-			times := <-health.List
+			buf, err := json.Marshal(sessions)
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error marshalling terminal sessions", err)
+			}
 
-			if _, ok := times[n]; !ok {
-				return http.StatusNotFound, nil, nil
+			r = io.NopCloser(bytes.NewReader(buf))
+			header = http.Header{
+				"Content-Type": []string{"application/json"},
 			}
-			health.Get<-health.Request{
-				Time: n,
-				WriteCloser: w,
+		case strings.HasPrefix(rest, "sessions/"):
+			f, err := Terminals.Open(strings.TrimPrefix(rest, "sessions/"))
+			if errors.Is(err, terminal.ErrNotFound) {
+				return Fail(ctx, http.StatusNotFound, "no such terminal session", err)
+			} else if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error opening terminal recording", err)
 			}
+
+			r = f
+			header = http.Header{
+				"Content-Type": []string{"application/x-asciicast"},
+			}
+		default:
+			return http.StatusNotFound, nil, nil
 		}
-	case "/api/completions":
-		if req.Method != "POST" {
+	case "/api/health":
+		if req.Method != "GET" {
 			return http.StatusMethodNotAllowed, nil, nil
 		}
 
-		req.RequestURI = ""
-		req.URL.Scheme = "http"
-		req.URL.Host = "localhost"
-		req.URL.Path = "/completions"
-		res, err := llama.Client.Do(req)
-		if err != nil {
-			log.Println("error forwarding request to llama:", err)
-			return http.StatusInternalServerError, nil, nil
-		} else if res.StatusCode < 200 || res.StatusCode >= 300 {
-			log.Println("error forwarding request to llama:", err)
-			return http.StatusInternalServerError, nil, nil
+		header = http.Header{
+			"Content-Type": []string{"application/json"},
 		}
 
-		r = res.Body
+		switch req.URL.Path[i:] {
+		case "/", "":
+			buf, err := json.Marshal(Health.List())
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error marshalling health runs", err)
+			}
+			r = io.NopCloser(bytes.NewReader(buf))
+		default:
+			ts, view, _ := strings.Cut(req.URL.Path[i+1:], "/")
+			n, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return Fail(ctx, http.StatusBadRequest, "malformed run time", err)
+			}
+
+			switch view {
+			case "":
+				report, err := Health.Report(n)
+				if errors.Is(err, health.ErrNotFound) {
+					return Fail(ctx, http.StatusNotFound, "no such health check run", err)
+				} else if err != nil {
+					return Fail(ctx, http.StatusInternalServerError, "error reading health check report", err)
+				}
 
-		header = res.Header
+				buf, err := json.Marshal(report)
+				if err != nil {
+					return Fail(ctx, http.StatusInternalServerError, "error marshalling health check report", err)
+				}
+				r = io.NopCloser(bytes.NewReader(buf))
+			case "stream":
+				if _, ok := Health.List()[n]; !ok {
+					return Fail(ctx, http.StatusNotFound, "no such health check run", health.ErrNotFound)
+				}
+
+				// one event per line until the run finishes
+				pr, pw := io.Pipe()
+				go func() {
+					enc := json.NewEncoder(pw)
+					pw.CloseWithError(Health.Follow(ctx, n, func(e health.Event) error {
+						return enc.Encode(e)
+					}))
+				}()
+				r = pr
+				header.Set("Content-Type", "application/x-ndjson")
+			case "transcript":
+				r, err = Health.Transcript(n)
+				if errors.Is(err, health.ErrNotFound) {
+					return Fail(ctx, http.StatusNotFound, "no such health check run", err)
+				} else if err != nil {
+					return Fail(ctx, http.StatusInternalServerError, "error opening health check transcript", err)
+				}
+				header.Set("Content-Type", "text/plain; charset=utf-8")
+			default:
+				return http.StatusNotFound, nil, nil
+			}
+		}
+	case "/api/assistant":
+		switch rest := req.URL.Path[i:]; {
+		case rest == "/sessions" || strings.HasPrefix(rest, "/sessions/"):
+			return assist(llama.WithClient(ctx, remote(conn)), req, strings.TrimPrefix(rest, "/sessions"))
+		default:
+			return http.StatusNotFound, nil, nil
+		}
+	case "/api/completions":
+		return completions(ctx, req, conn)
 	case "/api/services":
-		if req.Method != "GET" {
-			return http.StatusMethodNotAllowed, nil, nil
+		switch action := strings.TrimPrefix(req.URL.Path[i:], "/"); action {
+		case "":
+			if req.Method != "GET" {
+				return http.StatusMethodNotAllowed, nil, nil
+			}
+
+			m, err := ListServices(ctx)
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "failed listing systemd services", err)
+			}
+
+			buf, err := json.Marshal(m)
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error marshalling systemd services", err)
+			}
+
+			r = io.NopCloser(bytes.NewReader(buf))
+			header = http.Header{
+				"Content-Type": []string{"application/json"},
+			}
+		case "start", "stop", "restart":
+			if req.Method != "POST" {
+				return http.StatusMethodNotAllowed, nil, nil
+			}
+			var conn *systemd.Conn
+			conn, err = systemd.NewSystemConnectionContext(ctx)
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "failed connecting to systemd", err)
+			}
+			defer conn.Close()
+
+			dec := json.NewDecoder(req.Body)
+			if t, _ := dec.Token(); t != json.Delim('[') {
+				return Fail(ctx, http.StatusBadRequest, "expected a JSON array of unit names", nil)
+			}
+
+			var service string
+			for dec.More() {
+				err = dec.Decode(&service)
+				if err != nil {
+					break
+				}
+				switch action {
+				case "start":
+					_, err = conn.StartUnitContext(ctx, service, "replace", nil)
+				case "stop":
+					_, err = conn.StopUnitContext(ctx, service, "replace", nil)
+				case "restart":
+					_, err = conn.RestartUnitContext(ctx, service, "replace", nil)
+				}
+				if err != nil {
+					break
+				}
+			}
+
+			if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, fmt.Sprintf("failed to %s %s", action, service), err)
+			}
+
+			if t, _ := dec.Token(); t != json.Delim(']') {
+				return Fail(ctx, http.StatusBadRequest, "expected a JSON array of unit names", nil)
+			}
+		default:
+			return http.StatusNotFound, nil, nil
+		}
+	case "/api/log":
+		if req.URL.Path[i:] != "/level" {
+			return http.StatusNotFound, nil, nil
 		}
 
-		m, err := ListServices(ctx)
-		if err != nil {
-			panic(err)
+		switch req.Method {
+		case "GET":
+		case "PUT":
+			var change client.LogLevel
+			if err := json.NewDecoder(io.LimitReader(req.Body, 1<<12)).Decode(&change); err != nil {
+				return Fail(ctx, http.StatusBadRequest, "malformed log level", err)
+			}
+
+			if change.Level == "" && change.Subsystem != "" {
+				logging.ResetLevel(change.Subsystem)
+			} else if level, err := logging.ParseLevel(change.Level); err != nil {
+				return Fail(ctx, http.StatusBadRequest, "malformed log level", err)
+			} else {
+				logging.SetLevel(change.Subsystem, level)
+			}
+			httpLogger.InfoContext(ctx, "log level changed", "subsystem", change.Subsystem, "level", change.Level)
+		default:
+			return http.StatusMethodNotAllowed, nil, nil
 		}
 
-		buf, err := json.Marshal(m)
+		buf, err := json.Marshal(logging.Levels())
 		if err != nil {
-			log.Println("error marshalling systemd services", err)
-			return http.StatusInternalServerError, nil, nil
+			return Fail(ctx, http.StatusInternalServerError, "error marshalling log levels", err)
 		}
-
 		r = io.NopCloser(bytes.NewReader(buf))
 		header = http.Header{
 			"Content-Type": []string{"application/json"},
 		}
-		return
-	case "/api/services/start", "/api/services/stop", "/api/services/restart":
-		if req.Method != "POST" {
+	case "/api/alerts":
+		rest := req.URL.Path[i:]
+		switch {
+		case rest == "" && req.Method == "GET":
+		case rest == "/rules" && (req.Method == "GET" || req.Method == "PUT"):
+		case rest == "/sinks" && (req.Method == "GET" || req.Method == "PUT"):
+		case rest == "/silences" && (req.Method == "GET" || req.Method == "POST"):
+		case strings.HasPrefix(rest, "/silences/") && req.Method == "DELETE":
+		case rest == "", rest == "/rules", rest == "/sinks", strings.HasPrefix(rest, "/silences"):
 			return http.StatusMethodNotAllowed, nil, nil
-		}
-		var conn *systemd.Conn
-		conn, err = systemd.NewSystemConnectionContext(ctx)
-		if err != nil {
-			log.Println("failed connecting to systemd:", err)
-			return http.StatusInternalServerError, nil, nil
-		}
-		defer conn.Close()
-
-		dec := json.NewDecoder(req.Body)
-		if t, _ := dec.Token(); t != json.Delim('[') {
-			log.Println("error reading services '[' for restart:", err)
-			return http.StatusInternalServerError, nil, nil
+		default:
+			return http.StatusNotFound, nil, nil
 		}
 
-		var service string
-		for dec.More() {
-			err = dec.Decode(&service)
-			if err != nil {
-				break
+		body := io.LimitReader(req.Body, 1<<20)
+		var v interface{}
+		switch rest {
+		case "":
+			v = Alerts.Alerts()
+		case "/rules":
+			if req.Method == "PUT" {
+				var rules []alerts.Rule
+				if err := json.NewDecoder(body).Decode(&rules); err != nil {
+					return Fail(ctx, http.StatusBadRequest, "malformed alert rules", err)
+				}
+				if err := Alerts.SetRules(rules); errors.Is(err, alerts.ErrInvalid) {
+					return Fail(ctx, http.StatusBadRequest, "invalid alert rules", err)
+				} else if err != nil {
+					return Fail(ctx, http.StatusInternalServerError, "error saving alert rules", err)
+				}
+				httpLogger.InfoContext(ctx, "alert rules changed", "count", len(rules))
 			}
-			switch req.URL.Path {
-			case "/api/services/start":
-				_, err = conn.StartUnitContext(ctx, service, "replace", nil)
-			case "/api/services/stop":
-				_, err = conn.StopUnitContext(ctx, service, "replace", nil)
-			case "/api/services/restart":
-				_, err = conn.RestartUnitContext(ctx, service, "replace", nil)
+			v = Alerts.Rules()
+		case "/sinks":
+			if req.Method == "PUT" {
+				var sinks []alerts.SinkConfig
+				if err := json.NewDecoder(body).Decode(&sinks); err != nil {
+					return Fail(ctx, http.StatusBadRequest, "malformed alert sinks", err)
+				}
+				if err := Alerts.SetSinks(sinks); errors.Is(err, alerts.ErrInvalid) {
+					return Fail(ctx, http.StatusBadRequest, "invalid alert sinks", err)
+				} else if err != nil {
+					return Fail(ctx, http.StatusInternalServerError, "error saving alert sinks", err)
+				}
+				httpLogger.InfoContext(ctx, "alert sinks changed", "count", len(sinks))
 			}
-			if err != nil {
+			v = Alerts.Sinks()
+		case "/silences":
+			if req.Method == "GET" {
+				v = Alerts.Silences()
 				break
 			}
-		}
 
-		if err != nil {
-			log.Println("error reading services for restart:", err)
-			return http.StatusInternalServerError, nil, nil
+			var silence alerts.Silence
+			if err := json.NewDecoder(body).Decode(&silence); err != nil {
+				return Fail(ctx, http.StatusBadRequest, "malformed silence", err)
+			}
+			silence, err := Alerts.Silence(silence)
+			if errors.Is(err, alerts.ErrInvalid) {
+				return Fail(ctx, http.StatusBadRequest, "invalid silence", err)
+			} else if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error saving silence", err)
+			}
+			httpLogger.InfoContext(ctx, "alerts silenced", "id", silence.ID, "rule", silence.Rule, "subject", silence.Subject, "until", silence.Until)
+			v = silence
+		default:
+			id := strings.TrimPrefix(rest, "/silences/")
+			if err := Alerts.Unsilence(id); errors.Is(err, alerts.ErrNotFound) {
+				return Fail(ctx, http.StatusNotFound, "no such silence", err)
+			} else if err != nil {
+				return Fail(ctx, http.StatusInternalServerError, "error saving silences", err)
+			}
+			return http.StatusNoContent, nil, nil
 		}
 
-		if t, _ := dec.Token(); t != json.Delim(']') {
-			log.Println("error reading services ']' for restart:", err)
-			return http.StatusInternalServerError, nil, nil
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return Fail(ctx, http.StatusInternalServerError, "error marshalling alerts", err)
 		}
-	case "", "/":
-		code = http.StatusMovedPermanently
+		r = io.NopCloser(bytes.NewReader(buf))
 		header = http.Header{
-			"Location": []string{"/dashboard/"},
+			"Content-Type": []string{"application/json"},
 		}
-		return
-	default:
+	case "/api/dns":
+		return resolver(ctx, req, req.URL.Path[i:])
+	case "/api/metrics":
 		if req.Method != "GET" {
-			return http.StatusNotFound, nil, nil
+			return http.StatusMethodNotAllowed, nil, nil
 		}
 
-		path := filepath.Join(ServeDirectory, filepath.Clean(req.URL.Path))
-
-		if strings.HasSuffix(req.URL.Path, "/") {
-			path = filepath.Join(ServeDirectory, filepath.Clean(req.URL.Path), "index.html")
+		var v interface{}
+		switch q := req.URL.Query(); req.URL.Path[i:] {
+		case "/series":
+			v = History.Names(q.Get("prefix"))
+		case "/query":
+			m, err := QueryHistory(q, time.Now())
+			switch {
+			case err == tsdb.ErrNoSeries:
+				return Fail(ctx, http.StatusNotFound, "no matching series", err)
+			case err != nil:
+				return Fail(ctx, http.StatusBadRequest, "malformed metrics query", err)
+			}
+			v = m
+		default:
+			return http.StatusNotFound, nil, nil
 		}
 
-		info, err := os.Stat(path)
+		buf, err := json.Marshal(v)
 		if err != nil {
-			return http.StatusNotFound, nil, nil
-		} else if info.IsDir() {
-			code = http.StatusMovedPermanently
-			header = http.Header{
-				"Location": []string{req.URL.Path + "/"},
-			}
-			return
-		} else if ts := req.Header.Get("If-Modified-Since"); ts == "" {
-			// fine
-		} else if t, err := time.Parse(http.TimeFormat, ts); err != nil {
-			// fine
-			log.Printf("If-Modified-Since time parse failure: %v\n", err)
-		} else if !info.ModTime().Truncate(time.Second).After(t) {
-			return http.StatusNotModified, nil, nil
+			return Fail(ctx, http.StatusInternalServerError, "error marshalling metrics", err)
 		}
-
-		if r, err = os.Open(path); err != nil {
-			log.Println("error openning:", err)
-			return http.StatusInternalServerError, nil, nil
+		r = io.NopCloser(bytes.NewReader(buf))
+		header = http.Header{
+			"Content-Type": []string{"application/json"},
+		}
+	case "/metrics":
+		if req.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil, nil
 		}
 
+		var w *io.PipeWriter
+		r, w = io.Pipe()
+		go func() {
+			w.CloseWithError(metrics.Default.Write(ctx, w))
+		}()
+		header = http.Header{
+			"Content-Type": []string{metrics.ContentType},
+		}
+	case "/api/openapi.json":
+		if req.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil, nil
+		}
+		r = io.NopCloser(bytes.NewReader(client.Spec))
+		header = http.Header{
+			"Content-Type": []string{"application/json"},
+		}
+	case "", "/":
+		code = http.StatusMovedPermanently
 		header = http.Header{
-			"Content-Type":   []string{mime.TypeByExtension(filepath.Ext(path))},
-			"Last-Modified":  []string{info.ModTime().UTC().Format(http.TimeFormat)},
-			"Content-Length": []string{strconv.FormatInt(info.Size(), 10)},
+			"Location": []string{"/dashboard/"},
 		}
+		return
+	default:
+		return Static.Serve(req.WithContext(ctx))
 	}
 	return
 }
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"avaron/agent"
+	"avaron/assistant"
+	"avaron/client"
+	"avaron/dns"
+	"avaron/llama"
+	"avaron/rid"
+	"avaron/tsdb"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	filepath "path"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+type spec struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func loadSpec(t *testing.T) spec {
+	var s spec
+	if err := json.Unmarshal(client.Spec, &s); err != nil {
+		t.Fatalf("openapi.json doesn't parse: %v", err)
+	}
+	if len(s.Paths) == 0 {
+		t.Fatal("openapi.json documents no paths")
+	}
+	return s
+}
+
+// fill substitutes path parameters with something the handlers will route
+func fill(path string) string {
+	for {
+		i := strings.Index(path, "{")
+		j := strings.Index(path, "}")
+		if i < 0 || j < i {
+			return path
+		}
+		path = path[:i] + "1" + path[j+1:]
+	}
+}
+
+func TestSpecMethods(t *testing.T) {
+	for path, ops := range loadSpec(t).Paths {
+		for method := range ops {
+			switch method {
+			case "get", "post", "put", "delete", "patch":
+			default:
+				t.Errorf("%s: unexpected operation '%s'", path, method)
+			}
+		}
+
+		// every documented route must be routed, so a bogus method is refused rather than not found
+		req := httptest.NewRequest("BREW", fill(path), nil)
+		code, _, r := handle(context.Background(), req, nil)
+		if r != nil {
+			r.Close()
+		}
+		if code != http.StatusMethodNotAllowed {
+			t.Errorf("BREW %s: got %d, want %d", path, code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestSpecCoversRoutes(t *testing.T) {
+	s := loadSpec(t)
+
+	f, err := parser.ParseFile(token.NewFileSet(), "http.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var routes []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		if fn, ok := n.(*ast.FuncDecl); ok && fn.Name.Name != "handle" {
+			return false
+		}
+		clause, ok := n.(*ast.CaseClause)
+		if !ok {
+			return true
+		}
+		for _, e := range clause.List {
+			lit, ok := e.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				continue
+			}
+			if v, _ := strconv.Unquote(lit.Value); strings.HasPrefix(v, "/api/") {
+				routes = append(routes, v)
+			}
+		}
+		return true
+	})
+
+	if len(routes) == 0 {
+		t.Fatal("found no routes in handle()")
+	}
+	// prefixes like /api/keys are covered by their sub-routes
+	documented := func(route string) bool {
+		for path := range s.Paths {
+			if path == route || strings.HasPrefix(path, route+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, route := range routes {
+		if !documented(route) {
+			t.Errorf("%s is routed but missing from openapi.json", route)
+		}
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	ctx := rid.With(context.Background(), "test-id")
+
+	req := httptest.NewRequest("BREW", "/api/nodes", nil)
+	code, header, r := recovered(ctx, req, nil)
+	if code != http.StatusMethodNotAllowed {
+		t.Fatalf("got %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if ct := header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %s", ct)
+	}
+	defer r.Close()
+
+	var e client.Error
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != code || e.Message == "" || e.RequestID != "test-id" {
+		t.Errorf("unexpected envelope %+v", e)
+	}
+}
+
+func TestFailDetails(t *testing.T) {
+	ctx := rid.With(context.Background(), "abc")
+	code, _, r := Fail(ctx, http.StatusBadRequest, "malformed thing", errors.New("bad byte"))
+	defer r.Close()
+
+	var e client.Error
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadRequest || e.Message != "malformed thing" || e.Details != "bad byte" || e.RequestID != "abc" {
+		t.Errorf("unexpected envelope %d %+v", code, e)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	for path, want := range map[string]string{
+		"/":                         "/",
+		"/api/health/1700000000":    "/api/health",
+		"/api/ca/csr":               "/api/ca",
+		"/api/nodes":                "/api/nodes",
+		"/metrics":                  "/metrics",
+		"/dashboard/index.js":       "static",
+		"/favicon.png":              "static",
+		"/api/terminal/sessions/12": "/api/terminal",
+		"/api/made-up-1234":         "other",
+		"/api/":                     "other",
+	} {
+		if got := route(path); got != want {
+			t.Errorf("route(%s) = %s, want %s", path, got, want)
+		}
+	}
+
+	for m, want := range map[string]string{"GET": "GET", "DELETE": "DELETE", "get": "OTHER", "BREW": "OTHER"} {
+		if got := method(m); got != want {
+			t.Errorf("method(%s) = %s, want %s", m, got, want)
+		}
+	}
+}
+
+func TestQueryHistory(t *testing.T) {
+	now := time.Unix(1700000400, 0)
+	for i := 0; i < 30; i++ {
+		History.Add("interface/test0/rx_bytes", tsdb.Counter, now.Add(time.Duration(i-30)*10*time.Second), float64(i*500))
+	}
+
+	m, err := QueryHistory(url.Values{"series": {"interface/test0/*"}, "from": {"-2m"}, "step": {"60"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Step != 60 || len(m.Series["interface/test0/rx_bytes"]) != 2 {
+		t.Fatalf("unexpected result %+v", m)
+	}
+	for _, p := range m.Series["interface/test0/rx_bytes"] {
+		if p[1] != 50 {
+			t.Errorf("rate at %v is %v, want 50", p[0], p[1])
+		}
+	}
+
+	if _, err := QueryHistory(url.Values{"series": {"nope"}}, now); err != tsdb.ErrNoSeries {
+		t.Errorf("got %v, want ErrNoSeries", err)
+	}
+	if _, err := QueryHistory(url.Values{"series": {"interface/*"}, "from": {"yesterday"}}, now); err == nil {
+		t.Error("accepted a malformed time")
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	fake := &llama.Fake{Responses: []string{"HEALTHY enough"}}
+	defer func(b llama.Backend) { llama.Default = b }(llama.Default)
+	llama.Default = fake
+
+	body := `{"messages":[{"role":"user","content":"how's the network?"}],"stream":true}`
+	req := httptest.NewRequest("POST", "/api/completions", strings.NewReader(body))
+	code, header, r := handle(context.Background(), req, nil)
+	if code != http.StatusOK || header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d %v", code, header)
+	}
+	defer r.Close()
+
+	var content string
+	buf, _ := io.ReadAll(r)
+	for _, line := range strings.Split(string(buf), "\n") {
+		var token llama.Token
+		if line == "" {
+			continue
+		} else if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &token); err != nil {
+			t.Fatalf("bad event %q: %v", line, err)
+		}
+		content += token.Content
+	}
+	if content != "HEALTHY enough" || len(fake.Requests) != 1 || fake.Requests[0] != "how's the network?" {
+		t.Errorf("unexpected completion %q for %q", content, fake.Requests)
+	}
+}
+
+func TestCompletionErrors(t *testing.T) {
+	upstream := &llama.StatusError{Code: http.StatusBadRequest, Status: "400 Bad Request", Body: []byte(`{"error":{"code":400,"message":"context too long"}}`)}
+	fake := &llama.Fake{Err: upstream}
+	defer func(b llama.Backend) { llama.Default = b }(llama.Default)
+	llama.Default = fake
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`{"prompt":"hi"}`, http.StatusBadRequest},
+		{`{"prompt":"hi","stream":true}`, http.StatusBadRequest},
+		{fmt.Sprintf(`{"prompt":"hi","n_predict":%d}`, llama.MaxPredict+1), http.StatusBadRequest},
+		{`{"prompt":"` + strings.Repeat("x", MaxCompletionRequest) + `"}`, http.StatusRequestEntityTooLarge},
+		{`{"prompt":`, http.StatusBadRequest},
+	} {
+		code, _, r := handle(context.Background(), httptest.NewRequest("POST", "/api/completions", strings.NewReader(c.body)), nil)
+		if code != c.code {
+			t.Errorf("got %d, want %d", code, c.code)
+		}
+		r.Close()
+	}
+	if len(fake.Requests) != 2 {
+		t.Errorf("got %d requests to llama, want the 2 within limits", len(fake.Requests))
+	}
+
+	// llama-server's error reaches the client as it was
+	code, _, r := handle(context.Background(), httptest.NewRequest("POST", "/api/completions", strings.NewReader(`{"prompt":"hi"}`)), nil)
+	var e struct {
+		Details json.RawMessage `json:"details"`
+	}
+	json.NewDecoder(r).Decode(&e)
+	r.Close()
+	if code != http.StatusBadRequest || string(e.Details) != string(upstream.Body) {
+		t.Errorf("got %d with %s", code, e.Details)
+	}
+
+	fake.Err = llama.ErrQueueFull
+	if code, header, _ := handle(context.Background(), httptest.NewRequest("POST", "/api/completions", strings.NewReader(`{"prompt":"hi"}`)), nil); code != http.StatusServiceUnavailable || header.Get("Retry-After") == "" {
+		t.Errorf("got %d %v while llama's busy", code, header)
+	}
+	fake.Err = &llama.RateError{Client: "10.0.0.2", Retry: 1500 * time.Millisecond}
+	if code, header, _ := handle(context.Background(), httptest.NewRequest("POST", "/api/completions", strings.NewReader(`{"prompt":"hi"}`)), nil); code != http.StatusTooManyRequests || header.Get("Retry-After") != "2" {
+		t.Errorf("got %d %v over the rate limit", code, header)
+	}
+}
+
+func TestAssistant(t *testing.T) {
+	a := agent.New()
+	a.Backend = &llama.Fake{Responses: []string{"all good"}}
+	defer func(m *assistant.Manager) { Assistant = m }(Assistant)
+	Assistant = assistant.New(t.TempDir(), a)
+
+	ctx := context.Background()
+	code, _, r := handle(ctx, httptest.NewRequest("POST", "/api/assistant/sessions", nil), nil)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d creating a session", code)
+	}
+	var s assistant.Session
+	json.NewDecoder(r).Decode(&s)
+	r.Close()
+
+	code, _, _ = handle(ctx, httptest.NewRequest("POST", "/api/assistant/sessions/42/messages", strings.NewReader(`{"content":"hi"}`)), nil)
+	if code != http.StatusNotFound {
+		t.Errorf("got %d asking an unknown session", code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/assistant/sessions/"+s.ID+"/messages", strings.NewReader(`{"content":"how's the network?"}`))
+	code, header, r := handle(ctx, req, nil)
+	if code != http.StatusOK || header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d %v", code, header)
+	}
+	buf, _ := io.ReadAll(r)
+	r.Close()
+	events := strings.Split(strings.TrimSpace(string(buf)), "\n\n")
+	if len(events) != 3 || !strings.HasPrefix(events[0], "event: token\n") || !strings.HasPrefix(events[2], "event: done\ndata: {\"role\":\"assistant\",\"content\":\"all good\"") {
+		t.Errorf("unexpected events %q", events)
+	}
+}
+
+func TestDNS(t *testing.T) {
+	dir := t.TempDir()
+	zone := template.Must(template.New("").Parse(NamedZone))
+	defer func(z *dns.Zone, r dns.Resolver) { Zone, Resolver = z, r }(Zone, Resolver)
+	Zone = dns.New("avaron.lan", filepath.Join(dir, "zone"), net.ParseIP("fc00:a7a0::1"), zone)
+	Zone.RecordsFile = filepath.Join(dir, "records.json")
+	Resolver = dns.NewServer(Zone, nil)
+
+	ctx := context.Background()
+	code, _, r := handle(ctx, httptest.NewRequest("POST", "/api/dns/records", strings.NewReader(`{"name":"printer","type":"A","value":"192.0.2.7"}`)), nil)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d adding a record", code)
+	}
+	var record dns.Custom
+	json.NewDecoder(r).Decode(&record)
+	r.Close()
+	// the zone's rendered from the real template
+	if buf, _ := os.ReadFile(Zone.File); !strings.Contains(string(buf), "\nprinter.avaron.lan. 30 IN A 192.0.2.7\n") {
+		t.Errorf("record missing from zone\n%s", buf)
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/api/dns/records", `{"name":"printer","type":"CNAME","value":"branch-a.avaron.lan"}`, http.StatusBadRequest},
+		{"POST", "/api/dns/records", `{"name":"bad name","type":"A","value":"192.0.2.7"}`, http.StatusBadRequest},
+		{"PUT", "/api/dns/records/" + record.ID, `{"name":"printer","type":"AAAA","value":"fc00:a7a0::7"}`, http.StatusOK},
+		{"PUT", "/api/dns/records/42", `{"name":"printer","type":"A","value":"192.0.2.8"}`, http.StatusNotFound},
+		{"GET", "/api/dns/records/" + record.ID, "", http.StatusMethodNotAllowed},
+		{"PUT", "/api/dns/forwarders", `["192.0.2.53", "nowhere"]`, http.StatusBadRequest},
+		{"PUT", "/api/dns/forwarders", `["192.0.2.53"]`, http.StatusOK},
+		{"GET", "/api/dns/stats", "", http.StatusOK},
+		{"DELETE", "/api/dns/records/" + record.ID, "", http.StatusNoContent},
+		{"GET", "/api/dns/zones", "", http.StatusNotFound},
+	} {
+		code, _, r := handle(ctx, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)), nil)
+		if code != c.code {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.path, code, c.code)
+		}
+		if r != nil {
+			r.Close()
+		}
+	}
+
+	if list := Resolver.Forwarders(); len(list) != 1 || list[0] != "192.0.2.53:53" {
+		t.Errorf("unexpected forwarders %q", list)
+	}
+	if buf, _ := os.ReadFile(Zone.File); strings.Contains(string(buf), "printer") {
+		t.Errorf("unexpected zone\n%s", buf)
+	}
+}
@@ -0,0 +1,114 @@
+package llama
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Fake answers deterministically, for tests & running without a model
+type Fake struct {
+	// answered in turn, repeating the last, "HEALTHY" when empty
+	Responses []string
+	// made along with the response of the same index, which isn't repeated
+	ToolCalls [][]ToolCall
+	// every prompt, or chat's last message, in order
+	Requests []string
+	// returned instead of a response when set
+	Err error
+
+	lock sync.Mutex
+	n    int
+}
+
+func (f *Fake) next(prompt string) (string, []ToolCall) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.Requests = append(f.Requests, prompt)
+
+	n := f.n
+	f.n++
+	var calls []ToolCall
+	if n < len(f.ToolCalls) {
+		calls = f.ToolCalls[n]
+	}
+	switch {
+	case len(f.Responses) == 0:
+		return "HEALTHY", calls
+	case n >= len(f.Responses):
+		return f.Responses[len(f.Responses)-1], calls
+	}
+	return f.Responses[n], calls
+}
+
+func (f *Fake) Complete(ctx context.Context, req Request) (Completion, error) {
+	return f.Stream(ctx, req, nil)
+}
+
+func (f *Fake) Stream(ctx context.Context, req Request, fn func(Token) error) (Completion, error) {
+	return f.respond(ctx, req.Prompt, fn)
+}
+
+func (f *Fake) Chat(ctx context.Context, req ChatRequest, fn func(Token) error) (Completion, error) {
+	var last string
+	if n := len(req.Messages); n > 0 {
+		last = req.Messages[n-1].Content
+	}
+	return f.respond(ctx, last, fn)
+}
+
+// respond streams the next response a word at a time
+func (f *Fake) respond(ctx context.Context, prompt string, fn func(Token) error) (c Completion, err error) {
+	response, calls := f.next(prompt)
+	if f.Err != nil {
+		return c, f.Err
+	}
+	words := split(response)
+	c.ToolCalls = calls
+	c.Evaluated = len(split(prompt))
+	for i, word := range words {
+		if err = ctx.Err(); err != nil {
+			return c, err
+		}
+		c.Content += word
+		c.Predicted++
+		if fn == nil {
+			continue
+		}
+		token := Token{Index: i, Content: word, Stop: i == len(words)-1}
+		if token.Stop {
+			token.Predicted, token.Evaluated = c.Predicted, c.Evaluated
+		}
+		if err = fn(token); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// Tokenize numbers each word by its length
+func (f *Fake) Tokenize(ctx context.Context, text string) ([]int, error) {
+	words := split(text)
+	tokens := make([]int, len(words))
+	for i, word := range words {
+		tokens[i] = len(word)
+	}
+	return tokens, nil
+}
+
+// split breaks s after each run of whitespace, so the pieces join back into s
+func split(s string) (words []string) {
+	for len(s) > 0 {
+		i := strings.IndexAny(s, " \n\t")
+		if i == -1 {
+			return append(words, s)
+		}
+		j := i + 1
+		for j < len(s) && strings.IndexByte(" \n\t", s[j]) != -1 {
+			j++
+		}
+		words = append(words, s[:j])
+		s = s[j:]
+	}
+	return
+}
@@ -1,17 +1,32 @@
 package llama
 
 import (
+	"avaron/logging"
+	"avaron/metrics"
+	"avaron/rid"
+	"bufio"
+	"bytes"
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+var logger = logging.For("llama")
+
 type Request struct {
-	Prompt string `json:"prompt"`
-	Model  string `json:"model"`
-	Stream bool   `json:"stream"`
+	Prompt  string `json:"prompt"`
+	Model   string `json:"model"`
+	Stream  bool   `json:"stream"`
+	Predict int    `json:"n_predict,omitempty"` // most tokens to generate, unlimited when 0
 }
 
 type Token struct {
@@ -24,28 +39,267 @@ type Token struct {
 	Evaluated int    `json:"tokens_evaluated"`
 }
 
+// Message is one entry of a chat
+type Message struct {
+	Role    string `json:"role"` // system, user, assistant or tool
+	Content string `json:"content"`
+
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // the assistant's
+	ToolCallID string     `json:"tool_call_id,omitempty"` // what a tool message answers
+	Name       string     `json:"name,omitempty"`         // of the tool answering
+}
+
+// Tool is a function the model may call, described by a JSON schema of its arguments
+type Tool struct {
+	Type     string   `json:"type"` // function
+	Function Function `json:"function"`
+}
+
+type Function struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"` // function
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON
+}
+
+type ChatRequest struct {
+	Model     string    `json:"model"`
+	Messages  []Message `json:"messages"`
+	Tools     []Tool    `json:"tools,omitempty"`
+	MaxTokens int       `json:"max_tokens,omitempty"`
+}
+
+// Completion is the whole of a model's response
+type Completion struct {
+	Content   string     `json:"content"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Predicted int        `json:"tokens_predicted"`
+	Evaluated int        `json:"tokens_evaluated"`
+}
+
+// Backend is an LLM server
+type Backend interface {
+	// Complete generates a continuation of req.Prompt
+	Complete(ctx context.Context, req Request) (Completion, error)
+	// Stream is Complete, calling fn with each token as it's generated
+	Stream(ctx context.Context, req Request, fn func(Token) error) (Completion, error)
+	// Chat responds to req.Messages, streaming tokens to fn unless it's nil
+	Chat(ctx context.Context, req ChatRequest, fn func(Token) error) (Completion, error)
+	// Tokenize splits text into the model's tokens
+	Tokenize(ctx context.Context, text string) ([]int, error)
+}
+
+var ErrUnsupported = errors.New("unsupported by this backend")
+
+// StatusError is a non-2xx response from the backend
+type StatusError struct {
+	Code   int
+	Status string
+	Body   []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("llama responded with %s: %s", e.Status, bytes.TrimSpace(e.Body))
+}
+
 var (
 	Client http.Client
+
+	// Default answers the health checker & /api/completions
+	Default Backend = &Fake{}
+
+	// Model is asked for when a request doesn't name one, LLAMA_MODEL
+	Model = "mixtral.gguf"
+
+	// MaxPredict bounds the tokens an API request may ask for, LLAMA_MAX_PREDICT
+	MaxPredict = 2048
+
+	Duration = metrics.NewHistogram("avaron_llama_request_duration_seconds",
+		"Time from sending a request to llama-server until its response is consumed, by path & status",
+		[]float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "path", "code")
 )
 
+// requestID tags requests with the ID of the API request they serve, if any
+type requestID struct {
+	http.RoundTripper
+}
+
+func (t requestID) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := rid.From(req.Context()); id != "" && req.Header.Get(rid.Header) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(rid.Header, id)
+	}
+
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		Duration.Observe(time.Since(start).Seconds(), req.URL.Path, "error")
+		return nil, err
+	}
+	// responses stream, so the request lasts until the body is done with
+	res.Body = &timed{ReadCloser: res.Body, start: start, path: req.URL.Path, code: strconv.Itoa(res.StatusCode)}
+	return res, nil
+}
+
+type timed struct {
+	io.ReadCloser
+	start      time.Time
+	path, code string
+	once       sync.Once
+}
+
+func (t *timed) Close() error {
+	t.once.Do(func() {
+		Duration.Observe(time.Since(t.start).Seconds(), t.path, t.code)
+	})
+	return t.ReadCloser.Close()
+}
+
+// post sends in as JSON, returning the response if it's 2xx
+func post(ctx context.Context, c *http.Client, url, key string, in interface{}) (*http.Response, error) {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	return do(c, req)
+}
+
+// get is post without a body
+func get(ctx context.Context, c *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(c, req)
+}
+
+// do returns the response to req if it's 2xx, & a StatusError otherwise
+func do(c *http.Client, req *http.Request) (*http.Response, error) {
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		return nil, &StatusError{Code: res.StatusCode, Status: res.Status, Body: body}
+	}
+	return res, nil
+}
+
+// events calls fn with the data of each server-sent event in r, until a [DONE] event or EOF
+func events(r io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case len(line) == 0, strings.HasPrefix(line, ":"), strings.HasPrefix(line, "event:"), strings.HasPrefix(line, "id:"):
+			continue
+		case strings.HasPrefix(line, "error:"):
+			return fmt.Errorf("llama stream failed: %s", strings.TrimSpace(strings.TrimPrefix(line, "error:")))
+		case !strings.HasPrefix(line, "data:"):
+			return fmt.Errorf("unexpected line in llama stream: %q", line)
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+		if err := fn([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Init picks the backend from LLAMA_BACKEND: llama.cpp (the default), openai or fake
 func Init() {
+	if model := os.Getenv("LLAMA_MODEL"); model != "" {
+		Model = model
+	}
+
+	var backend Backend
+	switch name := os.Getenv("LLAMA_BACKEND"); name {
+	case "", "llama.cpp":
+		dial()
+		backend = &LlamaCpp{HTTP: &Client, Base: "http://localhost"}
+	case "openai":
+		Client = http.Client{Transport: requestID{http.DefaultTransport}}
+		base := os.Getenv("LLAMA_SERVER")
+		if base == "" {
+			base = "https://api.openai.com"
+		}
+		backend = &OpenAI{HTTP: &Client, Base: strings.TrimSuffix(base, "/"), Key: os.Getenv("LLAMA_API_KEY")}
+	case "fake":
+		backend = &Fake{}
+	default:
+		logger.Warn("unknown LLAMA_BACKEND, falling back to llama.cpp", "backend", name)
+		dial()
+		backend = &LlamaCpp{HTTP: &Client, Base: "http://localhost"}
+	}
+
+	slots, depth, rate, burst := 0, DefaultDepth, DefaultRate, DefaultBurst
+	for _, env := range []struct {
+		name string
+		n    *int
+	}{{"LLAMA_SLOTS", &slots}, {"LLAMA_QUEUE", &depth}, {"LLAMA_RATE", &rate}, {"LLAMA_BURST", &burst}, {"LLAMA_MAX_PREDICT", &MaxPredict}} {
+		if s := os.Getenv(env.name); s == "" {
+			// default
+		} else if n, err := strconv.Atoi(s); err != nil || n <= 0 {
+			logger.Warn("ignoring "+env.name, "value", s, "err", err)
+		} else {
+			*env.n = n
+		}
+	}
+	// llama-server holds whatever it can't start in its own unbounded queue,
+	// so requests wait here instead where they can be ordered, refused or
+	// cancelled. Its slot count is followed unless LLAMA_SLOTS is set
+	scheduler := NewScheduler(backend, slots, depth)
+	scheduler.Discover = slots == 0
+	scheduler.Rate, scheduler.Burst = float64(rate)/60, burst
+	Default = scheduler
+}
+
+// dial points Client at llama-server's socket, or LLAMA_SERVER
+func dial() {
 	host := os.Getenv("LLAMA_SERVER")
-	log.Println("host", host)
+	logger.Debug("llama-server", "host", host)
 	if host == "" {
 		Client = http.Client{
-			Transport: &http.Transport{
+			Transport: requestID{&http.Transport{
 				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
 					return net.Dial("unix", "/var/run/llama.sock")
 				},
-			},
+			}},
 		}
 	} else {
 		Client = http.Client{
-			Transport: &http.Transport{
+			Transport: requestID{&http.Transport{
 				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
 					return net.Dial("tcp", host)
 				},
-			},
+			}},
 		}
 	}
 }
@@ -0,0 +1,254 @@
+package llama
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collect streams into a slice of token contents
+func collect(tokens *[]string) func(Token) error {
+	return func(t Token) error {
+		*tokens = append(*tokens, t.Content)
+		return nil
+	}
+}
+
+func TestLlamaCpp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		switch {
+		case req.URL.Path == "/tokenize":
+			io.WriteString(w, `{"tokens":[1,2,3]}`)
+		case req.URL.Path == "/completions" && strings.Contains(string(body), `"stream":true`):
+			io.WriteString(w, "data: {\"content\":\"HEAL\"}\n\n")
+			io.WriteString(w, "data: {\"content\":\"THY\",\"stop\":true,\"tokens_predicted\":2,\"tokens_evaluated\":7}\n\n")
+		case req.URL.Path == "/completions":
+			io.WriteString(w, `{"content":"HEALTHY","stop":true,"tokens_predicted":2}`)
+		case req.URL.Path == "/v1/chat/completions":
+			io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+		default:
+			http.Error(w, `{"error":"nope"}`, http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	l := &LlamaCpp{HTTP: server.Client(), Base: server.URL}
+	ctx := context.Background()
+
+	var tokens []string
+	c, err := l.Stream(ctx, Request{Prompt: "?"}, collect(&tokens))
+	if err != nil || c.Content != "HEALTHY" || c.Predicted != 2 || len(tokens) != 2 {
+		t.Errorf("unexpected stream %+v %v: %v", c, tokens, err)
+	}
+	if c, err = l.Complete(ctx, Request{Prompt: "?"}); err != nil || c.Content != "HEALTHY" {
+		t.Errorf("unexpected completion %+v: %v", c, err)
+	}
+	if c, err = l.Chat(ctx, ChatRequest{Messages: []Message{{Role: "user", Content: "hello"}}}, collect(&tokens)); err != nil || c.Content != "hi" {
+		t.Errorf("unexpected chat %+v: %v", c, err)
+	}
+	if ids, err := l.Tokenize(ctx, "a b c"); err != nil || len(ids) != 3 {
+		t.Errorf("unexpected tokens %v: %v", ids, err)
+	}
+
+	var status *StatusError
+	l.Base += "/missing"
+	if _, err = l.Complete(ctx, Request{}); !errors.As(err, &status) || status.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %v, want a 503 StatusError", err)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	for _, body := range []string{
+		"data: {\"content\":\"a\"}\n\nerror: {\"message\":\"slot unavailable\"}\n\n",
+		"data: {\"content\":\"a\"}\n\nwhat's this\n",
+		"data: {nope\n\n",
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, body)
+		}))
+		l := &LlamaCpp{HTTP: server.Client(), Base: server.URL}
+		if _, err := l.Stream(context.Background(), Request{}, func(Token) error { return nil }); err == nil {
+			t.Errorf("accepted stream %q", body)
+		}
+		server.Close()
+	}
+}
+
+func TestOpenAI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		switch {
+		case req.URL.Path == "/v1/completions" && strings.Contains(string(body), `"stream":true`):
+			for _, s := range []string{"UN", "HEALTHY"} {
+				fmt.Fprintf(w, "data: {\"choices\":[{\"text\":%q,\"finish_reason\":null}]}\n\n", s)
+			}
+			io.WriteString(w, "data: [DONE]\n\n")
+		case req.URL.Path == "/v1/chat/completions" && strings.Contains(string(body), `"stream":true`):
+			// tool calls arrive in pieces
+			io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"ping\",\"arguments\":\"{\\\"host\\\":\"}}]}}]}\n\n")
+			io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\"::1\\\"}\"}}]},\"finish_reason\":\"tool_calls\"}]}\n\n")
+			io.WriteString(w, "data: [DONE]\n\n")
+		case req.URL.Path == "/v1/chat/completions":
+			io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	o := &OpenAI{HTTP: server.Client(), Base: server.URL, Key: "secret"}
+	ctx := context.Background()
+
+	var tokens []string
+	c, err := o.Stream(ctx, Request{Prompt: "?"}, collect(&tokens))
+	if err != nil || c.Content != "UNHEALTHY" || len(tokens) != 2 {
+		t.Errorf("unexpected stream %+v %v: %v", c, tokens, err)
+	}
+	if c, err = o.Chat(ctx, ChatRequest{Messages: []Message{{Role: "user", Content: "hello"}}}, nil); err != nil || c.Content != "hi" || c.Evaluated != 3 {
+		t.Errorf("unexpected chat %+v: %v", c, err)
+	}
+	c, err = o.Chat(ctx, ChatRequest{Messages: []Message{{Role: "user", Content: "ping"}}}, collect(&tokens))
+	if err != nil || len(c.ToolCalls) != 1 || c.ToolCalls[0].ID != "call_1" || c.ToolCalls[0].Function.Arguments != `{"host":"::1"}` {
+		t.Errorf("unexpected tool calls %+v: %v", c.ToolCalls, err)
+	}
+	if _, err = o.Tokenize(ctx, "a"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("got %v, want ErrUnsupported", err)
+	}
+}
+
+func TestFake(t *testing.T) {
+	f := &Fake{Responses: []string{"UNHEALTHY\n\n$ ip -br link show", "HEALTHY"}}
+	ctx := context.Background()
+
+	var tokens []string
+	c, err := f.Stream(ctx, Request{Prompt: "how's the network?"}, collect(&tokens))
+	if err != nil || c.Content != f.Responses[0] || strings.Join(tokens, "") != c.Content || len(tokens) != 6 {
+		t.Errorf("unexpected stream %+v %q: %v", c, tokens, err)
+	}
+	for i := 0; i < 2; i++ {
+		if c, _ = f.Complete(ctx, Request{}); c.Content != "HEALTHY" {
+			t.Errorf("response %d was %q, want the last repeated", i, c.Content)
+		}
+	}
+	if len(f.Requests) != 3 || f.Requests[0] != "how's the network?" {
+		t.Errorf("unexpected requests %q", f.Requests)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	fake := &Fake{}
+	s := NewScheduler(fake, 1, 2)
+	ctx := context.Background()
+
+	// the only slot is held until released
+	holding, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Stream(ctx, Request{}, func(Token) error {
+			close(holding)
+			<-release
+			return nil
+		})
+	}()
+	<-holding
+
+	// a health check queues first, then someone asks, then gives up
+	wait := func(ctx context.Context, p Priority) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := s.Complete(WithPriority(ctx, p), Request{Prompt: p.String()})
+			errs <- err
+		}()
+		for n := s.Waiting(); s.Waiting() == n; {
+			time.Sleep(time.Millisecond)
+		}
+		return errs
+	}
+	background := wait(ctx, Background)
+	interactive := wait(ctx, Interactive)
+	if _, err := s.Complete(ctx, Request{}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got %v, want ErrQueueFull", err)
+	}
+	impatient, cancel := context.WithCancel(ctx)
+	s.Depth = 3
+	cancelled := wait(impatient, Interactive)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+
+	// the one asking goes ahead of the health check
+	close(release)
+	<-done
+	if err1, err2 := <-interactive, <-background; err1 != nil || err2 != nil {
+		t.Errorf("unexpected errors %v %v", err1, err2)
+	}
+	if got := strings.Join(fake.Requests, " "); got != " interactive background" {
+		t.Errorf("served %q", got)
+	}
+	if stats := s.Stats(); stats != (Stats{Slots: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewScheduler(&Fake{}, 4, 0)
+	s.Rate, s.Burst = 1, 2
+	now := time.Now()
+
+	for i, want := range []bool{true, true, false} {
+		if _, ok := s.allow("10.0.0.2", now); ok != want {
+			t.Errorf("request %d allowed %t", i, ok)
+		}
+	}
+	if retry, ok := s.allow("10.0.0.2", now.Add(500*time.Millisecond)); ok || retry != 500*time.Millisecond {
+		t.Errorf("allowed %t, retry in %s", ok, retry)
+	}
+	if _, ok := s.allow("10.0.0.2", now.Add(time.Second)); !ok {
+		t.Error("refused once refilled")
+	}
+	if _, ok := s.allow("10.0.0.3", now); !ok {
+		t.Error("refused another client")
+	}
+
+	var limited *RateError
+	ctx := WithClient(context.Background(), "10.0.0.4")
+	for i := 0; i < 3; i++ {
+		_, err := s.Complete(ctx, Request{})
+		if i < 2 && err != nil || i == 2 && !errors.As(err, &limited) {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+}
+
+func TestSlots(t *testing.T) {
+	props := `{"total_slots":4}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/props":
+			io.WriteString(w, props)
+		case "/slots":
+			io.WriteString(w, `[{"id":0},{"id":1}]`)
+		}
+	}))
+	defer server.Close()
+
+	l := &LlamaCpp{HTTP: server.Client(), Base: server.URL}
+	for _, want := range []int{4, 2} {
+		if n, err := l.Slots(context.Background()); err != nil || n != want {
+			t.Errorf("got %d slots, want %d: %v", n, want, err)
+		}
+		props = `{}`
+	}
+}
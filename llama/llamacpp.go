@@ -0,0 +1,98 @@
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// LlamaCpp is llama.cpp's llama-server
+type LlamaCpp struct {
+	HTTP *http.Client
+	Base string // ie. http://localhost
+}
+
+func (l *LlamaCpp) Complete(ctx context.Context, req Request) (c Completion, err error) {
+	req.Stream = false
+	res, err := post(ctx, l.HTTP, l.Base+"/completions", "", req)
+	if err != nil {
+		return c, err
+	}
+	defer res.Body.Close()
+
+	var token Token
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return c, fmt.Errorf("decoding llama completion: %+v", err)
+	}
+	return Completion{Content: token.Content, Predicted: token.Predicted, Evaluated: token.Evaluated}, nil
+}
+
+func (l *LlamaCpp) Stream(ctx context.Context, req Request, fn func(Token) error) (c Completion, err error) {
+	req.Stream = true
+	res, err := post(ctx, l.HTTP, l.Base+"/completions", "", req)
+	if err != nil {
+		return c, err
+	}
+	defer res.Body.Close()
+
+	err = events(res.Body, func(data []byte) error {
+		var token Token
+		if err := json.Unmarshal(data, &token); err != nil {
+			return fmt.Errorf("decoding llama token %q: %+v", data, err)
+		}
+		c.Content += token.Content
+		if token.Stop {
+			c.Predicted, c.Evaluated = token.Predicted, token.Evaluated
+		}
+		return fn(token)
+	})
+	return c, err
+}
+
+// Chat goes through llama-server's OpenAI compatible endpoint, which applies the model's chat template
+func (l *LlamaCpp) Chat(ctx context.Context, req ChatRequest, fn func(Token) error) (Completion, error) {
+	return (&OpenAI{HTTP: l.HTTP, Base: l.Base}).Chat(ctx, req, fn)
+}
+
+func (l *LlamaCpp) Tokenize(ctx context.Context, text string) ([]int, error) {
+	res, err := post(ctx, l.HTTP, l.Base+"/tokenize", "", map[string]string{"content": text})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Tokens []int `json:"tokens"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding llama tokens: %+v", err)
+	}
+	return body.Tokens, nil
+}
+
+// Slots is llama-server's --parallel, from /props or failing that /slots
+func (l *LlamaCpp) Slots(ctx context.Context) (int, error) {
+	res, err := get(ctx, l.HTTP, l.Base+"/props")
+	if err == nil {
+		defer res.Body.Close()
+		var props struct {
+			TotalSlots int `json:"total_slots"`
+		}
+		if err = json.NewDecoder(res.Body).Decode(&props); err == nil && props.TotalSlots > 0 {
+			return props.TotalSlots, nil
+		}
+	}
+
+	// older servers, without total_slots in /props
+	res, err = get(ctx, l.HTTP, l.Base+"/slots")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var slots []json.RawMessage
+	if err = json.NewDecoder(res.Body).Decode(&slots); err != nil {
+		return 0, fmt.Errorf("decoding llama slots: %+v", err)
+	}
+	return len(slots), nil
+}
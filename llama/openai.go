@@ -0,0 +1,129 @@
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// OpenAI is any server implementing OpenAI's /v1/completions & /v1/chat/completions
+type OpenAI struct {
+	HTTP *http.Client
+	Base string // ie. https://api.openai.com
+	Key  string // bearer token, if the server wants one
+}
+
+type openaiRequest struct {
+	Model     string    `json:"model"`
+	Prompt    string    `json:"prompt,omitempty"`
+	Messages  []Message `json:"messages,omitempty"`
+	Tools     []Tool    `json:"tools,omitempty"`
+	MaxTokens int       `json:"max_tokens,omitempty"`
+	Stream    bool      `json:"stream"`
+}
+
+// openaiChunk is a whole response, or one event of a streamed one
+type openaiChunk struct {
+	Choices []struct {
+		Index   int          `json:"index"`
+		Text    string       `json:"text"`
+		Message *Message     `json:"message"`
+		Delta   *openaiDelta `json:"delta"`
+		Finish  *string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		Prompt     int `json:"prompt_tokens"`
+		Completion int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// openaiDelta is the part of a message in one streamed event, tool calls arriving in pieces
+type openaiDelta struct {
+	Content   string `json:"content"`
+	ToolCalls []struct {
+		Index int `json:"index"`
+		ToolCall
+	} `json:"tool_calls"`
+}
+
+func (o *OpenAI) Complete(ctx context.Context, req Request) (Completion, error) {
+	return o.do(ctx, "/v1/completions", openaiRequest{Model: req.Model, Prompt: req.Prompt, MaxTokens: req.Predict}, nil)
+}
+
+func (o *OpenAI) Stream(ctx context.Context, req Request, fn func(Token) error) (Completion, error) {
+	return o.do(ctx, "/v1/completions", openaiRequest{Model: req.Model, Prompt: req.Prompt, MaxTokens: req.Predict, Stream: true}, fn)
+}
+
+func (o *OpenAI) Chat(ctx context.Context, req ChatRequest, fn func(Token) error) (Completion, error) {
+	return o.do(ctx, "/v1/chat/completions", openaiRequest{Model: req.Model, Messages: req.Messages, Tools: req.Tools, MaxTokens: req.MaxTokens, Stream: fn != nil}, fn)
+}
+
+// Tokenize isn't part of OpenAI's API
+func (o *OpenAI) Tokenize(ctx context.Context, text string) ([]int, error) {
+	return nil, ErrUnsupported
+}
+
+func (o *OpenAI) do(ctx context.Context, path string, req openaiRequest, fn func(Token) error) (c Completion, err error) {
+	res, err := post(ctx, o.HTTP, o.Base+path, o.Key, req)
+	if err != nil {
+		return c, err
+	}
+	defer res.Body.Close()
+
+	if !req.Stream {
+		var chunk openaiChunk
+		if err = json.NewDecoder(res.Body).Decode(&chunk); err != nil {
+			return c, fmt.Errorf("decoding %s response: %+v", path, err)
+		}
+		c.add(chunk)
+		return c, nil
+	}
+
+	var i int
+	err = events(res.Body, func(data []byte) error {
+		var chunk openaiChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("decoding %s event %q: %+v", path, data, err)
+		}
+		token := c.add(chunk)
+		token.Index = i
+		i++
+		return fn(token)
+	})
+	return c, err
+}
+
+// add appends the first choice of chunk to c, returning it as a token
+func (c *Completion) add(chunk openaiChunk) (token Token) {
+	if len(chunk.Choices) > 0 {
+		choice := chunk.Choices[0]
+		switch {
+		case choice.Delta != nil:
+			token.Content = choice.Delta.Content
+			for _, delta := range choice.Delta.ToolCalls {
+				for delta.Index >= len(c.ToolCalls) {
+					c.ToolCalls = append(c.ToolCalls, ToolCall{Type: "function"})
+				}
+				call := &c.ToolCalls[delta.Index]
+				if delta.ID != "" {
+					call.ID = delta.ID
+				}
+				call.Function.Name += delta.Function.Name
+				call.Function.Arguments += delta.Function.Arguments
+			}
+		case choice.Message != nil:
+			token.Content = choice.Message.Content
+			c.ToolCalls = append(c.ToolCalls, choice.Message.ToolCalls...)
+		default:
+			token.Content = choice.Text
+		}
+		token.Stop = choice.Finish != nil && *choice.Finish != ""
+	}
+	if chunk.Usage != nil {
+		c.Predicted, c.Evaluated = chunk.Usage.Completion, chunk.Usage.Prompt
+		token.Predicted, token.Evaluated = c.Predicted, c.Evaluated
+	}
+	c.Content += token.Content
+	return token
+}
@@ -0,0 +1,345 @@
+package llama
+
+import (
+	"avaron/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSlots = 1
+	DefaultDepth = 16
+	// DefaultRate & DefaultBurst are the requests each client may make a minute, & at once
+	DefaultRate  = 60
+	DefaultBurst = 10
+
+	// SlotsInterval is how often llama-server is asked how many slots it has
+	SlotsInterval = time.Minute
+
+	// clients beyond which idle rate limits are forgotten
+	maxClients = 1024
+)
+
+// Priority orders requests waiting for a slot
+type Priority int
+
+const (
+	Interactive Priority = iota // someone's waiting on it, the default
+	Background                  // ie. health checks
+)
+
+func (p Priority) String() string {
+	if p == Background {
+		return "background"
+	}
+	return "interactive"
+}
+
+var ErrQueueFull = errors.New("too many requests waiting for llama")
+
+// RateError refuses a client that's used up its requests
+type RateError struct {
+	Client string
+	Retry  time.Duration
+}
+
+func (e *RateError) Error() string {
+	return fmt.Sprintf("%s is making too many llama requests, retry in %s", e.Client, e.Retry.Round(time.Second))
+}
+
+var (
+	QueueWait = metrics.NewHistogram("avaron_llama_queue_wait_seconds",
+		"Time requests waited for a free llama-server slot, by priority",
+		[]float64{.01, .1, .5, 1, 5, 10, 30, 60, 300}, "priority")
+	Refused = metrics.NewCounter("avaron_llama_refused_total",
+		"Requests refused before reaching llama-server, by priority & reason",
+		"priority", "reason")
+)
+
+type priorityKey struct{}
+type clientKey struct{}
+
+// WithPriority marks requests made with ctx
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority of ctx, Interactive unless marked otherwise
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p == Background {
+		return p
+	}
+	return Interactive
+}
+
+// WithClient names who requests made with ctx are for, so they're rate limited
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFrom returns the client of ctx, or "" when it isn't limited
+func ClientFrom(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// SlotCounter is a backend that knows how many requests it serves at once
+type SlotCounter interface {
+	Slots(ctx context.Context) (int, error)
+}
+
+// Scheduler shares a backend's slots between everyone using it. Requests
+// beyond the slots wait, interactive ones ahead of background, & are
+// refused outright beyond Depth waiting or their client's rate limit
+type Scheduler struct {
+	Backend
+	Depth int
+	// Rate is the requests a second each client may make, in bursts of
+	// up to Burst, unlimited when 0
+	Rate  float64
+	Burst int
+	// Discover has Watch follow the backend's own slot count
+	Discover bool
+
+	lock    sync.Mutex
+	slots   int
+	busy    int
+	queues  [2][]*waiter
+	clients map[string]*bucket
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// bucket holds a client's remaining requests as of last
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewScheduler uses DefaultSlots when slots isn't positive
+func NewScheduler(b Backend, slots, depth int) *Scheduler {
+	if slots <= 0 {
+		slots = DefaultSlots
+	}
+	return &Scheduler{Backend: b, Depth: depth, slots: slots, clients: make(map[string]*bucket)}
+}
+
+// SetSlots changes how many requests may run at once, starting waiting ones if there are now more
+func (s *Scheduler) SetSlots(n int) {
+	if n <= 0 {
+		n = DefaultSlots
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.slots = n
+	s.dispatch()
+}
+
+// Watch asks the backend for its slot count every SlotsInterval until ctx
+// is done, if it can say & Discover is set
+func (s *Scheduler) Watch(ctx context.Context) {
+	counter, ok := s.Backend.(SlotCounter)
+	if !ok || !s.Discover {
+		return
+	}
+
+	ticker := time.NewTicker(SlotsInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := counter.Slots(ctx); err != nil {
+			logger.DebugContext(ctx, "failed counting llama slots", "err", err)
+		} else if n > 0 {
+			if stats := s.Stats(); stats.Slots != n {
+				logger.InfoContext(ctx, "llama slots changed", "from", stats.Slots, "to", n)
+				s.SetSlots(n)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stats is the scheduler's state at one moment
+type Stats struct {
+	Slots       int `json:"slots"`
+	Busy        int `json:"busy"`
+	Interactive int `json:"interactive"` // waiting
+	Background  int `json:"background"`
+}
+
+func (s *Scheduler) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Stats{s.slots, s.busy, len(s.queues[Interactive]), len(s.queues[Background])}
+}
+
+// Waiting is how many requests are queued for a slot
+func (s *Scheduler) Waiting() int {
+	stats := s.Stats()
+	return stats.Interactive + stats.Background
+}
+
+// allow takes one of client's requests, or says how long until it has one
+func (s *Scheduler) allow(client string, now time.Time) (time.Duration, bool) {
+	if s.Rate <= 0 || client == "" {
+		return 0, true
+	}
+	burst := float64(s.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := s.clients[client]
+	if !ok {
+		if len(s.clients) >= maxClients {
+			// full buckets are the same as none
+			for c, b := range s.clients {
+				if b.tokens+now.Sub(b.last).Seconds()*s.Rate >= burst {
+					delete(s.clients, c)
+				}
+			}
+		}
+		b = &bucket{tokens: burst, last: now}
+		s.clients[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * s.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / s.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// acquire waits for a slot, which is held until release is called
+func (s *Scheduler) acquire(ctx context.Context) (release func(), err error) {
+	p := PriorityFrom(ctx)
+	client := ClientFrom(ctx)
+
+	s.lock.Lock()
+	if retry, ok := s.allow(client, time.Now()); !ok {
+		s.lock.Unlock()
+		Refused.Inc(p.String(), "rate")
+		return nil, &RateError{Client: client, Retry: retry}
+	}
+	if s.busy < s.slots {
+		s.busy++
+		s.lock.Unlock()
+		QueueWait.Observe(0, p.String())
+		return s.release, nil
+	}
+	if s.Depth > 0 && len(s.queues[Interactive])+len(s.queues[Background]) >= s.Depth {
+		s.lock.Unlock()
+		Refused.Inc(p.String(), "queue")
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	s.queues[p] = append(s.queues[p], w)
+	s.lock.Unlock()
+
+	t := time.Now()
+	select {
+	case <-w.ready:
+		QueueWait.Observe(time.Since(t).Seconds(), p.String())
+		return s.release, nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if w.granted {
+		// the slot came too late, so it's the next waiter's
+		s.busy--
+		s.dispatch()
+	} else {
+		for i, other := range s.queues[p] {
+			if other == w {
+				s.queues[p] = append(s.queues[p][:i], s.queues[p][i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+func (s *Scheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.busy--
+	s.dispatch()
+}
+
+// dispatch hands free slots to waiters in order of priority, s.lock being held
+func (s *Scheduler) dispatch() {
+	for p := range s.queues {
+		for s.busy < s.slots && len(s.queues[p]) > 0 {
+			w := s.queues[p][0]
+			s.queues[p] = s.queues[p][1:]
+			w.granted = true
+			s.busy++
+			close(w.ready)
+		}
+	}
+}
+
+func (s *Scheduler) Complete(ctx context.Context, req Request) (Completion, error) {
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return Completion{}, err
+	}
+	defer release()
+	return s.Backend.Complete(ctx, req)
+}
+
+func (s *Scheduler) Stream(ctx context.Context, req Request, fn func(Token) error) (Completion, error) {
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return Completion{}, err
+	}
+	defer release()
+	return s.Backend.Stream(ctx, req, fn)
+}
+
+func (s *Scheduler) Chat(ctx context.Context, req ChatRequest, fn func(Token) error) (Completion, error) {
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return Completion{}, err
+	}
+	defer release()
+	return s.Backend.Chat(ctx, req, fn)
+}
+
+// collectScheduler reports the shared scheduler's state
+func collectScheduler(ctx context.Context, w *metrics.Writer) {
+	s, ok := Default.(*Scheduler)
+	if !ok {
+		return
+	}
+	stats := s.Stats()
+
+	w.Header("avaron_llama_slots", "gauge", "Requests llama-server serves at once")
+	w.Sample("avaron_llama_slots", float64(stats.Slots))
+	w.Header("avaron_llama_slots_busy", "gauge", "llama-server slots in use")
+	w.Sample("avaron_llama_slots_busy", float64(stats.Busy))
+	w.Header("avaron_llama_queue_depth", "gauge", "Requests waiting for a llama-server slot, by priority")
+	w.Sample("avaron_llama_queue_depth", float64(stats.Interactive), "priority", Interactive.String())
+	w.Sample("avaron_llama_queue_depth", float64(stats.Background), "priority", Background.String())
+}
+
+func init() {
+	metrics.Collect(collectScheduler)
+}
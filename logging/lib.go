@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"avaron/rid"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	filepath "path"
+	"strings"
+	"sync"
+)
+
+var (
+	// Level applies to subsystems without a level of their own
+	Level = new(slog.LevelVar)
+
+	lock   sync.RWMutex
+	root   slog.Handler = slog.NewTextHandler(os.Stderr, options())
+	levels              = make(map[string]*slog.LevelVar)
+)
+
+func options() *slog.HandlerOptions {
+	return &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug, // filtering happens per subsystem
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key != slog.SourceKey || len(groups) > 0 {
+				return a
+			}
+			// like log.Lshortfile
+			if src, ok := a.Value.Any().(*slog.Source); ok {
+				return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+			}
+			return a
+		},
+	}
+}
+
+// Setup directs every logger, including the log package's, to w as text or JSON lines
+func Setup(w io.Writer, json bool) {
+	var h slog.Handler
+	if json {
+		h = slog.NewJSONHandler(w, options())
+	} else {
+		h = slog.NewTextHandler(w, options())
+	}
+
+	lock.Lock()
+	root = h
+	lock.Unlock()
+
+	// stragglers still using the log package end up here at info
+	log.SetFlags(log.Lshortfile)
+	slog.SetDefault(For("main"))
+}
+
+// Configure applies a spec like "info" or "warn,health=debug,mickey=error"
+func Configure(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		subsystem, name := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			subsystem, name = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		SetLevel(subsystem, level)
+	}
+	return nil
+}
+
+func ParseLevel(s string) (level slog.Level, err error) {
+	if err = level.UnmarshalText([]byte(s)); err != nil {
+		err = fmt.Errorf("unknown log level '%s'", s)
+	}
+	return
+}
+
+// SetLevel changes a subsystem's level at runtime, "" being the default for all
+func SetLevel(subsystem string, level slog.Level) {
+	if subsystem == "" {
+		Level.Set(level)
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	v, ok := levels[subsystem]
+	if !ok {
+		v = new(slog.LevelVar)
+		levels[subsystem] = v
+	}
+	v.Set(level)
+}
+
+// ResetLevel makes a subsystem follow the default level again
+func ResetLevel(subsystem string) {
+	lock.Lock()
+	delete(levels, subsystem)
+	lock.Unlock()
+}
+
+// Levels reports the default level under "" alongside any per-subsystem ones
+func Levels() map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	m := map[string]string{"": Level.Level().String()}
+	for name, v := range levels {
+		m[name] = v.Level().String()
+	}
+	return m
+}
+
+func level(subsystem string) slog.Level {
+	lock.RLock()
+	v, ok := levels[subsystem]
+	lock.RUnlock()
+	if ok {
+		return v.Level()
+	}
+	return Level.Level()
+}
+
+// handler defers to whatever Setup installed, so loggers can be made at init
+type handler struct {
+	subsystem string
+	with      []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= level(h.subsystem)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if id := rid.From(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+
+	lock.RLock()
+	next := root
+	lock.RUnlock()
+
+	next = next.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, fn := range h.with {
+		next = fn(next)
+	}
+	return next.Handle(ctx, r)
+}
+
+func (h *handler) chain(fn func(slog.Handler) slog.Handler) *handler {
+	with := make([]func(slog.Handler) slog.Handler, len(h.with), len(h.with)+1)
+	copy(with, h.with)
+	return &handler{subsystem: h.subsystem, with: append(with, fn)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.chain(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.chain(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+// For returns the logger of a subsystem, ie. logging.For("health")
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem})
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"avaron/rid"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func lines(t *testing.T, buf *bytes.Buffer) (out []map[string]interface{}) {
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		out = append(out, m)
+	}
+	buf.Reset()
+	return
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, true)
+	defer SetLevel("", slog.LevelInfo)
+	defer ResetLevel("chatty")
+
+	if err := Configure("warn,chatty=debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	quiet, chatty := For("quiet"), For("chatty")
+	quiet.Info("dropped")
+	chatty.Debug("kept", "n", 1)
+	quiet.Warn("kept too")
+
+	got := lines(t, &buf)
+	if len(got) != 2 {
+		t.Fatalf("got %d lines, want 2: %v", len(got), got)
+	}
+	if got[0]["subsystem"] != "chatty" || got[0]["msg"] != "kept" || got[0]["n"] != 1.0 {
+		t.Errorf("unexpected line %v", got[0])
+	}
+	if !strings.HasPrefix(got[0]["source"].(string), "logging_test.go:") {
+		t.Errorf("unexpected source %v", got[0]["source"])
+	}
+
+	ResetLevel("chatty")
+	chatty.Info("dropped")
+	if got := lines(t, &buf); len(got) != 0 {
+		t.Errorf("reset subsystem still logging: %v", got)
+	}
+
+	if levels := Levels(); levels[""] != "WARN" {
+		t.Errorf("unexpected levels %v", levels)
+	}
+
+	if err := Configure("loud"); err == nil {
+		t.Error("accepted unknown level")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, true)
+	SetLevel("", slog.LevelInfo)
+
+	ctx := rid.With(context.Background(), "abc123")
+	For("http").With("remote", "[::1]:1234").InfoContext(ctx, "request")
+
+	got := lines(t, &buf)
+	if len(got) != 1 || got[0]["request_id"] != "abc123" || got[0]["remote"] != "[::1]:1234" || got[0]["subsystem"] != "http" {
+		t.Errorf("unexpected lines %v", got)
+	}
+}
+
+func TestLogPackage(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, true)
+	SetLevel("", slog.LevelInfo)
+
+	log.Printf("legacy %d\n", 1)
+
+	got := lines(t, &buf)
+	if len(got) != 1 || got[0]["msg"] != "legacy 1" || got[0]["subsystem"] != "main" {
+		t.Errorf("unexpected lines %v", got)
+	}
+}
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"avaron/agent"
+	"avaron/alerts"
+	"avaron/assistant"
+	"avaron/ca"
+	"avaron/certs"
+	"avaron/client"
+	"avaron/diag"
+	"avaron/dns"
 	"avaron/llama"
+	"avaron/logging"
 	network "avaron/net"
+	"avaron/rid"
+	"avaron/terminal"
 	"avaron/vertex"
 	"avaron/whois"
 	wg "avaron/wireguard"
 	"bytes"
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"avaron/health"
 	"encoding/json"
@@ -22,6 +34,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	filepath "path"
 	"strconv"
@@ -58,7 +71,7 @@ func GenerateLinkLocal(k1, k2 *vertex.Key) (n1, n2 net.IPNet) {
 	if len(k1) < net.IPv6len {
 		panic("key should be longer than IPv6 address")
 	}
-	log.Printf("XORING\n%s\n%s\n", k1.String(), k2.String())
+	logger.Debug("generating link-local addresses", "k1", k1.String(), "k2", k2.String())
 
 	var (
 		prefix = []byte{0xfe, 0x80}
@@ -101,20 +114,18 @@ func GenerateLinkLocal(k1, k2 *vertex.Key) (n1, n2 net.IPNet) {
 	return
 }
 
-type Node struct {
-	Name       string                        `json:"name"`
-	Location   *whois.Info                   `json:"location"`
-	Interfaces map[string]*network.Interface `json:"interfaces"`
-	Tunnels    map[vertex.Key]*wg.Interface  `json:"tunnels"`
-	TCPMetrics []network.TCPMetric           `json:"metrics"`
-	Routes     map[string]*network.Route     `json:"routes"`
-}
+var (
+	logger     = logging.For("main")
+	syncLogger = logging.For("sync")
+)
+
+type Node = client.Node
 
 func ListServices(ctx context.Context) (m map[string]systemd.UnitStatus, err error) {
 	var conn *systemd.Conn
 	conn, err = systemd.NewSystemConnectionContext(ctx)
 	if err != nil {
-		fmt.Printf("Failed to connect to systemd: %v\n", err)
+		logger.ErrorContext(ctx, "failed to connect to systemd", "err", err)
 		return
 	}
 	defer conn.Close()
@@ -122,7 +133,7 @@ func ListServices(ctx context.Context) (m map[string]systemd.UnitStatus, err err
 	var files []systemd.UnitFile
 	files, err = conn.ListUnitFilesByPatternsContext(ctx, nil, nil)
 	if err != nil {
-		log.Println("failed to list unit-files:", err)
+		logger.ErrorContext(ctx, "failed to list unit-files", "err", err)
 		return
 	}
 
@@ -147,7 +158,7 @@ func ListServices(ctx context.Context) (m map[string]systemd.UnitStatus, err err
 
 	units, err := conn.ListUnitsByNamesContext(ctx, paths)
 	if err != nil {
-		log.Println("failed to list units:", err)
+		logger.ErrorContext(ctx, "failed to list units", "err", err)
 		return
 	}
 
@@ -199,6 +210,8 @@ var (
 	PublicSSHKeys      string
 	PublicWireguardKey vertex.Key
 	WhoisInfo          whois.Info
+	Zone               *dns.Zone
+	Resolver           dns.Resolver // named, or the built in server with DNS_MODE=builtin
 )
 
 func controller() error {
@@ -211,43 +224,16 @@ func controller() error {
 		if len(os.Args) <= 2 {
 			return fmt.Errorf("not enough arguments")
 		}
-		peer := fmt.Sprintf("http://%s/api/keys/wireguard", os.Args[2])
-		r1, err := http.Get(peer)
+		c := client.New("http://"+os.Args[2], nil)
+		key, err := c.WireguardKey(context.Background())
 		if err != nil {
 			return err
 		}
-		defer r1.Body.Close()
-
-		if r1.StatusCode != http.StatusOK {
-			return fmt.Errorf("%s responded with %s", peer, r1.Status)
-		}
 
-		buf, err := io.ReadAll(r1.Body)
-		if err != nil {
-			return fmt.Errorf("reading response body: %+v", err)
-		}
-
-		var key vertex.Key
-		_, err = key.UnmarshalText(bytes.TrimSpace(buf))
-		if err != nil {
-			return fmt.Errorf("failed to parse response as Wireguard Key: %+v", err)
-		}
-
-		peer = fmt.Sprintf("http://%s/api/keys/ssh", os.Args[2])
-		r2, err := http.Get(peer)
+		ssh, err := c.SSHKeys(context.Background())
 		if err != nil {
 			return err
 		}
-		defer r2.Body.Close()
-
-		if r2.StatusCode != http.StatusOK {
-			return fmt.Errorf("%s responded with %s", peer, r2.Status)
-		}
-
-		ssh, err := io.ReadAll(r2.Body)
-		if err != nil {
-			return fmt.Errorf("reading response body: %+v", err)
-		}
 
 		dir := filepath.Join("peers", key.Path())
 		err = os.Mkdir(dir, 0755)
@@ -256,7 +242,7 @@ func controller() error {
 		}
 
 		// TODO: rm -rf on failure
-		url, _ := url.Parse(peer)
+		url, _ := url.Parse(c.Base)
 		host := url.Host
 		if i := strings.Index(host, ":"); i > 0 {
 			host = host[:i]
@@ -272,7 +258,7 @@ func controller() error {
 			return fmt.Errorf("failed writing ssh file: %+v", err)
 		}
 
-		log.Printf("got public keys - wg: %s, ssh: %s\n", key.String(), string(ssh))
+		logger.Info("got public keys", "wg", key.String(), "ssh", string(ssh))
 
 		peers, err := GetPeerInfo()
 		if err != nil {
@@ -290,6 +276,18 @@ func controller() error {
 		if err = Shell(ctx, r); err != nil {
 			return fmt.Errorf("failed writing network peer configuration to shell: %+v\n", err)
 		}
+	case "ca":
+		if len(os.Args) <= 2 || os.Args[2] != "init" {
+			return fmt.Errorf("usage: %s ca init", os.Args[0])
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to query OS hostname: %+v", err)
+		}
+		if err = Authority.Init(hostname + " mesh CA"); err != nil {
+			return fmt.Errorf("failed creating certificate authority: %+v", err)
+		}
+		logger.Info("designated as a CA, restart to reissue its own certificate", "host", hostname)
 	default:
 		return fmt.Errorf("unknown option: %s", os.Args[1])
 	}
@@ -309,66 +307,99 @@ func (p *PeerFSEntry) IP() string {
 	return p.address
 }
 
-func Sync(ctx context.Context, k *vertex.Key, ch chan pair) error {
-	addr := k.GlobalAddress()
-	host := fmt.Sprintf("%s:8080", addr.IP.String())
-	fmt.Printf("fetching branch updates from %+v\n", host)
-	req := &http.Request{
-		URL: &url.URL{
-			Scheme:      "http",
-			Host:        host,
-			Path:        "/api/sdwan",
-			Fragment:    "",
-			RawFragment: "",
-		},
-		Proto:      "HTTP/1.1",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header: map[string][]string{
-			"User-Agent": {"Avaron-Core"},
-		},
-	}
-
-	res, err := http.DefaultClient.Do(req)
+// Enroll keeps this node's certificate issued by a designated mesh CA & the trusted CAs/CRLs fresh
+func Enroll(ctx context.Context) {
+	hostname, err := os.Hostname()
 	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	dec := json.NewDecoder(res.Body)
-
-	if t, _ := dec.Token(); t != json.Delim('[') {
-		return fmt.Errorf("expected '[' as starting delimeter")
+		logger.Error("failed to query OS hostname", "err", err)
+		return
 	}
 
-	var node Node
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
 
-	for dec.More() {
-		key, err := dec.Token()
+	for {
+		authorities, err := Authority.Authorities()
 		if err != nil {
-			return err
+			logger.Error("failed reading designated CAs", "err", err)
+		} else if len(authorities) > 0 || Authority.IsAuthority() {
+			Authority.Refresh(ctx, authorities, MeshClient)
+
+			leaf := Certificates.Leaf()
+			if !Authority.Issuer(leaf) || time.Until(leaf.NotAfter) < certs.Renewal {
+				if err := Authority.Enroll(ctx, authorities, PublicWireguardKey, hostname, Certificates.Store); err != nil {
+					logger.Warn("failed enrolling with mesh CA", "err", err)
+				} else {
+					logger.Info("enrolled with mesh CA")
+				}
+			}
 		}
 
-		err = dec.Decode(&node)
-		if err != nil {
-			return err
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
+	}
+}
+
+// MeshClient authenticates both ends with mesh issued certificates, the peer's must be bound to k
+func MeshClient(k vertex.Key) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:              Authority.Pool(),
+				GetClientCertificate: Certificates.GetClientCertificate,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					return Authority.Verify(cs, &k)
+				},
+			},
+		},
+	}
+}
+
+func Sync(ctx context.Context, k *vertex.Key, ch chan pair) error {
+	// plain HTTP until this node holds a mesh certificate
+	c := client.ForKey(*k, "http", 8080, nil)
+	if Certificates != nil && Authority.Issuer(Certificates.Leaf()) {
+		c = client.ForKey(*k, "https", 8443, MeshClient(*k))
+		defer c.HTTP.CloseIdleConnections()
+	}
 
+	syncLogger.DebugContext(ctx, "fetching branch updates", "base", c.Base)
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for key, node := range nodes {
 		select {
-		case ch <- struct {
-			string
-			Node
-		}{key.(string), node}:
+		case ch <- pair{key, node}:
 		case <-ctx.Done():
 			return nil
 		}
 	}
 
-	if t, _ := dec.Token(); t != json.Delim(']') {
-		return fmt.Errorf("expected ']' as starting delimeter")
+	return nil
+}
+
+// publishNodes puts each node that's told us its hostname in the zone, & this one
+func publishNodes(ctx context.Context, nodes map[vertex.Key]Node) {
+	hosts := make(map[string]net.IP, len(nodes)+1)
+	for k, node := range nodes {
+		if node.Name != "" {
+			hosts[node.Name] = k.GlobalAddress().IP
+		}
+	}
+	if name, err := os.Hostname(); err == nil {
+		hosts[name] = PublicWireguardKey.GlobalAddress().IP
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := Zone.Replace(ctx, hosts); err != nil {
+		logger.WarnContext(ctx, "failed updating zone", "err", err)
+	}
 }
 
 func GetPeerInfo() (map[vertex.Key]PeerInfo, error) {
@@ -376,7 +407,7 @@ func GetPeerInfo() (map[vertex.Key]PeerInfo, error) {
 
 	peers := make(map[vertex.Key]PeerInfo, len(entries))
 	if err != nil {
-		log.Println("failed to read peers directory:", err)
+		logger.Warn("failed to read peers directory", "err", err)
 		// this is fine
 		return peers, nil
 	}
@@ -384,12 +415,11 @@ func GetPeerInfo() (map[vertex.Key]PeerInfo, error) {
 	for _, entry := range entries {
 		k := new(vertex.Key)
 		text := strings.Replace(entry.Name(), "-", "/", -1)
-		_, err := k.UnmarshalText([]byte(text))
+		err := k.UnmarshalText([]byte(text))
 		if err != nil {
 			return peers, fmt.Errorf("failed to parse key '%s': %+v\n", entry.Name(), err)
 		}
-		log.Printf("parsed key: %s\n", k.String())
-		dir := filepath.Join("peers", entry.Name())
+				dir := filepath.Join("peers", entry.Name())
 		address, err := os.ReadFile(filepath.Join(dir, "address"))
 		if err == nil {
 			peers[*k] = &PeerFSEntry{
@@ -400,7 +430,7 @@ func GetPeerInfo() (map[vertex.Key]PeerInfo, error) {
 		} else if err != nil {
 			return peers, fmt.Errorf("failed to read address for peer '%s': %+v\n", entry.Name(), err)
 		}
-		log.Printf("read peer: %s, %s\n", k.String(), string(address))
+		logger.Debug("read peer", "key", k.String(), "address", string(bytes.TrimSpace(address)))
 	}
 
 	return peers, nil
@@ -461,25 +491,48 @@ func WritePeerConfiguration(w io.Writer, us *vertex.Key, peers map[vertex.Key]Pe
 }
 
 type pair struct {
-	string
+	vertex.Key
 	Node
 }
 
+// peerChange is a peer added or removed through the API
+type peerChange struct {
+	vertex.Key
+	Removed bool
+}
+
 var (
 	UpdateNode   = make(chan pair)
 	RequestNodes = make(chan io.WriteCloser)
+	ChangePeer   = make(chan peerChange)
 )
 
+// notifyPeer hands c to the sync loop, which follows the peer & updates the zone
+func notifyPeer(ctx context.Context, c peerChange) {
+	select {
+	case ChangePeer <- c:
+	case <-ctx.Done():
+		syncLogger.WarnContext(ctx, "peer change not applied until restart", "key", c.Key.String(), "removed", c.Removed)
+	}
+}
+
 var (
 	//go:embed named/conf.template
 	NamedConfiguration string
 
 	//go:embed named/zone.template
 	NamedZone string
+
+	//go:embed named/reverse.template
+	NamedReverseZone string
 )
 
 func main() {
-	log.SetFlags(log.Lshortfile)
+	logging.Setup(os.Stderr, os.Getenv("LOG_FORMAT") == "json")
+	if err := logging.Configure(os.Getenv("LOG_LEVEL")); err != nil {
+		logger.Warn("ignoring LOG_LEVEL", "err", err)
+	}
+
 	if len(os.Args) < 1 {
 		log.Fatalf("unnamed binary\n")
 	}
@@ -506,17 +559,119 @@ func main() {
 	}
 
 	if err := os.Chdir(user.HomeDir); err != nil {
-		log.Println("changing to home directory:", err)
+		logger.Error("changing to home directory", "err", err)
 		os.Exit(1)
 	}
 
 	llama.Init()
 
+	allowlist := os.Getenv("DIAG_ALLOWLIST")
+	if allowlist == "" {
+		allowlist = "diag/allow"
+	}
+	if Diagnostics, err = diag.Load(allowlist); err != nil {
+		logger.Error("failed to load diagnostics allowlist", "err", err)
+		os.Exit(1)
+	}
+	switch mode := os.Getenv("DIAG_MODE"); mode {
+	case "":
+	case diag.ModeRun, diag.ModeApprove, diag.ModeDryRun:
+		Diagnostics.Mode = mode
+	default:
+		logger.Warn("ignoring DIAG_MODE", "value", mode)
+	}
+	Diagnostics.Record = "diag/history.jsonl"
+	health.Diagnostics = Diagnostics
+
+	// the assistant has the health checker's tools, its commands proposed as its own
+	Assistant = assistant.New("assistant", agent.New())
+	Assistant.Agent.Register(health.Command("assistant"))
+	Assistant.Agent.Register(health.Ping("assistant"))
+	Assistant.Seed = func(ctx context.Context) (string, error) {
+		node, err := GetNode(ctx)
+		if err != nil {
+			return "", err
+		}
+		// the model has no business with keys
+		for _, t := range node.Tunnels {
+			t.PrivateKey = nil
+			for _, p := range t.Peers {
+				p.PresharedKey = nil
+			}
+		}
+		buf, err := json.Marshal(node)
+		return string(buf), err
+	}
+
+	for _, a := range []*agent.Agent{health.Agent, Assistant.Agent} {
+		registerAgentTools(a)
+		for _, env := range []struct {
+			name string
+			n    *int
+		}{{"AGENT_MAX_STEPS", &a.MaxSteps}, {"AGENT_MAX_TOKENS", &a.MaxTokens}} {
+			if s := os.Getenv(env.name); s == "" {
+				// default
+			} else if n, err := strconv.Atoi(s); err != nil || n < 0 {
+				logger.Warn("ignoring "+env.name, "value", s, "err", err)
+			} else {
+				*env.n = n
+			}
+		}
+	}
+
+	alertsConfig := os.Getenv("ALERTS_CONFIG")
+	if alertsConfig == "" {
+		alertsConfig = "alerts/config.json"
+	}
+	if Alerts, err = alerts.Load(alertsConfig); err != nil {
+		logger.Error("failed to load alert configuration", "err", err)
+		os.Exit(1)
+	}
+	registerAlertSources(Alerts)
+
+	Terminals = terminal.New("terminal")
+	if s := os.Getenv("TERMINAL_IDLE"); s == "" {
+		// default
+	} else if d, err := time.ParseDuration(s); err != nil {
+		logger.Warn("ignoring TERMINAL_IDLE", "value", s, "err", err)
+	} else {
+		Terminals.Idle = d
+	}
+
+	Health = health.New("health")
+	for _, env := range []struct {
+		name string
+		d    *time.Duration
+	}{{"HEALTH_INTERVAL", &Health.Interval}, {"HEALTH_TIMEOUT", &Health.Timeout}, {"HEALTH_MAX_AGE", &Health.MaxAge}} {
+		if s := os.Getenv(env.name); s == "" {
+			// default
+		} else if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			logger.Warn("ignoring "+env.name, "value", s, "err", err)
+		} else {
+			*env.d = d
+		}
+	}
+	for _, env := range []struct {
+		name string
+		n    *int
+	}{{"HEALTH_CONCURRENCY", &Health.Concurrency}, {"HEALTH_KEEP", &Health.Keep}} {
+		if s := os.Getenv(env.name); s == "" {
+			// default
+		} else if n, err := strconv.Atoi(s); err != nil || n <= 0 {
+			logger.Warn("ignoring "+env.name, "value", s, "err", err)
+		} else {
+			*env.n = n
+		}
+	}
+	if err := Health.Load(); err != nil {
+		logger.Warn("discarding saved health checks", "err", err)
+	}
+
 	createPIDFile := func() {
 		buf := fmt.Sprintf("%d\n", os.Getpid())
 		err := os.WriteFile("pid", []byte(buf), 0644)
 		if err != nil {
-			log.Println("failed to create PID file:", err)
+			logger.Error("failed to create PID file", "err", err)
 			os.Exit(1)
 		}
 	}
@@ -526,15 +681,15 @@ func main() {
 
 	paths, err := fs.Glob(ssh, "*.pub")
 	if err != nil {
-		log.Println("failed to find public SSH keys:", err)
+		logger.Error("failed to find public SSH keys", "err", err)
 		os.Exit(1)
 	}
-	log.Printf("found %d SSH public keys: %s\n", len(paths), strings.Join(paths, ", "))
+	logger.Info("found SSH public keys", "count", len(paths), "files", strings.Join(paths, ", "))
 
 	for _, path := range paths {
 		pub, err := fs.ReadFile(ssh, path)
 		if err != nil {
-			log.Printf("error reading %s: %+v\n", path, err)
+			logger.Warn("error reading SSH public key", "file", path, "err", err)
 			continue
 		}
 		PublicSSHKeys += string(pub)
@@ -544,24 +699,34 @@ func main() {
 		log.Fatalf("failed to find/read public SSH key files\n")
 	}
 
-	log.Printf("%s\n", PublicSSHKeys)
-
-	log.Printf("getting wireguard public key...\n")
+	logger.Debug("SSH public keys", "keys", PublicSSHKeys)
 
 	var file *os.File
 	file, err = os.Open("wireguard/private")
 	if err != nil {
-		log.Println("failed to open wireguard/private:", err)
+		logger.Error("failed to open wireguard/private", "err", err)
 		os.Exit(1)
 	}
 
 	// reading wireguard public key
 	if PublicWireguardKey, err = wg.PublicKey(file); err != nil {
-		log.Println("failed to dervice public key:", err)
+		logger.Error("failed to dervice public key", "err", err)
 		os.Exit(1)
 	}
 
-	log.Println("derived public key:", PublicWireguardKey)
+	logger.Info("derived wireguard public key", "key", PublicWireguardKey.String())
+
+	Authority, err = ca.New("ca", "tls/ca.pem", "tls/ca.key", func(k vertex.Key) bool {
+		if k == PublicWireguardKey {
+			return true
+		}
+		info, err := os.Stat(filepath.Join("peers", k.Path()))
+		return err == nil && info.IsDir()
+	})
+	if err != nil {
+		logger.Error("failed to load certificate authority", "err", err)
+		os.Exit(1)
+	}
 
 	buf, err := os.ReadFile("pid")
 	if err != nil && os.IsNotExist(err) {
@@ -570,10 +735,10 @@ func main() {
 		}
 		createPIDFile()
 	} else if err != nil {
-		log.Println("failed to read PID file:", err)
+		logger.Error("failed to read PID file", "err", err)
 		os.Exit(1)
 	} else if pid, err := strconv.Atoi(string(bytes.TrimSpace(buf))); err != nil {
-		log.Println("failed to read PID file:", err)
+		logger.Error("failed to read PID file", "err", err)
 		os.Exit(1)
 	} else {
 		var e1, e2 error
@@ -595,100 +760,162 @@ func main() {
 		}
 	}
 
-	ctx, _ := context.WithCancel(context.Background())
+	// stopping cancels ctx, so whatever's in flight winds down & is saved
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	go ServeHTTP(ctx)
-	go health.Loop(ctx)
+	if Certificates, err = LoadCertificates(); err != nil {
+		logger.Error("failed to load certificates", "err", err)
+	} else if Certificates.CertFile == "tls/cert.pem" {
+		// only certificates we manage ourselves are swapped for mesh issued ones
+		go Enroll(ctx)
+	}
 
-	{
-		named := exec.CommandContext(ctx, "/bin/sudo", "-S", "/usr/local/bin/named", "-f", "-g", "-c", "/tmp/conf")
-		//named.Stderr = os.Stderr
-		//named.Stdout = os.Stderr
+	go Health.Loop(ctx)
+	if scheduler, ok := llama.Default.(*llama.Scheduler); ok {
+		go scheduler.Watch(ctx)
+	}
+	recorded := make(chan struct{})
+	go func() {
+		record(ctx)
+		close(recorded)
+	}()
+	go Alerts.Loop(ctx)
 
+	{
+		// named's zone, key & config files sit in a directory only we can write
+		// to, rather than at guessable names in /tmp
 		dir := os.Getenv("NAMED_DIR")
 		if dir == "" {
-			dir = "/tmp"
+			wd, err := os.Getwd()
+			if err != nil {
+				logger.Error("failed finding the working directory", "err", err)
+				os.Exit(1)
+			}
+			dir = filepath.Join(wd, "bind")
 		}
-
-		os.Remove("/tmp/zone")
-		f, err := os.OpenFile("/tmp/zone", os.O_CREATE|os.O_WRONLY, 0666)
-		if err != nil {
-			log.Println("error opening /tmp/zone", err)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			logger.Error("failed creating the named directory", "dir", dir, "err", err)
 			os.Exit(1)
-
 		}
 
 		t, err := template.New("").Parse(NamedZone)
 		if err != nil {
-			log.Println("failed parsing it", NamedZone)
+			logger.Error("failed parsing zone template", "err", err)
+			os.Exit(1)
 		}
-
-		err = t.Execute(f, struct {
-			IPv6 string
-		}{
-			PublicWireguardKey.GlobalAddress().IP.String(),
-		})
-		if err != nil {
-			log.Println("error executing template:", err)
+		// named isn't running yet, so the zone is reloaded only from here on
+		Zone = dns.New("avaron.lan", filepath.Join(dir, "zone"), PublicWireguardKey.GlobalAddress().IP, t)
+		Zone.Prefix, Zone.ReverseFile = vertex.Overlay, filepath.Join(dir, "reverse")
+		if Zone.ReverseTemplate, err = template.New("").Parse(NamedReverseZone); err != nil {
+			logger.Error("failed parsing reverse zone template", "err", err)
 			os.Exit(1)
 		}
-
-		f.Close()
-
-		os.Remove("/tmp/conf")
-		f, err = os.OpenFile("/tmp/conf", os.O_CREATE|os.O_WRONLY, 0666)
+		reverse, err := dns.ReverseOrigin(Zone.Prefix)
 		if err != nil {
-			log.Println("error opening /tmp/zone", err)
+			logger.Error("failed naming reverse zone", "err", err)
 			os.Exit(1)
-
 		}
-
-		t, err = template.New("").Parse(NamedConfiguration)
-		if err != nil {
-			log.Println("failed parsing it", NamedConfiguration)
-		}
-
-		t.Execute(f, struct {
-			Directory     string
-			ProcessIDFile string
-			Reverse       string
-			Zone          string
-		}{
-			"/tmp",
-			"/tmp/named-pid",
-			"",
-			"/tmp/zone",
-		})
-		if err != nil {
-			log.Println("error executing template:", err)
+		records := os.Getenv("DNS_RECORDS")
+		if records == "" {
+			records = "dns/records.json"
+		}
+		if err = Zone.LoadRecords(records); err != nil {
+			logger.Error("failed loading custom dns records", "err", err)
+			os.Exit(1)
+		}
+		if err = Zone.Publish(ctx); err != nil {
+			logger.Error("error writing zone", "err", err)
 			os.Exit(1)
 		}
 
-		f.Close()
-
-		err = named.Start()
+		// forwarders set through the API outlive DNS_UPSTREAMS & resolv.conf
+		forwarders := os.Getenv("DNS_FORWARDERS")
+		if forwarders == "" {
+			forwarders = "dns/forwarders.json"
+		}
+		upstreams, saved, err := dns.LoadForwarders(forwarders)
 		if err != nil {
-			log.Println("failed starting named:", err)
-			os.Exit(1)
+			logger.Warn("discarding saved forwarders", "err", err)
+		}
+		if saved {
+			// as they were
+		} else if s := os.Getenv("DNS_UPSTREAMS"); s != "" {
+			if upstreams, err = dns.ParseForwarders(strings.Split(s, ",")); err != nil {
+				logger.Warn("ignoring DNS_UPSTREAMS", "value", s, "err", err)
+			}
+		} else if upstreams, err = dns.Upstreams("/etc/resolv.conf"); err != nil {
+			logger.Warn("failed reading upstream resolvers, only answering for the zone", "err", err)
 		}
 
-		go func() {
-			err := named.Wait()
-			if err != nil {
-				log.Panicln("named exited:", err)
+		switch mode := os.Getenv("DNS_MODE"); mode {
+		case "builtin":
+			// answered from the zone in memory, so there's nothing to reload
+			addr := os.Getenv("DNS_LISTEN")
+			if addr == "" {
+				addr = ":53"
 			}
-		}()
+
+			server := dns.NewServer(Zone, upstreams)
+			server.ForwardersFile = forwarders
+			Resolver = server
+			go func() {
+				if err := server.ListenAndServe(ctx, addr); err != nil {
+					logger.Error("dns server failed", "addr", addr, "err", err)
+				}
+			}()
+		default:
+			if mode != "" && mode != "named" {
+				logger.Warn("unknown DNS_MODE, falling back to named", "mode", mode)
+			}
+
+			// RNDC names the rndc binary when it isn't on PATH
+			rndc := dns.Rndc{Command: os.Getenv("RNDC"), KeyFile: filepath.Join(dir, "rndc.key"), Server: "127.0.0.1", Port: 953}
+			if err = dns.WriteKey(rndc.KeyFile); err != nil {
+				logger.Error("error writing rndc key", "err", err)
+				os.Exit(1)
+			}
+
+			if t, err = template.New("").Parse(NamedConfiguration); err != nil {
+				logger.Error("failed parsing named configuration template", "err", err)
+				os.Exit(1)
+			}
+			confFile := filepath.Join(dir, "conf")
+			named := dns.NewNamed(confFile, t, dns.NamedConf{
+				Directory:     dir,
+				ProcessIDFile: filepath.Join(dir, "named-pid"),
+				Reverse:       Zone.ReverseFile,
+				ReverseZone:   reverse,
+				Zone:          Zone.File,
+				KeyFile:       rndc.KeyFile,
+				KeyName:       dns.KeyName,
+				ControlPort:   rndc.Port,
+			}, rndc, upstreams)
+			named.ForwardersFile = forwarders
+			os.Remove(confFile)
+			if err = named.Write(); err != nil {
+				logger.Error("error writing named configuration", "err", err)
+				os.Exit(1)
+			}
+			Resolver = named
+
+			go dns.Supervise(ctx, []string{"/bin/sudo", "-S", "/usr/local/bin/named", "-f", "-g", "-c", confFile})
+			Zone.Reload = rndc.Reload
+		}
 	}
 
+	// the API reaches Zone & Resolver without locks, so they're in place first
+	go ServeHTTP(ctx)
+
 	links, err := network.List(ctx)
 	if err != nil {
-		log.Println("failed to probe network links:", err)
+		logger.Error("failed to probe network links", "err", err)
 		os.Exit(1)
 	}
 
 	peers, err := GetPeerInfo()
 	if err != nil {
-		log.Println("failed getting peers:", err)
+		logger.Error("failed getting peers", "err", err)
 		os.Exit(1)
 	}
 
@@ -709,77 +936,104 @@ func main() {
 		}()
 		err = Shell(ctx, r)
 		if err != nil {
-			log.Println("failed writing network configuration to shell:", err)
+			logger.Error("failed writing network configuration to shell", "err", err)
 			os.Exit(1)
 		}
 		cancel()
 
 	}
 
-	log.Printf("iterating over %d peers\n", len(peers))
+	logger.Info("syncing with peers", "count", len(peers))
 
-	for key := range peers {
-		go func(key vertex.Key) {
+	// each peer is synced until it's removed
+	syncs := make(map[vertex.Key]context.CancelFunc, len(peers))
+	follow := func(key vertex.Key) {
+		ctx, cancel := context.WithCancel(ctx)
+		syncs[key] = cancel
+		go func() {
 			ticker := time.NewTicker(time.Second * 5)
+			defer ticker.Stop()
 			for {
 				select {
 				case <-ticker.C:
 				case <-ctx.Done():
 					return
 				}
+				ctx := rid.With(ctx, rid.New())
 				err := Sync(ctx, &key, UpdateNode)
 				if err != nil {
-					log.Println("error fetching updates:", err)
+					syncLogger.WarnContext(ctx, "error fetching updates", "peer", key.String(), "err", err)
+					Syncs.Inc(key.String(), "failure")
+				} else {
+					Syncs.Inc(key.String(), "success")
 				}
 			}
-		}(key)
+		}()
+	}
+	for key := range peers {
+		follow(key)
 	}
 
 	WhoisInfo, err = whois.Get()
 	if err != nil {
-		log.Println("failed to get coordinates:", err)
+		logger.Warn("failed to get coordinates", "err", err)
 	} else {
-		log.Println("got coordinates", WhoisInfo)
+		logger.Info("got coordinates", "location", WhoisInfo)
 	}
 
-	nodes := make(map[vertex.Key]Node)
+	nodes := make(map[vertex.Key]Node, len(peers))
+	publishNodes(ctx, nodes)
 	for {
 		select {
 		case pair := <-UpdateNode:
-			fmt.Printf("updating nodes\n")
-			var k vertex.Key
-			_, err := k.UnmarshalText([]byte(pair.string))
-			if err != nil {
-				log.Printf("failed to parse peer ID: %s\n", pair.string)
-				continue
-			}
+			syncLogger.Debug("updating node", "key", pair.Key.String())
+			k := pair.Key
 
 			if bytes.Equal(k[:], PublicWireguardKey[:]) {
 				continue
 			}
 
-			_, ok := nodes[k]
+			_, ok := peers[k]
 			if !ok {
-				log.Printf("unfound peer: %s\n", k.String())
+				syncLogger.Debug("ignoring update for unknown peer", "key", k.String())
 				continue
 			}
 			nodes[k] = pair.Node
+			publishNodes(ctx, nodes)
+		case change := <-ChangePeer:
+			k := change.Key
+			syncLogger.Debug("peer changed", "key", k.String(), "removed", change.Removed)
+
+			if change.Removed {
+				if stop, ok := syncs[k]; ok {
+					stop()
+				}
+				delete(syncs, k)
+				delete(peers, k)
+				delete(nodes, k)
+			} else if _, ok := peers[k]; !ok {
+				peers[k] = &PeerFSEntry{}
+				follow(k)
+			}
+			publishNodes(ctx, nodes)
 		case w := <-RequestNodes:
-			fmt.Printf("requesting nodes\n")
+			syncLogger.Debug("requesting nodes")
 
 			var buf []byte
 			var err error
 
 			if nodes[PublicWireguardKey], err = GetNode(ctx); err != nil {
-				log.Printf("failed to get local branch: %+v", err)
+				syncLogger.Error("failed to get local branch", "err", err)
 			} else if buf, err = json.Marshal(nodes); err != nil {
-				log.Printf("failed to marshal nodes: %+v", err)
+				syncLogger.Error("failed to marshal nodes", "err", err)
 			} else if _, err = w.Write(buf); err != nil {
-				log.Println("error writing nodes:", err)
+				syncLogger.Debug("error writing nodes", "err", err)
 			}
 
 			w.Close()
 		case <-ctx.Done():
+			// the metrics history is saved one last time
+			<-recorded
 			return
 		}
 	}
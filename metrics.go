@@ -0,0 +1,289 @@
+package main
+
+import (
+	"avaron/client"
+	"avaron/metrics"
+	network "avaron/net"
+	"avaron/tsdb"
+	wg "avaron/wireguard"
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// History of the counters below, queried through /api/metrics/query
+var History = tsdb.New("tsdb/series.gob", nil)
+
+var (
+	RequestDuration = metrics.NewHistogram("avaron_http_request_duration_seconds",
+		"Time to serve API & dashboard requests, by route", nil, "route", "method", "code")
+	Syncs = metrics.NewCounter("avaron_sync_total",
+		"Attempts to fetch node state from peers, by peer & result", "peer", "result")
+)
+
+// interface counters from `ip -s address show`
+func collectInterfaces(ctx context.Context, w *metrics.Writer) {
+	links, err := network.List(ctx)
+	if err != nil {
+		logger.WarnContext(ctx, "failed collecting interface metrics", "err", err)
+		return
+	}
+
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counters := []struct {
+		name, help string
+		value      func(*network.Stats) uint64
+	}{
+		{"bytes", "Bytes", func(s *network.Stats) uint64 { return s.Bytes }},
+		{"packets", "Packets", func(s *network.Stats) uint64 { return s.Packets }},
+		{"errors", "Errors", func(s *network.Stats) uint64 { return s.Errors }},
+		{"dropped", "Dropped packets", func(s *network.Stats) uint64 { return s.Dropped }},
+	}
+
+	for _, dir := range []struct{ name, help string }{{"receive", "received"}, {"transmit", "transmitted"}} {
+		for _, c := range counters {
+			name := "avaron_interface_" + dir.name + "_" + c.name + "_total"
+			w.Header(name, "counter", c.help+" "+dir.help+" by each interface")
+			for _, ifname := range names {
+				link := links[ifname]
+				stats := &link.Stats64.Rx
+				if dir.name == "transmit" {
+					stats = &link.Stats64.Tx
+				}
+				w.Sample(name, float64(c.value(stats)), "interface", ifname)
+			}
+		}
+	}
+
+	w.Header("avaron_interface_up", "gauge", "Whether each interface's operational state is UP")
+	for _, ifname := range names {
+		up := 0.0
+		if links[ifname].OperState == "UP" {
+			up = 1
+		}
+		w.Sample("avaron_interface_up", up, "interface", ifname)
+	}
+}
+
+// peer handshakes & transfer from `wg show all dump`
+func collectWireguard(ctx context.Context, w *metrics.Writer) {
+	peers, err := wg.Dump(ctx)
+	if err != nil {
+		logger.WarnContext(ctx, "failed collecting wireguard metrics", "err", err)
+		return
+	}
+
+	now := time.Now()
+	w.Header("avaron_wireguard_handshake_age_seconds", "gauge", "Time since each peer's latest handshake, absent if there's been none")
+	for _, p := range peers {
+		if !p.LatestHandshake.IsZero() {
+			w.Sample("avaron_wireguard_handshake_age_seconds", now.Sub(p.LatestHandshake).Seconds(), "interface", p.Interface, "peer", p.Key.String())
+		}
+	}
+
+	w.Header("avaron_wireguard_receive_bytes_total", "counter", "Bytes received from each peer")
+	for _, p := range peers {
+		w.Sample("avaron_wireguard_receive_bytes_total", float64(p.Received), "interface", p.Interface, "peer", p.Key.String())
+	}
+
+	w.Header("avaron_wireguard_transmit_bytes_total", "counter", "Bytes sent to each peer")
+	for _, p := range peers {
+		w.Sample("avaron_wireguard_transmit_bytes_total", float64(p.Sent), "interface", p.Interface, "peer", p.Key.String())
+	}
+}
+
+// cached per destination metrics from `ip tcp_metrics`
+func collectTCP(ctx context.Context, w *metrics.Writer) {
+	list, err := network.Metrics(ctx)
+	if err != nil {
+		logger.WarnContext(ctx, "failed collecting TCP metrics", "err", err)
+		return
+	}
+
+	w.Header("avaron_tcp_rtt_seconds", "gauge", "Cached round trip time to each destination")
+	for _, m := range list {
+		w.Sample("avaron_tcp_rtt_seconds", m.RoundTripTime, "destination", m.Destination.String())
+	}
+
+	w.Header("avaron_tcp_rtt_variance_seconds", "gauge", "Cached round trip time variance to each destination")
+	for _, m := range list {
+		w.Sample("avaron_tcp_rtt_variance_seconds", m.RoundTripTimeVariance, "destination", m.Destination.String())
+	}
+
+	w.Header("avaron_tcp_cwnd", "gauge", "Cached congestion window to each destination, in segments")
+	for _, m := range list {
+		w.Sample("avaron_tcp_cwnd", float64(m.CongestionWindow), "destination", m.Destination.String())
+	}
+}
+
+// record samples interfaces, tunnels & TCP metrics into History, saving
+// it every few minutes & once more when ctx is done
+func record(ctx context.Context) {
+	if err := History.Load(); err != nil {
+		logger.Warn("discarding saved metrics history", "err", err)
+	}
+
+	sample := time.NewTicker(10 * time.Second)
+	defer sample.Stop()
+	save := time.NewTicker(5 * time.Minute)
+	defer save.Stop()
+
+	for {
+		select {
+		case now := <-sample.C:
+			sampleHistory(ctx, now)
+		case <-save.C:
+			// series unseen for a month are gone, ie. removed peers
+			History.Prune(time.Now().Add(-30 * 24 * time.Hour))
+			if err := History.Save(); err != nil {
+				logger.Warn("failed saving metrics history", "err", err)
+			}
+		case <-ctx.Done():
+			if err := History.Save(); err != nil {
+				logger.Warn("failed saving metrics history", "err", err)
+			}
+			return
+		}
+	}
+}
+
+func sampleHistory(ctx context.Context, now time.Time) {
+	if links, err := network.List(ctx); err != nil {
+		logger.DebugContext(ctx, "failed sampling interfaces", "err", err)
+	} else {
+		for name, link := range links {
+			prefix := "interface/" + name + "/"
+			for _, dir := range []struct {
+				name  string
+				stats *network.Stats
+			}{{"rx", &link.Stats64.Rx}, {"tx", &link.Stats64.Tx}} {
+				History.Add(prefix+dir.name+"_bytes", tsdb.Counter, now, float64(dir.stats.Bytes))
+				History.Add(prefix+dir.name+"_packets", tsdb.Counter, now, float64(dir.stats.Packets))
+				History.Add(prefix+dir.name+"_errors", tsdb.Counter, now, float64(dir.stats.Errors))
+				History.Add(prefix+dir.name+"_dropped", tsdb.Counter, now, float64(dir.stats.Dropped))
+			}
+		}
+	}
+
+	if peers, err := wg.Dump(ctx); err != nil {
+		logger.DebugContext(ctx, "failed sampling tunnels", "err", err)
+	} else {
+		for _, p := range peers {
+			prefix := "wireguard/" + p.Key.String() + "/"
+			History.Add(prefix+"rx_bytes", tsdb.Counter, now, float64(p.Received))
+			History.Add(prefix+"tx_bytes", tsdb.Counter, now, float64(p.Sent))
+			if !p.LatestHandshake.IsZero() {
+				History.Add(prefix+"handshake_age", tsdb.Gauge, now, now.Sub(p.LatestHandshake).Seconds())
+			}
+		}
+	}
+
+	if list, err := network.Metrics(ctx); err != nil {
+		logger.DebugContext(ctx, "failed sampling TCP metrics", "err", err)
+	} else {
+		for _, m := range list {
+			prefix := "tcp/" + m.Destination.String() + "/"
+			History.Add(prefix+"rtt", tsdb.Gauge, now, m.RoundTripTime)
+			History.Add(prefix+"rtt_variance", tsdb.Gauge, now, m.RoundTripTimeVariance)
+			History.Add(prefix+"cwnd", tsdb.Gauge, now, float64(m.CongestionWindow))
+		}
+	}
+}
+
+// QueryHistory answers /api/metrics/query, series being comma separated or
+// repeated names & patterns, from & to default to the last hour
+func QueryHistory(q url.Values, now time.Time) (m client.Metrics, err error) {
+	from, to := now.Add(-time.Hour), now
+	if s := q.Get("from"); s != "" {
+		if from, err = parseTime(s, now); err != nil {
+			return
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = parseTime(s, now); err != nil {
+			return
+		}
+	}
+
+	var step time.Duration
+	if s := q.Get("step"); s == "" {
+		// finest available
+	} else if n, e := strconv.ParseInt(s, 10, 64); e == nil {
+		step = time.Duration(n) * time.Second
+	} else if step, err = time.ParseDuration(s); err != nil {
+		return
+	}
+	if step < 0 {
+		return m, tsdb.ErrRange
+	}
+
+	var names []string
+	for _, list := range q["series"] {
+		for _, pattern := range strings.Split(list, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				names = append(names, History.Match(pattern)...)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return m, tsdb.ErrNoSeries
+	}
+
+	// series with shorter history come at a finer resolution, so the coarsest
+	// step found is applied to all of them
+	results := make(map[string][]tsdb.Point, len(names))
+	for pass := 0; pass < 2; pass++ {
+		for _, name := range names {
+			points, width, err := History.Query(name, from, to, step)
+			if err == tsdb.ErrNoSeries {
+				continue // pruned meanwhile
+			} else if err != nil {
+				return m, err
+			}
+			results[name] = points
+			if width > step {
+				step = width
+			}
+		}
+	}
+
+	m.Step = int64(step / time.Second)
+	m.Series = make(map[string][][2]float64, len(results))
+	for name, points := range results {
+		values := make([][2]float64, len(points))
+		for i, p := range points {
+			values[i] = [2]float64{float64(p.T), p.V}
+		}
+		m.Series[name] = values
+	}
+	return
+}
+
+// parseTime accepts unix seconds, RFC 3339 or a duration relative to now, ie. -6h
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("malformed time '%s'", s)
+}
+
+func init() {
+	metrics.Collect(collectInterfaces)
+	metrics.Collect(collectWireguard)
+	metrics.Collect(collectTCP)
+}
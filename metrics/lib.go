@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit request latencies, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type metric interface {
+	write(w *Writer)
+}
+
+// Registry holds the metrics instrumented in code, & collectors
+// which report the rest (ie. interface counters) at scrape time
+type Registry struct {
+	lock       sync.Mutex
+	metrics    []metric
+	collectors []func(context.Context, *Writer)
+}
+
+var Default = &Registry{}
+
+// Collect registers fn to be run on every scrape of the default registry
+func Collect(fn func(context.Context, *Writer)) {
+	Default.Collect(fn)
+}
+
+func (r *Registry) Collect(fn func(context.Context, *Writer)) {
+	r.lock.Lock()
+	r.collectors = append(r.collectors, fn)
+	r.lock.Unlock()
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	r.metrics = append(r.metrics, m)
+	r.lock.Unlock()
+}
+
+// Write renders every metric in the text exposition format
+func (r *Registry) Write(ctx context.Context, out io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	collectors := append(([]func(context.Context, *Writer))(nil), r.collectors...)
+	r.lock.Unlock()
+
+	w := &Writer{w: bufio.NewWriter(out)}
+	for _, m := range metrics {
+		m.write(w)
+	}
+	for _, fn := range collectors {
+		fn(ctx, w)
+	}
+	return w.w.Flush()
+}
+
+// Writer emits samples, collectors call Header once per family followed by its samples
+type Writer struct {
+	w *bufio.Writer
+}
+
+// Header describes a metric family, typ being counter, gauge or histogram
+func (w *Writer) Header(name, typ, help string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes one value, labels being name/value pairs
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.w.WriteString(name)
+	if len(labels) > 1 {
+		w.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			w.w.WriteString(labels[i])
+			w.w.WriteString(`="`)
+			w.w.WriteString(escape(labels[i+1]))
+			w.w.WriteByte('"')
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(format(value))
+	w.w.WriteByte('\n')
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// key joins label values, they're split again when writing
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func pairs(names []string, k string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	values := strings.Split(k, "\xff")
+	labels := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		labels = append(labels, name, values[i])
+	}
+	return labels
+}
+
+// Counter only goes up, one series per combination of label values
+type Counter struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{Name: name, Help: help, Labels: labels, values: make(map[string]float64)}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add(v float64, values ...string) {
+	if len(values) != len(c.Labels) {
+		panic(fmt.Sprintf("%s has %d labels, got %d values", c.Name, len(c.Labels), len(values)))
+	}
+	c.lock.Lock()
+	c.values[key(values)] += v
+	c.lock.Unlock()
+}
+
+func (c *Counter) write(w *Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	w.Header(c.Name, "counter", c.Help)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.Sample(c.Name, c.values[k], pairs(c.Labels, k)...)
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	Name    string
+	Help    string
+	Buckets []float64
+	Labels  []string
+
+	lock   sync.Mutex
+	series map[string]*histogram
+}
+
+// NewHistogram uses DefaultBuckets when buckets is nil
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{Name: name, Help: help, Buckets: buckets, Labels: labels, series: make(map[string]*histogram)}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	if len(values) != len(h.Labels) {
+		panic(fmt.Sprintf("%s has %d labels, got %d values", h.Name, len(h.Labels), len(values)))
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	k := key(values)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.Buckets))}
+		h.series[k] = s
+	}
+
+	i := sort.SearchFloat64s(h.Buckets, v)
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w *Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	w.Header(h.Name, "histogram", h.Help)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, labels := h.series[k], pairs(h.Labels, k)
+
+		var cumulative uint64
+		for i, le := range h.Buckets {
+			cumulative += s.counts[i]
+			w.Sample(h.Name+"_bucket", float64(cumulative), append(labels[:len(labels):len(labels)], "le", format(le))...)
+		}
+		w.Sample(h.Name+"_bucket", float64(s.count), append(labels[:len(labels):len(labels)], "le", "+Inf")...)
+		w.Sample(h.Name+"_sum", s.sum, labels...)
+		w.Sample(h.Name+"_count", float64(s.count), labels...)
+	}
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	saved := Default
+	Default = &Registry{}
+	defer func() { Default = saved }()
+
+	c := NewCounter("test_total", "Things\nthat happened", "peer", "result")
+	c.Inc("a", "success")
+	c.Inc("a", "success")
+	c.Add(3, `b"\`, "failure")
+
+	h := NewHistogram("test_seconds", "Latency", []float64{1, 0.1}, "route")
+	h.Observe(0.05, "/api/x")
+	h.Observe(0.5, "/api/x")
+	h.Observe(5, "/api/x")
+
+	Collect(func(_ context.Context, w *Writer) {
+		w.Header("test_gauge", "gauge", "A gauge")
+		w.Sample("test_gauge", 1.5)
+	})
+
+	var buf bytes.Buffer
+	if err := Default.Write(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_total Things\nthat happened
+# TYPE test_total counter
+test_total{peer="a",result="success"} 2
+test_total{peer="b\"\\",result="failure"} 3
+# HELP test_seconds Latency
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/api/x",le="0.1"} 1
+test_seconds_bucket{route="/api/x",le="1"} 2
+test_seconds_bucket{route="/api/x",le="+Inf"} 3
+test_seconds_sum{route="/api/x"} 5.55
+test_seconds_count{route="/api/x"} 3
+# HELP test_gauge A gauge
+# TYPE test_gauge gauge
+test_gauge 1.5
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	saved := Default
+	Default = &Registry{}
+	defer func() { Default = saved }()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for missing label values")
+		}
+	}()
+	NewCounter("x_total", "x", "a").Inc()
+}
+
+func TestEscape(t *testing.T) {
+	if got := escape("a\nb"); !strings.Contains(got, `\n`) {
+		t.Errorf("newline not escaped: %q", got)
+	}
+}
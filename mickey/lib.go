@@ -1,11 +1,13 @@
 package mickey
 
 import (
+	"avaron/logging"
 	"io"
 	"sync"
-	"log"
 )
 
+var logger = logging.For("mickey")
+
 type Muxer struct {
 	lock sync.RWMutex
 	r io.Reader // underlying reader
@@ -26,7 +28,9 @@ func (m *Muxer) EOF() bool {
 }
 
 func (r *reader) Read(p []byte) (n int, err error) {
-	defer log.Println("mickey muxer returning", n, err)
+	defer func() {
+		logger.Debug("read", "n", n, "err", err)
+	}()
 	m := r.m
 	var mn int // muxer number of bytes read
 
@@ -1,6 +1,6 @@
 import React, {StrictMode, useState, useEffect, useRef, useCallback} from 'react'
 import Frame from '../frame'
-import {size} from '../util'
+import {size, checked} from '../util'
 import ReactDOM from 'react-dom/client';
 
 function parseTick(input) {
@@ -220,69 +220,184 @@ function style(s) {
 	switch (s) {
 	case "healthy": return "success";
 	case "unhealthy": return "danger";
+	case "degraded": return "warning";
+	case "error": return "secondary";
 	default: return "warning";
 	}
 }
 
+// commands suggested by health checks, which only run once approved
+const Approvals = () => {
+	const [pending, setPending] = useState([])
+	const [error, setError] = useState(null)
+
+	const refresh = useCallback(() => {
+		fetch("/api/exec/pending")
+			.then(checked)
+			.then(r => r.json())
+			.then(setPending)
+			.catch(e => setError(e.message))
+	}, [setPending, setError])
+
+	const decide = useCallback((id, approve) => {
+		fetch("/api/exec/pending/" + id, {
+			method: "POST",
+			body: JSON.stringify({ approve }),
+		})
+			.then(checked)
+			.then(refresh)
+			.catch(e => setError(e.message))
+	}, [refresh, setError])
+
+	useEffect(() => {
+		refresh()
+		const interval = setInterval(refresh, 5000)
+		return () => clearInterval(interval)
+	}, [refresh])
+
+	if (pending.length == 0 && !error) {
+		return null
+	}
+
+	return (
+		<div class="card text-bg-dark mb-2">
+			<div class="card-header">
+				Awaiting approval
+			</div>
+			<div class="card-body">
+				{error && <div class="alert alert-danger">{error}</div>}
+				<table class="w-100">
+					{pending.map(p => (
+						<tr key={p.id}>
+							<td><tt>$ {p.argv.join(" ")}</tt></td>
+							<td class="text-secondary">{p.source}</td>
+							<td class="text-end">
+								<button class="btn btn-sm btn-outline-success me-1" onClick={decide.bind(null, p.id, true)}>Run</button>
+								<button class="btn btn-sm btn-outline-danger" onClick={decide.bind(null, p.id, false)}>Reject</button>
+							</td>
+						</tr>
+					))}
+				</table>
+			</div>
+		</div>
+	)
+}
+
+// dialogue renders a health check report as the messages the model saw
+function dialogue(report) {
+	const inputs = report.inputs.map(i => "`$ " + i.name + "`:\n```\n" + i.output + "\n```\n")
+	if (report.probes.length) {
+		const probes = report.probes.map(p => p.name + ": " + p.status.toUpperCase() + " - " + p.detail)
+		inputs.push("Probe results:\n```\n" + probes.join("\n") + "\n```\n")
+	}
+
+	const messages = [{ role: "user", content: inputs.join("\n") }]
+	for (const turn of report.turns) {
+		switch (turn.role) {
+		case "model":
+			// replies that only call tools are empty, unless they're still streaming
+			if (turn.content || turn === report.turns[report.turns.length-1]) {
+				messages.push({ role: "assistant", content: turn.content || "" })
+			}
+			break
+		case "command": {
+			const c = turn.command
+			messages.push({ role: "user", content: "`$ " + c.argv.join(" ") + "`:\n```\n" + c.stdout + c.stderr + "\n```\n" })
+			break
+		}
+		case "tool":
+			messages.push({ role: "user", content: "`" + turn.tool + "(" + turn.arguments + ")`:\n```\n" + turn.content + "\n```\n" })
+			break
+		default:
+			messages.push({ role: "note", content: turn.content })
+		}
+	}
+	if (report.error) {
+		messages.push({ role: "note", content: report.error })
+	}
+	return messages
+}
+
+// apply folds a streamed health check event into its report
+function apply(report, e) {
+	switch (e.type) {
+	case "input":
+		return { ...report, inputs: [...report.inputs, e.input] }
+	case "probes":
+		return { ...report, probes: [...report.probes, ...e.probes] }
+	case "turn":
+		return { ...report, turns: [...report.turns, e.turn] }
+	case "token": {
+		const turns = report.turns.slice()
+		const last = turns.length - 1
+		turns[last] = { ...turns[last], content: (turns[last].content || "") + e.token }
+		return { ...report, turns }
+	}
+	case "done":
+		return e.report
+	}
+	return report
+}
+
 const Chat = () => {
-	const [prompt,     setPromptInner] = useState("")
+	const [messages,  setMessages] = useState([])
 	const [entries,   setEntries] = useState({})
 	const [textArea, setTextArea] = useState(false)
 	const input                   = useRef("")
 	const xhr                     = useRef(null)
 
-	const setPrompt = (p) => {
-		console.trace("set prompt", p)
-		setPromptInner(p)
-	}
-
-
 	const fetchEntries = useCallback(() => {
 		fetch("/api/health")
 			.then(r => r.json())
-			.then((r) => (console.log(r), r))
 			.then(setEntries)
 	}, [setEntries])
 
 	const post = useCallback((content) => {
+		if (xhr.current) {
+			xhr.current.abort()
+			xhr.current = null
+		}
+
+		const history = [...messages.filter(m => m.role != "note"), { role: "user", content }]
+		setMessages([...history, { role: "assistant", content: "" }])
+
 		const request = new XMLHttpRequest();
 		request.open("POST", "/api/completions", true);
 
 		let i = 0, j = 0
-		request.onreadystatechange = function(e) {
-			switch (request.readyState) {
-			case 3: break;
-			default:
-				return
-			}
-
-			for (; i < request.responseText.length; i += j+1) {
-				const rest = request.responseText.slice(i)
-
-				j = rest.indexOf('\n')
-				if (j == -1) {
-					break
-				} else if (j == 0) {
-					continue
+		return new Promise((res) => {
+			request.onreadystatechange = function(e) {
+				switch (request.readyState) {
+				case 3: break;
+				case 4: return res();
+				default:
+					return
 				}
 
-				const token = JSON.parse(rest.slice("data: ".length, j))
-				setPrompt(chat => chat + token.content)
-			}
-		};
-
-		const p = prompt+"[INST]"+content+"[/INST]"
-		const promise = new Promise((res) => setPrompt(p, res))
-
-		request.send(JSON.stringify({
-			prompt: p,
-			model: "mixtral.gguf",
-			stream: true,
-		}));
-
-		return promise
+				for (; i < request.responseText.length; i += j+1) {
+					const rest = request.responseText.slice(i)
+
+					j = rest.indexOf('\n')
+					if (j == -1) {
+						break
+					} else if (j == 0) {
+						continue
+					}
+
+					const token = JSON.parse(rest.slice("data: ".length, j))
+					setMessages(chat => {
+						const last = chat[chat.length-1]
+						return [...chat.slice(0, -1), { ...last, content: last.content + token.content }]
+					})
+				}
+			};
 
-	}, [prompt, setPrompt])
+			request.send(JSON.stringify({
+				messages: history,
+				stream: true,
+			}));
+		})
+	}, [messages, setMessages])
 
 	const submit = useCallback((e) => {
 		e.preventDefault()
@@ -291,95 +406,72 @@ const Chat = () => {
 		}
 
 		post(input.current.value).then(() => (input.current.value = ""))
-	}, [setPrompt])
+	}, [post])
 
 	const shell = useCallback((command) => {
-		const request = new XMLHttpRequest();
-		request.open("POST", "/api/shell/", true);
-
-		request.onreadystatechange = function(e) {
-			switch (e.target.readyState) {
-			case 4:
-				if (e.target.responseText.length) {
-					break
-				}
-			default:
-					return
-			}
-			post("\n```\n" + e.target.responseText + "\n```\n")
-		};
-
-		request.send(command);
-	}, [setPrompt])
-
+		fetch("/api/exec", {
+			method: "POST",
+			body: JSON.stringify({ argv: command.trim().split(/\s+/) }),
+		})
+			.then(r => r.json())
+			.then(r => post("`$ " + command.trim() + "`:\n```\n" + r.stdout + r.stderr + "\n```\n"))
+	}, [post])
 
+	// follows a run's events, which stream until it finishes
 	const focusLog = useCallback((ts) => {
 		if (xhr.current) {
 			xhr.current.abort()
 			xhr.current = null
 		}
 
+		let report = { inputs: [], probes: [], turns: [] }, i = 0
 		xhr.current = new XMLHttpRequest();
-		xhr.current.open("GET", "/api/health/" + ts, true);
+		xhr.current.open("GET", "/api/health/" + ts + "/stream", true);
 
 		xhr.current.onreadystatechange = function(e) {
 			switch (e.target.readyState){
-			case 4: break
+			case 3: case 4: break
 			default:
-				if (e.target.responseText.length <= 0) {
-					return
-				}
+				return
+			}
+
+			const text = e.target.responseText
+			for (let j; (j = text.indexOf('\n', i)) != -1; i = j+1) {
+				report = apply(report, JSON.parse(text.slice(i, j)))
 			}
-			setPrompt(e.target.responseText)
+			setMessages(dialogue(report))
 		};
 
 		xhr.current.send();
-	}, [setPrompt])
+	}, [setMessages])
 
 	useEffect(fetchEntries, [])
 
-	let i, j;
-	const messages = new Array()
-
-	for (i = 0; i < prompt.length; i += j) {
-		j = prompt.slice(i).indexOf("[INST]")
-
-		switch (j) {
-		case 0:
-			j = prompt.slice(i).indexOf("[/INST]")
-			if (j == -1) {
-				throw "bad prompt"
-			} else if (j > "[INST]".length) {
-				const message = markdown(shell, prompt.slice(i+"[INST]".length, i+j))
-				messages.push((
-					<div class="ms-auto bg-secondary p-3 pb-1 rounded mb-1">
-						<p key={i}>
-							{message ? message : "..."}
-						</p>
-					</div>
-				))
-			}
-			j += "[/INST]".length
-			break;
-		case -1:
-			j = prompt.length
-		default:
-			if (i == 0) {
-				continue
-			}
-			if (space(prompt.slice(i, i+j))) {
-				break
-			}
-			const message = markdown(shell, prompt.slice(i, i+j))
-			messages.push((
+	const bubbles = messages.map((m, i) => {
+		const message = markdown(shell, m.content)
+		switch (m.role) {
+		case "user":
+			return (
+				<div key={i} class="ms-auto bg-secondary p-3 pb-1 rounded mb-1">
+					{message ? message : "..."}
+				</div>
+			)
+		case "assistant":
+			return (
 				<div key={i} class="me-auto bg-primary p-2 pb-1 rounded mb-1">
 					{message ? message : "..."}
 				</div>
-			))
+			)
+		default:
+			return (
+				<div key={i} class="mx-auto text-secondary small mb-1">
+					{m.content}
+				</div>
+			)
 		}
-	}
+	})
 
-	i = size(entries)
+	let i = size(entries)
 	const logs = new Array(i)
 	for (entry in entries) {
 		logs[--i] = ((
@@ -398,12 +490,14 @@ const Chat = () => {
 		<Frame>
 			<div class="d-flex flex-column w-100">
 
+				<Approvals />
+
 				<div class="card text-bg-dark flex-fill overflow-x-auto mb-2">
 					<div class="card-header">
 						Chat
 					</div>
 					<div class="card-body d-flex flex-column">
-						{messages}
+						{bubbles}
 						<div class="w-100 d-flex"  >
 							<form class="w-100 d-flex flex-row" onSubmit={submit}>
 								<div class="input-group">  
@@ -1,12 +1,230 @@
-import React, {StrictMode} from 'react'
+import React, {StrictMode, useState, useEffect, useCallback} from 'react'
 import Frame from '../frame'
+import {checked} from '../util'
 import ReactDOM from 'react-dom/client';
 
+const types = ["A", "AAAA", "CNAME", "TXT", "SRV"]
+
+const empty = {name: "", type: "A", ttl: 0, value: "", priority: 0, weight: 0, port: 0}
+
+const Records = () => {
+	const [records, setRecords] = useState([])
+	const [draft, setDraft] = useState(empty)
+	const [editing, setEditing] = useState(null)
+
+	const fetchRecords = useCallback(() => {
+		fetch("/api/dns/records")
+			.then(checked)
+			.then(r => r.json())
+			.then(setRecords)
+			.catch(e => alert(e.message))
+	}, [setRecords])
+
+	useEffect(fetchRecords, [])
+
+	const save = useCallback(() => {
+		const record = {...draft, ttl: +draft.ttl, priority: +draft.priority, weight: +draft.weight, port: +draft.port}
+		const [method, path] = editing ? ["PUT", "/api/dns/records/" + encodeURIComponent(editing)] : ["POST", "/api/dns/records"]
+		fetch(path, {method, body: JSON.stringify(record), headers: {"Content-Type": "application/json"}})
+			.then(checked)
+			.then(() => {
+				setDraft(empty)
+				setEditing(null)
+				fetchRecords()
+			})
+			.catch(e => alert(e.message))
+	}, [draft, editing, fetchRecords])
+
+	const remove = (id) => {
+		fetch("/api/dns/records/" + encodeURIComponent(id), {method: "DELETE"})
+			.then(checked)
+			.then(fetchRecords)
+			.catch(e => alert(e.message))
+	}
+
+	const edit = (record) => {
+		setEditing(record.id)
+		setDraft({...empty, ...record})
+	}
+
+	const set = (key) => (e) => setDraft({...draft, [key]: e.target.value})
+
+	const rows = records.map(record => (
+		<tr key={record.id} class={record.id === editing ? "table-active" : ""}>
+			<td class="py-3"><tt>{record.name}</tt></td>
+			<td class="py-3">{record.type}</td>
+			<td class="py-3">{record.ttl}</td>
+			<td class="py-3 text-break">
+				<tt>{record.type === "SRV" ? `${record.priority} ${record.weight} ${record.port} ${record.value}` : record.value}</tt>
+			</td>
+			<td class="text-end">
+				<button type="button" class="btn btn-primary me-1" onClick={edit.bind(null, record)}>
+					Edit
+				</button>
+				<button type="button" class="btn btn-danger" onClick={remove.bind(null, record.id)}>
+					Delete
+				</button>
+			</td>
+		</tr>
+	))
+
+	return (
+		<div class="card text-bg-dark mb-2">
+			<div class="card-header">
+				avaron.lan Records
+			</div>
+			<div class="card-body">
+				<table class="table table-dark">
+					<thead>
+						<tr>
+							<th scope="col">Name</th>
+							<th scope="col">Type</th>
+							<th scope="col">TTL</th>
+							<th scope="col">Value</th>
+							<th scope="col"></th>
+						</tr>
+					</thead>
+					<tbody>
+						{rows}
+					</tbody>
+				</table>
+				<div class="d-flex flex-row flex-wrap gap-1">
+					<input class="form-control w-auto" placeholder="name, @ for the zone" value={draft.name} onChange={set("name")} />
+					<select class="form-select w-auto" value={draft.type} onChange={set("type")}>
+						{types.map(t => <option key={t} value={t}>{t}</option>)}
+					</select>
+					<input class="form-control w-auto" type="number" min="0" placeholder="TTL" title="TTL, the zone's when 0" value={draft.ttl} onChange={set("ttl")} />
+					{draft.type === "SRV" ? (
+						<>
+							<input class="form-control w-auto" type="number" min="0" title="priority" value={draft.priority} onChange={set("priority")} />
+							<input class="form-control w-auto" type="number" min="0" title="weight" value={draft.weight} onChange={set("weight")} />
+							<input class="form-control w-auto" type="number" min="1" title="port" value={draft.port} onChange={set("port")} />
+						</>
+					) : null}
+					<input class="form-control flex-grow-1 w-auto" placeholder="address, target or text" value={draft.value} onChange={set("value")} />
+					<button type="button" class="btn btn-success" onClick={save}>
+						{editing ? "Save" : "Add"}
+					</button>
+					{editing ? (
+						<button type="button" class="btn btn-secondary" onClick={() => (setEditing(null), setDraft(empty))}>
+							Cancel
+						</button>
+					) : null}
+				</div>
+			</div>
+		</div>
+	)
+}
+
+const Forwarders = () => {
+	const [text, setText] = useState("")
+
+	useEffect(() => {
+		fetch("/api/dns/forwarders")
+			.then(checked)
+			.then(r => r.json())
+			.then(list => setText(list.join("\n")))
+			.catch(e => alert(e.message))
+	}, [])
+
+	const save = () => {
+		const list = text.split(/[\s,]+/).filter(s => s !== "")
+		fetch("/api/dns/forwarders", {method: "PUT", body: JSON.stringify(list), headers: {"Content-Type": "application/json"}})
+			.then(checked)
+			.then(r => r.json())
+			.then(list => setText(list.join("\n")))
+			.catch(e => alert(e.message))
+	}
+
+	return (
+		<div class="card text-bg-dark mb-2">
+			<div class="card-header">
+				Forwarders
+			</div>
+			<div class="card-body">
+				<textarea
+					class="form-control mb-2"
+					rows="3"
+					placeholder="one resolver per line, with an optional port"
+					value={text}
+					onChange={e => setText(e.target.value)}
+				/>
+				<button type="button" class="btn btn-success" onClick={save}>
+					Apply
+				</button>
+			</div>
+		</div>
+	)
+}
+
+const Stats = () => {
+	const [stats, setStats] = useState(null)
+	const [error, setError] = useState(null)
+
+	useEffect(() => {
+		const update = () => fetch("/api/dns/stats")
+			.then(checked)
+			.then(r => r.json())
+			.then(setStats)
+			.catch(e => setError(e.message))
+		update()
+		const interval = setInterval(update, 10000)
+		return () => clearInterval(interval)
+	}, [])
+
+	const rows = (stats || []).map(s => (
+		<tr key={s.client}>
+			<td class="py-3"><tt>{s.client}</tt></td>
+			<td class="py-3">{s.queries}</td>
+			<td class="py-3">{Object.entries(s.types).map(([k, v]) => `${k} ${v}`).join(", ")}</td>
+			<td class="py-3">{Object.entries(s.outcomes).map(([k, v]) => `${k} ${v}`).join(", ")}</td>
+			<td class="py-3">{new Date(s.last).toLocaleString()}</td>
+		</tr>
+	))
+
+	return (
+		<div class="card text-bg-dark">
+			<div class="card-header">
+				Queries by Client
+			</div>
+			<div class="card-body">
+				{stats ? (
+					<table class="table table-dark">
+						<thead>
+							<tr>
+								<th scope="col">Client</th>
+								<th scope="col">Queries</th>
+								<th scope="col">Types</th>
+								<th scope="col">Outcomes</th>
+								<th scope="col">Last</th>
+							</tr>
+						</thead>
+						<tbody>
+							{rows}
+						</tbody>
+					</table>
+				) : <p class="m-0">{error}</p>}
+			</div>
+		</div>
+	)
+}
+
+const DNS = () => (
+	<Frame>
+		<div
+			style={{scrollbarWidth: "none", maxHeight: "100vh"}}
+			class="d-flex flex-column w-100 overflow-auto"
+		>
+			<Records />
+			<Forwarders />
+			<Stats />
+		</div>
+	</Frame>
+)
+
 const root = ReactDOM.createRoot(document.getElementById('root'));
 root.render(
 	<StrictMode>
-		<Frame />
+		<DNS />
 	</StrictMode>
 );
-
-
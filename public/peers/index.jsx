@@ -1,6 +1,6 @@
 import React, {StrictMode, useState, useEffect, useRef, useCallback} from 'react'
 import Frame from '../frame'
-import {size} from '../util'
+import {size, checked} from '../util'
 import ReactDOM from 'react-dom/client';
 
 const Peers = () => {
@@ -30,12 +30,17 @@ const Peers = () => {
 	const create = useCallback(() => {
 		setFetching(true)
 		const promise = fetch("/api/wireguard", { method: "POST" })
+			.then(checked)
 			.then(r => r.text())
 			.then(t => {
 				console.log("setting inner html")
 				setQR(t)
 				fetchPeers()
 			})
+			.catch(e => {
+				setFetching(false)
+				alert(e.message)
+			})
 	}, [setFetching, fetchPeers, setQR])
 
 	useEffect(fetchPeers, [])
@@ -55,7 +60,9 @@ const Peers = () => {
 		const peer = peers[key]
 		const fn = (key) => {
 			fetch("/api/wireguard", {method: "DELETE", body: key})
+				.then(checked)
 				.then(fetchPeers)
+				.catch(e => alert(e.message))
 		}
 
 		rows[i++] = (
@@ -5,3 +5,21 @@ export function size(obj) {
 	}
 	return n
 }
+
+// rejects with the API's error message for non-2xx responses
+export async function checked(r) {
+	if (r.ok) {
+		return r
+	}
+	let message = r.statusText
+	try {
+		const body = await r.json()
+		message = body.details ? `${body.message}: ${body.details}` : body.message
+		if (body.request_id) {
+			message += ` (request ${body.request_id})`
+		}
+	} catch (e) {
+		// not an API error
+	}
+	throw new Error(message)
+}
@@ -0,0 +1,394 @@
+package static
+
+import (
+	"avaron/logging"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	filepath "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("static")
+
+const (
+	MinCompress = 1024     // smaller files aren't worth gzipping
+	MaxCompress = 8 << 20  // nor are larger ones worth holding in memory
+	MaxCache    = 64 << 20 // total bytes of gzipped files kept around
+)
+
+type entry struct {
+	mod  time.Time
+	size int64
+	etag string
+}
+
+type Server struct {
+	FS fs.FS
+
+	lock    sync.Mutex
+	etags   map[string]entry
+	gzipped map[string][]byte // by etag
+	cached  int
+}
+
+// Primary constructor for this package
+func New(fsys fs.FS) *Server {
+	return &Server{
+		FS:      fsys,
+		etags:   make(map[string]entry),
+		gzipped: make(map[string][]byte),
+	}
+}
+
+// etag hashes the file's content, remembering the result until it's modified
+func (s *Server) etag(name string, info fs.FileInfo) (string, error) {
+	s.lock.Lock()
+	e, ok := s.etags[name]
+	s.lock.Unlock()
+	if ok && e.mod.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.etag, nil
+	}
+
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	e = entry{
+		mod:  info.ModTime(),
+		size: info.Size(),
+		etag: `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`,
+	}
+
+	s.lock.Lock()
+	s.etags[name] = e
+	s.lock.Unlock()
+	return e.etag, nil
+}
+
+func (s *Server) compress(name, etag string) ([]byte, error) {
+	s.lock.Lock()
+	buf, ok := s.gzipped[etag]
+	s.lock.Unlock()
+	if ok {
+		return buf, nil
+	}
+
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var b bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+	if _, err = io.Copy(w, f); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cached+b.Len() > MaxCache {
+		// crude, but the UI is small enough that this shouldn't happen
+		s.gzipped = make(map[string][]byte)
+		s.cached = 0
+	}
+	s.gzipped[etag] = b.Bytes()
+	s.cached += b.Len()
+	return b.Bytes(), nil
+}
+
+func compressible(contentType string) bool {
+	switch {
+	case strings.HasPrefix(contentType, "text/"):
+	case strings.Contains(contentType, "javascript"):
+	case strings.Contains(contentType, "json"):
+	case strings.Contains(contentType, "xml"):
+	case strings.HasPrefix(contentType, "image/svg"):
+	default:
+		return false
+	}
+	return true
+}
+
+func accepts(req *http.Request, encoding string) bool {
+	for _, v := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		v = strings.TrimSpace(v)
+		name, q := v, ""
+		if i := strings.Index(v, ";"); i >= 0 {
+			name, q = strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])
+		}
+		if strings.EqualFold(name, encoding) {
+			return q != "q=0" && q != "q=0.0"
+		}
+	}
+	return false
+}
+
+// matches checks an If-None-Match/If-Match style list against etag, weakly
+func matches(list, etag string) bool {
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange supports a single "bytes=" range, ok is false if the header should
+// be ignored as malformed ranges are, err only for ones beyond size
+func parseRange(s string, size int64) (start, length int64, ok bool, err error) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return 0, 0, false, nil
+	}
+	s = strings.TrimPrefix(s, "bytes=")
+	if strings.Contains(s, ",") {
+		// multipart/byteranges isn't worth it, serving everything is permitted
+		return 0, 0, false, nil
+	}
+
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return 0, 0, false, nil
+	}
+	first, last := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+
+	switch {
+	case first == "":
+		// suffix, the last n bytes
+		n, e := strconv.ParseInt(last, 10, 64)
+		if e != nil || n < 0 {
+			return 0, 0, false, nil
+		} else if n == 0 {
+			return 0, 0, false, fmt.Errorf("range '%s' not satisfiable", s)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	default:
+		start, e := strconv.ParseInt(first, 10, 64)
+		if e != nil || start < 0 {
+			return 0, 0, false, nil
+		}
+		end := size - 1
+		if last != "" {
+			if end, e = strconv.ParseInt(last, 10, 64); e != nil || end < start {
+				return 0, 0, false, nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			return 0, 0, false, fmt.Errorf("range '%s' not satisfiable", s)
+		}
+		return start, end - start + 1, true, nil
+	}
+}
+
+type section struct {
+	io.Reader
+	io.Closer
+}
+
+// resolve maps the URL path to a file, falling back to the closest
+// index.html for client side routes: paths without an extension at the top
+// or under a directory that exists, never the API's
+func (s *Server) resolve(path string) (name string, info fs.FileInfo, redirect bool, err error) {
+	name = strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	if name == "" {
+		name = "."
+	}
+	if strings.HasSuffix(path, "/") {
+		name = filepath.Join(name, "index.html")
+	}
+
+	info, err = fs.Stat(s.FS, name)
+	if err == nil && info.IsDir() {
+		return name, info, true, nil
+	} else if err == nil || filepath.Ext(name) != "" {
+		return
+	}
+
+	top, _, nested := strings.Cut(name, "/")
+	if top == "api" {
+		return
+	} else if nested {
+		if i, e := fs.Stat(s.FS, top); e != nil || !i.IsDir() {
+			return
+		}
+	}
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		index := filepath.Join(dir, "index.html")
+		if i, e := fs.Stat(s.FS, index); e == nil && !i.IsDir() {
+			return index, i, false, nil
+		}
+		if dir == "." || dir == "/" {
+			return
+		}
+	}
+}
+
+func (s *Server) Serve(req *http.Request) (code int, header http.Header, r io.ReadCloser) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return http.StatusNotFound, nil, nil
+	}
+
+	name, info, redirect, err := s.resolve(req.URL.Path)
+	if err != nil {
+		return http.StatusNotFound, nil, nil
+	} else if redirect {
+		return http.StatusMovedPermanently, http.Header{
+			"Location": []string{req.URL.Path + "/"},
+		}, nil
+	}
+
+	etag, err := s.etag(name, info)
+	if err != nil {
+		logger.ErrorContext(req.Context(), "error hashing", "file", name, "err", err)
+		return http.StatusInternalServerError, nil, nil
+	}
+
+	f, err := s.FS.Open(name)
+	if err != nil {
+		logger.ErrorContext(req.Context(), "error opening", "file", name, "err", err)
+		return http.StatusInternalServerError, nil, nil
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		var sniff [512]byte
+		n, _ := io.ReadFull(f, sniff[:])
+		contentType = http.DetectContentType(sniff[:n])
+		f.Close()
+		if f, err = s.FS.Open(name); err != nil {
+			logger.ErrorContext(req.Context(), "error opening", "file", name, "err", err)
+			return http.StatusInternalServerError, nil, nil
+		}
+	}
+
+	header = http.Header{
+		"Content-Type":  []string{contentType},
+		"Accept-Ranges": []string{"bytes"},
+		"Vary":          []string{"Accept-Encoding"},
+	}
+	// embedded files have no modification time, their ETag has to do
+	modified := info.ModTime()
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if strings.HasPrefix(contentType, "text/html") {
+		header.Set("Cache-Control", "no-cache")
+	}
+
+	var (
+		size                   = info.Size()
+		body     io.ReadCloser = f
+		encoding string
+	)
+
+	// precompressed sidecars are preferred, then gzipping on the fly
+	rng := req.Header.Get("Range")
+	if rng == "" {
+		for _, enc := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+			if !accepts(req, enc.name) {
+				continue
+			}
+			sidecar, e := fs.Stat(s.FS, name+enc.ext)
+			if e != nil || sidecar.IsDir() {
+				continue
+			}
+			g, e := s.FS.Open(name + enc.ext)
+			if e != nil {
+				continue
+			}
+			f.Close()
+			body, size, encoding = g, sidecar.Size(), enc.name
+			break
+		}
+
+		if encoding == "" && accepts(req, "gzip") && compressible(contentType) && size >= MinCompress && size <= MaxCompress {
+			if buf, e := s.compress(name, etag); e != nil {
+				logger.ErrorContext(req.Context(), "error compressing", "file", name, "err", e)
+			} else {
+				f.Close()
+				body, size, encoding = io.NopCloser(bytes.NewReader(buf)), int64(len(buf)), "gzip"
+			}
+		}
+	}
+
+	// each representation has its own entity tag
+	if encoding != "" {
+		etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("ETag", etag)
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if matches(inm, etag) {
+			body.Close()
+			return http.StatusNotModified, header, nil
+		}
+	} else if ts := req.Header.Get("If-Modified-Since"); ts == "" || modified.IsZero() {
+		// fine
+	} else if t, err := time.Parse(http.TimeFormat, ts); err != nil {
+		// fine
+		logger.DebugContext(req.Context(), "bad If-Modified-Since", "err", err)
+	} else if !modified.Truncate(time.Second).After(t) {
+		body.Close()
+		return http.StatusNotModified, header, nil
+	}
+
+	code = http.StatusOK
+	if ir := req.Header.Get("If-Range"); rng != "" && ir != "" && ir != etag && (modified.IsZero() || ir != header.Get("Last-Modified")) {
+		rng = ""
+	}
+
+	if start, length, ok, err := parseRange(rng, size); err != nil {
+		body.Close()
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return http.StatusRequestedRangeNotSatisfiable, header, nil
+	} else if ok {
+		if seeker, ok := body.(io.Seeker); !ok {
+			// serve the whole thing
+		} else if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			logger.ErrorContext(req.Context(), "error seeking", "file", name, "err", err)
+			body.Close()
+			return http.StatusInternalServerError, nil, nil
+		} else {
+			code = http.StatusPartialContent
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+			body = section{io.LimitReader(body, length), body}
+			size = length
+		}
+	}
+
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	if req.Method == "HEAD" {
+		body.Close()
+		return code, header, nil
+	}
+	return code, header, body
+}
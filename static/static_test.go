@@ -0,0 +1,120 @@
+package static
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func get(s *Server, path string, header ...string) (int, http.Header, string) {
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: path}, Header: http.Header{}}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	code, h, r := s.Serve(req)
+	var body []byte
+	if r != nil {
+		body, _ = io.ReadAll(r)
+		r.Close()
+	}
+	return code, h, string(body)
+}
+
+func TestServe(t *testing.T) {
+	js := strings.Repeat("console.log('hello')\n", 100)
+	s := New(fstest.MapFS{
+		"index.html":           {Data: []byte("<html>root</html>"), ModTime: time.Now()},
+		"dashboard/index.html": {Data: []byte("<html>dashboard</html>"), ModTime: time.Now()},
+		"dashboard/index.js":   {Data: []byte(js), ModTime: time.Now()},
+		"app.js":               {Data: []byte("0123456789")},
+		"app.js.br":            {Data: []byte("brotli")},
+		"blob":                 {Data: []byte("\x89PNG\r\n\x1a\n")},
+	})
+
+	code, h, body := get(s, "/dashboard/")
+	if code != 200 || body != "<html>dashboard</html>" || h.Get("ETag") == "" {
+		t.Fatalf("unexpected index: %d %q %v", code, body, h)
+	}
+	etag := h.Get("ETag")
+
+	if code, _, _ = get(s, "/dashboard/", "If-None-Match", `"other", `+etag); code != 304 {
+		t.Errorf("expected 304 for matching etag, got %d", code)
+	}
+	if code, _, _ = get(s, "/dashboard"); code != 301 {
+		t.Errorf("expected redirect for directory, got %d", code)
+	}
+
+	// client side routes fall back to the closest index.html
+	if _, _, body = get(s, "/dashboard/peers/123"); body != "<html>dashboard</html>" {
+		t.Errorf("unexpected SPA fallback: %q", body)
+	}
+	if _, _, body = get(s, "/settings"); body != "<html>root</html>" {
+		t.Errorf("unexpected SPA fallback: %q", body)
+	}
+	for _, path := range []string{"/api/nodez", "/api", "/nowhere/peers/123"} {
+		if code, _, _ = get(s, path); code != 404 {
+			t.Errorf("expected 404 for %s, got %d", path, code)
+		}
+	}
+	if code, _, _ = get(s, "/missing.js"); code != 404 {
+		t.Errorf("expected 404 for missing asset, got %d", code)
+	}
+
+	code, h, body = get(s, "/app.js", "Range", "bytes=2-4")
+	if code != 206 || body != "234" || h.Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("unexpected range: %d %q %v", code, body, h)
+	}
+	if _, _, body = get(s, "/app.js", "Range", "bytes=-3"); body != "789" {
+		t.Errorf("unexpected suffix range: %q", body)
+	}
+	for _, rng := range []string{"bytes=20-", "bytes=-0"} {
+		if code, _, _ = get(s, "/app.js", "Range", rng); code != 416 {
+			t.Errorf("expected 416 for %q, got %d", rng, code)
+		}
+	}
+	for _, rng := range []string{"bytes=4-2", "bytes=x-", "bytes=-y", "bytes=3"} {
+		if code, _, body = get(s, "/app.js", "Range", rng); code != 200 || body != "0123456789" {
+			t.Errorf("expected malformed %q to serve everything, got %d", rng, code)
+		}
+	}
+	if code, _, _ = get(s, "/app.js", "Range", "bytes=2-4", "If-Range", `"stale"`); code != 200 {
+		t.Errorf("expected If-Range mismatch to serve everything, got %d", code)
+	}
+
+	if _, h, body = get(s, "/app.js", "Accept-Encoding", "gzip, br"); body != "brotli" || h.Get("Content-Encoding") != "br" {
+		t.Errorf("expected brotli sidecar, got %q %v", body, h)
+	}
+
+	_, h, body = get(s, "/dashboard/index.js", "Accept-Encoding", "gzip")
+	if h.Get("Content-Encoding") != "gzip" || !strings.HasSuffix(h.Get("ETag"), `-gzip"`) {
+		t.Fatalf("expected gzip, got %v", h)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := io.ReadAll(zr); string(buf) != js {
+		t.Errorf("gzipped content mismatch")
+	}
+
+	if _, h, _ = get(s, "/blob"); h.Get("Content-Type") != "image/png" {
+		t.Errorf("expected sniffed content type, got %s", h.Get("Content-Type"))
+	}
+
+	// undated files, like embedded ones, only validate by ETag
+	since := time.Now().UTC().Format(http.TimeFormat)
+	if code, h, _ = get(s, "/app.js", "If-Modified-Since", since); code != 200 || h.Get("Last-Modified") != "" {
+		t.Errorf("expected an undated file to be served, got %d %v", code, h)
+	}
+	if code, _, _ = get(s, "/app.js", "Range", "bytes=2-4", "If-Range", since); code != 200 {
+		t.Errorf("expected a dated If-Range to serve everything, got %d", code)
+	}
+	if code, _, _ = get(s, "/dashboard/", "If-Modified-Since", since); code != 304 {
+		t.Errorf("expected 304 for a dated file, got %d", code)
+	}
+}
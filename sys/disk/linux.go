@@ -0,0 +1,59 @@
+package disk
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+)
+
+type Usage struct {
+	Mount     string
+	Device    string
+	Total     uint64 // bytes
+	Available uint64 // bytes, to unprivileged users
+}
+
+// Used is the fraction of space unavailable to unprivileged users
+func (u *Usage) Used() float64 {
+	if u.Total == 0 {
+		return 0
+	}
+	return 1 - float64(u.Available)/float64(u.Total)
+}
+
+// List reports usage of every mounted block device, pseudo filesystems are skipped
+func List() ([]Usage, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		list []Usage
+		seen = make(map[string]bool)
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") || seen[fields[1]] {
+			continue
+		}
+		// octal escapes, ie. \040 for spaces
+		mount := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(fields[1])
+		seen[fields[1]] = true
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(mount, &stat); err != nil {
+			continue // ie. not permitted
+		}
+		list = append(list, Usage{
+			Mount:     mount,
+			Device:    fields[0],
+			Total:     stat.Blocks * uint64(stat.Bsize),
+			Available: stat.Bavail * uint64(stat.Bsize),
+		})
+	}
+	return list, scanner.Err()
+}
@@ -1,14 +1,16 @@
 package mem
 
 import (
+	"avaron/logging"
 	"bufio"
 	"fmt"
-	"log"
 	"os"
 	"strconv"
 	"strings"
 )
 
+var logger = logging.For("mem")
+
 type info struct {
 	value int64
 	unit  string
@@ -47,7 +49,7 @@ func meminfo() (map[string]info, error) {
 			}
 			fallthrough
 		default:
-			log.Printf("junk line from %s: '%s'\n", file.Name(), line)
+			logger.Warn("junk line", "file", file.Name(), "line", line)
 			continue
 		}
 
@@ -61,13 +63,23 @@ func meminfo() (map[string]info, error) {
 }
 
 func GetTotal() (int64, error) {
+	return get("MemTotal")
+}
+
+// GetAvailable estimates memory available to new processes without swapping
+func GetAvailable() (int64, error) {
+	return get("MemAvailable")
+}
+
+// get returns a field of /proc/meminfo in bytes
+func get(field string) (int64, error) {
 	m, err := meminfo()
 	if err != nil {
 		return 0, err
 	}
-	info, ok := m["MemTotal"]
+	info, ok := m[field]
 	if !ok {
-		return 0, fmt.Errorf("MemTotal missing from /proc/meminfo")
+		return 0, fmt.Errorf("%s missing from /proc/meminfo", field)
 	}
 	var total int64
 	switch info.unit {
@@ -0,0 +1,88 @@
+package pty
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	Rows uint16
+	Cols uint16
+	X    uint16
+	Y    uint16
+}
+
+func ioctl(f *os.File, req, arg uintptr) (err error) {
+	// f.Fd() would switch the descriptor to blocking mode, which stops Close
+	// from interrupting a pending Read
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	e := conn.Control(func(fd uintptr) {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+			err = errno
+		}
+	})
+	if e != nil {
+		return e
+	}
+	return
+}
+
+// Open allocates a pseudo-terminal, returning the master & slave ends
+func Open() (ptm, pts *os.File, err error) {
+	ptm, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		unlock int32
+		n      uint32
+	)
+
+	if err = ioctl(ptm, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		ptm.Close()
+		return nil, nil, fmt.Errorf("unlocking pty: %+v", err)
+	}
+
+	if err = ioctl(ptm, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		ptm.Close()
+		return nil, nil, fmt.Errorf("getting pty number: %+v", err)
+	}
+
+	path := "/dev/pts/" + strconv.FormatUint(uint64(n), 10)
+	pts, err = os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, fmt.Errorf("opening %s: %+v", path, err)
+	}
+
+	return ptm, pts, nil
+}
+
+// Setsize changes the window size of the terminal, delivering SIGWINCH to its foreground process group
+func Setsize(f *os.File, rows, cols uint16) error {
+	ws := winsize{Rows: rows, Cols: cols}
+	return ioctl(f, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// Start runs cmd as a session leader with pts as its controlling terminal & stdio
+func Start(cmd *exec.Cmd, pts *os.File) error {
+	cmd.Stdin = pts
+	cmd.Stdout = pts
+	cmd.Stderr = pts
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	return cmd.Start()
+}
@@ -0,0 +1,388 @@
+package terminal
+
+import (
+	"avaron/logging"
+	"avaron/sys/pty"
+	"avaron/websocket"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	filepath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var logger = logging.For("terminal")
+
+const (
+	DefaultRows = 24
+	DefaultCols = 80
+)
+
+var (
+	ErrIdle     = errors.New("terminal session idle")
+	ErrNotFound = errors.New("terminal session not found")
+)
+
+// Session describes a live or recorded terminal
+type Session struct {
+	ID      string     `json:"id"`
+	Remote  string     `json:"remote"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	Active  bool       `json:"active"`
+	Rows    uint16     `json:"rows"`
+	Cols    uint16     `json:"cols"`
+	Size    int64      `json:"size"` // bytes of recording
+}
+
+// Control is sent by the client as a text frame, binary frames are raw keyboard input
+type Control struct {
+	Type string `json:"type"` // "resize" or "input"
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// asciicast v2 header, see https://docs.asciinema.org/manual/asciicast/v2/
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type Manager struct {
+	Dir   string        // where recordings are kept
+	Shell []string      // argv of the login shell
+	Idle  time.Duration // sessions without input or output for this long are hung up
+
+	lock   sync.Mutex
+	active map[string]*Session
+}
+
+// Primary constructor for this package
+func New(dir string) *Manager {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+	return &Manager{
+		Dir:    dir,
+		Shell:  []string{shell, "-l"},
+		Idle:   15 * time.Minute,
+		active: make(map[string]*Session),
+	}
+}
+
+// recorder appends asciicast events, output & resize events race so it locks
+type recorder struct {
+	lock  sync.Mutex
+	start time.Time
+	w     *bufio.Writer
+	f     *os.File
+}
+
+func (r *recorder) event(kind string, data string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	buf, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, data})
+	r.w.Write(buf)
+	r.w.WriteByte('\n')
+}
+
+func (r *recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.w.Flush()
+	return r.f.Close()
+}
+
+func (m *Manager) path(id string) string {
+	return filepath.Join(m.Dir, id+".cast")
+}
+
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Serve runs a login shell on a fresh pty & bridges it to ws until either side hangs up
+func (m *Manager) Serve(ctx context.Context, ws *websocket.Conn, remote string) (err error) {
+	if err = os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+
+	ptm, pts, err := pty.Open()
+	if err != nil {
+		return err
+	}
+	defer ptm.Close()
+
+	session := &Session{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 10),
+		Remote:  remote,
+		Started: time.Now(),
+		Active:  true,
+		Rows:    DefaultRows,
+		Cols:    DefaultCols,
+	}
+
+	if err = pty.Setsize(ptm, session.Rows, session.Cols); err != nil {
+		pts.Close()
+		return err
+	}
+
+	f, err := os.OpenFile(m.path(session.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		pts.Close()
+		return err
+	}
+
+	rec := &recorder{start: session.Started, w: bufio.NewWriter(f), f: f}
+	defer rec.Close()
+
+	buf, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     session.Cols,
+		Height:    session.Rows,
+		Timestamp: session.Started.Unix(),
+		Title:     remote,
+		Env:       map[string]string{"SHELL": m.Shell[0], "TERM": "xterm-256color"},
+	})
+	rec.w.Write(append(buf, '\n'))
+
+	cmd := exec.Command(m.Shell[0], m.Shell[1:]...)
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	err = pty.Start(cmd, pts)
+	pts.Close()
+	if err != nil {
+		return fmt.Errorf("starting %s: %+v", m.Shell[0], err)
+	}
+
+	m.lock.Lock()
+	m.active[session.ID] = session
+	m.lock.Unlock()
+
+	logger.InfoContext(ctx, "opened", "id", session.ID, "remote", remote, "pid", cmd.Process.Pid)
+
+	var (
+		done     = make(chan error, 2)
+		activity = make(chan struct{}, 1)
+		touch    = func() {
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	)
+
+	// pty -> websocket
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := ptm.Read(buf)
+			if n > 0 {
+				touch()
+				rec.event("o", string(buf[:n]))
+				if err := ws.WriteMessage(websocket.Binary, buf[:n]); err != nil {
+					done <- err
+					return
+				}
+			}
+			if errors.Is(err, syscall.EIO) {
+				// slave side closed, the shell exited
+				done <- io.EOF
+				return
+			} else if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	// websocket -> pty
+	go func() {
+		for {
+			op, p, err := ws.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			touch()
+
+			if op == websocket.Binary {
+				_, err = ptm.Write(p)
+			} else {
+				var c Control
+				if err := json.Unmarshal(p, &c); err != nil {
+					logger.Warn("bad control message", "id", session.ID, "err", err)
+					continue
+				}
+				switch c.Type {
+				case "input":
+					_, err = ptm.Write([]byte(c.Data))
+				case "resize":
+					if c.Rows == 0 || c.Cols == 0 {
+						continue
+					}
+					if err = pty.Setsize(ptm, c.Rows, c.Cols); err == nil {
+						m.lock.Lock()
+						session.Rows, session.Cols = c.Rows, c.Cols
+						m.lock.Unlock()
+						rec.event("r", fmt.Sprintf("%dx%d", c.Cols, c.Rows))
+					}
+				}
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	idle := time.NewTimer(m.Idle)
+	defer idle.Stop()
+
+loop:
+	for {
+		select {
+		case <-activity:
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(m.Idle)
+		case <-idle.C:
+			err = ErrIdle
+			break loop
+		case err = <-done:
+			break loop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+	}
+
+	// hang up the whole session
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+	ptm.Close()
+	// once reaped, the group's ID may be reused, so the kill is called off
+	kill := time.AfterFunc(5*time.Second, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	cmd.Wait()
+	kill.Stop()
+
+	if err == ErrIdle {
+		ws.Close(websocket.CloseGoingAway, "idle timeout")
+	} else {
+		ws.Close(websocket.CloseNormal, "")
+	}
+
+	m.lock.Lock()
+	delete(m.active, session.ID)
+	m.lock.Unlock()
+
+	logger.InfoContext(ctx, "closed", "id", session.ID, "err", err)
+
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func readHeader(path string) (h castHeader, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	err = json.Unmarshal(line, &h)
+	return
+}
+
+// List returns live & recorded sessions, most recent first
+func (m *Manager) List() ([]Session, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if os.IsNotExist(err) {
+		return []Session{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sessions := make([]Session, 0, len(entries))
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".cast")
+		if id == entry.Name() || !validID(id) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		var s Session
+		if active, ok := m.active[id]; ok {
+			s = *active
+		} else if h, err := readHeader(m.path(id)); err != nil {
+			logger.Warn("skipping unreadable recording", "file", entry.Name(), "err", err)
+			continue
+		} else {
+			ended := info.ModTime()
+			s = Session{
+				ID:      id,
+				Remote:  h.Title,
+				Started: time.Unix(h.Timestamp, 0),
+				Ended:   &ended,
+				Rows:    h.Height,
+				Cols:    h.Width,
+			}
+		}
+		s.Size = info.Size()
+		sessions = append(sessions, s)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.After(sessions[j].Started)
+	})
+	return sessions, nil
+}
+
+// Open returns the asciicast recording of a session for replay
+func (m *Manager) Open(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(m.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
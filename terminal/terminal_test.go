@@ -0,0 +1,66 @@
+package terminal
+
+import (
+	"avaron/sys/pty"
+	"avaron/websocket"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	if ptm, pts, err := pty.Open(); err != nil {
+		t.Skip("no pty available:", err)
+	} else {
+		ptm.Close()
+		pts.Close()
+	}
+
+	m := New(t.TempDir())
+	m.Shell = []string{"/bin/sh"}
+	m.Idle = 5 * time.Second
+
+	cr, cw := io.Pipe() // client -> server
+	sr, sw := io.Pipe() // server -> client
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Serve(context.Background(), websocket.New(cr, sw), "test")
+		sw.Close()
+	}()
+
+	// masked text frame, mask of zero keeps the payload readable
+	input := `{"type":"input","data":"echo hello-$((6*7)); exit\n"}`
+	go cw.Write(append([]byte{0x81, 0x80 | byte(len(input)), 0, 0, 0, 0}, input...))
+
+	out, _ := io.ReadAll(sr)
+	cw.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "hello-42") {
+		t.Errorf("expected command output, got %q", out)
+	}
+
+	sessions, err := m.List()
+	if err != nil || len(sessions) != 1 || sessions[0].Active {
+		t.Fatalf("unexpected sessions: %+v %v", sessions, err)
+	}
+
+	f, err := m.Open(sessions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cast, _ := io.ReadAll(f)
+	if !strings.HasPrefix(string(cast), `{"version":2`) || !strings.Contains(string(cast), "hello-42") {
+		t.Errorf("unexpected recording: %s", cast)
+	}
+
+	if _, err = m.Open("../../etc/passwd"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+package tsdb
+
+import (
+	"encoding/gob"
+	"errors"
+	"math"
+	"os"
+	filepath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind decides how a series is downsampled & queried
+type Kind int
+
+const (
+	Gauge   Kind = iota // averaged
+	Counter             // monotonic, queried as a per second rate
+)
+
+var (
+	ErrNoSeries = errors.New("no such series")
+	ErrRange    = errors.New("bad time range")
+)
+
+// Tier is one resolution, ie. 10s for an hour
+type Tier struct {
+	Step   time.Duration
+	Points int
+}
+
+// DefaultTiers keep 10s resolution for 3 hours, 1m for a day, 10m for a week
+// & 1h for a month, about 68KiB per series
+var DefaultTiers = []Tier{
+	{10 * time.Second, 1080},
+	{time.Minute, 1440},
+	{10 * time.Minute, 1008},
+	{time.Hour, 720},
+}
+
+type Point struct {
+	T int64 // unix seconds, the start of the step
+	V float64
+}
+
+// Ring is a fixed size buffer of points at one resolution, exported for gob
+type Ring struct {
+	Step   int64 // seconds
+	Points []Point
+	Start  int // index of the oldest point
+	Len    int
+	N      int // samples merged into the newest point, for averaging gauges
+}
+
+func newRing(t Tier) *Ring {
+	return &Ring{Step: int64(t.Step / time.Second), Points: make([]Point, t.Points)}
+}
+
+func (r *Ring) last() *Point {
+	if r.Len == 0 {
+		return nil
+	}
+	return &r.Points[(r.Start+r.Len-1)%len(r.Points)]
+}
+
+func (r *Ring) add(kind Kind, t int64, v float64) {
+	bucket := t - t%r.Step
+	if p := r.last(); p != nil && p.T == bucket {
+		if kind == Counter {
+			p.V = v // the latest value wins
+		} else {
+			r.N++
+			p.V += (v - p.V) / float64(r.N)
+		}
+		return
+	} else if p != nil && p.T > bucket {
+		// clock went backwards, drop it
+		return
+	}
+
+	r.N = 1
+	if r.Len < len(r.Points) {
+		r.Points[(r.Start+r.Len)%len(r.Points)] = Point{bucket, v}
+		r.Len++
+	} else {
+		r.Points[r.Start] = Point{bucket, v}
+		r.Start = (r.Start + 1) % len(r.Points)
+	}
+}
+
+// between returns points with from <= T < to, oldest first
+func (r *Ring) between(from, to int64) (out []Point) {
+	for i := 0; i < r.Len; i++ {
+		p := r.Points[(r.Start+i)%len(r.Points)]
+		if p.T >= from && p.T < to {
+			out = append(out, p)
+		}
+	}
+	return
+}
+
+func (r *Ring) oldest() int64 {
+	if r.Len == 0 {
+		return math.MaxInt64
+	}
+	return r.Points[r.Start].T
+}
+
+type Series struct {
+	Kind  Kind
+	Rings []*Ring
+}
+
+// DB samples are kept in memory, Save & Load persist them across restarts
+type DB struct {
+	Path  string
+	Tiers []Tier
+
+	lock   sync.RWMutex
+	series map[string]*Series
+}
+
+// Primary constructor for this package, path is where Save writes
+func New(path string, tiers []Tier) *DB {
+	if tiers == nil {
+		tiers = DefaultTiers
+	}
+	return &DB{
+		Path:   path,
+		Tiers:  tiers,
+		series: make(map[string]*Series),
+	}
+}
+
+// Add records a sample, series are created on first use
+func (db *DB) Add(name string, kind Kind, t time.Time, v float64) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	s, ok := db.series[name]
+	if !ok || len(s.Rings) != len(db.Tiers) {
+		s = &Series{Kind: kind}
+		for _, tier := range db.Tiers {
+			s.Rings = append(s.Rings, newRing(tier))
+		}
+		db.series[name] = s
+	}
+	for _, r := range s.Rings {
+		r.add(s.Kind, t.Unix(), v)
+	}
+}
+
+// Names lists series, those starting with prefix when given
+func (db *DB) Names(prefix string) []string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	names := make([]string, 0, len(db.series))
+	for name := range db.series {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Match expands a trailing '*' into every series with that prefix
+func (db *DB) Match(pattern string) []string {
+	if strings.HasSuffix(pattern, "*") {
+		return db.Names(strings.TrimSuffix(pattern, "*"))
+	}
+
+	db.lock.RLock()
+	_, ok := db.series[pattern]
+	db.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return []string{pattern}
+}
+
+// Query returns one point per step in [from, to). Counters are turned into
+// per second rates, tolerating resets. The finest tier still covering from
+// is used, & step is rounded up to its resolution.
+func (db *DB) Query(name string, from, to time.Time, step time.Duration) ([]Point, time.Duration, error) {
+	if !from.Before(to) || step < 0 {
+		return nil, 0, ErrRange
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	s, ok := db.series[name]
+	if !ok {
+		return nil, 0, ErrNoSeries
+	}
+
+	// finest resolution whose history reaches back far enough, or the coarsest
+	r := s.Rings[len(s.Rings)-1]
+	for _, ring := range s.Rings {
+		if ring.oldest() <= from.Unix() {
+			r = ring
+			break
+		}
+	}
+
+	width := int64(step / time.Second)
+	if width < r.Step {
+		width = r.Step
+	}
+	width = (width + r.Step - 1) / r.Step * r.Step
+
+	start, end := from.Unix()-from.Unix()%width, to.Unix()
+
+	// a counter's first rate needs the point before the window
+	points := r.between(start-r.Step, end)
+
+	var values []Point
+	if s.Kind == Counter {
+		for i := 1; i < len(points); i++ {
+			prev, cur := points[i-1], points[i]
+			dt := float64(cur.T - prev.T)
+			if dt <= 0 || cur.T < start {
+				continue
+			}
+			dv := cur.V - prev.V
+			if dv < 0 {
+				// reset, ie. an interface was recreated
+				dv = cur.V
+			}
+			values = append(values, Point{cur.T, dv / dt})
+		}
+	} else {
+		for _, p := range points {
+			if p.T >= start {
+				values = append(values, p)
+			}
+		}
+	}
+
+	// average into steps
+	var (
+		out []Point
+		sum float64
+		n   int
+	)
+	for i, p := range values {
+		bucket := p.T - p.T%width
+		sum += p.V
+		n++
+		if i+1 == len(values) || values[i+1].T-values[i+1].T%width != bucket {
+			out = append(out, Point{bucket, sum / float64(n)})
+			sum, n = 0, 0
+		}
+	}
+
+	return out, time.Duration(width) * time.Second, nil
+}
+
+// Prune drops series without samples since before, ie. removed interfaces
+func (db *DB) Prune(before time.Time) (n int) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for name, s := range db.series {
+		if p := s.Rings[0].last(); p == nil || p.T < before.Unix() {
+			delete(db.series, name)
+			n++
+		}
+	}
+	return
+}
+
+// Save atomically writes every series to Path
+func (db *DB) Save() error {
+	if err := os.MkdirAll(filepath.Dir(db.Path), 0700); err != nil {
+		return err
+	}
+
+	tmp := db.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	db.lock.RLock()
+	err = gob.NewEncoder(f).Encode(db.series)
+	db.lock.RUnlock()
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, db.Path)
+}
+
+// Load replaces the in memory series with those saved at Path, a missing file is fine
+func (db *DB) Load() error {
+	f, err := os.Open(db.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	series := make(map[string]*Series)
+	if err = gob.NewDecoder(f).Decode(&series); err != nil {
+		return err
+	}
+
+	// tiers changed since, start those series over
+	for name, s := range series {
+		if len(s.Rings) != len(db.Tiers) {
+			delete(series, name)
+			continue
+		}
+		for i, r := range s.Rings {
+			if r.Step != int64(db.Tiers[i].Step/time.Second) || len(r.Points) != db.Tiers[i].Points {
+				delete(series, name)
+				break
+			}
+		}
+	}
+
+	db.lock.Lock()
+	db.series = series
+	db.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,123 @@
+package tsdb
+
+import (
+	"math"
+	filepath "path"
+	"testing"
+	"time"
+)
+
+// a whole number of minutes, so steps line up
+var epoch = time.Unix(1699999980, 0)
+
+func TestCounterRate(t *testing.T) {
+	db := New("", []Tier{{10 * time.Second, 6}, {time.Minute, 10}})
+
+	// 100 bytes/s, reset after a minute
+	for i := 0; i <= 12; i++ {
+		v := float64(i * 1000)
+		if i > 6 {
+			v = float64((i - 6) * 1000)
+		}
+		db.Add("interface/eth0/rx_bytes", Counter, epoch.Add(time.Duration(i)*10*time.Second), v)
+	}
+
+	// the finest tier only holds the last minute, the oldest point has no rate
+	points, step, err := db.Query("interface/eth0/rx_bytes", epoch.Add(70*time.Second), epoch.Add(130*time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != 10*time.Second {
+		t.Errorf("step %s, want 10s", step)
+	}
+	if len(points) != 5 {
+		t.Fatalf("got %d points: %v", len(points), points)
+	}
+	for _, p := range points {
+		if p.V != 100 {
+			t.Errorf("rate at %d is %f, want 100", p.T, p.V)
+		}
+	}
+
+	// older history comes from the coarser tier
+	points, step, err = db.Query("interface/eth0/rx_bytes", epoch, epoch.Add(130*time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != time.Minute || len(points) == 0 {
+		t.Errorf("unexpected coarse query %s %v", step, points)
+	}
+}
+
+func TestGaugeAverage(t *testing.T) {
+	db := New("", []Tier{{10 * time.Second, 100}})
+	for i := 0; i < 12; i++ {
+		db.Add("tcp/10.0.0.1/rtt", Gauge, epoch.Add(time.Duration(i)*5*time.Second), float64(i%2))
+	}
+
+	points, step, err := db.Query("tcp/10.0.0.1/rtt", epoch, epoch.Add(time.Minute), 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != 30*time.Second || len(points) != 2 {
+		t.Fatalf("unexpected query %s %v", step, points)
+	}
+	for _, p := range points {
+		if math.Abs(p.V-0.5) > 1e-9 {
+			t.Errorf("average at %d is %f, want 0.5", p.T, p.V)
+		}
+	}
+
+	if _, _, err := db.Query("nope", epoch, epoch.Add(time.Minute), 0); err != ErrNoSeries {
+		t.Errorf("got %v, want ErrNoSeries", err)
+	}
+	if _, _, err := db.Query("tcp/10.0.0.1/rtt", epoch, epoch, 0); err != ErrRange {
+		t.Errorf("got %v, want ErrRange", err)
+	}
+}
+
+func TestRingWraps(t *testing.T) {
+	r := newRing(Tier{time.Second, 3})
+	for i := int64(0); i < 5; i++ {
+		r.add(Gauge, i, float64(i))
+	}
+	got := r.between(0, 10)
+	if len(got) != 3 || got[0].V != 2 || got[2].V != 4 {
+		t.Errorf("unexpected points %v", got)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tsdb", "series.gob")
+	db := New(path, nil)
+	db.Add("wireguard/k/rx_bytes", Counter, epoch, 1)
+	db.Add("wireguard/k/rx_bytes", Counter, epoch.Add(10*time.Second), 11)
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New(path, nil)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if names := loaded.Match("wireguard/*"); len(names) != 1 {
+		t.Fatalf("unexpected series %v", names)
+	}
+	points, _, err := loaded.Query("wireguard/k/rx_bytes", epoch, epoch.Add(time.Minute), 0)
+	if err != nil || len(points) != 1 || points[0].V != 1 {
+		t.Errorf("unexpected points %v %v", points, err)
+	}
+
+	// different tiers discard what was saved
+	other := New(path, []Tier{{time.Second, 10}})
+	if err := other.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if names := other.Names(""); len(names) != 0 {
+		t.Errorf("kept series with mismatched tiers: %v", names)
+	}
+
+	if n := loaded.Prune(epoch.Add(time.Hour)); n != 1 {
+		t.Errorf("pruned %d series, want 1", n)
+	}
+}
@@ -10,17 +10,24 @@ import (
 
 type Key [32]byte
 
+// Overlay is the prefix of every key's GlobalAddress, fc00:a7a0::/32
+var Overlay = net.IPNet{
+	IP:   net.IP{0xfc, 0x00, 0xa7, 0xa0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	Mask: net.CIDRMask(32, 8*net.IPv6len),
+}
+
 func (k Key) String() string {
 	return base64.StdEncoding.EncodeToString(k[:])
 }
 
-func (k *Key) UnmarshalText(buf []byte) (int64, error) {
+// implements encoding.TextUnmarshaler, so keys decode from JSON (incl. as map keys)
+func (k *Key) UnmarshalText(buf []byte) error {
 	if len(buf) < 44 {
-		return 0, io.ErrShortBuffer
+		return io.ErrShortBuffer
 	}
 
 	_, err := base64.StdEncoding.Decode(k[:], bytes.TrimSpace(buf[:]))
-	return int64(len(buf)), err
+	return err
 }
 
 func (k Key) MarshalText() ([]byte, error) {
@@ -43,7 +50,7 @@ func (k Key) GlobalAddress() *net.IPNet {
 	}
 
 	var (
-		prefix = []byte{0xfc, 0x00, 0xa7, 0xa0}
+		prefix = Overlay.IP[:4]
 		mask   = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 	)
 
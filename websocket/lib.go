@@ -0,0 +1,287 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// RFC 6455
+const magic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	Continuation byte = 0x0
+	Text         byte = 0x1
+	Binary       byte = 0x2
+	Close        byte = 0x8
+	Ping         byte = 0x9
+	Pong         byte = 0xA
+)
+
+const (
+	CloseNormal    uint16 = 1000
+	CloseGoingAway uint16 = 1001
+	CloseProtocol  uint16 = 1002
+	CloseTooBig    uint16 = 1009
+)
+
+var (
+	ErrHandshake = errors.New("not a websocket upgrade request")
+	ErrOrigin    = errors.New("cross-origin websocket request")
+	ErrTooBig    = errors.New("websocket message too big")
+	ErrProtocol  = errors.New("websocket protocol error")
+)
+
+func headerContains(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin checks a browser's Origin is the host it's asking, which other
+// clients leave out
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+// Accept validates the client's opening handshake & returns the headers of
+// the 101 Switching Protocols response. Browsers are held to the same
+// origin, since they'd let any page they visit open a websocket
+func Accept(req *http.Request) (http.Header, error) {
+	if req.Method != "GET" {
+		return nil, fmt.Errorf("%w: method %s", ErrHandshake, req.Method)
+	} else if !headerContains(req.Header, "Connection", "upgrade") {
+		return nil, fmt.Errorf("%w: missing 'Connection: upgrade'", ErrHandshake)
+	} else if !headerContains(req.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("%w: missing 'Upgrade: websocket'", ErrHandshake)
+	} else if v := req.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		return nil, fmt.Errorf("%w: unsupported version '%s'", ErrHandshake, v)
+	} else if !sameOrigin(req) {
+		return nil, fmt.Errorf("%w: origin '%s' isn't '%s'", ErrOrigin, req.Header.Get("Origin"), req.Host)
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if buf, err := base64.StdEncoding.DecodeString(key); err != nil || len(buf) != 16 {
+		return nil, fmt.Errorf("%w: bad Sec-WebSocket-Key '%s'", ErrHandshake, key)
+	}
+
+	sum := sha1.Sum([]byte(key + magic))
+	return http.Header{
+		"Upgrade":              []string{"websocket"},
+		"Connection":           []string{"Upgrade"},
+		"Sec-Websocket-Accept": []string{base64.StdEncoding.EncodeToString(sum[:])},
+	}, nil
+}
+
+// Conn is the server side of a websocket, frames are read from r & written to w
+type Conn struct {
+	r    *bufio.Reader
+	w    io.Writer
+	lock sync.Mutex // serialises writes, control frames can interleave with data
+
+	// MaxMessage bounds the size of a reassembled message, 0 means unbounded
+	MaxMessage int64
+}
+
+// Primary constructor for this package
+func New(r io.Reader, w io.Writer) *Conn {
+	return &Conn{
+		r:          bufio.NewReader(r),
+		w:          w,
+		MaxMessage: 1 << 20,
+	}
+}
+
+type header struct {
+	fin    bool
+	op     byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func (c *Conn) readHeader() (h header, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(c.r, b[:2]); err != nil {
+		return
+	}
+
+	h.fin = b[0]&0x80 != 0
+	h.op = b[0] & 0x0F
+	h.masked = b[1]&0x80 != 0
+
+	if b[0]&0x70 != 0 {
+		return h, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+
+	switch n := b[1] & 0x7F; n {
+	case 126:
+		if _, err = io.ReadFull(c.r, b[:2]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.r, b[:8]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[:8]))
+		if h.length < 0 {
+			return h, fmt.Errorf("%w: negative length", ErrProtocol)
+		}
+	default:
+		h.length = int64(n)
+	}
+
+	if h.op >= Close && (!h.fin || h.length > 125) {
+		return h, fmt.Errorf("%w: fragmented or oversized control frame", ErrProtocol)
+	}
+
+	if h.masked {
+		_, err = io.ReadFull(c.r, h.mask[:])
+	}
+	return
+}
+
+func (c *Conn) readPayload(h header, dst []byte) ([]byte, error) {
+	n := len(dst)
+	dst = append(dst, make([]byte, h.length)...)
+	if _, err := io.ReadFull(c.r, dst[n:]); err != nil {
+		return dst, err
+	}
+	if h.masked {
+		for i := range dst[n:] {
+			dst[n+i] ^= h.mask[i%4]
+		}
+	}
+	return dst, nil
+}
+
+// ReadMessage returns the next data message, reassembling fragments.
+// Pings are answered transparently, a close frame is acknowledged &
+// reported as io.EOF.
+func (c *Conn) ReadMessage() (op byte, p []byte, err error) {
+	for {
+		var h header
+		if h, err = c.readHeader(); err != nil {
+			return
+		}
+
+		if !h.masked {
+			// clients MUST mask
+			c.Close(CloseProtocol, "unmasked frame")
+			return op, nil, fmt.Errorf("%w: unmasked client frame", ErrProtocol)
+		}
+
+		if c.MaxMessage > 0 && int64(len(p))+h.length > c.MaxMessage {
+			c.Close(CloseTooBig, "")
+			return op, nil, ErrTooBig
+		}
+
+		switch h.op {
+		case Ping:
+			var buf []byte
+			if buf, err = c.readPayload(h, nil); err != nil {
+				return
+			}
+			if err = c.WriteMessage(Pong, buf); err != nil {
+				return
+			}
+			continue
+		case Pong:
+			if _, err = c.readPayload(h, nil); err != nil {
+				return
+			}
+			continue
+		case Close:
+			var buf []byte
+			if buf, err = c.readPayload(h, nil); err != nil {
+				return
+			}
+			code := CloseNormal
+			if len(buf) >= 2 {
+				code = binary.BigEndian.Uint16(buf)
+			}
+			c.Close(code, "")
+			return op, nil, io.EOF
+		case Continuation:
+			if op == 0 {
+				return op, nil, fmt.Errorf("%w: unexpected continuation", ErrProtocol)
+			}
+		case Text, Binary:
+			if op != 0 {
+				return op, nil, fmt.Errorf("%w: expected continuation", ErrProtocol)
+			}
+			op = h.op
+		default:
+			return op, nil, fmt.Errorf("%w: unknown opcode %d", ErrProtocol, h.op)
+		}
+
+		if p, err = c.readPayload(h, p); err != nil {
+			return
+		}
+
+		if h.fin {
+			return
+		}
+	}
+}
+
+// WriteMessage writes p as a single unmasked frame
+func (c *Conn) WriteMessage(op byte, p []byte) error {
+	var (
+		b [10]byte
+		n int
+	)
+
+	b[0] = 0x80 | op
+	switch l := len(p); {
+	case l < 126:
+		b[1] = byte(l)
+		n = 2
+	case l <= 0xFFFF:
+		b[1] = 126
+		binary.BigEndian.PutUint16(b[2:], uint16(l))
+		n = 4
+	default:
+		b[1] = 127
+		binary.BigEndian.PutUint64(b[2:], uint64(l))
+		n = 10
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, err := c.w.Write(b[:n]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(p)
+	return err
+}
+
+// Close sends a close frame, the caller is responsible for the underlying transport
+func (c *Conn) Close(code uint16, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	buf := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(buf, code)
+	return c.WriteMessage(Close, append(buf, reason...))
+}
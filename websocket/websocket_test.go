@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// frame builds a masked client frame
+func frame(fin bool, op byte, p []byte) []byte {
+	mask := [4]byte{1, 2, 3, 4}
+	b := []byte{op, 0x80 | byte(len(p))}
+	if fin {
+		b[0] |= 0x80
+	}
+	b = append(b, mask[:]...)
+	for i := range p {
+		b = append(b, p[i]^mask[i%4])
+	}
+	return b
+}
+
+func TestAccept(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		Header: http.Header{
+			"Connection":            {"keep-alive, Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+			"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+		},
+	}
+	h, err := Accept(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// example from RFC 6455 section 1.3
+	if v := h.Get("Sec-WebSocket-Accept"); v != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept: %s", v)
+	}
+
+	req.Host = "node.avaron.lan:8443"
+	req.Header.Set("Origin", "https://node.avaron.lan:8443")
+	if _, err = Accept(req); err != nil {
+		t.Errorf("refused the same origin: %v", err)
+	}
+	for _, origin := range []string{"https://evil.example", "null", "https://node.avaron.lan"} {
+		req.Header.Set("Origin", origin)
+		if _, err = Accept(req); !errors.Is(err, ErrOrigin) {
+			t.Errorf("accepted origin %s: %v", origin, err)
+		}
+	}
+	req.Header.Del("Origin")
+
+	req.Header.Del("Upgrade")
+	if _, err = Accept(req); err == nil {
+		t.Errorf("expected handshake error")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	var in, out bytes.Buffer
+	in.Write(frame(false, Text, []byte("hel")))
+	in.Write(frame(true, Ping, []byte("!")))
+	in.Write(frame(true, Continuation, []byte("lo")))
+	in.Write(frame(true, Close, []byte{0x03, 0xe8}))
+
+	c := New(&in, &out)
+	op, p, err := c.ReadMessage()
+	if err != nil || op != Text || string(p) != "hello" {
+		t.Fatalf("unexpected message: %d %q %v", op, p, err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{0x80 | Pong, 1, '!'}) {
+		t.Errorf("expected pong, got %v", out.Bytes())
+	}
+
+	out.Reset()
+	if _, _, err = c.ReadMessage(); err != io.EOF {
+		t.Errorf("expected EOF on close, got %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{0x80 | Close, 2, 0x03, 0xe8}) {
+		t.Errorf("expected close echo, got %v", out.Bytes())
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	var out bytes.Buffer
+	c := New(&bytes.Buffer{}, &out)
+	c.WriteMessage(Binary, make([]byte, 300))
+	if b := out.Bytes(); b[0] != 0x80|Binary || b[1] != 126 || b[2] != 1 || b[3] != 44 || len(b) != 304 {
+		t.Errorf("unexpected frame header: %v", b[:4])
+	}
+}
@@ -3,6 +3,7 @@ package wireguard
 import (
 	"avaron/vertex"
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Peer struct {
@@ -39,7 +41,7 @@ func GenerateKeyPair() (public, private vertex.Key, err error) {
 		return
 	}
 
-	_, err = private.UnmarshalText(buf)
+	err = private.UnmarshalText(buf)
 	public, err = PublicKey(strings.NewReader(private.String()))
 
 	return
@@ -56,7 +58,7 @@ func PublicKey(r io.Reader) (k vertex.Key, err error) {
 		return
 	}
 
-	_, err = k.UnmarshalText(buf)
+	err = k.UnmarshalText(buf)
 
 	return
 }
@@ -119,7 +121,7 @@ func Interfaces(ctx context.Context) (map[vertex.Key]*Interface, error) {
 					return m, fmt.Errorf("unexpected 'peer': %s", line)
 				}
 				peer = &Peer{}
-				if _, err := key.UnmarshalText([]byte(v)); err != nil {
+				if err := key.UnmarshalText([]byte(v)); err != nil {
 					return m, err
 				}
 				i.Peers[key] = peer
@@ -130,7 +132,7 @@ func Interfaces(ctx context.Context) (map[vertex.Key]*Interface, error) {
 			switch k {
 			case "public key":
 				var key vertex.Key
-				if _, err := key.UnmarshalText([]byte(v)); err != nil {
+				if err := key.UnmarshalText([]byte(v)); err != nil {
 					return m, err
 				}
 				m[key] = i
@@ -138,7 +140,7 @@ func Interfaces(ctx context.Context) (map[vertex.Key]*Interface, error) {
 				var key vertex.Key
 				if v == "(hidden)" {
 					// ok
-				} else if _, err := key.UnmarshalText([]byte(v)); err != nil {
+				} else if err := key.UnmarshalText([]byte(v)); err != nil {
 					return m, err
 				} else {
 					i.PrivateKey = &key
@@ -154,7 +156,7 @@ func Interfaces(ctx context.Context) (map[vertex.Key]*Interface, error) {
 				var key vertex.Key
 				if v == "(hidden)" {
 					// ok
-				} else if _, err := key.UnmarshalText([]byte(v)); err != nil {
+				} else if err := key.UnmarshalText([]byte(v)); err != nil {
 					return m, err
 				} else {
 					peer.PresharedKey = &key
@@ -208,3 +210,66 @@ interface: avaron
   listening port: 51820
 
 */
+
+// PeerStats is a peer's line of `wg show all dump`, the numeric
+// counterpart of Peer for monitoring
+type PeerStats struct {
+	Interface       string
+	Key             vertex.Key
+	Endpoint        string
+	LatestHandshake time.Time // zero if there hasn't been one
+	Received        uint64
+	Sent            uint64
+}
+
+func Dump(ctx context.Context) ([]PeerStats, error) {
+	cmd := exec.CommandContext(ctx, "sudo", "/bin/wg", "show", "all", "dump")
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show all dump: %+v", err)
+	}
+	return ParseDump(bytes.NewReader(buf))
+}
+
+// ParseDump reads tab separated interface lines (5 fields) & peer lines (9 fields)
+func ParseDump(r io.Reader) (peers []PeerStats, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		switch len(fields) {
+		case 5:
+			// interface
+			continue
+		case 9:
+		default:
+			return peers, fmt.Errorf("unexpected wg dump line: %s", scanner.Text())
+		}
+
+		peer := PeerStats{
+			Interface: fields[0],
+			Endpoint:  fields[3],
+		}
+		if peer.Endpoint == "(none)" {
+			peer.Endpoint = ""
+		}
+		if err = peer.Key.UnmarshalText([]byte(fields[1])); err != nil {
+			return peers, err
+		}
+
+		handshake, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return peers, fmt.Errorf("bad latest handshake '%s': %+v", fields[5], err)
+		} else if handshake != 0 {
+			peer.LatestHandshake = time.Unix(handshake, 0)
+		}
+
+		if peer.Received, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return peers, fmt.Errorf("bad transfer rx '%s': %+v", fields[6], err)
+		}
+		if peer.Sent, err = strconv.ParseUint(fields[7], 10, 64); err != nil {
+			return peers, fmt.Errorf("bad transfer tx '%s': %+v", fields[7], err)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, scanner.Err()
+}
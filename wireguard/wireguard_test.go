@@ -1,13 +1,15 @@
 package wireguard
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
-	//"context"
+	"time"
 )
 
 func Test(t *testing.T) {
-	interfaces, err := Interfaces(t.Context())
+	interfaces, err := Interfaces(context.Background())
 	if err != nil {
 		panic(err)
 	}
@@ -17,3 +19,35 @@ func Test(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDump(t *testing.T) {
+	dump := "avaron\tcHJpdmF0ZXByaXZhdGVwcml2YXRlcHJpdmF0ZXByaXY=\tgnH2O6at5ezSKaUezd/c1FpeO8gtYdRXtpo1Km/nxXg=\t51820\toff\n" +
+		"avaron\th7HfpSlMu/99KnouS6s8Ugcmemmw2rvND9jrwTvv7UE=\t(none)\t45.77.215.144:51820\tfc00:a7a0::/32\t1700000000\t2652\t1024\t25\n" +
+		"avaron\tIY/C7eZfk3/YJbiExUQY39zMjPqn77sXoKUWKm70Vw4=\t(none)\t(none)\tfc00:a7a0::/32\t0\t0\t0\toff\n"
+
+	peers, err := ParseDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(peers))
+	}
+
+	p := peers[0]
+	if p.Interface != "avaron" || p.Endpoint != "45.77.215.144:51820" || p.Received != 2652 || p.Sent != 1024 {
+		t.Errorf("unexpected peer %+v", p)
+	}
+	if !p.LatestHandshake.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected handshake %s", p.LatestHandshake)
+	}
+	if p.Key.String() != "h7HfpSlMu/99KnouS6s8Ugcmemmw2rvND9jrwTvv7UE=" {
+		t.Errorf("unexpected key %s", p.Key)
+	}
+	if peers[1].Endpoint != "" || !peers[1].LatestHandshake.IsZero() {
+		t.Errorf("unexpected idle peer %+v", peers[1])
+	}
+
+	if _, err := ParseDump(strings.NewReader("garbage\n")); err == nil {
+		t.Error("accepted garbage")
+	}
+}